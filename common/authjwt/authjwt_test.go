@@ -0,0 +1,372 @@
+package authjwt
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func accessClaims(iss string, exp time.Time) jwt.MapClaims {
+	return jwt.MapClaims{"iss": iss, "sub": "42", "name": "alice", "exp": exp.Unix()}
+}
+
+func signHS(t *testing.T, secret string, claims jwt.MapClaims) string {
+	t.Helper()
+	s, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+	require.NoError(t, err)
+	return s
+}
+
+func signEd(t *testing.T, kid string, priv ed25519.PrivateKey, claims jwt.MapClaims) string {
+	t.Helper()
+	tok := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+	tok.Header["kid"] = kid
+	s, err := tok.SignedString(priv)
+	require.NoError(t, err)
+	return s
+}
+
+func TestSecretVerifier(t *testing.T) {
+	v, err := New(Config{Issuer: "auth.test", Secret: "s3cret"})
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	p, err := v.Verify(ctx, signHS(t, "s3cret", accessClaims("auth.test", time.Now().Add(time.Minute))))
+	require.NoError(t, err)
+	assert.Equal(t, int64(42), p.UserID)
+	assert.Equal(t, "alice", p.Username)
+	assert.False(t, p.EmailVerified)
+	assert.False(t, p.ExpiresAt.IsZero())
+
+	verified := accessClaims("auth.test", time.Now().Add(time.Minute))
+	verified["email_verified"] = true
+	p, err = v.Verify(ctx, signHS(t, "s3cret", verified))
+	require.NoError(t, err)
+	assert.True(t, p.EmailVerified)
+
+	_, err = v.Verify(ctx, signHS(t, "other", accessClaims("auth.test", time.Now().Add(time.Minute))))
+	assert.ErrorIs(t, err, ErrInvalidToken)
+	_, err = v.Verify(ctx, signHS(t, "s3cret", accessClaims("evil", time.Now().Add(time.Minute))))
+	assert.ErrorIs(t, err, ErrInvalidToken)
+	_, err = v.Verify(ctx, signHS(t, "s3cret", accessClaims("auth.test", time.Now().Add(-time.Minute))))
+	assert.ErrorIs(t, err, ErrInvalidToken)
+}
+
+func TestSecretsVerifier(t *testing.T) {
+	v, err := New(Config{Issuer: "auth.test", Secrets: []Secret{{KID: "old", Secret: "one"}, {KID: "new", Secret: "two"}}})
+	require.NoError(t, err)
+	ctx := context.Background()
+	signKID := func(kid, secret string) string {
+		tok := jwt.NewWithClaims(jwt.SigningMethodHS256, accessClaims("auth.test", time.Now().Add(time.Minute)))
+		if kid != "" {
+			tok.Header["kid"] = kid
+		}
+		s, err := tok.SignedString([]byte(secret))
+		require.NoError(t, err)
+		return s
+	}
+
+	_, err = v.Verify(ctx, signKID("old", "one"))
+	assert.NoError(t, err)
+	_, err = v.Verify(ctx, signKID("new", "two"))
+	assert.NoError(t, err)
+	_, err = v.Verify(ctx, signKID("new", "one"))
+	assert.ErrorIs(t, err, ErrInvalidToken)
+	_, err = v.Verify(ctx, signKID("", "two"))
+	assert.ErrorIs(t, err, ErrInvalidToken)
+
+	v, err = New(Config{Issuer: "auth.test", Secret: "legacy", Secrets: []Secret{{KID: "new", Secret: "two"}}})
+	require.NoError(t, err)
+	_, err = v.Verify(ctx, signKID("", "legacy"))
+	assert.NoError(t, err)
+	_, err = v.Verify(ctx, signKID("new", "two"))
+	assert.NoError(t, err)
+}
+
+func TestNew_ConfigValidation(t *testing.T) {
+	_, err := New(Config{})
+	assert.Error(t, err)
+	_, err = New(Config{Secret: "a", JWKSURL: "http://b"})
+	assert.Error(t, err)
+	_, err = New(Config{Secrets: []Secret{{KID: "a", Secret: "a"}}, JWKSURL: "http://b"})
+	assert.Error(t, err)
+}
+
+// jwksServer publishes whatever keys are currently in the map.
+func jwksServer(t *testing.T, keys map[string]ed25519.PublicKey, hits *int32) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(hits, 1)
+		var set struct {
+			Keys []map[string]string `json:"keys"`
+		}
+		for kid, pub := range keys {
+			set.Keys = append(set.Keys, map[string]string{
+				"kty": "OKP", "crv": "Ed25519", "alg": "EdDSA", "use": "sig", "kid": kid,
+				"x": base64.RawURLEncoding.EncodeToString(pub),
+			})
+		}
+		_ = json.NewEncoder(w).Encode(set)
+	}))
+}
+
+func TestJWKSVerifier_Rotation(t *testing.T) {
+	pub1, priv1, _ := ed25519.GenerateKey(rand.Reader)
+	pub2, priv2, _ := ed25519.GenerateKey(rand.Reader)
+	keys := map[string]ed25519.PublicKey{"k1": pub1}
+	var hits int32
+	srv := jwksServer(t, keys, &hits)
+	defer srv.Close()
+
+	v, err := New(Config{Issuer: "auth.test", JWKSURL: srv.URL})
+	require.NoError(t, err)
+	ctx := context.Background()
+	exp := time.Now().Add(time.Minute)
+
+	p, err := v.Verify(ctx, signEd(t, "k1", priv1, accessClaims("auth.test", exp)))
+	require.NoError(t, err)
+	assert.Equal(t, int64(42), p.UserID)
+	_, err = v.Verify(ctx, signEd(t, "k1", priv1, accessClaims("auth.test", exp)))
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&hits), "keys should be cached")
+
+	// A new kid within the refetch back-off is rejected without a fetch.
+	keys["k2"] = pub2
+	_, err = v.Verify(ctx, signEd(t, "k2", priv2, accessClaims("auth.test", exp)))
+	assert.ErrorIs(t, err, ErrInvalidToken)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&hits))
+
+}
+
+func TestJWKS_UnknownKidRefetch(t *testing.T) {
+	pub1, _, _ := ed25519.GenerateKey(rand.Reader)
+	pub2, priv2, _ := ed25519.GenerateKey(rand.Reader)
+	keys := map[string]ed25519.PublicKey{"k1": pub1}
+	var hits int32
+	srv := jwksServer(t, keys, &hits)
+	defer srv.Close()
+
+	j := NewJWKS(srv.URL, srv.Client(), time.Hour)
+	_, err := j.lookup("k1")
+	require.NoError(t, err)
+
+	keys["k2"] = pub2
+	j.attemptedAt = time.Now().Add(-minJWKSRefetch)
+	v := NewJWTVerifier(Options{Keyfunc: j.Keyfunc, Methods: j.Methods()})
+	_, err = v.Verify(context.Background(), signEd(t, "k2", priv2, accessClaims("", time.Now().Add(time.Minute))))
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&hits))
+}
+
+func TestJWKS_FailedFetchBacksOff(t *testing.T) {
+	var hits int32
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		<-release
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+	j := NewJWKS(srv.URL, srv.Client(), time.Hour)
+
+	// Concurrent lookups share the fetch in flight.
+	var wg sync.WaitGroup
+	errs := make([]error, 5)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = j.lookup("k1")
+		}(i)
+	}
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&hits) == 1 }, time.Second, time.Millisecond)
+	close(release)
+	wg.Wait()
+	for _, err := range errs {
+		assert.Error(t, err)
+	}
+
+	// A failed fetch is not retried within the back-off.
+	_, err := j.lookup("k2")
+	assert.Error(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&hits))
+
+	j.attemptedAt = time.Now().Add(-minJWKSRefetch)
+	_, err = j.lookup("k2")
+	assert.Error(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&hits))
+}
+
+func TestJWKS_RejectsAlgMismatch(t *testing.T) {
+	pub1, _, _ := ed25519.GenerateKey(rand.Reader)
+	var hits int32
+	srv := jwksServer(t, map[string]ed25519.PublicKey{"k1": pub1}, &hits)
+	defer srv.Close()
+
+	v := NewJWTVerifier(Options{Keyfunc: NewJWKS(srv.URL, srv.Client(), 0).Keyfunc, Methods: []string{"HS256", "EdDSA"}})
+	tok := jwt.NewWithClaims(jwt.SigningMethodHS256, accessClaims("", time.Now().Add(time.Minute)))
+	tok.Header["kid"] = "k1"
+	signed, err := tok.SignedString([]byte(pub1))
+	require.NoError(t, err)
+
+	_, err = v.Verify(context.Background(), signed)
+	assert.ErrorIs(t, err, ErrInvalidToken)
+}
+
+func TestMiddleware(t *testing.T) {
+	v := NewJWTVerifier(Options{Secret: "s3cret"})
+	var seen *Principal
+	protected := Authenticate(v)(RequireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen, _ = PrincipalFrom(r.Context())
+	})))
+	public := Authenticate(v)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, ok := PrincipalFrom(r.Context())
+		assert.False(t, ok)
+	}))
+
+	call := func(h http.Handler, auth string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	w := call(protected, "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, "Bearer", w.Header().Get("WWW-Authenticate"))
+
+	w = call(protected, "Bearer garbage")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Body.String(), ErrInvalidToken.Error())
+
+	w = call(protected, "Bearer "+signHS(t, "s3cret", accessClaims("", time.Now().Add(time.Minute))))
+	assert.Equal(t, http.StatusOK, w.Code)
+	require.NotNil(t, seen)
+	assert.Equal(t, int64(42), seen.UserID)
+
+	assert.Equal(t, http.StatusOK, call(public, "Bearer garbage").Code)
+}
+
+func TestRequireRole(t *testing.T) {
+	v := NewJWTVerifier(Options{Secret: "s3cret"})
+	h := Authenticate(v)(RequireRole(RoleAdmin)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+
+	call := func(claims jwt.MapClaims) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if claims != nil {
+			req.Header.Set("Authorization", "Bearer "+signHS(t, "s3cret", claims))
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, call(nil).Code)
+
+	user := accessClaims("", time.Now().Add(time.Minute))
+	user["roles"] = []string{RoleUser}
+	assert.Equal(t, http.StatusForbidden, call(user).Code)
+
+	admin := accessClaims("", time.Now().Add(time.Minute))
+	admin["roles"] = []string{RoleUser, RoleAdmin}
+	assert.Equal(t, http.StatusOK, call(admin).Code)
+}
+
+func TestGatewayHeaders(t *testing.T) {
+	var seen *Principal
+	h := FromGateway(RequireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen, _ = PrincipalFrom(r.Context())
+	})))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	SetIdentityHeaders(req.Header, &Principal{UserID: 42, Username: "alice", Roles: []string{RoleUser, RoleAdmin}})
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	require.NotNil(t, seen)
+	assert.Equal(t, int64(42), seen.UserID)
+	assert.Equal(t, "alice", seen.Username)
+	assert.True(t, seen.HasRole(RoleAdmin))
+	assert.Nil(t, seen.Scopes)
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	SetIdentityHeaders(req.Header, &Principal{UserID: 42, Scopes: []string{ScopeProfileRead}})
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, []string{ScopeProfileRead}, seen.Scopes)
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(HeaderUserID, "nope")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestRequireScope(t *testing.T) {
+	h := FromGateway(RequireScope(ScopeProfileWrite)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+	call := func(p *Principal) int {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if p != nil {
+			SetIdentityHeaders(req.Header, p)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, call(nil))
+	assert.Equal(t, http.StatusOK, call(&Principal{UserID: 42}), "login sessions have every scope")
+	assert.Equal(t, http.StatusForbidden, call(&Principal{UserID: 42, Scopes: []string{ScopeProfileRead}}))
+	assert.Equal(t, http.StatusOK, call(&Principal{UserID: 42, Scopes: []string{ScopeProfileRead, ScopeProfileWrite}}))
+}
+
+func TestIntrospector(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		require.NoError(t, r.ParseForm())
+		switch r.PostForm.Get("token") {
+		case PersonalTokenPrefix + "good":
+			_, _ = w.Write([]byte(`{"active":true,"sub":"42","username":"alice","roles":["user"],"scope":"profile:read"}`))
+		default:
+			_, _ = w.Write([]byte(`{"active":false}`))
+		}
+	}))
+	defer srv.Close()
+
+	v, err := New(Config{Issuer: "auth.test", Secret: "s3cret", IntrospectURL: srv.URL})
+	require.NoError(t, err)
+
+	p, err := v.Verify(context.Background(), PersonalTokenPrefix+"good")
+	require.NoError(t, err)
+	assert.Equal(t, int64(42), p.UserID)
+	assert.Equal(t, "alice", p.Username)
+	assert.Equal(t, []string{ScopeProfileRead}, p.Scopes)
+	assert.True(t, p.HasScope(ScopeProfileRead))
+	assert.False(t, p.HasScope(ScopeProfileWrite))
+
+	_, err = v.Verify(context.Background(), PersonalTokenPrefix+"revoked")
+	assert.ErrorIs(t, err, ErrInvalidToken)
+
+	// JWTs are still verified locally.
+	jwtToken := signHS(t, "s3cret", accessClaims("auth.test", time.Now().Add(time.Minute)))
+	p, err = v.Verify(context.Background(), jwtToken)
+	require.NoError(t, err)
+	assert.Nil(t, p.Scopes)
+	assert.Equal(t, int32(2), calls.Load())
+}
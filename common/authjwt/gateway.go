@@ -0,0 +1,61 @@
+package authjwt
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Identity headers the gateway forwards to upstreams once the auth service
+// accepted the caller's access token. Roles and scopes are comma separated;
+// scopes are only sent for personal access tokens.
+const (
+	HeaderUserID     = "X-User-Id"
+	HeaderUserName   = "X-User-Name"
+	HeaderUserRoles  = "X-User-Roles"
+	HeaderUserScopes = "X-User-Scopes"
+)
+
+// SetIdentityHeaders describes p in the identity headers.
+func SetIdentityHeaders(h http.Header, p *Principal) {
+	h.Set(HeaderUserID, strconv.FormatInt(p.UserID, 10))
+	h.Set(HeaderUserName, p.Username)
+	h.Set(HeaderUserRoles, strings.Join(p.Roles, ","))
+	if p.Scopes != nil {
+		h.Set(HeaderUserScopes, strings.Join(p.Scopes, ","))
+	}
+}
+
+// FromGateway stores the Principal described by the identity headers in the
+// request context. Requests without them pass through anonymously, like
+// with Authenticate. The headers are trusted as they are, so this is only
+// safe behind a gateway that overwrites them on every request.
+func FromGateway(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(r.Header.Get(HeaderUserID), 10, 64)
+		if err != nil || id <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		p := &Principal{
+			UserID:   id,
+			Username: r.Header.Get(HeaderUserName),
+			Roles:    splitList(r.Header.Get(HeaderUserRoles)),
+		}
+		if scopes, ok := r.Header[http.CanonicalHeaderKey(HeaderUserScopes)]; ok && len(scopes) > 0 {
+			// Never nil: a personal token without scopes may do nothing.
+			p.Scopes = append([]string{}, splitList(scopes[0])...)
+		}
+		next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), p)))
+	})
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
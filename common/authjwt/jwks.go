@@ -0,0 +1,181 @@
+package authjwt
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var ErrUnknownKey = errors.New("unknown signing key")
+
+const (
+	defaultJWKSRefresh = 10 * time.Minute
+	// minJWKSRefetch limits how often an unknown kid or a failing auth
+	// service can trigger a fetch.
+	minJWKSRefetch = 30 * time.Second
+	// jwksTimeout bounds a fetch made by New.
+	jwksTimeout = 5 * time.Second
+)
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+}
+
+type jwksKey struct {
+	alg string
+	pub any
+}
+
+// JWKS resolves verification keys from the auth service key set endpoint.
+// Keys are cached and refetched every refresh interval, or earlier when a
+// token names a kid that is not cached yet (a freshly rotated key). The
+// client should have a timeout, since verification waits for fetches.
+type JWKS struct {
+	url     string
+	client  *http.Client
+	refresh time.Duration
+
+	mu          sync.Mutex
+	keys        map[string]jwksKey
+	fetchedAt   time.Time
+	attemptedAt time.Time
+	fetchErr    error
+	inflight    chan struct{}
+}
+
+func NewJWKS(url string, client *http.Client, refresh time.Duration) *JWKS {
+	if refresh <= 0 {
+		refresh = defaultJWKSRefresh
+	}
+	return &JWKS{url: url, client: client, refresh: refresh}
+}
+
+// Methods lists the algorithms a JWKS key can use.
+func (j *JWKS) Methods() []string {
+	return []string{jwt.SigningMethodRS256.Alg(), jwt.SigningMethodEdDSA.Alg()}
+}
+
+func (j *JWKS) Keyfunc(t *jwt.Token) (any, error) {
+	kid, _ := t.Header["kid"].(string)
+	if kid == "" {
+		return nil, ErrUnknownKey
+	}
+	k, err := j.lookup(kid)
+	if err != nil {
+		return nil, err
+	}
+	if k.alg != t.Method.Alg() {
+		return nil, ErrUnknownKey
+	}
+	return k.pub, nil
+}
+
+// lookup returns the key named kid, fetching the key set when kid is not
+// cached or the cache is stale. Fetches run without holding j.mu and at most
+// once per minJWKSRefetch, failed ones included; concurrent callers wait for
+// the fetch in flight instead of starting their own.
+func (j *JWKS) lookup(kid string) (jwksKey, error) {
+	j.mu.Lock()
+	k, ok := j.keys[kid]
+	if ok && time.Since(j.fetchedAt) < j.refresh {
+		j.mu.Unlock()
+		return k, nil
+	}
+	if done := j.inflight; done != nil {
+		j.mu.Unlock()
+		<-done
+		j.mu.Lock()
+	} else if time.Since(j.attemptedAt) >= minJWKSRefetch {
+		done := make(chan struct{})
+		j.inflight = done
+		j.attemptedAt = time.Now()
+		j.mu.Unlock()
+		keys, err := j.fetch()
+		j.mu.Lock()
+		if err == nil {
+			j.keys = keys
+			j.fetchedAt = time.Now()
+		}
+		j.fetchErr = err
+		j.inflight = nil
+		close(done)
+	}
+	defer j.mu.Unlock()
+
+	if k, ok = j.keys[kid]; ok {
+		return k, nil
+	}
+	if j.keys == nil && j.fetchErr != nil {
+		return jwksKey{}, j.fetchErr
+	}
+	return jwksKey{}, ErrUnknownKey
+}
+
+func (j *JWKS) fetch() (map[string]jwksKey, error) {
+	resp, err := j.client.Get(j.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("authjwt: jwks fetch: status %d", resp.StatusCode)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("authjwt: jwks decode: %w", err)
+	}
+	keys := make(map[string]jwksKey, len(set.Keys))
+	for _, k := range set.Keys {
+		parsed, err := k.parse()
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = parsed
+	}
+	return keys, nil
+}
+
+func (k jwk) parse() (jwksKey, error) {
+	enc := base64.RawURLEncoding
+	switch k.Kty {
+	case "RSA":
+		n, err := enc.DecodeString(k.N)
+		if err != nil {
+			return jwksKey{}, err
+		}
+		e, err := enc.DecodeString(k.E)
+		if err != nil {
+			return jwksKey{}, err
+		}
+		pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		return jwksKey{alg: jwt.SigningMethodRS256.Alg(), pub: pub}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return jwksKey{}, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := enc.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return jwksKey{}, errors.New("invalid Ed25519 key")
+		}
+		return jwksKey{alg: jwt.SigningMethodEdDSA.Alg(), pub: ed25519.PublicKey(x)}, nil
+	default:
+		return jwksKey{}, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
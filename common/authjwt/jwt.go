@@ -0,0 +1,157 @@
+package authjwt
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Secret is a shared HS256 secret named by the "kid" header of the tokens
+// it signed.
+type Secret struct {
+	KID    string `yaml:"kid"`
+	Secret string `yaml:"secret"`
+}
+
+// Config is the yaml section services use to describe how access tokens are
+// verified. Either JWKSURL or the HS256 secrets must be set, not both.
+// Secrets lists the auth service's jwt.secrets; Secret verifies tokens whose
+// kid is not among them.
+type Config struct {
+	Issuer      string        `yaml:"issuer"`
+	Secret      string        `yaml:"secret"`
+	Secrets     []Secret      `yaml:"secrets"`
+	JWKSURL     string        `yaml:"jwks_url"`
+	JWKSRefresh time.Duration `yaml:"jwks_refresh"`
+	// IntrospectURL is the auth service's POST /introspect endpoint. When
+	// set, personal access tokens are accepted and checked there.
+	IntrospectURL string `yaml:"introspect_url"`
+	// TrustGateway takes the caller from the identity headers the gateway
+	// sets after asking the auth service (see FromGateway) instead of
+	// verifying tokens locally. Only enable it for services that cannot be
+	// reached around the gateway.
+	TrustGateway bool `yaml:"trust_gateway"`
+}
+
+// Options configures a JWTVerifier directly. Keyfunc and Methods take
+// precedence over Secret.
+type Options struct {
+	Issuer  string
+	Secret  string
+	Keyfunc jwt.Keyfunc
+	Methods []string
+	NowFn   func() time.Time
+}
+
+// JWTVerifier validates access tokens issued by the auth service.
+type JWTVerifier struct {
+	opts Options
+}
+
+func NewJWTVerifier(opts Options) *JWTVerifier {
+	if opts.Keyfunc == nil {
+		secret := []byte(opts.Secret)
+		opts.Keyfunc = func(*jwt.Token) (any, error) { return secret, nil }
+		opts.Methods = []string{jwt.SigningMethodHS256.Alg()}
+	}
+	if opts.NowFn == nil {
+		opts.NowFn = time.Now
+	}
+	return &JWTVerifier{opts: opts}
+}
+
+// New builds a verifier from a service config section.
+func New(c Config) (Verifier, error) {
+	var v Verifier
+	shared := c.Secret != "" || len(c.Secrets) > 0
+	switch {
+	case c.JWKSURL != "" && shared:
+		return nil, errors.New("authjwt: secret and jwks_url are mutually exclusive")
+	case c.JWKSURL != "":
+		jwks := NewJWKS(c.JWKSURL, &http.Client{Timeout: jwksTimeout}, c.JWKSRefresh)
+		v = NewJWTVerifier(Options{Issuer: c.Issuer, Keyfunc: jwks.Keyfunc, Methods: jwks.Methods()})
+	case len(c.Secrets) > 0:
+		v = NewJWTVerifier(Options{
+			Issuer:  c.Issuer,
+			Keyfunc: secretsKeyfunc(c.Secret, c.Secrets),
+			Methods: []string{jwt.SigningMethodHS256.Alg()},
+		})
+	case c.Secret != "":
+		v = NewJWTVerifier(Options{Issuer: c.Issuer, Secret: c.Secret})
+	default:
+		return nil, errors.New("authjwt: either secret or jwks_url is required")
+	}
+	if c.IntrospectURL != "" {
+		v = WithIntrospection(v, NewIntrospector(c.IntrospectURL, &http.Client{Timeout: 5 * time.Second}))
+	}
+	return v, nil
+}
+
+// secretsKeyfunc picks the secret named by the token's kid, falling back to
+// fallback when it is set.
+func secretsKeyfunc(fallback string, secrets []Secret) jwt.Keyfunc {
+	byKID := make(map[string][]byte, len(secrets))
+	for _, s := range secrets {
+		byKID[s.KID] = []byte(s.Secret)
+	}
+	return func(t *jwt.Token) (any, error) {
+		kid, _ := t.Header["kid"].(string)
+		if secret, ok := byKID[kid]; ok {
+			return secret, nil
+		}
+		if fallback != "" {
+			return []byte(fallback), nil
+		}
+		return nil, ErrInvalidToken
+	}
+}
+
+func (v *JWTVerifier) Verify(_ context.Context, token string) (*Principal, error) {
+	claims := jwt.MapClaims{}
+	parserOpts := []jwt.ParserOption{
+		jwt.WithValidMethods(v.opts.Methods),
+		jwt.WithExpirationRequired(),
+		jwt.WithTimeFunc(v.opts.NowFn),
+	}
+	if v.opts.Issuer != "" {
+		parserOpts = append(parserOpts, jwt.WithIssuer(v.opts.Issuer))
+	}
+	if _, err := jwt.ParseWithClaims(token, claims, v.opts.Keyfunc, parserOpts...); err != nil {
+		return nil, ErrInvalidToken
+	}
+	return principalFromClaims(claims)
+}
+
+func principalFromClaims(claims jwt.MapClaims) (*Principal, error) {
+	sub, err := claims.GetSubject()
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	id, err := strconv.ParseInt(sub, 10, 64)
+	if err != nil || id <= 0 {
+		return nil, ErrInvalidToken
+	}
+	name, _ := claims["name"].(string)
+	sid, _ := claims["sid"].(string)
+	verified, _ := claims["email_verified"].(bool)
+	var roles []string
+	if list, ok := claims["roles"].([]any); ok {
+		for _, r := range list {
+			if s, ok := r.(string); ok {
+				roles = append(roles, s)
+			}
+		}
+	}
+	p := &Principal{UserID: id, Username: name, SessionID: sid, EmailVerified: verified, Roles: roles}
+	if iat, err := claims.GetIssuedAt(); err == nil && iat != nil {
+		p.IssuedAt = iat.Time
+	}
+	if exp, err := claims.GetExpirationTime(); err == nil && exp != nil {
+		p.ExpiresAt = exp.Time
+	}
+	return p, nil
+}
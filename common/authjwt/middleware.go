@@ -0,0 +1,104 @@
+package authjwt
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// Authenticate verifies the "Authorization: Bearer" token when one is sent
+// and stores the Principal in the request context. Requests without a token,
+// or with one that fails verification, pass through anonymously so public
+// routes keep working; guard private routes with RequireAuth.
+func Authenticate(v Verifier) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, ok := BearerToken(r)
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+			p, err := v.Verify(r.Context(), token)
+			var ctx context.Context
+			if err != nil {
+				ctx = context.WithValue(r.Context(), authErrKey, err)
+			} else {
+				ctx = NewContext(r.Context(), p)
+			}
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// RequireAuth answers 401 unless Authenticate stored a Principal.
+func RequireAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := PrincipalFrom(r.Context()); !ok {
+			err, _ := r.Context().Value(authErrKey).(error)
+			if err == nil {
+				err = ErrMissingToken
+			}
+			writeUnauthorized(w, err)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireRole answers 401 without a Principal and 403 unless the caller has
+// one of roles.
+func RequireRole(roles ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return RequireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p, _ := PrincipalFrom(r.Context())
+			for _, role := range roles {
+				if p.HasRole(role) {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+			writeError(w, http.StatusForbidden, ErrForbidden)
+		}))
+	}
+}
+
+// RequireScope answers 401 without a Principal and 403 unless the caller
+// may act within scope. Callers from a login session pass every scope.
+func RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return RequireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p, _ := PrincipalFrom(r.Context())
+			if !p.HasScope(scope) {
+				writeError(w, http.StatusForbidden, ErrForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		}))
+	}
+}
+
+// BearerToken extracts the token from an "Authorization: Bearer" header.
+func BearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+func writeUnauthorized(w http.ResponseWriter, err error) {
+	challenge := `Bearer`
+	if err != ErrMissingToken {
+		challenge = `Bearer error="invalid_token"`
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+	writeError(w, http.StatusUnauthorized, err)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
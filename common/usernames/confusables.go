@@ -0,0 +1,59 @@
+package usernames
+
+import (
+	"strings"
+	"unicode"
+)
+
+// confusables maps characters to the Latin letter they are easily mistaken
+// for. It covers the Cyrillic and Greek look-alikes and the digits people
+// use in place of letters; the Unicode confusables table is far larger, but
+// names outside the ASCII set are refused unless the policy allows Unicode.
+var confusables = map[rune]rune{
+	// Digits and ASCII letters that read as other letters.
+	'0': 'o', '1': 'l', '3': 'e', '4': 'a', '5': 's', '7': 't', '8': 'b', 'i': 'l',
+
+	// Cyrillic.
+	'а': 'a', 'в': 'b', 'е': 'e', 'ё': 'e', 'з': 'e', 'і': 'l', 'ї': 'l', 'ј': 'j', 'к': 'k',
+	'м': 'm', 'н': 'h', 'о': 'o', 'п': 'n', 'р': 'p', 'с': 'c', 'т': 't', 'у': 'y',
+	'х': 'x', 'ѕ': 's', 'ԁ': 'd', 'ԛ': 'q', 'ԝ': 'w', 'ү': 'y', 'һ': 'h', 'ӏ': 'l',
+
+	// Greek, with the capitals whose lower case looks different.
+	'α': 'a', 'β': 'b', 'ε': 'e', 'η': 'n', 'ι': 'l', 'κ': 'k', 'ν': 'v', 'ο': 'o',
+	'ρ': 'p', 'τ': 't', 'υ': 'u', 'χ': 'x', 'ζ': 'z', 'μ': 'u',
+	'Β': 'b', 'Η': 'h', 'Μ': 'm', 'Ν': 'n', 'Υ': 'y',
+}
+
+// Skeleton reduces name to a form in which names that look alike are
+// equal: case and separators are dropped, full-width forms folded and
+// look-alike characters replaced, so "Adm1n", "ad_min" and "аdmin" with a
+// Cyrillic а all give "admln".
+func Skeleton(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		r = foldWidth(r)
+		if c, ok := confusables[r]; ok {
+			r = c
+		}
+		r = unicode.ToLower(r)
+		if c, ok := confusables[r]; ok {
+			r = c
+		}
+		if isSeparator(r) || unicode.IsSpace(r) {
+			continue
+		}
+		b.WriteRune(r)
+	}
+	s := b.String()
+	s = strings.ReplaceAll(s, "rn", "m")
+	s = strings.ReplaceAll(s, "vv", "w")
+	return s
+}
+
+// foldWidth maps full-width ASCII forms to ASCII.
+func foldWidth(r rune) rune {
+	if r >= 0xFF01 && r <= 0xFF5E {
+		return r - 0xFEE0
+	}
+	return r
+}
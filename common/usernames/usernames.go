@@ -0,0 +1,221 @@
+// Package usernames decides which account names may be registered. The
+// auth service checks new and changed names against a Policy; the profile
+// service uses the same rules for the names it serves under /{username}.
+package usernames
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// Config is the yaml section describing the username policy. Zero values
+// fall back to the defaults below.
+type Config struct {
+	MinLength int `yaml:"min_length"`
+	MaxLength int `yaml:"max_length"`
+	// Unicode allows letters and digits from any script. By default only
+	// ASCII letters and digits are accepted.
+	Unicode bool `yaml:"unicode"`
+	// Reserved names and the file they are read from, one per line. Both
+	// are added to the route names each service reserves itself.
+	Reserved     []string `yaml:"reserved"`
+	ReservedFile string   `yaml:"reserved_file"`
+	// Profanity lists words refused anywhere inside a name, so keep entries
+	// long enough not to match innocent names.
+	Profanity     []string `yaml:"profanity"`
+	ProfanityFile string   `yaml:"profanity_file"`
+}
+
+const (
+	DefaultMinLength = 3
+	DefaultMaxLength = 64
+)
+
+// Reason tells clients why a name was refused.
+type Reason string
+
+const (
+	ReasonTooShort   Reason = "too_short"
+	ReasonTooLong    Reason = "too_long"
+	ReasonCharacters Reason = "invalid_characters"
+	ReasonFormat     Reason = "invalid_format"
+	ReasonReserved   Reason = "reserved"
+	ReasonProfanity  Reason = "profanity"
+)
+
+// Error is returned for names the policy refuses.
+type Error struct {
+	Reason Reason
+	msg    string
+}
+
+func (e *Error) Error() string { return e.msg }
+
+// Policy checks usernames. Reserve may only be called before the policy is
+// shared between goroutines.
+type Policy struct {
+	min, max  int
+	unicode   bool
+	reserved  map[string]struct{}
+	profanity []string
+}
+
+// New builds a policy from cfg, reading the reserved and profanity files
+// when they are set.
+func New(cfg Config) (*Policy, error) {
+	p := &Policy{
+		min:      cfg.MinLength,
+		max:      cfg.MaxLength,
+		unicode:  cfg.Unicode,
+		reserved: make(map[string]struct{}),
+	}
+	if p.min <= 0 {
+		p.min = DefaultMinLength
+	}
+	if p.max <= 0 {
+		p.max = DefaultMaxLength
+	}
+	if p.min > p.max {
+		return nil, fmt.Errorf("usernames: min_length %d exceeds max_length %d", p.min, p.max)
+	}
+
+	reserved := cfg.Reserved
+	if cfg.ReservedFile != "" {
+		words, err := readList(cfg.ReservedFile)
+		if err != nil {
+			return nil, err
+		}
+		reserved = append(reserved, words...)
+	}
+	p.Reserve(reserved...)
+
+	profanity := cfg.Profanity
+	if cfg.ProfanityFile != "" {
+		words, err := readList(cfg.ProfanityFile)
+		if err != nil {
+			return nil, err
+		}
+		profanity = append(profanity, words...)
+	}
+	for _, w := range profanity {
+		if s := Skeleton(w); s != "" {
+			p.profanity = append(p.profanity, s)
+		}
+	}
+	return p, nil
+}
+
+// Default returns a policy with the default lengths and character set and
+// no reserved or profane words.
+func Default() *Policy {
+	p, _ := New(Config{})
+	return p
+}
+
+// Reserve refuses words, and every name that looks like one of them.
+func (p *Policy) Reserve(words ...string) {
+	for _, w := range words {
+		if s := Skeleton(w); s != "" {
+			p.reserved[s] = struct{}{}
+		}
+	}
+}
+
+// Normalize checks name against the whole policy and returns the form to
+// store: surrounding space trimmed and full-width characters folded.
+func (p *Policy) Normalize(name string) (string, error) {
+	name = strings.Map(foldWidth, strings.TrimSpace(name))
+	if err := p.CheckFormat(name); err != nil {
+		return "", err
+	}
+	skel := Skeleton(name)
+	if _, ok := p.reserved[skel]; ok {
+		return "", &Error{Reason: ReasonReserved, msg: "username is reserved"}
+	}
+	for _, w := range p.profanity {
+		if strings.Contains(skel, w) {
+			return "", &Error{Reason: ReasonProfanity, msg: "username is not allowed"}
+		}
+	}
+	return name, nil
+}
+
+// CheckFormat checks only the length and characters of name. Names failing
+// it can never belong to an account.
+func (p *Policy) CheckFormat(name string) error {
+	n := 0
+	prevSep := true
+	for _, r := range name {
+		n++
+		sep := isSeparator(r)
+		switch {
+		case sep && prevSep:
+			// Also catches a leading separator.
+			return &Error{Reason: ReasonFormat, msg: "username must start and end with a letter or digit and not repeat '.', '_' or '-'"}
+		case !sep && !p.allowed(r):
+			return &Error{Reason: ReasonCharacters, msg: "username may only contain letters, digits, '.', '_' and '-'"}
+		}
+		prevSep = sep
+	}
+	switch {
+	case n < p.min:
+		return &Error{Reason: ReasonTooShort, msg: fmt.Sprintf("username must be at least %d characters", p.min)}
+	case n > p.max:
+		return &Error{Reason: ReasonTooLong, msg: fmt.Sprintf("username must be at most %d characters", p.max)}
+	case prevSep:
+		return &Error{Reason: ReasonFormat, msg: "username must start and end with a letter or digit and not repeat '.', '_' or '-'"}
+	}
+	return nil
+}
+
+func (p *Policy) allowed(r rune) bool {
+	if r < unicode.MaxASCII {
+		return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9'
+	}
+	return p.unicode && (unicode.IsLetter(r) || unicode.Is(unicode.Nd, r))
+}
+
+func isSeparator(r rune) bool {
+	return r == '.' || r == '_' || r == '-'
+}
+
+// RouteWords returns the first static segment of each route pattern, the
+// names that would be shadowed by a route mounted next to /{username}.
+func RouteWords(patterns ...string) []string {
+	seen := make(map[string]bool)
+	var words []string
+	for _, pat := range patterns {
+		seg, _, _ := strings.Cut(strings.TrimPrefix(pat, "/"), "/")
+		if seg == "" || strings.ContainsAny(seg, "{*") || seen[seg] {
+			continue
+		}
+		seen[seg] = true
+		words = append(words, seg)
+	}
+	return words
+}
+
+// readList reads one word per line, skipping blank lines and # comments.
+func readList(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("usernames: %w", err)
+	}
+	defer f.Close()
+
+	var words []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		if line = strings.TrimSpace(line); line != "" {
+			words = append(words, line)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("usernames: read %s: %w", path, err)
+	}
+	return words, nil
+}
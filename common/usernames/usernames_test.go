@@ -0,0 +1,118 @@
+package usernames
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func reason(t *testing.T, err error) Reason {
+	t.Helper()
+	var e *Error
+	require.True(t, errors.As(err, &e), "want *Error, got %v", err)
+	return e.Reason
+}
+
+func TestNormalize_Format(t *testing.T) {
+	p := Default()
+
+	cases := []struct {
+		name string
+		want Reason
+	}{
+		{"al", ReasonTooShort},
+		{strings.Repeat("a", 65), ReasonTooLong},
+		{"bob/alice", ReasonCharacters},
+		{"bob smith", ReasonCharacters},
+		{"émile", ReasonCharacters},
+		{"party🎉", ReasonCharacters},
+		{"_bob", ReasonFormat},
+		{"bob.", ReasonFormat},
+		{"bob__smith", ReasonFormat},
+	}
+	for _, c := range cases {
+		_, err := p.Normalize(c.name)
+		assert.Equal(t, c.want, reason(t, err), c.name)
+	}
+
+	for _, name := range []string{"bob", "Bob.Smith", "user_42", "a-b-c", strings.Repeat("a", 64)} {
+		got, err := p.Normalize(name)
+		assert.NoError(t, err, name)
+		assert.Equal(t, name, got)
+	}
+}
+
+func TestNormalize_TrimsAndFoldsWidth(t *testing.T) {
+	got, err := Default().Normalize("  ｂｏｂ ")
+	require.NoError(t, err)
+	assert.Equal(t, "bob", got)
+}
+
+func TestNormalize_Unicode(t *testing.T) {
+	p, err := New(Config{Unicode: true, Reserved: []string{"admin"}})
+	require.NoError(t, err)
+
+	got, err := p.Normalize("émile")
+	require.NoError(t, err)
+	assert.Equal(t, "émile", got)
+
+	_, err = p.Normalize("party🎉")
+	assert.Equal(t, ReasonCharacters, reason(t, err))
+
+	// A Cyrillic а in place of the Latin a.
+	_, err = p.Normalize("аdmin")
+	assert.Equal(t, ReasonReserved, reason(t, err))
+}
+
+func TestNormalize_Reserved(t *testing.T) {
+	p, err := New(Config{Reserved: []string{"admin"}})
+	require.NoError(t, err)
+	p.Reserve(RouteWords("/ping", "/{username}", "/internal/randompage")...)
+
+	for _, name := range []string{"admin", "ADMIN", "adm1n", "ad_min", "ping", "P1NG", "internal", "lnternal"} {
+		_, err := p.Normalize(name)
+		assert.Equal(t, ReasonReserved, reason(t, err), name)
+	}
+	_, err = p.Normalize("administrator")
+	assert.NoError(t, err)
+}
+
+func TestNormalize_Profanity(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "profanity.txt")
+	require.NoError(t, os.WriteFile(path, []byte("# comment\n\nbadword\n"), 0o600))
+
+	p, err := New(Config{ProfanityFile: path})
+	require.NoError(t, err)
+
+	for _, name := range []string{"badword", "the_badword_guy", "B4DW0RD"} {
+		_, err := p.Normalize(name)
+		assert.Equal(t, ReasonProfanity, reason(t, err), name)
+	}
+	_, err = p.Normalize("goodword")
+	assert.NoError(t, err)
+}
+
+func TestNew_Errors(t *testing.T) {
+	_, err := New(Config{ReservedFile: filepath.Join(t.TempDir(), "missing.txt")})
+	assert.Error(t, err)
+
+	_, err = New(Config{MinLength: 10, MaxLength: 5})
+	assert.Error(t, err)
+}
+
+func TestSkeleton(t *testing.T) {
+	assert.Equal(t, "admln", Skeleton("Adm1n"))
+	assert.Equal(t, Skeleton("modern"), Skeleton("modem"))
+	assert.Equal(t, Skeleton("ΒΟΒ"), Skeleton("bob"))
+}
+
+func TestRouteWords(t *testing.T) {
+	got := RouteWords("/ping", "/{username}", "/users/{id}", "/users", "/*", "/internal/randompage", "/")
+	assert.Equal(t, []string{"ping", "users", "internal"}, got)
+}
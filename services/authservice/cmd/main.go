@@ -3,19 +3,40 @@ package main
 import (
 	"bioly/asynclogger"
 	"bioly/auth/internal/config"
+	"bioly/auth/internal/janitor"
+	"bioly/auth/internal/keys"
+	"bioly/auth/internal/magiclink"
+	"bioly/auth/internal/mailer"
+	"bioly/auth/internal/oauth"
+	"bioly/auth/internal/passwords"
+	"bioly/auth/internal/pow"
+	"bioly/auth/internal/ratelimit"
 	"bioly/auth/internal/repositories"
+	"bioly/auth/internal/secretbox"
 	"bioly/auth/internal/transport"
 	"bioly/auth/internal/usecase"
 	"bioly/storage"
+	"bioly/usernames"
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
 )
 
 func main() {
 	cfgFile := os.Getenv("CONFIG_PATH")
 	cfg := config.New(cfgFile)
+	if os.Getenv("DEV_MODE") == "1" {
+		cfg.DevMode = true
+	}
 
 	logDirName := os.Getenv("LOG_DIR")
 	loggerInfo := asynclogger.LoggerInfo{FilePath: logDirName, MaxSize: 10, MaxBackups: 5, MaxAge: 30, IsCompress: true}
@@ -27,6 +48,10 @@ func main() {
 		logger.Close()
 	}()
 
+	if err := cfg.CheckSecrets(); err != nil {
+		asynclogger.Fatal("Refusing to start: %v", err)
+	}
+
 	db, err := storage.New(&cfg.DBInfo)
 	if err != nil {
 		asynclogger.Fatal("Can't connect to auth DB: %v", err)
@@ -35,15 +60,159 @@ func main() {
 	userRepo := repositories.NewUsers(db)
 	refreshRepo := repositories.NewRefreshTokens(db)
 
-	uc := usecase.NewAuth(userRepo, refreshRepo, &cfg.JWT)
+	keySet, err := keys.FromConfig(&cfg.JWT)
+	if err != nil {
+		asynclogger.Fatal("Can't load JWT keys: %v", err)
+	}
+
+	var failures ratelimit.Store = ratelimit.NewMemoryStore()
+	if cfg.LoginThrottle.Store == "postgres" {
+		failures = repositories.NewLoginFailures(db)
+	}
+	limiter := ratelimit.New(failures, &cfg.LoginThrottle)
+
+	mail, err := mailer.FromConfig(&cfg.Mail)
+	if err != nil {
+		asynclogger.Fatal("Can't set up mailer: %v", err)
+	}
+	resetRepo := repositories.NewPasswordResets(db)
+	if cfg.EmailVerification.Secret == "" {
+		asynclogger.Fatal("email_verification.secret is not set")
+	}
+
+	names, err := usernames.New(cfg.Username.Policy)
+	if err != nil {
+		asynclogger.Fatal("Can't load username policy: %v", err)
+	}
+
+	var breached *passwords.Breached
+	if cfg.PasswordPolicy.BreachedFile != "" {
+		breached, err = passwords.OpenBreached(cfg.PasswordPolicy.BreachedFile)
+		if err != nil {
+			asynclogger.Fatal("Can't open breached password list: %v", err)
+		}
+		defer breached.Close()
+	} else {
+		asynclogger.Warning("password_policy.breached_file is not set, new passwords are not checked against breaches")
+	}
+
+	opts := []usecase.Option{
+		usecase.WithKeys(keySet),
+		usecase.WithLoginThrottle(limiter, &cfg.LoginThrottle),
+		usecase.WithMailThrottle(limiter.Namespace("mail:")),
+		usecase.WithHasher(passwords.FromConfig(&cfg.PasswordHash)),
+		usecase.WithPasswordReset(resetRepo, mail, &cfg.PasswordReset),
+		usecase.WithEmailVerification(mail, &cfg.EmailVerification),
+		usecase.WithUsernameChange(&cfg.Username),
+		usecase.WithUsernamePolicy(names),
+		usecase.WithPasswordPolicy(passwords.NewPolicy(&cfg.PasswordPolicy, breached)),
+		usecase.WithPersonalTokens(repositories.NewPersonalTokens(db), &cfg.PersonalTokens),
+	}
+	if cfg.MFA.EncryptionKey != "" {
+		box, err := secretbox.NewFromBase64(cfg.MFA.EncryptionKey)
+		if err != nil {
+			asynclogger.Fatal("Invalid mfa.encryption_key: %v", err)
+		}
+		opts = append(opts, usecase.WithMFA(repositories.NewMFA(db), box, &cfg.MFA))
+	} else {
+		asynclogger.Warning("mfa.encryption_key is not set, two-factor authentication is disabled")
+	}
+	if cfg.OAuth.CookieKey != "" {
+		box, err := secretbox.NewFromBase64(cfg.OAuth.CookieKey)
+		if err != nil {
+			asynclogger.Fatal("Invalid oauth.cookie_key: %v", err)
+		}
+		providers := oauth.FromConfig(&cfg.OAuth, &http.Client{Timeout: 10 * time.Second})
+		opts = append(opts, usecase.WithOAuth(repositories.NewIdentities(db), providers, box, &cfg.OAuth))
+		asynclogger.Info("Sign-in with %d external provider(s) enabled", len(providers))
+	} else {
+		asynclogger.Warning("oauth.cookie_key is not set, sign-in with external providers is disabled")
+	}
+
+	if cfg.Registration.Secret != "" {
+		issuer := pow.New([]byte(cfg.Registration.Secret), cfg.Registration.Difficulty, cfg.Registration.ChallengeTTL)
+		opts = append(opts, usecase.WithRegistration(repositories.NewRegistrations(db), issuer, &cfg.Registration))
+		asynclogger.Info("Self-service registration enabled difficulty=%d invite_only=%t", cfg.Registration.Difficulty, cfg.Registration.InviteOnly)
+	} else {
+		asynclogger.Warning("registration.secret is not set, self-service registration is disabled")
+	}
+
+	if cfg.WebAuthn.SessionKey != "" {
+		box, err := secretbox.NewFromBase64(cfg.WebAuthn.SessionKey)
+		if err != nil {
+			asynclogger.Fatal("Invalid webauthn.session_key: %v", err)
+		}
+		timeout := webauthn.TimeoutConfig{Enforce: true, Timeout: cfg.WebAuthn.Timeout}
+		wa, err := webauthn.New(&webauthn.Config{
+			RPID:          cfg.WebAuthn.RPID,
+			RPDisplayName: cfg.WebAuthn.RPName,
+			RPOrigins:     cfg.WebAuthn.Origins,
+			Timeouts:      webauthn.TimeoutsConfig{Login: timeout, Registration: timeout},
+		})
+		if err != nil {
+			asynclogger.Fatal("Invalid webauthn config: %v", err)
+		}
+		opts = append(opts, usecase.WithWebAuthn(repositories.NewWebAuthnCredentials(db), wa, box, &cfg.WebAuthn))
+		asynclogger.Info("Passkey login enabled rp_id=%s", cfg.WebAuthn.RPID)
+	} else {
+		asynclogger.Warning("webauthn.session_key is not set, passkey login is disabled")
+	}
+
+	if cfg.MagicLink.Secret != "" {
+		signer := magiclink.New([]byte(cfg.MagicLink.Secret), cfg.MagicLink.TokenTTL)
+		opts = append(opts, usecase.WithMagicLink(repositories.NewMagicLinks(db), mail, signer, &cfg.MagicLink))
+		asynclogger.Info("Magic link login enabled token_ttl=%s", cfg.MagicLink.TokenTTL)
+	} else {
+		asynclogger.Warning("magic_link.secret is not set, magic link login is disabled")
+	}
 
-	handler := transport.NewHandler(uc)
+	uc := usecase.NewAuth(userRepo, refreshRepo, &cfg.JWT, opts...)
+
+	audit := usecase.NewAudit(repositories.NewAuditEvents(db))
+	handlerOpts := []transport.HandlerOption{transport.WithAudit(audit)}
+	if cfg.RefreshCookie.Enabled {
+		handlerOpts = append(handlerOpts, transport.WithRefreshCookie(&cfg.RefreshCookie, cfg.JWT.RefreshTTL))
+		asynclogger.Info("Refresh tokens are delivered in the %s cookie path=%s", cfg.RefreshCookie.Name, cfg.RefreshCookie.Path)
+	}
+	handler := transport.NewHandler(uc, handlerOpts...)
+	// The policy is shared with uc, so this must happen before serving.
+	names.Reserve(handler.RouteNames()...)
 	router := transport.NewRouter(handler)
 
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var workers sync.WaitGroup
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		janitor.New(refreshRepo, &cfg.TokenJanitor).Run(ctx)
+	}()
+
 	addr := fmt.Sprintf("%s:%d", cfg.HTTP.Host, cfg.HTTP.Port)
-	asynclogger.Info("Starting auth service on %s", addr)
+	srv := &http.Server{
+		Addr:         addr,
+		Handler:      router,
+		ReadTimeout:  cfg.HTTP.ReadTimeout,
+		WriteTimeout: cfg.HTTP.WriteTimeout,
+	}
+	// Shutdown makes ListenAndServe return at once; waiting for this
+	// goroutine lets requests in flight finish.
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			asynclogger.Error("Server shutdown: %v", err)
+		}
+	}()
 
-	if err := http.ListenAndServe(addr, router); err != nil {
+	asynclogger.Info("Starting auth service on %s", addr)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		asynclogger.Fatal("Server stopped: %v", err)
 	}
+	workers.Wait()
+	asynclogger.Info("Auth service stopped")
 }
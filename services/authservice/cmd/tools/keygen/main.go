@@ -0,0 +1,49 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// keygen writes a new PKCS#8 signing key into the JWT keys directory.
+func main() {
+	dir := flag.String("dir", "keys", "JWT keys directory")
+	kid := flag.String("kid", time.Now().UTC().Format("20060102"), "key ID, used as the file name")
+	alg := flag.String("alg", "ed25519", "key type: ed25519 or rsa")
+	flag.Parse()
+
+	var priv any
+	var err error
+	switch *alg {
+	case "ed25519":
+		_, priv, err = ed25519.GenerateKey(rand.Reader)
+	case "rsa":
+		priv, err = rsa.GenerateKey(rand.Reader, 2048)
+	default:
+		panic("unsupported alg " + *alg)
+	}
+	if err != nil {
+		panic(err)
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		panic(err)
+	}
+	if err := os.MkdirAll(*dir, 0o700); err != nil {
+		panic(err)
+	}
+	path := filepath.Join(*dir, *kid+".pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		panic(err)
+	}
+	println("Key written:", path)
+}
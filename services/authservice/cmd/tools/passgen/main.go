@@ -1,21 +1,43 @@
 package main
 
-import "github.com/alexedwards/argon2id"
+import (
+	"flag"
+	"fmt"
 
+	"bioly/auth/internal/config"
+	"bioly/auth/internal/passwords"
+)
+
+// passgen prints argon2id hashes for seed data. Pass -config to hash with
+// the parameters of a deployed auth.yaml, otherwise the defaults are used.
 func main() {
-	passwords := []string{
-		"password123",
-		"admin",
-		"rootuser",
-		"123456",
-		"pass",
+	cfgFile := flag.String("config", "", "path to auth.yaml")
+	flag.Parse()
+
+	cfg := &config.Config{}
+	if *cfgFile != "" {
+		cfg = config.New(*cfgFile)
+	} else {
+		cfg.SetDefaults()
+	}
+	hasher := passwords.FromConfig(&cfg.PasswordHash)
+
+	pwds := flag.Args()
+	if len(pwds) == 0 {
+		pwds = []string{
+			"password123",
+			"admin",
+			"rootuser",
+			"123456",
+			"pass",
+		}
 	}
 
-	for _, pwd := range passwords {
-		hashed, err := argon2id.CreateHash(pwd, argon2id.DefaultParams)
+	for _, pwd := range pwds {
+		hashed, err := hasher.Hash(pwd)
 		if err != nil {
 			panic(err)
 		}
-		println("Password:", pwd, "Hash:", hashed)
+		fmt.Println("Password:", pwd, "Hash:", hashed)
 	}
 }
@@ -8,24 +8,39 @@ replace bioly/yamlconf => ../../common/yamlconf
 
 replace bioly/asynclogger => ../../common/asynclogger
 
+replace bioly/authjwt => ../../common/authjwt
+
+replace bioly/usernames => ../../common/usernames
+
+require (
+	bioly/asynclogger v0.0.0-00010101000000-000000000000
+	bioly/authjwt v0.0.0-00010101000000-000000000000
+	bioly/storage v0.0.0-00010101000000-000000000000
+	bioly/usernames v0.0.0-00010101000000-000000000000
+	bioly/yamlconf v0.0.0-00010101000000-000000000000
+	github.com/DATA-DOG/go-sqlmock v1.5.2
+	github.com/alexedwards/argon2id v1.0.0
+	github.com/fxamacker/cbor/v2 v2.9.0
+	github.com/go-chi/chi/v5 v5.2.3
+	github.com/go-chi/render v1.0.3
+	github.com/go-webauthn/webauthn v0.15.0
+	github.com/golang-jwt/jwt/v5 v5.3.0
+	github.com/google/uuid v1.6.0
+	github.com/jmoiron/sqlx v1.4.0
+	github.com/lib/pq v1.10.9
+	github.com/stretchr/testify v1.11.1
+)
+
 require (
-	bioly/asynclogger v0.0.0-00010101000000-000000000000 // indirect
-	bioly/storage v0.0.0-00010101000000-000000000000 // indirect
-	bioly/yamlconf v0.0.0-00010101000000-000000000000 // indirect
-	github.com/DATA-DOG/go-sqlmock v1.5.2 // indirect
 	github.com/ajg/form v1.5.1 // indirect
-	github.com/alexedwards/argon2id v1.0.0 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
-	github.com/go-chi/chi/v5 v5.2.3 // indirect
-	github.com/go-chi/render v1.0.3 // indirect
-	github.com/golang-jwt/jwt/v5 v5.3.0 // indirect
-	github.com/google/uuid v1.6.0 // indirect
-	github.com/jmoiron/sqlx v1.4.0 // indirect
-	github.com/lib/pq v1.10.9 // indirect
+	github.com/go-viper/mapstructure/v2 v2.4.0 // indirect
+	github.com/go-webauthn/x v0.1.26 // indirect
+	github.com/google/go-tpm v0.9.6 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	github.com/stretchr/testify v1.11.1 // indirect
-	golang.org/x/crypto v0.14.0 // indirect
-	golang.org/x/sys v0.13.0 // indirect
+	github.com/x448/float16 v0.8.4 // indirect
+	golang.org/x/crypto v0.43.0 // indirect
+	golang.org/x/sys v0.37.0 // indirect
 	gopkg.in/natefinch/lumberjack.v2 v2.2.1 // indirect
 	gopkg.in/yaml.v2 v2.4.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
@@ -2,7 +2,9 @@ package config
 
 import (
 	"bioly/storage"
+	"bioly/usernames"
 	"bioly/yamlconf"
+	"fmt"
 	"log"
 	"time"
 )
@@ -14,18 +16,239 @@ type HTTP struct {
 	WriteTimeout time.Duration `yaml:"write_timeout"`
 }
 
+// HMACSecret is a shared HS256 secret named by the "kid" header of the
+// tokens it signs.
+type HMACSecret struct {
+	KID    string `yaml:"kid"`
+	Secret string `yaml:"secret"`
+}
+
 type JWT struct {
-	AccessSecret  string        `yaml:"access_secret"`
+	// AccessSecret is the single HS256 secret used before Secrets. Tokens
+	// it signed carry no kid; it keeps verifying them while Secrets is
+	// rolled out.
+	AccessSecret string `yaml:"access_secret"`
+	// RefreshSecret is unused: refresh tokens are random values stored
+	// hashed. It is still accepted so that older configs load.
 	RefreshSecret string        `yaml:"refresh_secret"`
 	AccessTTL     time.Duration `yaml:"access_ttl"`
 	RefreshTTL    time.Duration `yaml:"refresh_ttl"`
 	Issuer        string        `yaml:"issuer"`
+	// Secrets are the HS256 secrets access tokens are verified with;
+	// ActiveKID picks the one new tokens are signed with.
+	Secrets []HMACSecret `yaml:"secrets"`
+	// KeysDir switches access tokens to asymmetric signing. Every *.pem file
+	// in it is a key named after the file; ActiveKID picks the signing one.
+	KeysDir   string `yaml:"keys_dir"`
+	ActiveKID string `yaml:"active_kid"`
+}
+
+// LoginThrottle limits password guessing. Failed logins are counted per
+// username and per IP in a sliding Window; past the free attempts each try
+// waits BaseDelay, doubling up to MaxDelay. After LockoutThreshold failures
+// in a row the account itself is locked for LockoutDuration.
+type LoginThrottle struct {
+	Store            string        `yaml:"store"`
+	Window           time.Duration `yaml:"window"`
+	FreeAttempts     int           `yaml:"free_attempts"`
+	IPFreeAttempts   int           `yaml:"ip_free_attempts"`
+	BaseDelay        time.Duration `yaml:"base_delay"`
+	MaxDelay         time.Duration `yaml:"max_delay"`
+	LockoutThreshold int           `yaml:"lockout_threshold"`
+	LockoutDuration  time.Duration `yaml:"lockout_duration"`
+}
+
+// PasswordHash holds the argon2id parameters for new hashes. Memory is in
+// KiB. Existing hashes made with other values are upgraded on login.
+type PasswordHash struct {
+	Memory      uint32 `yaml:"memory"`
+	Iterations  uint32 `yaml:"iterations"`
+	Parallelism uint8  `yaml:"parallelism"`
+	SaltLength  uint32 `yaml:"salt_length"`
+	KeyLength   uint32 `yaml:"key_length"`
+}
+
+// PasswordPolicy decides which new passwords are accepted. MinStrength is
+// the lowest passwords.Strength score allowed, from 0 to 4. BreachedFile
+// is an optional file of SHA-1 hashes of breached passwords sorted by hash
+// (see passwords.Breached).
+type PasswordPolicy struct {
+	MinLength    int    `yaml:"min_length"`
+	MaxLength    int    `yaml:"max_length"`
+	MinStrength  int    `yaml:"min_strength"`
+	BreachedFile string `yaml:"breached_file"`
+}
+
+type SMTP struct {
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// Mail selects how messages to users are delivered. Driver is "smtp" or
+// "outbox"; the outbox appends messages to the Outbox file, or prints them
+// to stdout when no file is set.
+type Mail struct {
+	Driver string `yaml:"driver"`
+	From   string `yaml:"from"`
+	Outbox string `yaml:"outbox"`
+	SMTP   SMTP   `yaml:"smtp"`
+}
+
+// PasswordReset configures reset links. The token is appended to LinkURL.
+type PasswordReset struct {
+	TokenTTL time.Duration `yaml:"token_ttl"`
+	LinkURL  string        `yaml:"link_url"`
+}
+
+// EmailVerification configures the signed links that confirm an email
+// address. The token is appended to LinkURL.
+type EmailVerification struct {
+	Secret   string        `yaml:"secret"`
+	TokenTTL time.Duration `yaml:"token_ttl"`
+	LinkURL  string        `yaml:"link_url"`
+}
+
+// MFA configures TOTP two-factor authentication. EncryptionKey is a base64
+// 32 byte key for the TOTP secrets; 2FA is disabled when it is empty.
+type MFA struct {
+	EncryptionKey string        `yaml:"encryption_key"`
+	Issuer        string        `yaml:"issuer"`
+	PendingTTL    time.Duration `yaml:"pending_ttl"`
+	RecoveryCodes int           `yaml:"recovery_codes"`
+}
+
+// Username configures account renames and the policy all new names follow.
+// A previous name stays reserved for its old owner during ReserveFor so
+// shared links keep redirecting.
+type Username struct {
+	ReserveFor time.Duration    `yaml:"reserve_for"`
+	Policy     usernames.Config `yaml:",inline"`
+}
+
+// OAuthProvider is an external OAuth2/OIDC identity provider. With Issuer
+// set the endpoints are discovered from its openid-configuration, otherwise
+// (e.g. GitHub) they are configured directly. The *Claim fields name the
+// user info fields holding the account id and the preferred username.
+type OAuthProvider struct {
+	ClientID      string   `yaml:"client_id"`
+	ClientSecret  string   `yaml:"client_secret"`
+	Issuer        string   `yaml:"issuer"`
+	AuthURL       string   `yaml:"auth_url"`
+	TokenURL      string   `yaml:"token_url"`
+	UserInfoURL   string   `yaml:"userinfo_url"`
+	Scopes        []string `yaml:"scopes"`
+	SubjectClaim  string   `yaml:"subject_claim"`
+	UsernameClaim string   `yaml:"username_claim"`
+}
+
+// OAuth configures sign-in with external providers. CallbackURL is the
+// public address of /oauth/{provider}/callback, with the literal
+// "{provider}" replaced by the provider name. CookieKey is a base64 32 byte
+// key sealing the cookie that ties a callback to the browser which started
+// the login. Sign-in with providers is disabled when it is empty.
+type OAuth struct {
+	CallbackURL string                   `yaml:"callback_url"`
+	CookieKey   string                   `yaml:"cookie_key"`
+	StateTTL    time.Duration            `yaml:"state_ttl"`
+	Providers   map[string]OAuthProvider `yaml:"providers"`
+}
+
+// TokenJanitor purges refresh tokens that can no longer be used. Every
+// Interval it deletes expired tokens, and revoked ones once they are older
+// than RevokedRetention, BatchSize rows per statement.
+type TokenJanitor struct {
+	Interval         time.Duration `yaml:"interval"`
+	BatchSize        int           `yaml:"batch_size"`
+	RevokedRetention time.Duration `yaml:"revoked_retention"`
+}
+
+// PersonalTokens limits personal access tokens. MaxTTL caps their
+// lifetime, and tokens created without an expiry get MaxTTL; when it is
+// zero tokens may never expire.
+type PersonalTokens struct {
+	MaxPerUser int           `yaml:"max_per_user"`
+	MaxTTL     time.Duration `yaml:"max_ttl"`
+}
+
+// Registration configures self-service sign up at POST /register. Every
+// sign up must solve a proof-of-work challenge signed with Secret, taking
+// about 2^Difficulty hashes; Difficulty must be 1 to 255. With InviteOnly
+// an invite code is required as well; invites are valid for InviteTTL. Sign
+// up is disabled when Secret is empty.
+type Registration struct {
+	Secret       string        `yaml:"secret"`
+	Difficulty   int           `yaml:"difficulty"`
+	ChallengeTTL time.Duration `yaml:"challenge_ttl"`
+	InviteOnly   bool          `yaml:"invite_only"`
+	InviteTTL    time.Duration `yaml:"invite_ttl"`
+}
+
+// WebAuthn configures passkey login. RPID is the domain passkeys are bound
+// to and Origins the web origins allowed to use them, such as
+// "https://bioly.localhost". SessionKey is a base64 32 byte key sealing the
+// ceremony state a client carries from begin to finish; a ceremony must
+// finish within Timeout. Passkeys are disabled when SessionKey is empty.
+type WebAuthn struct {
+	RPID       string        `yaml:"rp_id"`
+	RPName     string        `yaml:"rp_name"`
+	Origins    []string      `yaml:"origins"`
+	SessionKey string        `yaml:"session_key"`
+	Timeout    time.Duration `yaml:"timeout"`
+}
+
+// MagicLink configures login links sent by email. A link is signed with
+// Secret, only works in the browser that asked for it and expires after
+// TokenTTL. The token is appended to LinkURL. Magic links are disabled when
+// Secret is empty.
+type MagicLink struct {
+	Secret   string        `yaml:"secret"`
+	TokenTTL time.Duration `yaml:"token_ttl"`
+	LinkURL  string        `yaml:"link_url"`
+}
+
+// RefreshCookie delivers refresh tokens to browsers in a Secure, HttpOnly
+// cookie named Name, sent only to Path, instead of the response body.
+// Browsers are told apart by their Fetch Metadata headers, and a client can
+// pick with "X-Refresh-Delivery: cookie" or "body".
+// Refreshing with the cookie needs the value of the CSRFCookie cookie in the
+// CSRFHeader header. SameSite is "strict", "lax" or "none"; anything else
+// means strict. Clients sending the refresh token in the body are served as
+// before.
+type RefreshCookie struct {
+	Enabled    bool   `yaml:"enabled"`
+	Name       string `yaml:"name"`
+	Path       string `yaml:"path"`
+	Domain     string `yaml:"domain"`
+	SameSite   string `yaml:"same_site"`
+	CSRFCookie string `yaml:"csrf_cookie"`
+	CSRFHeader string `yaml:"csrf_header"`
 }
 
 type Config struct {
-	DBInfo storage.DbInfo `yaml:"auth_db"`
-	HTTP   HTTP           `yaml:"http"`
-	JWT    JWT            `yaml:"jwt"`
+	// DevMode allows the example secrets checked into configs/, see
+	// CheckSecrets. The DEV_MODE=1 environment variable also sets it. Never
+	// set it in production.
+	DevMode           bool              `yaml:"dev_mode"`
+	DBInfo            storage.DbInfo    `yaml:"auth_db"`
+	HTTP              HTTP              `yaml:"http"`
+	JWT               JWT               `yaml:"jwt"`
+	LoginThrottle     LoginThrottle     `yaml:"login_throttle"`
+	PasswordHash      PasswordHash      `yaml:"password_hash"`
+	PasswordPolicy    PasswordPolicy    `yaml:"password_policy"`
+	Mail              Mail              `yaml:"mail"`
+	PasswordReset     PasswordReset     `yaml:"password_reset"`
+	EmailVerification EmailVerification `yaml:"email_verification"`
+	MFA               MFA               `yaml:"mfa"`
+	Username          Username          `yaml:"username"`
+	OAuth             OAuth             `yaml:"oauth"`
+	TokenJanitor      TokenJanitor      `yaml:"token_janitor"`
+	PersonalTokens    PersonalTokens    `yaml:"personal_tokens"`
+	Registration      Registration      `yaml:"registration"`
+	WebAuthn          WebAuthn          `yaml:"webauthn"`
+	MagicLink         MagicLink         `yaml:"magic_link"`
+	RefreshCookie     RefreshCookie     `yaml:"refresh_cookie"`
 }
 
 func (c *Config) SetDefaults() {
@@ -38,6 +261,159 @@ func (c *Config) SetDefaults() {
 	if c.JWT.Issuer == "" {
 		c.JWT.Issuer = "auth.bioly.local"
 	}
+	if c.LoginThrottle.Store == "" {
+		c.LoginThrottle.Store = "memory"
+	}
+	if c.LoginThrottle.Window == 0 {
+		c.LoginThrottle.Window = 15 * time.Minute
+	}
+	if c.LoginThrottle.FreeAttempts == 0 {
+		c.LoginThrottle.FreeAttempts = 5
+	}
+	if c.LoginThrottle.IPFreeAttempts == 0 {
+		c.LoginThrottle.IPFreeAttempts = 20
+	}
+	if c.LoginThrottle.BaseDelay == 0 {
+		c.LoginThrottle.BaseDelay = time.Second
+	}
+	if c.LoginThrottle.MaxDelay == 0 {
+		c.LoginThrottle.MaxDelay = 5 * time.Minute
+	}
+	if c.LoginThrottle.LockoutDuration == 0 {
+		c.LoginThrottle.LockoutDuration = 15 * time.Minute
+	}
+	if c.PasswordHash.Memory == 0 {
+		c.PasswordHash.Memory = 64 * 1024
+	}
+	if c.PasswordHash.Iterations == 0 {
+		c.PasswordHash.Iterations = 1
+	}
+	if c.PasswordHash.Parallelism == 0 {
+		c.PasswordHash.Parallelism = 2
+	}
+	if c.PasswordHash.SaltLength == 0 {
+		c.PasswordHash.SaltLength = 16
+	}
+	if c.PasswordHash.KeyLength == 0 {
+		c.PasswordHash.KeyLength = 32
+	}
+	if c.PasswordPolicy.MinLength == 0 {
+		c.PasswordPolicy.MinLength = 8
+	}
+	if c.PasswordPolicy.MaxLength == 0 {
+		c.PasswordPolicy.MaxLength = 256
+	}
+	if c.Mail.Driver == "" {
+		c.Mail.Driver = "outbox"
+	}
+	if c.Mail.From == "" {
+		c.Mail.From = "noreply@bioly.localhost"
+	}
+	if c.Mail.SMTP.Port == 0 {
+		c.Mail.SMTP.Port = 587
+	}
+	if c.PasswordReset.TokenTTL == 0 {
+		c.PasswordReset.TokenTTL = 30 * time.Minute
+	}
+	if c.PasswordReset.LinkURL == "" {
+		c.PasswordReset.LinkURL = "https://bioly.localhost/password/reset?token="
+	}
+	if c.EmailVerification.TokenTTL == 0 {
+		c.EmailVerification.TokenTTL = 48 * time.Hour
+	}
+	if c.EmailVerification.LinkURL == "" {
+		c.EmailVerification.LinkURL = "https://bioly.localhost/email/verify?token="
+	}
+	if c.MFA.Issuer == "" {
+		c.MFA.Issuer = "Bioly"
+	}
+	if c.MFA.PendingTTL == 0 {
+		c.MFA.PendingTTL = 5 * time.Minute
+	}
+	if c.MFA.RecoveryCodes == 0 {
+		c.MFA.RecoveryCodes = 10
+	}
+	if c.Username.ReserveFor == 0 {
+		c.Username.ReserveFor = 90 * 24 * time.Hour
+	}
+	if c.OAuth.StateTTL == 0 {
+		c.OAuth.StateTTL = 10 * time.Minute
+	}
+	if c.TokenJanitor.Interval == 0 {
+		c.TokenJanitor.Interval = time.Hour
+	}
+	if c.TokenJanitor.BatchSize == 0 {
+		c.TokenJanitor.BatchSize = 1000
+	}
+	if c.TokenJanitor.RevokedRetention == 0 {
+		c.TokenJanitor.RevokedRetention = 30 * 24 * time.Hour
+	}
+	if c.PersonalTokens.MaxPerUser == 0 {
+		c.PersonalTokens.MaxPerUser = 20
+	}
+	if c.Registration.Difficulty == 0 {
+		c.Registration.Difficulty = 20
+	}
+	if c.Registration.ChallengeTTL == 0 {
+		c.Registration.ChallengeTTL = 10 * time.Minute
+	}
+	if c.Registration.InviteTTL == 0 {
+		c.Registration.InviteTTL = 7 * 24 * time.Hour
+	}
+	if c.WebAuthn.RPName == "" {
+		c.WebAuthn.RPName = "Bioly"
+	}
+	if c.WebAuthn.Timeout == 0 {
+		c.WebAuthn.Timeout = 5 * time.Minute
+	}
+	if c.MagicLink.TokenTTL == 0 {
+		c.MagicLink.TokenTTL = 10 * time.Minute
+	}
+	if c.MagicLink.LinkURL == "" {
+		c.MagicLink.LinkURL = "https://bioly.localhost/auth/login/magic/"
+	}
+	if c.RefreshCookie.Name == "" {
+		c.RefreshCookie.Name = "bioly_refresh"
+	}
+	if c.RefreshCookie.Path == "" {
+		c.RefreshCookie.Path = "/auth/refresh"
+	}
+	if c.RefreshCookie.SameSite == "" {
+		c.RefreshCookie.SameSite = "strict"
+	}
+	if c.RefreshCookie.CSRFCookie == "" {
+		c.RefreshCookie.CSRFCookie = "bioly_csrf"
+	}
+	if c.RefreshCookie.CSRFHeader == "" {
+		c.RefreshCookie.CSRFHeader = "X-CSRF-Token"
+	}
+	for name, p := range c.OAuth.Providers {
+		if p.SubjectClaim == "" {
+			p.SubjectClaim = "sub"
+		}
+		if p.UsernameClaim == "" {
+			p.UsernameClaim = "preferred_username"
+		}
+		c.OAuth.Providers[name] = p
+	}
+}
+
+// Validate refuses settings SetDefaults leaves alone but the service
+// cannot run with.
+func (c *Config) Validate() error {
+	if c.TokenJanitor.Interval <= 0 {
+		return fmt.Errorf("token_janitor.interval must be positive, got %s", c.TokenJanitor.Interval)
+	}
+	if c.TokenJanitor.BatchSize <= 0 {
+		return fmt.Errorf("token_janitor.batch_size must be positive, got %d", c.TokenJanitor.BatchSize)
+	}
+	if c.TokenJanitor.RevokedRetention < 0 {
+		return fmt.Errorf("token_janitor.revoked_retention must not be negative, got %s", c.TokenJanitor.RevokedRetention)
+	}
+	if c.Registration.Secret != "" && (c.Registration.Difficulty < 1 || c.Registration.Difficulty > 255) {
+		return fmt.Errorf("registration.difficulty must be between 1 and 255, got %d", c.Registration.Difficulty)
+	}
+	return nil
 }
 
 func New(path string) *Config {
@@ -48,6 +424,9 @@ func New(path string) *Config {
 	}
 
 	cfg.SetDefaults()
+	if err := cfg.Validate(); err != nil {
+		log.Fatal(err)
+	}
 
 	return cfg
 }
@@ -0,0 +1,36 @@
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidate(t *testing.T) {
+	c := &Config{}
+	c.SetDefaults()
+	require.NoError(t, c.Validate())
+
+	c.Registration.Secret = "Jq2rW9pLx4Hd0sVe"
+	for _, d := range []int{-1, 256} {
+		c.Registration.Difficulty = d
+		err := c.Validate()
+		require.Error(t, err, d)
+		assert.Contains(t, err.Error(), "registration.difficulty")
+	}
+	c.Registration.Difficulty = 255
+	assert.NoError(t, c.Validate())
+
+	c.TokenJanitor.Interval = -time.Minute
+	err := c.Validate()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "token_janitor.interval")
+	c.TokenJanitor.Interval = time.Hour
+
+	c.TokenJanitor.BatchSize = -1
+	err = c.Validate()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "token_janitor.batch_size")
+}
@@ -0,0 +1,45 @@
+package config
+
+import "fmt"
+
+// placeholderSecrets are the example values checked into configs/auth.yaml.
+// Anyone can sign tokens or open sealed data with them.
+var placeholderSecrets = map[string]bool{
+	"super-secret-access-key":                      true,
+	"super-secret-refresh-key":                     true,
+	"super-secret-email-key":                       true,
+	"super-secret-registration-key":                true,
+	"super-secret-magic-link-key":                  true,
+	"ZGV2LW9ubHktbWZhLWtleS1jaGFuZ2UtbWUtcGxzISE=": true,
+	"ZGV2LW9ubHktb2F1dGgtY29va2llLWtleS1jaGFuZ2U=": true,
+	"ZGV2LW9ubHktd2ViYXV0aG4tc2Vzc2lvbi1rZXktMzI=": true,
+	"secret":   true,
+	"changeme": true,
+}
+
+// CheckSecrets refuses the example secrets unless DevMode is set. It names
+// the first setting that still holds one.
+func (c *Config) CheckSecrets() error {
+	if c.DevMode {
+		return nil
+	}
+	settings := []struct{ name, value string }{
+		{"jwt.access_secret", c.JWT.AccessSecret},
+		{"jwt.refresh_secret", c.JWT.RefreshSecret},
+		{"email_verification.secret", c.EmailVerification.Secret},
+		{"mfa.encryption_key", c.MFA.EncryptionKey},
+		{"oauth.cookie_key", c.OAuth.CookieKey},
+		{"registration.secret", c.Registration.Secret},
+		{"webauthn.session_key", c.WebAuthn.SessionKey},
+		{"magic_link.secret", c.MagicLink.Secret},
+	}
+	for _, s := range c.JWT.Secrets {
+		settings = append(settings, struct{ name, value string }{fmt.Sprintf("jwt.secrets[kid=%q]", s.KID), s.Secret})
+	}
+	for _, s := range settings {
+		if placeholderSecrets[s.value] {
+			return fmt.Errorf("%s is an example secret; set a random one or enable dev_mode", s.name)
+		}
+	}
+	return nil
+}
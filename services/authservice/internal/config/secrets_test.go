@@ -0,0 +1,29 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckSecrets(t *testing.T) {
+	c := &Config{}
+	c.JWT.Secrets = []HMACSecret{{KID: "2026-01", Secret: "m8yQf3kZ1vXcB7tN"}}
+	c.MagicLink.Secret = "Jq2rW9pLx4Hd0sVe"
+	require.NoError(t, c.CheckSecrets())
+
+	c.JWT.Secrets = append(c.JWT.Secrets, HMACSecret{KID: "dev", Secret: "super-secret-access-key"})
+	err := c.CheckSecrets()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `jwt.secrets[kid="dev"]`)
+
+	c.DevMode = true
+	assert.NoError(t, c.CheckSecrets())
+
+	c = &Config{}
+	c.WebAuthn.SessionKey = "ZGV2LW9ubHktd2ViYXV0aG4tc2Vzc2lvbi1rZXktMzI="
+	err = c.CheckSecrets()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "webauthn.session_key")
+}
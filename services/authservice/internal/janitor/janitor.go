@@ -0,0 +1,73 @@
+// Package janitor removes refresh tokens that can no longer be used, so
+// auth.refresh_tokens does not grow forever.
+package janitor
+
+import (
+	"context"
+	"time"
+
+	"bioly/asynclogger"
+	"bioly/auth/internal/config"
+)
+
+// Purger deletes up to limit unusable tokens and reports how many it
+// removed. repositories.RefreshTokens implements it.
+type Purger interface {
+	Purge(ctx context.Context, revokedBefore time.Time, limit int) (int64, error)
+}
+
+type Janitor struct {
+	repo  Purger
+	cfg   *config.TokenJanitor
+	nowFn func() time.Time
+}
+
+func New(repo Purger, cfg *config.TokenJanitor) *Janitor {
+	return &Janitor{repo: repo, cfg: cfg, nowFn: time.Now}
+}
+
+// Run sweeps right away and then every Interval until ctx is done.
+func (j *Janitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(j.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		start := time.Now()
+		n, err := j.Sweep(ctx)
+		switch {
+		case ctx.Err() != nil:
+			asynclogger.Info("token janitor stopped removed=%d", n)
+			return
+		case err != nil:
+			asynclogger.Error("token janitor failed removed=%d dur=%s err=%v", n, time.Since(start), err)
+		default:
+			asynclogger.Info("token janitor removed=%d dur=%s", n, time.Since(start))
+		}
+
+		select {
+		case <-ctx.Done():
+			asynclogger.Info("token janitor stopped")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sweep deletes batches of BatchSize rows until one comes back short, so a
+// single statement never locks more than a batch.
+func (j *Janitor) Sweep(ctx context.Context) (int64, error) {
+	revokedBefore := j.nowFn().Add(-j.cfg.RevokedRetention)
+	var total int64
+	for {
+		n, err := j.repo.Purge(ctx, revokedBefore, j.cfg.BatchSize)
+		total += n
+		if err != nil {
+			return total, err
+		}
+		if n < int64(j.cfg.BatchSize) {
+			return total, nil
+		}
+		if err := ctx.Err(); err != nil {
+			return total, err
+		}
+	}
+}
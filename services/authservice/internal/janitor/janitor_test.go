@@ -0,0 +1,88 @@
+package janitor
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"bioly/auth/internal/config"
+)
+
+// purgerFake hands out the queued batch sizes, then zero.
+type purgerFake struct {
+	mu      sync.Mutex
+	batches []int64
+	err     error
+	calls   int
+	before  time.Time
+	limit   int
+}
+
+func (p *purgerFake) Purge(ctx context.Context, revokedBefore time.Time, limit int) (int64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.calls++
+	p.before, p.limit = revokedBefore, limit
+	if p.err != nil {
+		return 0, p.err
+	}
+	if len(p.batches) == 0 {
+		return 0, nil
+	}
+	n := p.batches[0]
+	p.batches = p.batches[1:]
+	return n, nil
+}
+
+func (p *purgerFake) callCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.calls
+}
+
+func TestSweep_RepeatsFullBatches(t *testing.T) {
+	now := time.Date(2025, 1, 31, 0, 0, 0, 0, time.UTC)
+	repo := &purgerFake{batches: []int64{100, 100, 7, 100}}
+	j := New(repo, &config.TokenJanitor{BatchSize: 100, RevokedRetention: 30 * 24 * time.Hour})
+	j.nowFn = func() time.Time { return now }
+
+	n, err := j.Sweep(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, int64(207), n)
+	assert.Equal(t, 3, repo.calls)
+	assert.Equal(t, 100, repo.limit)
+	assert.Equal(t, time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), repo.before)
+}
+
+func TestSweep_Error(t *testing.T) {
+	repo := &purgerFake{err: errors.New("db down")}
+	j := New(repo, &config.TokenJanitor{BatchSize: 10})
+
+	_, err := j.Sweep(context.Background())
+	assert.Error(t, err)
+	assert.Equal(t, 1, repo.calls)
+}
+
+func TestRun_StopsOnCancel(t *testing.T) {
+	repo := &purgerFake{}
+	j := New(repo, &config.TokenJanitor{Interval: time.Millisecond, BatchSize: 10})
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan struct{})
+	go func() {
+		j.Run(ctx)
+		close(done)
+	}()
+	assert.Eventually(t, func() bool { return repo.callCount() >= 2 }, time.Second, time.Millisecond)
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return after cancel")
+	}
+}
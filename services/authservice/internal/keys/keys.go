@@ -0,0 +1,247 @@
+package keys
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"bioly/auth/internal/config"
+)
+
+var ErrUnknownKey = errors.New("unknown signing key")
+
+// Key is a single JWT key. Private is nil for keys that are only kept to
+// verify tokens signed before a rotation.
+type Key struct {
+	ID      string
+	Method  jwt.SigningMethod
+	Private any
+	Public  any
+}
+
+// KeySet holds the key used to sign new access tokens and every key that is
+// still accepted when verifying them.
+type KeySet struct {
+	active *Key
+	keys   map[string]*Key
+}
+
+// NewHMAC returns a key set with a single shared HS256 secret.
+func NewHMAC(kid, secret string) *KeySet {
+	k := &Key{ID: kid, Method: jwt.SigningMethodHS256, Private: []byte(secret), Public: []byte(secret)}
+	return &KeySet{active: k, keys: map[string]*Key{kid: k}}
+}
+
+// NewHMACSet returns a key set of shared HS256 secrets named by their kid;
+// activeKID selects the signing one. A secret with an empty kid verifies
+// tokens that carry no kid header.
+func NewHMACSet(secrets []config.HMACSecret, activeKID string) (*KeySet, error) {
+	ks := &KeySet{keys: make(map[string]*Key, len(secrets))}
+	for _, s := range secrets {
+		if s.Secret == "" {
+			return nil, fmt.Errorf("secret %q is empty", s.KID)
+		}
+		if _, ok := ks.keys[s.KID]; ok {
+			return nil, fmt.Errorf("secret %q is listed twice", s.KID)
+		}
+		secret := []byte(s.Secret)
+		ks.keys[s.KID] = &Key{ID: s.KID, Method: jwt.SigningMethodHS256, Private: secret, Public: secret}
+	}
+	active, ok := ks.keys[activeKID]
+	if !ok {
+		return nil, fmt.Errorf("active secret %q not found", activeKID)
+	}
+	ks.active = active
+	return ks, nil
+}
+
+// LoadDir reads every *.pem file in dir. The file name without extension is
+// the key ID. Private keys (PKCS#8, or PKCS#1 for RSA) can sign and verify,
+// public keys (PKIX) can only verify. activeKID selects the signing key.
+func LoadDir(dir, activeKID string) (*KeySet, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	ks := &KeySet{keys: make(map[string]*Key, len(files))}
+	for _, f := range files {
+		kid := strings.TrimSuffix(filepath.Base(f), ".pem")
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		k, err := parsePEM(kid, data)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %w", f, err)
+		}
+		ks.keys[kid] = k
+	}
+	if len(ks.keys) == 0 {
+		return nil, fmt.Errorf("no keys found in %s", dir)
+	}
+	active, ok := ks.keys[activeKID]
+	if !ok {
+		return nil, fmt.Errorf("active key %q not found in %s", activeKID, dir)
+	}
+	if active.Private == nil {
+		return nil, fmt.Errorf("active key %q has no private part", activeKID)
+	}
+	ks.active = active
+	return ks, nil
+}
+
+func parsePEM(kid string, data []byte) (*Key, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block")
+	}
+	switch block.Type {
+	case "PRIVATE KEY":
+		priv, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := priv.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported private key %T", priv)
+		}
+		return newKey(kid, priv, signer.Public())
+	case "RSA PRIVATE KEY":
+		priv, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return newKey(kid, priv, priv.Public())
+	case "PUBLIC KEY":
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return newKey(kid, nil, pub)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+}
+
+func newKey(kid string, priv, pub any) (*Key, error) {
+	switch pub.(type) {
+	case *rsa.PublicKey:
+		return &Key{ID: kid, Method: jwt.SigningMethodRS256, Private: priv, Public: pub}, nil
+	case ed25519.PublicKey:
+		return &Key{ID: kid, Method: jwt.SigningMethodEdDSA, Private: priv, Public: pub}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", pub)
+	}
+}
+
+// Sign signs claims with the active key and sets the "kid" header.
+func (ks *KeySet) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(ks.active.Method, claims)
+	if ks.active.ID != "" {
+		token.Header["kid"] = ks.active.ID
+	}
+	return token.SignedString(ks.active.Private)
+}
+
+// Keyfunc resolves the verification key for a parsed token. Tokens without a
+// "kid" header are checked against the key without an ID, or else the active
+// key.
+func (ks *KeySet) Keyfunc(t *jwt.Token) (any, error) {
+	k, ok := ks.keys[""]
+	if !ok {
+		k = ks.active
+	}
+	if kid, ok := t.Header["kid"].(string); ok {
+		if k, ok = ks.keys[kid]; !ok {
+			return nil, ErrUnknownKey
+		}
+	}
+	if t.Method.Alg() != k.Method.Alg() {
+		return nil, ErrUnknownKey
+	}
+	return k.Public, nil
+}
+
+// Methods lists the signing algorithms of all verification keys.
+func (ks *KeySet) Methods() []string {
+	seen := map[string]bool{}
+	var out []string
+	for _, k := range ks.keys {
+		alg := k.Method.Alg()
+		if !seen[alg] {
+			seen[alg] = true
+			out = append(out, alg)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public verification keys. Symmetric keys are never
+// published, so an HS256 key set yields an empty list.
+func (ks *KeySet) JWKS() JWKS {
+	out := JWKS{Keys: []JWK{}}
+	for _, k := range ks.keys {
+		enc := base64.RawURLEncoding
+		switch pub := k.Public.(type) {
+		case *rsa.PublicKey:
+			out.Keys = append(out.Keys, JWK{
+				Kty: "RSA", Kid: k.ID, Use: "sig", Alg: k.Method.Alg(),
+				N: enc.EncodeToString(pub.N.Bytes()),
+				E: enc.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+			})
+		case ed25519.PublicKey:
+			out.Keys = append(out.Keys, JWK{
+				Kty: "OKP", Kid: k.ID, Use: "sig", Alg: k.Method.Alg(),
+				Crv: "Ed25519",
+				X:   enc.EncodeToString(pub),
+			})
+		}
+	}
+	sort.Slice(out.Keys, func(i, j int) bool { return out.Keys[i].Kid < out.Keys[j].Kid })
+	return out
+}
+
+// FromConfig loads the configured key directory and falls back to the shared
+// HS256 secrets when no directory is set. The legacy access secret joins the
+// list without a kid, so tokens signed before the switch stay valid.
+func FromConfig(c *config.JWT) (*KeySet, error) {
+	if c.KeysDir != "" {
+		return LoadDir(c.KeysDir, c.ActiveKID)
+	}
+	secrets := c.Secrets[:len(c.Secrets):len(c.Secrets)]
+	if c.AccessSecret != "" {
+		secrets = append(secrets, config.HMACSecret{Secret: c.AccessSecret})
+	}
+	if len(secrets) == 0 {
+		return nil, errors.New("no JWT secret or keys_dir configured")
+	}
+	return NewHMACSet(secrets, c.ActiveKID)
+}
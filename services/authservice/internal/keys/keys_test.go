@@ -0,0 +1,199 @@
+package keys
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"bioly/auth/internal/config"
+)
+
+func writePEM(t *testing.T, dir, name, typ string, der []byte) {
+	t.Helper()
+	data := pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name), data, 0o600))
+}
+
+// keyDir creates an Ed25519 signing key "ed-new", an RSA signing key "rsa-old"
+// and a verify-only Ed25519 key "ed-retired".
+func keyDir(t *testing.T) (string, ed25519.PrivateKey) {
+	t.Helper()
+	dir := t.TempDir()
+
+	_, edPriv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(edPriv)
+	require.NoError(t, err)
+	writePEM(t, dir, "ed-new.pem", "PRIVATE KEY", der)
+
+	rsaPriv, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	writePEM(t, dir, "rsa-old.pem", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaPriv))
+
+	retiredPub, retiredPriv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	der, err = x509.MarshalPKIXPublicKey(retiredPub)
+	require.NoError(t, err)
+	writePEM(t, dir, "ed-retired.pem", "PUBLIC KEY", der)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "README"), []byte("ignored"), 0o600))
+	return dir, retiredPriv
+}
+
+func claims() jwt.MapClaims {
+	return jwt.MapClaims{"sub": "1", "exp": time.Now().Add(time.Minute).Unix()}
+}
+
+func TestLoadDir_SignAndVerify(t *testing.T) {
+	dir, _ := keyDir(t)
+	ks, err := LoadDir(dir, "ed-new")
+	require.NoError(t, err)
+
+	signed, err := ks.Sign(claims())
+	require.NoError(t, err)
+
+	tok, err := jwt.Parse(signed, ks.Keyfunc, jwt.WithValidMethods(ks.Methods()))
+	require.NoError(t, err)
+	assert.Equal(t, "ed-new", tok.Header["kid"])
+	assert.Equal(t, "EdDSA", tok.Method.Alg())
+	assert.ElementsMatch(t, []string{"EdDSA", "RS256"}, ks.Methods())
+}
+
+func TestLoadDir_RotationKeepsOldKeysVerifiable(t *testing.T) {
+	dir, _ := keyDir(t)
+	before, err := LoadDir(dir, "rsa-old")
+	require.NoError(t, err)
+	signed, err := before.Sign(claims())
+	require.NoError(t, err)
+
+	after, err := LoadDir(dir, "ed-new")
+	require.NoError(t, err)
+	_, err = jwt.Parse(signed, after.Keyfunc, jwt.WithValidMethods(after.Methods()))
+	assert.NoError(t, err)
+}
+
+func TestLoadDir_VerifyOnlyKey(t *testing.T) {
+	dir, retiredPriv := keyDir(t)
+	ks, err := LoadDir(dir, "ed-new")
+	require.NoError(t, err)
+
+	tok := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims())
+	tok.Header["kid"] = "ed-retired"
+	signed, err := tok.SignedString(retiredPriv)
+	require.NoError(t, err)
+	_, err = jwt.Parse(signed, ks.Keyfunc, jwt.WithValidMethods(ks.Methods()))
+	assert.NoError(t, err)
+
+	_, err = LoadDir(dir, "ed-retired")
+	assert.Error(t, err)
+}
+
+func TestLoadDir_Errors(t *testing.T) {
+	dir, _ := keyDir(t)
+	_, err := LoadDir(dir, "missing")
+	assert.Error(t, err)
+
+	_, err = LoadDir(t.TempDir(), "any")
+	assert.Error(t, err)
+}
+
+func TestKeyfunc_RejectsUnknownKidAndAlgMismatch(t *testing.T) {
+	dir, _ := keyDir(t)
+	ks, err := LoadDir(dir, "ed-new")
+	require.NoError(t, err)
+
+	tok := jwt.NewWithClaims(jwt.SigningMethodHS256, claims())
+	tok.Header["kid"] = "nope"
+	signed, err := tok.SignedString([]byte("secret"))
+	require.NoError(t, err)
+	_, err = jwt.Parse(signed, ks.Keyfunc)
+	assert.ErrorIs(t, err, ErrUnknownKey)
+
+	tok.Header["kid"] = "rsa-old"
+	signed, err = tok.SignedString([]byte("secret"))
+	require.NoError(t, err)
+	_, err = jwt.Parse(signed, ks.Keyfunc)
+	assert.ErrorIs(t, err, ErrUnknownKey)
+}
+
+func TestNewHMACSet_Rotation(t *testing.T) {
+	secrets := []config.HMACSecret{{KID: "2025-06", Secret: "old-secret"}, {KID: "2026-01", Secret: "new-secret"}}
+	before, err := NewHMACSet(secrets[:1], "2025-06")
+	require.NoError(t, err)
+	old, err := before.Sign(claims())
+	require.NoError(t, err)
+
+	ks, err := NewHMACSet(secrets, "2026-01")
+	require.NoError(t, err)
+	signed, err := ks.Sign(claims())
+	require.NoError(t, err)
+	tok, err := jwt.Parse(signed, ks.Keyfunc, jwt.WithValidMethods(ks.Methods()))
+	require.NoError(t, err)
+	assert.Equal(t, "2026-01", tok.Header["kid"])
+	_, err = jwt.Parse(old, ks.Keyfunc, jwt.WithValidMethods(ks.Methods()))
+	assert.NoError(t, err, "tokens of a listed older secret stay valid")
+	assert.Empty(t, ks.JWKS().Keys)
+
+	_, err = jwt.Parse(signed, before.Keyfunc)
+	assert.ErrorIs(t, err, ErrUnknownKey)
+
+	_, err = NewHMACSet(secrets, "missing")
+	assert.Error(t, err)
+	_, err = NewHMACSet(append(secrets, config.HMACSecret{KID: "2026-01", Secret: "again"}), "2026-01")
+	assert.Error(t, err)
+	_, err = NewHMACSet([]config.HMACSecret{{KID: "a"}}, "a")
+	assert.Error(t, err)
+}
+
+func TestFromConfig_LegacySecret(t *testing.T) {
+	legacy, err := FromConfig(&config.JWT{AccessSecret: "legacy"})
+	require.NoError(t, err)
+	old, err := legacy.Sign(claims())
+	require.NoError(t, err)
+
+	ks, err := FromConfig(&config.JWT{
+		AccessSecret: "legacy",
+		Secrets:      []config.HMACSecret{{KID: "k1", Secret: "fresh"}},
+		ActiveKID:    "k1",
+	})
+	require.NoError(t, err)
+	_, err = jwt.Parse(old, ks.Keyfunc)
+	assert.NoError(t, err, "tokens without kid check against the legacy secret")
+
+	signed, err := ks.Sign(claims())
+	require.NoError(t, err)
+	tok, err := jwt.Parse(signed, ks.Keyfunc)
+	require.NoError(t, err)
+	assert.Equal(t, "k1", tok.Header["kid"])
+
+	_, err = FromConfig(&config.JWT{})
+	assert.Error(t, err)
+}
+
+func TestJWKS(t *testing.T) {
+	dir, _ := keyDir(t)
+	ks, err := LoadDir(dir, "ed-new")
+	require.NoError(t, err)
+
+	set := ks.JWKS()
+	require.Len(t, set.Keys, 3)
+	assert.Equal(t, "ed-new", set.Keys[0].Kid)
+	assert.Equal(t, "OKP", set.Keys[0].Kty)
+	assert.Equal(t, "Ed25519", set.Keys[0].Crv)
+	assert.NotEmpty(t, set.Keys[0].X)
+	assert.Equal(t, "rsa-old", set.Keys[2].Kid)
+	assert.Equal(t, "RSA", set.Keys[2].Kty)
+	assert.Equal(t, "AQAB", set.Keys[2].E)
+
+	assert.Empty(t, NewHMAC("", "secret").JWKS().Keys)
+}
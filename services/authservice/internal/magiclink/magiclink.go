@@ -0,0 +1,129 @@
+// Package magiclink signs the login links mailed to users. A link names the
+// user and the address it was sent to, expires quickly and only works in the
+// browser that asked for it: the token carries a hash of that browser's
+// User-Agent. Tokens contain no dots, so they can be used as a URL path
+// segment.
+package magiclink
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrInvalid = errors.New("invalid login link")
+	ErrExpired = errors.New("login link expired")
+)
+
+// Link is an issued login link. ID identifies it so it can be used only
+// once; the Signer does not remember it.
+type Link struct {
+	ID        uuid.UUID
+	UserID    int64
+	ExpiresAt time.Time
+	Token     string
+	address   [hashLen]byte
+}
+
+// SentTo reports whether the link was mailed to email. Checking it against
+// the user's current address invalidates links sent before a change.
+func (l *Link) SentTo(email string) bool {
+	addr := addressHash(email)
+	return hmac.Equal(l.address[:], addr[:])
+}
+
+type Signer struct {
+	key   []byte
+	ttl   time.Duration
+	nowFn func() time.Time
+}
+
+// New returns a signer using key. Links are valid for ttl.
+func New(key []byte, ttl time.Duration) *Signer {
+	return &Signer{key: key, ttl: ttl, nowFn: time.Now}
+}
+
+// token layout: id (16) | user id (8) | expiry unix seconds (8) |
+// user agent hash (16) | address hash (16) | mac (32).
+const (
+	hashLen    = 16
+	payloadLen = 16 + 8 + 8 + 2*hashLen
+	tokenLen   = payloadLen + sha256.Size
+)
+
+// Issue signs a link mailed to email, logging in userID from the browser
+// sending userAgent.
+func (s *Signer) Issue(userID int64, email, userAgent string) (*Link, error) {
+	id, err := uuid.NewRandomFromReader(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	l := &Link{
+		ID:        id,
+		UserID:    userID,
+		ExpiresAt: s.nowFn().Add(s.ttl).Truncate(time.Second),
+		address:   addressHash(email),
+	}
+	buf := make([]byte, payloadLen, tokenLen)
+	copy(buf, id[:])
+	binary.BigEndian.PutUint64(buf[16:], uint64(userID))
+	binary.BigEndian.PutUint64(buf[24:], uint64(l.ExpiresAt.Unix()))
+	agent := agentHash(userAgent)
+	copy(buf[32:], agent[:])
+	copy(buf[32+hashLen:], l.address[:])
+	l.Token = base64.RawURLEncoding.EncodeToString(append(buf, s.mac(buf)...))
+	return l, nil
+}
+
+// Verify checks that token was issued by s for userAgent and has not
+// expired. A token opened in another browser is ErrInvalid.
+func (s *Signer) Verify(token, userAgent string) (*Link, error) {
+	raw, err := base64.RawURLEncoding.Strict().DecodeString(token)
+	if err != nil || len(raw) != tokenLen {
+		return nil, ErrInvalid
+	}
+	payload := raw[:payloadLen]
+	if !hmac.Equal(raw[payloadLen:], s.mac(payload)) {
+		return nil, ErrInvalid
+	}
+	agent := agentHash(userAgent)
+	if !hmac.Equal(payload[32:32+hashLen], agent[:]) {
+		return nil, ErrInvalid
+	}
+	l := &Link{
+		UserID:    int64(binary.BigEndian.Uint64(payload[16:])),
+		ExpiresAt: time.Unix(int64(binary.BigEndian.Uint64(payload[24:])), 0),
+		Token:     token,
+	}
+	copy(l.ID[:], payload[:16])
+	copy(l.address[:], payload[32+hashLen:])
+	if !s.nowFn().Before(l.ExpiresAt) {
+		return nil, ErrExpired
+	}
+	return l, nil
+}
+
+func (s *Signer) mac(payload []byte) []byte {
+	m := hmac.New(sha256.New, s.key)
+	m.Write(payload)
+	return m.Sum(nil)
+}
+
+func agentHash(userAgent string) [hashLen]byte {
+	sum := sha256.Sum256([]byte(userAgent))
+	return [hashLen]byte(sum[:hashLen])
+}
+
+// addressHash ignores case, as addresses are looked up case-insensitively.
+func addressHash(email string) [hashLen]byte {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(email))))
+	return [hashLen]byte(sum[:hashLen])
+}
@@ -0,0 +1,53 @@
+package magiclink
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIssueVerify(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	s := New([]byte("key"), 10*time.Minute)
+	s.nowFn = func() time.Time { return now }
+
+	l, err := s.Issue(42, "mina@example.com", "Firefox")
+	require.NoError(t, err)
+	assert.NotContains(t, l.Token, ".")
+	assert.NotContains(t, l.Token, "/")
+	assert.True(t, l.ExpiresAt.Equal(now.Add(10*time.Minute)))
+
+	got, err := s.Verify(l.Token, "Firefox")
+	require.NoError(t, err)
+	assert.Equal(t, l.ID, got.ID)
+	assert.Equal(t, int64(42), got.UserID)
+	assert.True(t, got.ExpiresAt.Equal(l.ExpiresAt))
+	assert.True(t, got.SentTo("Mina@Example.com"))
+	assert.False(t, got.SentTo("mina@example.org"), "the address changed")
+
+	other, err := s.Issue(42, "mina@example.com", "Firefox")
+	require.NoError(t, err)
+	assert.NotEqual(t, l.ID, other.ID, "every link is unique")
+
+	_, err = s.Verify(l.Token, "Chrome")
+	assert.ErrorIs(t, err, ErrInvalid, "opened in another browser")
+	_, err = New([]byte("other"), time.Minute).Verify(l.Token, "Firefox")
+	assert.ErrorIs(t, err, ErrInvalid, "signed with another key")
+	_, err = s.Verify(l.Token[:len(l.Token)-2], "Firefox")
+	assert.ErrorIs(t, err, ErrInvalid)
+	_, err = s.Verify(strings.Repeat("A", len(l.Token)), "Firefox")
+	assert.ErrorIs(t, err, ErrInvalid)
+	// Each link has a single spelling; the unused bits of the last
+	// character must stay zero.
+	alt := []byte(l.Token)
+	alt[len(alt)-1] ^= 1
+	_, err = s.Verify(string(alt), "Firefox")
+	assert.ErrorIs(t, err, ErrInvalid)
+
+	now = now.Add(10 * time.Minute)
+	_, err = s.Verify(l.Token, "Firefox")
+	assert.ErrorIs(t, err, ErrExpired)
+}
@@ -0,0 +1,113 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"bioly/auth/internal/config"
+)
+
+var ErrBadHeader = errors.New("mail header contains a line break")
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers plain text messages to users.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// FromConfig returns the mailer selected by c.Driver: "smtp", or "outbox"
+// which writes every message to c.Outbox (stdout when empty).
+func FromConfig(c *config.Mail) (Mailer, error) {
+	switch c.Driver {
+	case "smtp":
+		return NewSMTP(&c.SMTP, c.From), nil
+	case "", "outbox":
+		if c.Outbox == "" {
+			return NewOutbox(os.Stdout, c.From), nil
+		}
+		f, err := os.OpenFile(c.Outbox, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			return nil, err
+		}
+		return NewOutbox(f, c.From), nil
+	default:
+		return nil, fmt.Errorf("unknown mail driver %q", c.Driver)
+	}
+}
+
+type SMTP struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+func NewSMTP(c *config.SMTP, from string) *SMTP {
+	s := &SMTP{addr: net.JoinHostPort(c.Host, strconv.Itoa(c.Port)), from: from}
+	if c.Username != "" {
+		s.auth = smtp.PlainAuth("", c.Username, c.Password, c.Host)
+	}
+	return s
+}
+
+func (s *SMTP) Send(ctx context.Context, msg Message) error {
+	data, err := format(s.from, msg, time.Now())
+	if err != nil {
+		return err
+	}
+	return smtp.SendMail(s.addr, s.auth, s.from, []string{msg.To}, data)
+}
+
+// Outbox writes messages to w instead of delivering them. It is meant for
+// development and tests.
+type Outbox struct {
+	mu   sync.Mutex
+	w    io.Writer
+	from string
+}
+
+func NewOutbox(w io.Writer, from string) *Outbox {
+	return &Outbox{w: w, from: from}
+}
+
+func (o *Outbox) Send(ctx context.Context, msg Message) error {
+	data, err := format(o.from, msg, time.Now())
+	if err != nil {
+		return err
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	_, err = o.w.Write(append(data, "\r\n.\r\n"...))
+	return err
+}
+
+func format(from string, msg Message, now time.Time) ([]byte, error) {
+	for _, h := range []string{from, msg.To, msg.Subject} {
+		if strings.ContainsAny(h, "\r\n") {
+			return nil, ErrBadHeader
+		}
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return b.Bytes(), nil
+}
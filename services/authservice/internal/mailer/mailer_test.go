@@ -0,0 +1,32 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutbox_Send(t *testing.T) {
+	var buf bytes.Buffer
+	o := NewOutbox(&buf, "noreply@bioly.local")
+
+	err := o.Send(context.Background(), Message{To: "bob", Subject: "Hello", Body: "line one\nline two"})
+	assert.NoError(t, err)
+
+	out := buf.String()
+	assert.Contains(t, out, "From: noreply@bioly.local\r\n")
+	assert.Contains(t, out, "To: bob\r\n")
+	assert.Contains(t, out, "Subject: Hello\r\n")
+	assert.Contains(t, out, "\r\n\r\nline one\r\nline two\r\n.\r\n")
+}
+
+func TestOutbox_RejectsHeaderInjection(t *testing.T) {
+	var buf bytes.Buffer
+	o := NewOutbox(&buf, "noreply@bioly.local")
+
+	err := o.Send(context.Background(), Message{To: "bob\r\nBcc: eve", Subject: "Hello"})
+	assert.ErrorIs(t, err, ErrBadHeader)
+	assert.Zero(t, buf.Len())
+}
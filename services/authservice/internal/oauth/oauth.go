@@ -0,0 +1,271 @@
+// Package oauth implements the OAuth2 authorization code flow with PKCE
+// (RFC 7636) against external identity providers. The account is read from
+// the provider's user info endpoint, which works for OIDC providers as well
+// as plain OAuth2 ones like GitHub.
+package oauth
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"bioly/auth/internal/config"
+)
+
+// discoveryRetry is how long a failed discovery is answered from cache
+// before the provider is asked again.
+const discoveryRetry = 30 * time.Second
+
+// ErrProvider is returned when the provider rejects a request or answers
+// with something unusable.
+var ErrProvider = errors.New("identity provider error")
+
+// Identity is the external account that signed in.
+type Identity struct {
+	Subject  string
+	Username string
+}
+
+type endpoints struct {
+	AuthURL     string `json:"authorization_endpoint"`
+	TokenURL    string `json:"token_endpoint"`
+	UserInfoURL string `json:"userinfo_endpoint"`
+}
+
+type Provider struct {
+	name        string
+	cfg         config.OAuthProvider
+	redirectURL string
+	client      *http.Client
+
+	mu          sync.Mutex
+	eps         *endpoints
+	attemptedAt time.Time
+	discoverErr error
+	inflight    chan struct{}
+}
+
+// NewProvider returns provider name. redirectURL is the callback address
+// registered with the provider. Endpoints of OIDC providers are discovered
+// on first use, so an unreachable provider does not stop the service.
+func NewProvider(name string, cfg config.OAuthProvider, redirectURL string, client *http.Client) *Provider {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	p := &Provider{name: name, cfg: cfg, redirectURL: redirectURL, client: client}
+	if cfg.Issuer == "" {
+		p.eps = &endpoints{AuthURL: cfg.AuthURL, TokenURL: cfg.TokenURL, UserInfoURL: cfg.UserInfoURL}
+	}
+	return p
+}
+
+// FromConfig returns every configured provider by name.
+func FromConfig(c *config.OAuth, client *http.Client) map[string]*Provider {
+	providers := make(map[string]*Provider, len(c.Providers))
+	for name, pc := range c.Providers {
+		redirect := strings.ReplaceAll(c.CallbackURL, "{provider}", url.PathEscape(name))
+		providers[name] = NewProvider(name, pc, redirect, client)
+	}
+	return providers
+}
+
+func (p *Provider) Name() string { return p.name }
+
+// NewVerifier returns a random PKCE code verifier.
+func NewVerifier() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// Challenge returns the S256 code challenge for verifier.
+func Challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthCodeURL returns the address the browser is sent to for signing in.
+func (p *Provider) AuthCodeURL(ctx context.Context, state, verifier string) (string, error) {
+	eps, err := p.endpoints(ctx)
+	if err != nil {
+		return "", err
+	}
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.cfg.ClientID},
+		"redirect_uri":          {p.redirectURL},
+		"state":                 {state},
+		"code_challenge":        {Challenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	if len(p.cfg.Scopes) > 0 {
+		q.Set("scope", strings.Join(p.cfg.Scopes, " "))
+	}
+	sep := "?"
+	if strings.Contains(eps.AuthURL, "?") {
+		sep = "&"
+	}
+	return eps.AuthURL + sep + q.Encode(), nil
+}
+
+// Exchange trades an authorization code for an access token.
+func (p *Provider) Exchange(ctx context.Context, code, verifier string) (string, error) {
+	eps, err := p.endpoints(ctx)
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.redirectURL},
+		"code_verifier": {verifier},
+		"client_id":     {p.cfg.ClientID},
+		"client_secret": {p.cfg.ClientSecret},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, eps.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	var resp struct {
+		AccessToken string `json:"access_token"`
+		Error       string `json:"error"`
+	}
+	if err := p.do(req, &resp); err != nil {
+		return "", err
+	}
+	if resp.AccessToken == "" {
+		return "", fmt.Errorf("%w: %s: token exchange failed: %s", ErrProvider, p.name, resp.Error)
+	}
+	return resp.AccessToken, nil
+}
+
+// Identity fetches the account behind accessToken.
+func (p *Provider) Identity(ctx context.Context, accessToken string) (*Identity, error) {
+	eps, err := p.endpoints(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, eps.UserInfoURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+
+	var info map[string]any
+	if err := p.do(req, &info); err != nil {
+		return nil, err
+	}
+	subject := claimString(info[p.cfg.SubjectClaim])
+	if subject == "" {
+		return nil, fmt.Errorf("%w: %s: user info has no %q", ErrProvider, p.name, p.cfg.SubjectClaim)
+	}
+	return &Identity{Subject: subject, Username: claimString(info[p.cfg.UsernameClaim])}, nil
+}
+
+// endpoints returns the provider's endpoints, discovering them on first
+// use. Discovery runs without holding p.mu and at most once per
+// discoveryRetry while it keeps failing; concurrent callers wait for the
+// discovery in flight instead of starting their own.
+func (p *Provider) endpoints(ctx context.Context) (*endpoints, error) {
+	p.mu.Lock()
+	if p.eps != nil {
+		defer p.mu.Unlock()
+		return p.eps, nil
+	}
+	if done := p.inflight; done != nil {
+		p.mu.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		p.mu.Lock()
+	} else if time.Since(p.attemptedAt) >= discoveryRetry {
+		done := make(chan struct{})
+		p.inflight = done
+		p.attemptedAt = time.Now()
+		p.mu.Unlock()
+		// Other callers share the result, so one caller going away must
+		// not fail it; the client's timeout bounds the request.
+		eps, err := p.discover(context.WithoutCancel(ctx))
+		p.mu.Lock()
+		if err == nil {
+			p.eps = eps
+		}
+		p.discoverErr = err
+		p.inflight = nil
+		close(done)
+	}
+	defer p.mu.Unlock()
+
+	if p.eps != nil {
+		return p.eps, nil
+	}
+	return nil, p.discoverErr
+}
+
+func (p *Provider) discover(ctx context.Context) (*endpoints, error) {
+	wellKnown := strings.TrimSuffix(p.cfg.Issuer, "/") + "/.well-known/openid-configuration"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, wellKnown, nil)
+	if err != nil {
+		return nil, err
+	}
+	var eps endpoints
+	if err := p.do(req, &eps); err != nil {
+		return nil, err
+	}
+	if eps.AuthURL == "" || eps.TokenURL == "" || eps.UserInfoURL == "" {
+		return nil, fmt.Errorf("%w: %s: incomplete openid-configuration", ErrProvider, p.name)
+	}
+	return &eps, nil
+}
+
+func (p *Provider) do(req *http.Request, out any) error {
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrProvider, p.name, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrProvider, p.name, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: %s: %s answered %d", ErrProvider, p.name, req.URL.Path, resp.StatusCode)
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(out); err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrProvider, p.name, err)
+	}
+	return nil
+}
+
+// claimString accepts string and numeric claims; GitHub user ids are
+// numbers.
+func claimString(v any) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	}
+	return ""
+}
@@ -0,0 +1,115 @@
+package oauth_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"bioly/auth/internal/config"
+	"bioly/auth/internal/oauth"
+	"bioly/auth/internal/oauth/oauthtest"
+)
+
+func TestChallenge_RFC7636(t *testing.T) {
+	// Appendix B of RFC 7636.
+	assert.Equal(t, "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM",
+		oauth.Challenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"))
+}
+
+func TestProvider_CodeFlow(t *testing.T) {
+	srv := oauthtest.NewServer(t)
+	p := oauth.NewProvider("test", srv.Config(), "https://bioly.test/auth/oauth/test/callback", nil)
+	ctx := context.Background()
+
+	verifier, err := oauth.NewVerifier()
+	assert.NoError(t, err)
+	authURL, err := p.AuthCodeURL(ctx, "st4te", verifier)
+	assert.NoError(t, err)
+
+	u, _ := url.Parse(authURL)
+	assert.Equal(t, "/authorize", u.Path)
+	assert.Equal(t, "openid profile", u.Query().Get("scope"))
+	assert.Equal(t, oauth.Challenge(verifier), u.Query().Get("code_challenge"))
+
+	cb := srv.Authorize(t, authURL)
+	assert.Equal(t, "/auth/oauth/test/callback", cb.Path)
+	assert.Equal(t, "st4te", cb.Query().Get("state"))
+
+	_, err = p.Exchange(ctx, cb.Query().Get("code"), "wrong-verifier")
+	assert.ErrorIs(t, err, oauth.ErrProvider)
+
+	cb = srv.Authorize(t, authURL)
+	token, err := p.Exchange(ctx, cb.Query().Get("code"), verifier)
+	assert.NoError(t, err)
+
+	id, err := p.Identity(ctx, token)
+	assert.NoError(t, err)
+	assert.Equal(t, &oauth.Identity{Subject: "42", Username: "octo"}, id)
+}
+
+func TestProvider_StaticEndpointsAndNumericSubject(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /login/oauth/access_token", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/json", r.Header.Get("Accept"))
+		_, _ = w.Write([]byte(`{"access_token":"gho_x","token_type":"bearer"}`))
+	})
+	mux.HandleFunc("GET /user", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer gho_x", r.Header.Get("Authorization"))
+		_, _ = w.Write([]byte(`{"id":9007199254740993,"login":"octocat"}`))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	providers := oauth.FromConfig(&config.OAuth{
+		CallbackURL: "https://bioly.test/auth/oauth/{provider}/callback",
+		Providers: map[string]config.OAuthProvider{
+			"github": {
+				ClientID:      "id",
+				AuthURL:       "https://github.test/login/oauth/authorize",
+				TokenURL:      srv.URL + "/login/oauth/access_token",
+				UserInfoURL:   srv.URL + "/user",
+				SubjectClaim:  "id",
+				UsernameClaim: "login",
+			},
+		},
+	}, nil)
+	p := providers["github"]
+	ctx := context.Background()
+
+	authURL, err := p.AuthCodeURL(ctx, "s", "v")
+	assert.NoError(t, err)
+	u, _ := url.Parse(authURL)
+	assert.Equal(t, "github.test", u.Host)
+	assert.Equal(t, "https://bioly.test/auth/oauth/github/callback", u.Query().Get("redirect_uri"))
+
+	token, err := p.Exchange(ctx, "code", "v")
+	assert.NoError(t, err)
+	id, err := p.Identity(ctx, token)
+	assert.NoError(t, err)
+	assert.Equal(t, "9007199254740993", id.Subject)
+	assert.Equal(t, "octocat", id.Username)
+}
+
+func TestProvider_DiscoveryFailure(t *testing.T) {
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+
+	p := oauth.NewProvider("down", config.OAuthProvider{Issuer: srv.URL}, "https://bioly.test/cb", nil)
+	_, err := p.AuthCodeURL(context.Background(), "s", "v")
+	assert.ErrorIs(t, err, oauth.ErrProvider)
+
+	// The failure is remembered for a while instead of asking again on
+	// every login.
+	_, err = p.AuthCodeURL(context.Background(), "s", "v")
+	assert.ErrorIs(t, err, oauth.ErrProvider)
+	assert.Equal(t, int32(1), hits.Load())
+}
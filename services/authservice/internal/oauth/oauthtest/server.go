@@ -0,0 +1,183 @@
+// Package oauthtest runs a minimal OIDC provider for tests. It implements
+// discovery, an authorization endpoint that signs in without asking (see
+// SetUser), the token endpoint with PKCE checks and the user info endpoint.
+package oauthtest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"bioly/auth/internal/config"
+	"bioly/auth/internal/oauth"
+)
+
+const (
+	ClientID     = "test-client"
+	ClientSecret = "test-secret"
+)
+
+type grant struct {
+	redirectURI string
+	challenge   string
+	user        map[string]any
+}
+
+type Server struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	user   map[string]any
+	codes  map[string]grant
+	tokens map[string]map[string]any
+}
+
+// NewServer starts a provider that signs users in as {"sub": "42",
+// "preferred_username": "octo"} until SetUser is called.
+func NewServer(t testing.TB) *Server {
+	s := &Server{
+		user:   map[string]any{"sub": "42", "preferred_username": "octo"},
+		codes:  map[string]grant{},
+		tokens: map[string]map[string]any{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", s.discovery)
+	mux.HandleFunc("GET /authorize", s.authorize)
+	mux.HandleFunc("POST /token", s.token)
+	mux.HandleFunc("GET /userinfo", s.userinfo)
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Config returns provider settings pointing at the server.
+func (s *Server) Config() config.OAuthProvider {
+	return config.OAuthProvider{
+		ClientID:      ClientID,
+		ClientSecret:  ClientSecret,
+		Issuer:        s.URL,
+		Scopes:        []string{"openid", "profile"},
+		SubjectClaim:  "sub",
+		UsernameClaim: "preferred_username",
+	}
+}
+
+// SetUser sets the user info returned for logins that start afterwards.
+func (s *Server) SetUser(info map[string]any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.user = info
+}
+
+// Authorize plays the browser: it opens authURL and returns the callback
+// URL the provider redirects to.
+func (s *Server) Authorize(t testing.TB, authURL string) *url.URL {
+	t.Helper()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(authURL)
+	if err != nil {
+		t.Fatalf("authorize: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorize: status %d", resp.StatusCode)
+	}
+	loc, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatalf("authorize: %v", err)
+	}
+	return loc
+}
+
+func (s *Server) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{
+		"issuer":                 s.URL,
+		"authorization_endpoint": s.URL + "/authorize",
+		"token_endpoint":         s.URL + "/token",
+		"userinfo_endpoint":      s.URL + "/userinfo",
+	})
+}
+
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("client_id") != ClientID || q.Get("response_type") != "code" ||
+		q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		http.Error(w, "bad authorization request", http.StatusBadRequest)
+		return
+	}
+	redirect, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil || !redirect.IsAbs() {
+		http.Error(w, "bad redirect_uri", http.StatusBadRequest)
+		return
+	}
+
+	code := randomString()
+	s.mu.Lock()
+	s.codes[code] = grant{redirectURI: redirect.String(), challenge: q.Get("code_challenge"), user: s.user}
+	s.mu.Unlock()
+
+	cb := redirect.Query()
+	cb.Set("code", code)
+	cb.Set("state", q.Get("state"))
+	redirect.RawQuery = cb.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (s *Server) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+		return
+	}
+	if r.PostForm.Get("client_id") != ClientID || r.PostForm.Get("client_secret") != ClientSecret {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	code := r.PostForm.Get("code")
+	g, ok := s.codes[code]
+	delete(s.codes, code)
+	if !ok || r.PostForm.Get("grant_type") != "authorization_code" ||
+		r.PostForm.Get("redirect_uri") != g.redirectURI ||
+		oauth.Challenge(r.PostForm.Get("code_verifier")) != g.challenge {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	token := randomString()
+	s.tokens[token] = g.user
+	writeJSON(w, http.StatusOK, map[string]any{"access_token": token, "token_type": "Bearer", "expires_in": 3600})
+}
+
+func (s *Server) userinfo(w http.ResponseWriter, r *http.Request) {
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	s.mu.Lock()
+	info, ok := s.tokens[token]
+	s.mu.Unlock()
+	if !ok {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_token"})
+		return
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func randomString() string {
+	buf := make([]byte, 16)
+	_, _ = rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
@@ -0,0 +1,240 @@
+// Package passkeytest is a software WebAuthn authenticator for tests. It
+// answers the options of a registration or login ceremony the way a
+// browser with a platform passkey would, using an ECDSA P-256 key and
+// "none" attestation.
+package passkeytest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// Authenticator flags, WebAuthn §6.1.
+const (
+	flagUserPresent    = 0x01
+	flagUserVerified   = 0x04
+	flagBackupEligible = 0x08
+	flagBackupState    = 0x10
+	flagAttestedData   = 0x40
+)
+
+var b64 = base64.RawURLEncoding
+
+// Authenticator holds one passkey at a time; Create replaces it.
+type Authenticator struct {
+	// Origin is reported in the client data, like the page the browser
+	// runs the ceremony on.
+	Origin string
+	// NoCounter makes the authenticator report a signature counter of 0
+	// on every use, as synced passkeys do.
+	NoCounter bool
+	// SignCount is the last counter reported. Setting it back simulates a
+	// cloned authenticator.
+	SignCount uint32
+	// SkipUserVerification clears the user verified flag, as if no PIN or
+	// biometric check happened.
+	SkipUserVerification bool
+	// Synced marks the passkey as backed up to a cloud account.
+	Synced bool
+
+	key        *ecdsa.PrivateKey
+	id         []byte
+	rpID       string
+	userHandle []byte
+}
+
+func New(origin string) *Authenticator {
+	return &Authenticator{Origin: origin}
+}
+
+// CredentialID returns the id of the current passkey.
+func (a *Authenticator) CredentialID() []byte {
+	return a.id
+}
+
+type creationOptions struct {
+	PublicKey struct {
+		Challenge string `json:"challenge"`
+		RP        struct {
+			ID string `json:"id"`
+		} `json:"rp"`
+		User struct {
+			ID string `json:"id"`
+		} `json:"user"`
+		Exclude []struct {
+			ID string `json:"id"`
+		} `json:"excludeCredentials"`
+	} `json:"publicKey"`
+}
+
+type requestOptions struct {
+	PublicKey struct {
+		Challenge string `json:"challenge"`
+		RPID      string `json:"rpId"`
+		Allow     []struct {
+			ID string `json:"id"`
+		} `json:"allowCredentials"`
+	} `json:"publicKey"`
+}
+
+// Create answers navigator.credentials.create(options) with a new passkey
+// and returns the PublicKeyCredential as JSON. options is anything that
+// marshals to the creation options, such as *protocol.CredentialCreation.
+func (a *Authenticator) Create(options any) ([]byte, error) {
+	var opts creationOptions
+	if err := remarshal(options, &opts); err != nil {
+		return nil, err
+	}
+	for _, ex := range opts.PublicKey.Exclude {
+		if a.id != nil && ex.ID == b64.EncodeToString(a.id) {
+			return nil, errors.New("passkeytest: credential already registered")
+		}
+	}
+	userHandle, err := b64.DecodeString(opts.PublicKey.User.ID)
+	if err != nil {
+		return nil, fmt.Errorf("passkeytest: user id: %w", err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	a.key, a.id, a.rpID, a.userHandle, a.SignCount = key, id, opts.PublicKey.RP.ID, userHandle, 0
+
+	coseKey, err := cbor.Marshal(map[int]any{
+		1:  2,  // kty: EC2
+		3:  -7, // alg: ES256
+		-1: 1,  // crv: P-256
+		-2: key.PublicKey.X.FillBytes(make([]byte, 32)),
+		-3: key.PublicKey.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	authData := a.authData(flagAttestedData)
+	authData = append(authData, make([]byte, 16)...) // AAGUID
+	authData = binary.BigEndian.AppendUint16(authData, uint16(len(id)))
+	authData = append(authData, id...)
+	authData = append(authData, coseKey...)
+
+	attestation, err := cbor.Marshal(map[string]any{
+		"fmt":      "none",
+		"attStmt":  map[string]any{},
+		"authData": authData,
+	})
+	if err != nil {
+		return nil, err
+	}
+	clientData, err := a.clientData("webauthn.create", opts.PublicKey.Challenge)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(map[string]any{
+		"id":                      b64.EncodeToString(id),
+		"rawId":                   b64.EncodeToString(id),
+		"type":                    "public-key",
+		"authenticatorAttachment": "platform",
+		"clientExtensionResults":  map[string]any{},
+		"response": map[string]any{
+			"clientDataJSON":    b64.EncodeToString(clientData),
+			"attestationObject": b64.EncodeToString(attestation),
+			"transports":        []string{"internal", "hybrid"},
+		},
+	})
+}
+
+// Get answers navigator.credentials.get(options) with the current passkey
+// and returns the PublicKeyCredential as JSON. Each call counts as a use.
+func (a *Authenticator) Get(options any) ([]byte, error) {
+	var opts requestOptions
+	if err := remarshal(options, &opts); err != nil {
+		return nil, err
+	}
+	if a.key == nil || opts.PublicKey.RPID != a.rpID {
+		return nil, errors.New("passkeytest: no passkey for this site")
+	}
+	if len(opts.PublicKey.Allow) > 0 {
+		allowed := false
+		for _, c := range opts.PublicKey.Allow {
+			allowed = allowed || c.ID == b64.EncodeToString(a.id)
+		}
+		if !allowed {
+			return nil, errors.New("passkeytest: passkey not allowed")
+		}
+	}
+	if !a.NoCounter {
+		a.SignCount++
+	}
+
+	authData := a.authData(0)
+	clientData, err := a.clientData("webauthn.get", opts.PublicKey.Challenge)
+	if err != nil {
+		return nil, err
+	}
+	clientHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientHash[:]...))
+	sig, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(map[string]any{
+		"id":                      b64.EncodeToString(a.id),
+		"rawId":                   b64.EncodeToString(a.id),
+		"type":                    "public-key",
+		"authenticatorAttachment": "platform",
+		"clientExtensionResults":  map[string]any{},
+		"response": map[string]any{
+			"clientDataJSON":    b64.EncodeToString(clientData),
+			"authenticatorData": b64.EncodeToString(authData),
+			"signature":         b64.EncodeToString(sig),
+			"userHandle":        b64.EncodeToString(a.userHandle),
+		},
+	})
+}
+
+// authData returns the authenticator data up to and including the
+// signature counter.
+func (a *Authenticator) authData(flags byte) []byte {
+	flags |= flagUserPresent
+	if !a.SkipUserVerification {
+		flags |= flagUserVerified
+	}
+	if a.Synced {
+		flags |= flagBackupEligible | flagBackupState
+	}
+	rpIDHash := sha256.Sum256([]byte(a.rpID))
+	out := append(rpIDHash[:], flags)
+	return binary.BigEndian.AppendUint32(out, a.SignCount)
+}
+
+func (a *Authenticator) clientData(typ, challenge string) ([]byte, error) {
+	return json.Marshal(map[string]any{
+		"type":        typ,
+		"challenge":   challenge,
+		"origin":      a.Origin,
+		"crossOrigin": false,
+	})
+}
+
+func remarshal(in, out any) error {
+	raw, err := json.Marshal(in)
+	if err != nil {
+		return fmt.Errorf("passkeytest: options: %w", err)
+	}
+	if err := json.Unmarshal(raw, out); err != nil {
+		return fmt.Errorf("passkeytest: options: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package passwords
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Breached looks passwords up in a file of SHA-1 hashes sorted by hash, one
+// per line as "HASH" or "HASH:COUNT" in hex, such as the Have I Been Pwned
+// download ordered by hash. The file is binary searched in place, so it may
+// be far larger than memory and no network is needed.
+type Breached struct {
+	f    *os.File
+	size int64
+}
+
+const sha1HexLen = 2 * sha1.Size
+
+// OpenBreached opens the hash file at path.
+func OpenBreached(path string) (*Breached, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("breached passwords: %w", err)
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("breached passwords: %w", err)
+	}
+	return &Breached{f: f, size: st.Size()}, nil
+}
+
+func (b *Breached) Close() error {
+	return b.f.Close()
+}
+
+// Contains reports whether password appears in the file. It is safe for
+// concurrent use.
+func (b *Breached) Contains(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	target := make([]byte, sha1HexLen)
+	hex.Encode(target, sum[:])
+	target = bytes.ToUpper(target)
+
+	// lo is always the start of a line. A line matching target, if any,
+	// starts in [lo, hi).
+	lo, hi := int64(0), b.size
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		hash, next, err := b.lineFrom(mid)
+		if err != nil {
+			return false, err
+		}
+		if hash == nil {
+			hi = mid
+			continue
+		}
+		switch cmp := bytes.Compare(hash, target); {
+		case cmp == 0:
+			return true, nil
+		case cmp < 0:
+			lo = next
+		default:
+			hi = mid
+		}
+	}
+	return false, nil
+}
+
+// lineFrom returns the upper-cased hash of the first line starting at or
+// after off, and the offset of the line after it. hash is nil past the last
+// line.
+func (b *Breached) lineFrom(off int64) (hash []byte, next int64, err error) {
+	buf := make([]byte, 256)
+	if off > 0 {
+		// Skip the rest of the line off falls into, unless it starts one.
+		n, err := b.f.ReadAt(buf[:1], off-1)
+		if n == 0 {
+			return nil, 0, readErr(err)
+		}
+		if buf[0] != '\n' {
+			for {
+				n, err := b.f.ReadAt(buf, off)
+				if i := bytes.IndexByte(buf[:n], '\n'); i >= 0 {
+					off += int64(i) + 1
+					break
+				}
+				if n < len(buf) {
+					if err != nil && err != io.EOF {
+						return nil, 0, readErr(err)
+					}
+					// off was inside the last line.
+					return nil, 0, nil
+				}
+				off += int64(n)
+			}
+		}
+	}
+	if off >= b.size {
+		return nil, 0, nil
+	}
+
+	n, err := b.f.ReadAt(buf, off)
+	if n == 0 {
+		return nil, 0, readErr(err)
+	}
+	line := buf[:n]
+	end := bytes.IndexByte(line, '\n')
+	if end < 0 {
+		if n == len(buf) {
+			return nil, 0, fmt.Errorf("breached passwords: line at %d is too long", off)
+		}
+		end = n
+	}
+	line = bytes.TrimRight(line[:end], "\r")
+	if i := bytes.IndexByte(line, ':'); i >= 0 {
+		line = line[:i]
+	}
+	if len(line) != sha1HexLen {
+		return nil, 0, fmt.Errorf("breached passwords: malformed line at %d", off)
+	}
+	return bytes.ToUpper(line), off + int64(end) + 1, nil
+}
+
+// readErr turns the error of a read that should not have hit the end of
+// the file into a failure.
+func readErr(err error) error {
+	if err == nil || err == io.EOF {
+		return fmt.Errorf("breached passwords: unexpected end of file")
+	}
+	return fmt.Errorf("breached passwords: %w", err)
+}
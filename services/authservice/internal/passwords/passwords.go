@@ -0,0 +1,49 @@
+package passwords
+
+import (
+	"github.com/alexedwards/argon2id"
+
+	"bioly/auth/internal/config"
+)
+
+// Hasher creates and checks argon2id hashes with one fixed set of
+// parameters. Hashes made with other parameters still verify, and
+// NeedsRehash reports them so they can be upgraded.
+type Hasher struct {
+	params *argon2id.Params
+}
+
+func New(params *argon2id.Params) *Hasher {
+	return &Hasher{params: params}
+}
+
+// FromConfig builds a hasher from the password_hash config section.
+func FromConfig(c *config.PasswordHash) *Hasher {
+	return New(&argon2id.Params{
+		Memory:      c.Memory,
+		Iterations:  c.Iterations,
+		Parallelism: c.Parallelism,
+		SaltLength:  c.SaltLength,
+		KeyLength:   c.KeyLength,
+	})
+}
+
+func (h *Hasher) Hash(password string) (string, error) {
+	return argon2id.CreateHash(password, h.params)
+}
+
+// Compare reports whether password matches hash. A malformed hash is an
+// error rather than a mismatch.
+func (h *Hasher) Compare(password, hash string) (bool, error) {
+	return argon2id.ComparePasswordAndHash(password, hash)
+}
+
+// NeedsRehash reports whether hash was made with parameters other than the
+// configured ones, weaker or not.
+func (h *Hasher) NeedsRehash(hash string) bool {
+	p, _, _, err := argon2id.DecodeHash(hash)
+	if err != nil {
+		return true
+	}
+	return *p != *h.params
+}
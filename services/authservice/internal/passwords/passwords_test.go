@@ -0,0 +1,45 @@
+package passwords
+
+import (
+	"testing"
+
+	"github.com/alexedwards/argon2id"
+	"github.com/stretchr/testify/assert"
+
+	"bioly/auth/internal/config"
+)
+
+func testConfig() *config.PasswordHash {
+	return &config.PasswordHash{Memory: 1024, Iterations: 2, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+}
+
+func TestHasher_HashAndCompare(t *testing.T) {
+	h := FromConfig(testConfig())
+
+	hash, err := h.Hash("secret")
+	assert.NoError(t, err)
+	assert.Contains(t, hash, "$m=1024,t=2,p=1$")
+
+	ok, err := h.Compare("secret", hash)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = h.Compare("wrong", hash)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.False(t, h.NeedsRehash(hash))
+}
+
+func TestHasher_NeedsRehash(t *testing.T) {
+	h := FromConfig(testConfig())
+
+	weaker, err := argon2id.CreateHash("secret", &argon2id.Params{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32})
+	assert.NoError(t, err)
+	assert.True(t, h.NeedsRehash(weaker))
+
+	stronger, err := argon2id.CreateHash("secret", &argon2id.Params{Memory: 2048, Iterations: 2, Parallelism: 1, SaltLength: 16, KeyLength: 32})
+	assert.NoError(t, err)
+	assert.True(t, h.NeedsRehash(stronger))
+
+	assert.True(t, h.NeedsRehash("not-a-hash"))
+}
@@ -0,0 +1,67 @@
+package passwords
+
+import (
+	"fmt"
+	"unicode/utf8"
+
+	"bioly/auth/internal/config"
+)
+
+// Codes sent to clients in ErrResponse.AppCode for refused passwords.
+const (
+	CodeTooShort         int64 = 1001
+	CodeTooLong          int64 = 1002
+	CodeTooWeak          int64 = 1003
+	CodeBreached         int64 = 1004
+	CodeContainsPersonal int64 = 1005
+)
+
+// PolicyError is returned for passwords the policy refuses.
+type PolicyError struct {
+	Code int64
+	msg  string
+}
+
+func (e *PolicyError) Error() string { return e.msg }
+
+// Policy decides which new passwords are accepted. Existing passwords are
+// never checked, so tightening it does not lock anybody out.
+type Policy struct {
+	cfg      *config.PasswordPolicy
+	breached *Breached
+}
+
+// NewPolicy builds a policy from cfg. breached may be nil to skip the
+// breached password lookup.
+func NewPolicy(cfg *config.PasswordPolicy, breached *Breached) *Policy {
+	return &Policy{cfg: cfg, breached: breached}
+}
+
+// Check returns a *PolicyError when password is refused. userInputs, such
+// as the username and email, may not make up the password. Errors reading
+// the breached password file are returned as they are.
+func (p *Policy) Check(password string, userInputs ...string) error {
+	n := utf8.RuneCountInString(password)
+	if n < p.cfg.MinLength {
+		return &PolicyError{Code: CodeTooShort, msg: fmt.Sprintf("password must be at least %d characters", p.cfg.MinLength)}
+	}
+	if p.cfg.MaxLength > 0 && n > p.cfg.MaxLength {
+		return &PolicyError{Code: CodeTooLong, msg: fmt.Sprintf("password must be at most %d characters", p.cfg.MaxLength)}
+	}
+	if Strength(password, userInputs...) < p.cfg.MinStrength {
+		if Strength(password) >= p.cfg.MinStrength {
+			return &PolicyError{Code: CodeContainsPersonal, msg: "password is too close to your username or email"}
+		}
+		return &PolicyError{Code: CodeTooWeak, msg: "password is too easy to guess, use a longer one or a few unrelated words"}
+	}
+	if p.breached != nil {
+		found, err := p.breached.Contains(password)
+		if err != nil {
+			return err
+		}
+		if found {
+			return &PolicyError{Code: CodeBreached, msg: "password appears in a known data breach, choose another one"}
+		}
+	}
+	return nil
+}
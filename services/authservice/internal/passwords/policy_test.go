@@ -0,0 +1,121 @@
+package passwords
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"bioly/auth/internal/config"
+)
+
+// writeBreached writes the SHA-1 hashes of passwords sorted by hash, the
+// way the HIBP download does.
+func writeBreached(t *testing.T, passwords ...string) string {
+	t.Helper()
+	var lines []string
+	for i, p := range passwords {
+		sum := sha1.Sum([]byte(p))
+		lines = append(lines, fmt.Sprintf("%s:%d", strings.ToUpper(hex.EncodeToString(sum[:])), i+1))
+	}
+	sort.Strings(lines)
+	path := filepath.Join(t.TempDir(), "breached.txt")
+	require.NoError(t, os.WriteFile(path, []byte(strings.Join(lines, "\r\n")+"\r\n"), 0o600))
+	return path
+}
+
+func TestStrength(t *testing.T) {
+	weak := []string{"123456", "password", "Password1", "P@ssw0rd!", "qwertyuiop", "aaaaaaaaaaaa", "abcdefgh", "letmein2024", "iloveyou!!"}
+	for _, p := range weak {
+		assert.Less(t, Strength(p), 2, p)
+	}
+	strong := []string{"correct horse battery staple", "Tr0ub4dor&3x", "vN7#kq2!Lp9z", "plum-otter-sleeps-north"}
+	for _, p := range strong {
+		assert.GreaterOrEqual(t, Strength(p), 3, p)
+	}
+
+	assert.Greater(t, Strength("jonathan.harker1897"), Strength("jonathan.harker1897", "jonathan.harker", "jonathan.harker@example.com"))
+}
+
+func TestBreached_Contains(t *testing.T) {
+	var list []string
+	for i := 0; i < 500; i++ {
+		list = append(list, fmt.Sprintf("leaked-%d", i))
+	}
+	b, err := OpenBreached(writeBreached(t, list...))
+	require.NoError(t, err)
+	defer b.Close()
+
+	for _, p := range list {
+		found, err := b.Contains(p)
+		require.NoError(t, err)
+		assert.True(t, found, p)
+	}
+	for _, p := range []string{"", "leaked-500", "correct horse battery staple"} {
+		found, err := b.Contains(p)
+		require.NoError(t, err)
+		assert.False(t, found, p)
+	}
+}
+
+func TestBreached_SmallFiles(t *testing.T) {
+	empty := filepath.Join(t.TempDir(), "empty.txt")
+	require.NoError(t, os.WriteFile(empty, nil, 0o600))
+	b, err := OpenBreached(empty)
+	require.NoError(t, err)
+	found, err := b.Contains("123456")
+	require.NoError(t, err)
+	assert.False(t, found)
+	b.Close()
+
+	// A single line without count or final newline.
+	sum := sha1.Sum([]byte("123456"))
+	one := filepath.Join(t.TempDir(), "one.txt")
+	require.NoError(t, os.WriteFile(one, []byte(hex.EncodeToString(sum[:])), 0o600))
+	b, err = OpenBreached(one)
+	require.NoError(t, err)
+	found, err = b.Contains("123456")
+	require.NoError(t, err)
+	assert.True(t, found)
+	found, err = b.Contains("654321")
+	require.NoError(t, err)
+	assert.False(t, found)
+	b.Close()
+
+	_, err = OpenBreached(filepath.Join(t.TempDir(), "missing.txt"))
+	assert.Error(t, err)
+}
+
+func TestPolicy_Check(t *testing.T) {
+	b, err := OpenBreached(writeBreached(t, "plum-otter-sleeps-north"))
+	require.NoError(t, err)
+	defer b.Close()
+	p := NewPolicy(&config.PasswordPolicy{MinLength: 8, MaxLength: 64, MinStrength: 2}, b)
+
+	cases := []struct {
+		password string
+		want     int64
+	}{
+		{"short", CodeTooShort},
+		{strings.Repeat("x", 65), CodeTooLong},
+		{"password123", CodeTooWeak},
+		{"mina_murray!!", CodeContainsPersonal},
+		{"plum-otter-sleeps-north", CodeBreached},
+	}
+	for _, c := range cases {
+		err := p.Check(c.password, "mina_murray", "mina@example.com")
+		var pe *PolicyError
+		if assert.ErrorAs(t, err, &pe, c.password) {
+			assert.Equal(t, c.want, pe.Code, c.password)
+		}
+	}
+
+	assert.NoError(t, p.Check("velvet-canyon-drifts", "mina_murray"))
+}
@@ -0,0 +1,144 @@
+package passwords
+
+import (
+	"math"
+	"strings"
+	"unicode"
+)
+
+// commonWords are guessed first by every cracking tool. Passwords built on
+// them only get credit for the rest of their characters.
+var commonWords = []string{
+	"password", "passw0rd", "qwerty", "letmein", "welcome", "admin", "login",
+	"dragon", "monkey", "football", "baseball", "soccer", "hockey", "iloveyou",
+	"princess", "sunshine", "master", "shadow", "superman", "batman", "trustno",
+	"hello", "freedom", "whatever", "starwars", "summer", "winter", "spring",
+	"autumn", "secret", "computer", "internet", "flower", "killer", "pepper",
+	"cookie", "cheese", "orange", "banana", "purple", "charlie", "michael",
+	"jessica", "jordan", "hunter", "ranger", "thomas", "tigger", "buster",
+	"angel", "love", "test", "user", "guest", "root", "bioly", "abc", "pass",
+}
+
+var keyboardRows = []string{"1234567890", "qwertyuiop", "asdfghjkl", "zxcvbnm"}
+
+// leet undoes common letter substitutions before words are looked up.
+var leet = strings.NewReplacer("0", "o", "1", "i", "3", "e", "4", "a", "5", "s", "7", "t", "@", "a", "$", "s", "!", "i")
+
+// Strength scores password from 0 (guessed at once) to 4 (out of reach of
+// offline attacks). It is a rough estimate in the spirit of zxcvbn: the
+// brute force space of the character classes used, where repeats,
+// sequences, keyboard runs, common words and userInputs (such as the
+// username) add almost nothing.
+func Strength(password string, userInputs ...string) int {
+	bits := Entropy(password, userInputs...)
+	switch {
+	case bits < 25:
+		return 0
+	case bits < 35:
+		return 1
+	case bits < 45:
+		return 2
+	case bits < 60:
+		return 3
+	}
+	return 4
+}
+
+// Entropy estimates the bits an attacker must guess to find password.
+func Entropy(password string, userInputs ...string) float64 {
+	runes := []rune(password)
+	if len(runes) == 0 {
+		return 0
+	}
+	guessable := make([]bool, len(runes))
+
+	// Repeats, sequences and keyboard runs: a character continuing the
+	// step taken by the two before it is predictable.
+	for i := 2; i < len(runes); i++ {
+		if continuesPattern(runes[i-2], runes[i-1], runes[i]) {
+			guessable[i] = true
+		}
+	}
+
+	// Dictionary words, including the user's own details.
+	words := commonWords
+	for _, in := range userInputs {
+		in, _, _ = strings.Cut(strings.ToLower(in), "@")
+		if len(in) >= 3 {
+			words = append(words[:len(words):len(words)], in)
+		}
+	}
+	folded := []rune(leet.Replace(strings.ToLower(password)))
+	bits := 0.0
+	if len(folded) == len(runes) {
+		for _, w := range words {
+			wr := []rune(w)
+			for i := 0; i+len(wr) <= len(folded); i++ {
+				if string(folded[i:i+len(wr)]) != w {
+					continue
+				}
+				for j := i; j < i+len(wr); j++ {
+					guessable[j] = true
+				}
+				// Which word, and its capitalisation.
+				bits += math.Log2(float64(len(words))) + 1
+				i += len(wr) - 1
+			}
+		}
+	}
+
+	free := 0
+	for _, g := range guessable {
+		if !g {
+			free++
+		}
+	}
+	return bits + float64(free)*math.Log2(float64(poolSize(runes)))
+}
+
+func poolSize(runes []rune) int {
+	var lower, upper, digit, symbol, other bool
+	for _, r := range runes {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r < unicode.MaxASCII:
+			symbol = true
+		default:
+			other = true
+		}
+	}
+	n := 0
+	for _, c := range []struct {
+		used bool
+		size int
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {symbol, 33}, {other, 100}} {
+		if c.used {
+			n += c.size
+		}
+	}
+	return n
+}
+
+// continuesPattern reports whether c repeats the step from a to b, in the
+// alphabet or along a keyboard row, for steps of -1, 0 and 1.
+func continuesPattern(a, b, c rune) bool {
+	a, b, c = unicode.ToLower(a), unicode.ToLower(b), unicode.ToLower(c)
+	if d := b - a; d >= -1 && d <= 1 && c-b == d {
+		return true
+	}
+	for _, row := range keyboardRows {
+		ia, ib, ic := strings.IndexRune(row, a), strings.IndexRune(row, b), strings.IndexRune(row, c)
+		if ia < 0 || ib < 0 || ic < 0 {
+			continue
+		}
+		if d := ib - ia; (d == 1 || d == -1) && ic-ib == d {
+			return true
+		}
+	}
+	return false
+}
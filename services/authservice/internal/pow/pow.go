@@ -0,0 +1,139 @@
+// Package pow issues and checks proof-of-work challenges. A challenge is a
+// signed token; the client must find a nonce such that
+// SHA-256(token + nonce) starts with Difficulty zero bits. Checking takes a
+// single hash and no state, while solving takes 2^Difficulty hashes on
+// average, which makes creating accounts in bulk expensive.
+package pow
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"math/bits"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Algorithm names the hash clients must use.
+const Algorithm = "sha256"
+
+// MaxNonceLength bounds the nonce a client may send.
+const MaxNonceLength = 64
+
+var (
+	ErrInvalid  = errors.New("invalid challenge")
+	ErrExpired  = errors.New("challenge expired")
+	ErrUnsolved = errors.New("challenge not solved")
+)
+
+// Challenge is an issued challenge. ID identifies it so a solved challenge
+// can be used only once; the Issuer does not remember it.
+type Challenge struct {
+	ID         uuid.UUID
+	Difficulty int
+	ExpiresAt  time.Time
+	Token      string
+}
+
+type Issuer struct {
+	key        []byte
+	difficulty int
+	ttl        time.Duration
+	nowFn      func() time.Time
+}
+
+// New returns an issuer signing with key. Challenges require difficulty
+// leading zero bits and are valid for ttl.
+func New(key []byte, difficulty int, ttl time.Duration) *Issuer {
+	return &Issuer{key: key, difficulty: difficulty, ttl: ttl, nowFn: time.Now}
+}
+
+// token layout: id (16) | difficulty (1) | expiry unix seconds (8) | mac (32).
+const (
+	payloadLen = 16 + 1 + 8
+	tokenLen   = payloadLen + sha256.Size
+)
+
+func (i *Issuer) Issue() (*Challenge, error) {
+	id, err := uuid.NewRandomFromReader(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	c := &Challenge{
+		ID:         id,
+		Difficulty: i.difficulty,
+		ExpiresAt:  i.nowFn().Add(i.ttl).Truncate(time.Second),
+	}
+	buf := make([]byte, payloadLen, tokenLen)
+	copy(buf, id[:])
+	buf[16] = byte(c.Difficulty)
+	binary.BigEndian.PutUint64(buf[17:], uint64(c.ExpiresAt.Unix()))
+	c.Token = base64.RawURLEncoding.EncodeToString(append(buf, i.mac(buf)...))
+	return c, nil
+}
+
+// Verify checks that token was issued by i, has not expired and that nonce
+// solves it. The challenge is returned so the caller can make sure it is
+// not used twice.
+func (i *Issuer) Verify(token, nonce string) (*Challenge, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(raw) != tokenLen {
+		return nil, ErrInvalid
+	}
+	if !hmac.Equal(raw[payloadLen:], i.mac(raw[:payloadLen])) {
+		return nil, ErrInvalid
+	}
+	c := &Challenge{
+		ID:         uuid.UUID(raw[:16]),
+		Difficulty: int(raw[16]),
+		ExpiresAt:  time.Unix(int64(binary.BigEndian.Uint64(raw[17:payloadLen])), 0),
+		Token:      token,
+	}
+	if !i.nowFn().Before(c.ExpiresAt) {
+		return nil, ErrExpired
+	}
+	if nonce == "" || len(nonce) > MaxNonceLength || !Solves(token, nonce, c.Difficulty) {
+		return nil, ErrUnsolved
+	}
+	return c, nil
+}
+
+func (i *Issuer) mac(payload []byte) []byte {
+	m := hmac.New(sha256.New, i.key)
+	m.Write(payload)
+	return m.Sum(nil)
+}
+
+// Solves reports whether SHA-256(token + nonce) has at least difficulty
+// leading zero bits.
+func Solves(token, nonce string, difficulty int) bool {
+	sum := sha256.Sum256([]byte(token + nonce))
+	return leadingZeros(sum[:]) >= difficulty
+}
+
+func leadingZeros(b []byte) int {
+	n := 0
+	for _, x := range b {
+		if x != 0 {
+			return n + bits.LeadingZeros8(x)
+		}
+		n += 8
+	}
+	return n
+}
+
+// Solve finds a nonce for token by counting up from zero, the way clients
+// are expected to.
+func Solve(token string, difficulty int) string {
+	for n := uint64(0); ; n++ {
+		nonce := strconv.FormatUint(n, 10)
+		if Solves(token, nonce, difficulty) {
+			return nonce
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package pow
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIssueVerify(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	iss := New([]byte("key"), 8, time.Minute)
+	iss.nowFn = func() time.Time { return now }
+
+	c, err := iss.Issue()
+	require.NoError(t, err)
+	assert.Equal(t, 8, c.Difficulty)
+
+	nonce := Solve(c.Token, c.Difficulty)
+	got, err := iss.Verify(c.Token, nonce)
+	require.NoError(t, err)
+	assert.Equal(t, c.ID, got.ID)
+	assert.True(t, got.ExpiresAt.Equal(c.ExpiresAt))
+
+	// A nonce that does not solve it. With 8 bits one in 256 nonces does,
+	// so look for one that does not.
+	bad := "x"
+	for Solves(c.Token, bad, c.Difficulty) {
+		bad += "x"
+	}
+	_, err = iss.Verify(c.Token, bad)
+	assert.ErrorIs(t, err, ErrUnsolved)
+
+	_, err = New([]byte("other"), 8, time.Minute).Verify(c.Token, nonce)
+	assert.ErrorIs(t, err, ErrInvalid, "signed with another key")
+	_, err = iss.Verify(c.Token[:len(c.Token)-2], nonce)
+	assert.ErrorIs(t, err, ErrInvalid)
+
+	now = now.Add(time.Minute)
+	_, err = iss.Verify(c.Token, nonce)
+	assert.ErrorIs(t, err, ErrExpired)
+}
+
+func TestLeadingZeros(t *testing.T) {
+	assert.Equal(t, 0, leadingZeros([]byte{0x80}))
+	assert.Equal(t, 7, leadingZeros([]byte{0x01, 0xff}))
+	assert.Equal(t, 12, leadingZeros([]byte{0x00, 0x08}))
+	assert.Equal(t, 16, leadingZeros([]byte{0x00, 0x00}))
+}
@@ -0,0 +1,166 @@
+package ratelimit
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"bioly/auth/internal/config"
+)
+
+// Store keeps failed attempts per key. MemoryStore is enough for a single
+// node; replicas must share a store (see repositories.NewLoginFailures).
+type Store interface {
+	// Add records a failure at time at and drops failures older than window.
+	Add(ctx context.Context, key string, at time.Time, window time.Duration) error
+	// Since returns the number of failures after since and the latest one.
+	Since(ctx context.Context, key string, since time.Time) (count int, last time.Time, err error)
+	Reset(ctx context.Context, key string) error
+}
+
+// Limiter throttles login attempts per IP and per username. Failures are
+// counted in a sliding window; once a key has more than its free attempts
+// every further attempt must wait BaseDelay, doubling with each failure up
+// to MaxDelay.
+type Limiter struct {
+	store  Store
+	cfg    *config.LoginThrottle
+	prefix string
+	nowFn  func() time.Time
+}
+
+func New(store Store, cfg *config.LoginThrottle) *Limiter {
+	return &Limiter{store: store, cfg: cfg, nowFn: time.Now}
+}
+
+// Namespace returns a limiter with the same store and settings whose
+// counters are kept apart from l's by prefixing every key with ns.
+func (l *Limiter) Namespace(ns string) *Limiter {
+	n := *l
+	n.prefix = l.prefix + ns
+	return &n
+}
+
+func IPKey(ip string) string {
+	return "ip:" + ip
+}
+
+func UserKey(username string) string {
+	return "user:" + strings.ToLower(strings.TrimSpace(username))
+}
+
+// Check returns how long the caller has to wait before the next attempt.
+func (l *Limiter) Check(ctx context.Context, ip, username string) (time.Duration, error) {
+	now := l.nowFn()
+	var wait time.Duration
+	for _, k := range l.keys(ip, username) {
+		n, last, err := l.store.Since(ctx, k.key, now.Add(-l.cfg.Window))
+		if err != nil {
+			return 0, err
+		}
+		if w := l.delay(n, k.free) - now.Sub(last); w > wait {
+			wait = w
+		}
+	}
+	return wait, nil
+}
+
+func (l *Limiter) Fail(ctx context.Context, ip, username string) error {
+	now := l.nowFn()
+	for _, k := range l.keys(ip, username) {
+		if err := l.store.Add(ctx, k.key, now, l.cfg.Window); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Succeed clears the username counter. The IP counter is left alone so a
+// successful login on one account does not hide guessing on others.
+func (l *Limiter) Succeed(ctx context.Context, username string) error {
+	return l.store.Reset(ctx, l.prefix+UserKey(username))
+}
+
+type limitKey struct {
+	key  string
+	free int
+}
+
+func (l *Limiter) keys(ip, username string) []limitKey {
+	keys := []limitKey{{key: l.prefix + UserKey(username), free: l.cfg.FreeAttempts}}
+	if ip != "" {
+		keys = append(keys, limitKey{key: l.prefix + IPKey(ip), free: l.cfg.IPFreeAttempts})
+	}
+	return keys
+}
+
+func (l *Limiter) delay(failures, free int) time.Duration {
+	if failures < free {
+		return 0
+	}
+	d := l.cfg.BaseDelay
+	for i := free; i < failures && d < l.cfg.MaxDelay; i++ {
+		d *= 2
+	}
+	return min(d, l.cfg.MaxDelay)
+}
+
+// MemoryStore is an in-process Store.
+type MemoryStore struct {
+	mu        sync.Mutex
+	failures  map[string][]time.Time
+	lastSweep time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{failures: map[string][]time.Time{}}
+}
+
+func (m *MemoryStore) Add(_ context.Context, key string, at time.Time, window time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cutoff := at.Add(-window)
+	m.failures[key] = append(prune(m.failures[key], cutoff), at)
+
+	// Forget keys that have been quiet for a whole window.
+	if at.Sub(m.lastSweep) > window {
+		for k, ts := range m.failures {
+			if ts = prune(ts, cutoff); len(ts) == 0 {
+				delete(m.failures, k)
+			} else {
+				m.failures[k] = ts
+			}
+		}
+		m.lastSweep = at
+	}
+	return nil
+}
+
+func (m *MemoryStore) Since(_ context.Context, key string, since time.Time) (int, time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	ts := prune(m.failures[key], since)
+	if len(ts) == 0 {
+		return 0, time.Time{}, nil
+	}
+	return len(ts), ts[len(ts)-1], nil
+}
+
+func (m *MemoryStore) Reset(_ context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.failures, key)
+	return nil
+}
+
+// prune drops the leading timestamps that are not after cutoff.
+func prune(ts []time.Time, cutoff time.Time) []time.Time {
+	i := 0
+	for i < len(ts) && !ts[i].After(cutoff) {
+		i++
+	}
+	return ts[i:]
+}
@@ -0,0 +1,121 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"bioly/auth/internal/config"
+)
+
+func newTestLimiter() (*Limiter, *time.Time) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	l := New(NewMemoryStore(), &config.LoginThrottle{
+		Window:         10 * time.Minute,
+		FreeAttempts:   3,
+		IPFreeAttempts: 5,
+		BaseDelay:      time.Second,
+		MaxDelay:       8 * time.Second,
+	})
+	l.nowFn = func() time.Time { return now }
+	return l, &now
+}
+
+func TestLimiter_ExponentialBackoff(t *testing.T) {
+	l, now := newTestLimiter()
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, l.Fail(ctx, "", "alice"))
+	}
+	wait, err := l.Check(ctx, "", "alice")
+	assert.NoError(t, err)
+	assert.Zero(t, wait)
+
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 8 * time.Second}
+	for _, w := range want {
+		assert.NoError(t, l.Fail(ctx, "", "alice"))
+		wait, err = l.Check(ctx, "", "Alice")
+		assert.NoError(t, err)
+		assert.Equal(t, w, wait)
+	}
+
+	*now = now.Add(3 * time.Second)
+	wait, _ = l.Check(ctx, "", "alice")
+	assert.Equal(t, 5*time.Second, wait)
+}
+
+func TestLimiter_SlidingWindow(t *testing.T) {
+	l, now := newTestLimiter()
+	ctx := context.Background()
+
+	for i := 0; i < 4; i++ {
+		assert.NoError(t, l.Fail(ctx, "", "bob"))
+	}
+	wait, _ := l.Check(ctx, "", "bob")
+	assert.Greater(t, wait, time.Duration(0))
+
+	*now = now.Add(11 * time.Minute)
+	wait, _ = l.Check(ctx, "", "bob")
+	assert.Zero(t, wait)
+}
+
+func TestLimiter_PerIP(t *testing.T) {
+	l, _ := newTestLimiter()
+	ctx := context.Background()
+
+	// Spraying different usernames from one IP trips the IP counter.
+	for _, u := range []string{"a", "b", "c", "d", "e"} {
+		assert.NoError(t, l.Fail(ctx, "10.0.0.1", u))
+	}
+	wait, _ := l.Check(ctx, "10.0.0.1", "f")
+	assert.Equal(t, time.Second, wait)
+	wait, _ = l.Check(ctx, "10.0.0.2", "f")
+	assert.Zero(t, wait)
+}
+
+func TestLimiter_SucceedResetsUsernameOnly(t *testing.T) {
+	l, _ := newTestLimiter()
+	ctx := context.Background()
+
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, l.Fail(ctx, "10.0.0.1", "carol"))
+	}
+	assert.NoError(t, l.Succeed(ctx, "carol"))
+
+	wait, _ := l.Check(ctx, "10.0.0.2", "carol")
+	assert.Zero(t, wait)
+	wait, _ = l.Check(ctx, "10.0.0.1", "dave")
+	assert.Equal(t, time.Second, wait)
+}
+
+func TestLimiter_NamespaceKeepsCountersApart(t *testing.T) {
+	l, _ := newTestLimiter()
+	mail := l.Namespace("mail:")
+	ctx := context.Background()
+
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, mail.Fail(ctx, "10.0.0.1", "erin"))
+	}
+	wait, _ := mail.Check(ctx, "10.0.0.1", "erin")
+	assert.Positive(t, wait)
+	wait, _ = l.Check(ctx, "10.0.0.1", "erin")
+	assert.Zero(t, wait)
+}
+
+func TestMemoryStore_SweepsQuietKeys(t *testing.T) {
+	s := NewMemoryStore()
+	ctx := context.Background()
+	t0 := time.Now()
+
+	assert.NoError(t, s.Add(ctx, "old", t0, time.Minute))
+	assert.NoError(t, s.Add(ctx, "new", t0.Add(2*time.Minute), time.Minute))
+	assert.NotContains(t, s.failures, "old")
+
+	n, last, err := s.Since(ctx, "new", t0)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, t0.Add(2*time.Minute), last)
+}
@@ -0,0 +1,73 @@
+package repositories
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+
+	"bioly/auth/internal/types"
+)
+
+func TestAudit_Add(t *testing.T) {
+	db, mock := newSQLMock(t)
+	repo := NewAuditEvents(db)
+
+	now := time.Now().UTC()
+	id := int64(7)
+	e := &types.AuditEvent{
+		Type: types.AuditLogin, UserID: &id, Username: "alice", IP: "not-an-ip",
+		UserAgent: "UA", RequestID: "req-1", Outcome: types.OutcomeSuccess,
+	}
+	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO auth.audit_events`)).
+		WithArgs(types.AuditLogin, &id, (*int64)(nil), "alice", "", "UA", "req-1", types.OutcomeSuccess, "").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(int64(1), now))
+
+	assert.NoError(t, repo.Add(context.Background(), e))
+	assert.Equal(t, int64(1), e.ID)
+	assert.Equal(t, now, e.CreatedAt)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestAudit_List_Filters(t *testing.T) {
+	db, mock := newSQLMock(t)
+	repo := NewAuditEvents(db)
+
+	uid := int64(7)
+	since := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	rows := sqlmock.NewRows([]string{"id", "event_type", "user_id", "actor_id", "username", "ip", "user_agent", "request_id", "outcome", "detail", "created_at"}).
+		AddRow(int64(41), types.AuditLogin, uid, nil, "alice", "10.0.0.1", "UA", "req", types.OutcomeFailure, "invalid credentials", since)
+	mock.ExpectQuery(regexp.QuoteMeta(`WHERE user_id = $1 AND event_type = $2 AND created_at >= $3 AND id < $4
+		ORDER BY id DESC
+		LIMIT $5`)).
+		WithArgs(uid, types.AuditLogin, since, int64(42), 10).
+		WillReturnRows(rows)
+
+	events, err := repo.List(context.Background(), types.AuditFilter{
+		UserID: &uid, Type: types.AuditLogin, Since: since, Before: 42, Limit: 10,
+	})
+	assert.NoError(t, err)
+	if assert.Len(t, events, 1) {
+		assert.Equal(t, int64(41), events[0].ID)
+		assert.Nil(t, events[0].ActorID)
+		assert.Equal(t, "invalid credentials", events[0].Detail)
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestAudit_List_NoFilter(t *testing.T) {
+	db, mock := newSQLMock(t)
+	repo := NewAuditEvents(db)
+
+	mock.ExpectQuery(`FROM auth.audit_events\s+ORDER BY id DESC\s+LIMIT \$1`).
+		WithArgs(50).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+
+	events, err := repo.List(context.Background(), types.AuditFilter{Limit: 50})
+	assert.NoError(t, err)
+	assert.Empty(t, events)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,82 @@
+package repositories
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+
+	"bioly/auth/internal/types"
+)
+
+type AuditEvents interface {
+	Add(ctx context.Context, e *types.AuditEvent) error
+	List(ctx context.Context, f types.AuditFilter) ([]types.AuditEvent, error)
+}
+
+type auditEventsImpl struct {
+	db *sqlx.DB
+}
+
+func NewAuditEvents(db *sqlx.DB) AuditEvents {
+	return &auditEventsImpl{db: db}
+}
+
+func (r *auditEventsImpl) Add(ctx context.Context, e *types.AuditEvent) error {
+	ip := e.IP
+	if net.ParseIP(ip) == nil {
+		ip = ""
+	}
+	return r.db.QueryRowxContext(ctx, `
+		INSERT INTO auth.audit_events
+		  (event_type, user_id, actor_id, username, ip, user_agent, request_id, outcome, detail)
+		VALUES ($1, $2, $3, NULLIF($4, ''), NULLIF($5, '')::inet, NULLIF($6, ''), NULLIF($7, ''), $8, NULLIF($9, ''))
+		RETURNING id, created_at
+	`, e.Type, e.UserID, e.ActorID, e.Username, ip, e.UserAgent, e.RequestID, e.Outcome, e.Detail,
+	).Scan(&e.ID, &e.CreatedAt)
+}
+
+// List returns events matching f, newest first.
+func (r *auditEventsImpl) List(ctx context.Context, f types.AuditFilter) ([]types.AuditEvent, error) {
+	var where []string
+	var args []any
+	add := func(cond string, arg any) {
+		args = append(args, arg)
+		where = append(where, fmt.Sprintf(cond, len(args)))
+	}
+	if f.UserID != nil {
+		add("user_id = $%d", *f.UserID)
+	}
+	if f.Type != "" {
+		add("event_type = $%d", f.Type)
+	}
+	if !f.Since.IsZero() {
+		add("created_at >= $%d", f.Since)
+	}
+	if !f.Until.IsZero() {
+		add("created_at < $%d", f.Until)
+	}
+	if f.Before > 0 {
+		add("id < $%d", f.Before)
+	}
+
+	query := `
+		SELECT id, event_type, user_id, actor_id,
+		       COALESCE(username, '') AS username, COALESCE(host(ip), '') AS ip,
+		       COALESCE(user_agent, '') AS user_agent, COALESCE(request_id, '') AS request_id,
+		       outcome, COALESCE(detail, '') AS detail, created_at
+		FROM auth.audit_events`
+	if len(where) > 0 {
+		query += "\n\t\tWHERE " + strings.Join(where, " AND ")
+	}
+	args = append(args, f.Limit)
+	query += fmt.Sprintf("\n\t\tORDER BY id DESC\n\t\tLIMIT $%d", len(args))
+
+	events := []types.AuditEvent{}
+	if err := r.db.SelectContext(ctx, &events, query, args...); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
@@ -0,0 +1,73 @@
+package repositories
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+
+	"bioly/auth/internal/types"
+)
+
+func TestIdentities_Find(t *testing.T) {
+	db, mock := newSQLMock(t)
+	repo := NewIdentities(db)
+
+	q := regexp.QuoteMeta(`WHERE provider = $1 AND subject = $2`)
+	mock.ExpectQuery(q).
+		WithArgs("github", "583231").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "user_id", "provider", "subject", "created_at"}).
+			AddRow(int64(1), int64(7), "github", "583231", time.Now()))
+	mock.ExpectQuery(q).
+		WithArgs("github", "1").
+		WillReturnRows(sqlmock.NewRows([]string{"id"}))
+
+	ident, err := repo.Find(context.Background(), "github", "583231")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(7), ident.UserID)
+
+	_, err = repo.Find(context.Background(), "github", "1")
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestIdentities_AddUser(t *testing.T) {
+	db, mock := newSQLMock(t)
+	repo := NewIdentities(db)
+	now := time.Now()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO auth.users (username, email, password_hash, username_skeleton)`)).
+		WithArgs("octocat", nil, "hash", "octocat", DefaultRole).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at"}).AddRow(int64(9), now, now))
+	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO auth.identities (user_id, provider, subject)`)).
+		WithArgs(int64(9), "github", "583231").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(int64(3), now))
+	mock.ExpectCommit()
+
+	u := &types.User{Username: "octocat", PasswordHash: "hash"}
+	ident := &types.Identity{Provider: "github", Subject: "583231"}
+	assert.NoError(t, repo.AddUser(context.Background(), u, ident))
+	assert.Equal(t, int64(9), u.ID)
+	assert.Equal(t, int64(9), ident.UserID)
+	assert.Equal(t, int64(3), ident.ID)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestIdentities_AddUser_DuplicateUsername(t *testing.T) {
+	db, mock := newSQLMock(t)
+	repo := NewIdentities(db)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO auth.users`)).
+		WillReturnError(&pq.Error{Code: "23505"})
+	mock.ExpectRollback()
+
+	err := repo.AddUser(context.Background(), &types.User{Username: "admin"}, &types.Identity{Provider: "github", Subject: "1"})
+	assert.ErrorIs(t, err, ErrDuplicateUsername)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,62 @@
+package repositories
+
+import (
+	"bioly/auth/internal/types"
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type Identities interface {
+	Find(ctx context.Context, provider, subject string) (*types.Identity, error)
+	AddUser(ctx context.Context, u *types.User, ident *types.Identity) error
+}
+
+type identitiesImpl struct {
+	db *sqlx.DB
+}
+
+func NewIdentities(db *sqlx.DB) Identities {
+	return &identitiesImpl{db: db}
+}
+
+func (r *identitiesImpl) Find(ctx context.Context, provider, subject string) (*types.Identity, error) {
+	var ident types.Identity
+	err := r.db.GetContext(ctx, &ident, `
+		SELECT id, user_id, provider, subject, created_at
+		FROM auth.identities
+		WHERE provider = $1 AND subject = $2
+	`, provider, subject)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return &ident, nil
+}
+
+// AddUser creates u, like Users.Add, together with its first identity.
+func (r *identitiesImpl) AddUser(ctx context.Context, u *types.User, ident *types.Identity) error {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := insertUser(ctx, tx, u); err != nil {
+		return err
+	}
+	ident.UserID = u.ID
+	err = tx.QueryRowxContext(ctx, `
+		INSERT INTO auth.identities (user_id, provider, subject)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at
+	`, ident.UserID, ident.Provider, ident.Subject).Scan(&ident.ID, &ident.CreatedAt)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
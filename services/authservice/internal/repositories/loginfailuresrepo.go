@@ -0,0 +1,60 @@
+package repositories
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// LoginFailures is a Postgres backed ratelimit.Store, shared by every replica
+// of the service.
+type LoginFailures struct {
+	db *sqlx.DB
+}
+
+func NewLoginFailures(db *sqlx.DB) *LoginFailures {
+	return &LoginFailures{db: db}
+}
+
+func (r *LoginFailures) Add(ctx context.Context, key string, at time.Time, window time.Duration) error {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `
+		DELETE FROM auth.login_failures WHERE key = $1 AND failed_at <= $2
+	`, key, at.Add(-window)); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO auth.login_failures (key, failed_at) VALUES ($1, $2)
+	`, key, at); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *LoginFailures) Since(ctx context.Context, key string, since time.Time) (int, time.Time, error) {
+	var row struct {
+		Count int          `db:"count"`
+		Last  sql.NullTime `db:"last"`
+	}
+	err := r.db.GetContext(ctx, &row, `
+		SELECT COUNT(*) AS count, MAX(failed_at) AS last
+		FROM auth.login_failures
+		WHERE key = $1 AND failed_at > $2
+	`, key, since)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	return row.Count, row.Last.Time, nil
+}
+
+func (r *LoginFailures) Reset(ctx context.Context, key string) error {
+	_, err := r.db.ExecContext(ctx, `DELETE FROM auth.login_failures WHERE key = $1`, key)
+	return err
+}
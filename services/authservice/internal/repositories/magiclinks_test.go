@@ -0,0 +1,36 @@
+package repositories
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMagicLinks_Consume(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
+	assert.NoError(t, err)
+	xdb := sqlx.NewDb(db, "sqlmock")
+	defer xdb.Close()
+	repo := NewMagicLinks(xdb)
+
+	id := uuid.New()
+	exp := time.Now().Add(10 * time.Minute)
+	q := regexp.QuoteMeta(`INSERT INTO auth.magic_link_uses (token_id, user_id, ip, user_agent, expires_at)`)
+	mock.ExpectExec(q).
+		WithArgs(id, int64(7), "10.0.0.1", "Firefox", exp).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(q).
+		WithArgs(id, int64(7), "10.0.0.1", "Firefox", exp).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	assert.NoError(t, repo.Consume(context.Background(), id, 7, exp, "Firefox", "10.0.0.1"))
+	err = repo.Consume(context.Background(), id, 7, exp, "Firefox", "10.0.0.1")
+	assert.ErrorIs(t, err, ErrLinkUsed, "a link logs in once")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
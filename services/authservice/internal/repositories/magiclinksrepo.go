@@ -0,0 +1,40 @@
+package repositories
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+)
+
+type MagicLinks interface {
+	Consume(ctx context.Context, tokenID uuid.UUID, userID int64, expiresAt time.Time, userAgent, ip string) error
+}
+
+type magicLinksImpl struct {
+	db *sqlx.DB
+}
+
+func NewMagicLinks(db *sqlx.DB) MagicLinks {
+	return &magicLinksImpl{db: db}
+}
+
+// Consume records that the login link tokenID was used. The row stays as a
+// record of the login; a link that was used before returns ErrLinkUsed.
+func (r *magicLinksImpl) Consume(ctx context.Context, tokenID uuid.UUID, userID int64, expiresAt time.Time, userAgent, ip string) error {
+	res, err := r.db.ExecContext(ctx, `
+		INSERT INTO auth.magic_link_uses (token_id, user_id, ip, user_agent, expires_at)
+		VALUES ($1, $2, NULLIF($3, '')::inet, NULLIF($4, ''), $5)
+		ON CONFLICT (token_id) DO NOTHING
+	`, tokenID, userID, ip, userAgent, expiresAt)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrLinkUsed
+	}
+	return nil
+}
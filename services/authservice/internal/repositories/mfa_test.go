@@ -0,0 +1,98 @@
+package repositories
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMFA_Get(t *testing.T) {
+	db, mock := newSQLMock(t)
+	repo := NewMFA(db)
+
+	now := time.Now().UTC()
+	mock.ExpectQuery(regexp.QuoteMeta(`FROM auth.user_mfa`)).
+		WithArgs(int64(4)).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "secret_enc", "enabled_at", "last_step", "created_at", "updated_at"}).
+			AddRow(int64(4), "v1:xyz", now, int64(100), now, now))
+	mock.ExpectQuery(regexp.QuoteMeta(`FROM auth.user_mfa`)).
+		WithArgs(int64(5)).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}))
+
+	m, err := repo.Get(context.Background(), 4)
+	assert.NoError(t, err)
+	assert.Equal(t, "v1:xyz", m.SecretEnc)
+	assert.Equal(t, int64(100), m.LastStep)
+	assert.NotNil(t, m.EnabledAt)
+
+	_, err = repo.Get(context.Background(), 5)
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestMFA_Begin(t *testing.T) {
+	db, mock := newSQLMock(t)
+	repo := NewMFA(db)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`WHERE auth.user_mfa.enabled_at IS NULL`)).
+		WithArgs(int64(4), "v1:xyz").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM auth.mfa_recovery_codes WHERE user_id = $1`)).
+		WithArgs(int64(4)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO auth.mfa_recovery_codes`)).
+		WithArgs(int64(4), "h1").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO auth.mfa_recovery_codes`)).
+		WithArgs(int64(4), "h2").
+		WillReturnResult(sqlmock.NewResult(2, 1))
+	mock.ExpectCommit()
+
+	assert.NoError(t, repo.Begin(context.Background(), 4, "v1:xyz", []string{"h1", "h2"}))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestMFA_BeginWhenEnabled(t *testing.T) {
+	db, mock := newSQLMock(t)
+	repo := NewMFA(db)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO auth.user_mfa`)).
+		WithArgs(int64(4), "v1:xyz").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	assert.ErrorIs(t, repo.Begin(context.Background(), 4, "v1:xyz", nil), ErrMFAAlreadyEnabled)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestMFA_UseStepRejectsReplay(t *testing.T) {
+	db, mock := newSQLMock(t)
+	repo := NewMFA(db)
+
+	q := regexp.QuoteMeta(`WHERE user_id = $1 AND last_step < $2`)
+	mock.ExpectExec(q).WithArgs(int64(4), int64(101)).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(q).WithArgs(int64(4), int64(101)).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	assert.NoError(t, repo.UseStep(context.Background(), 4, 101))
+	assert.ErrorIs(t, repo.UseStep(context.Background(), 4, 101), ErrInvalidMFACode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestMFA_UseRecoveryCode(t *testing.T) {
+	db, mock := newSQLMock(t)
+	repo := NewMFA(db)
+
+	q := regexp.QuoteMeta(`WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL`)
+	mock.ExpectExec(q).WithArgs(int64(4), "h1").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(q).WithArgs(int64(4), "h1").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	assert.NoError(t, repo.UseRecoveryCode(context.Background(), 4, "h1"))
+	assert.ErrorIs(t, repo.UseRecoveryCode(context.Background(), 4, "h1"), ErrInvalidMFACode)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
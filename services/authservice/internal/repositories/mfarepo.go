@@ -0,0 +1,163 @@
+package repositories
+
+import (
+	"bioly/auth/internal/types"
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/jmoiron/sqlx"
+)
+
+var ErrMFAAlreadyEnabled = errors.New("two-factor authentication already enabled")
+var ErrMFANotEnabled = errors.New("two-factor authentication not enabled")
+var ErrInvalidMFACode = errors.New("invalid authentication code")
+
+type MFA interface {
+	Get(ctx context.Context, userID int64) (*types.MFA, error)
+	Begin(ctx context.Context, userID int64, secretEnc string, codeHashes []string) error
+	Enable(ctx context.Context, userID int64, step int64) error
+	Disable(ctx context.Context, userID int64) error
+	UseStep(ctx context.Context, userID int64, step int64) error
+	UseRecoveryCode(ctx context.Context, userID int64, codeHash string) error
+}
+
+type mfaImpl struct {
+	db *sqlx.DB
+}
+
+func NewMFA(db *sqlx.DB) MFA {
+	return &mfaImpl{db: db}
+}
+
+func (r *mfaImpl) Get(ctx context.Context, userID int64) (*types.MFA, error) {
+	var m types.MFA
+	err := r.db.GetContext(ctx, &m, `
+		SELECT user_id, secret_enc, enabled_at, last_step, created_at, updated_at
+		FROM auth.user_mfa
+		WHERE user_id = $1
+	`, userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return &m, nil
+}
+
+// Begin stores a new, not yet enabled TOTP secret and replaces the recovery
+// codes. Repeating an unfinished enrolment starts over; an enabled one has
+// to be disabled first.
+func (r *mfaImpl) Begin(ctx context.Context, userID int64, secretEnc string, codeHashes []string) error {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `
+		INSERT INTO auth.user_mfa (user_id, secret_enc)
+		VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE
+		SET secret_enc = EXCLUDED.secret_enc, last_step = 0, updated_at = NOW()
+		WHERE auth.user_mfa.enabled_at IS NULL
+	`, userID, secretEnc)
+	if err != nil {
+		return err
+	}
+	aff, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if aff == 0 {
+		return ErrMFAAlreadyEnabled
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM auth.mfa_recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+	for _, h := range codeHashes {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO auth.mfa_recovery_codes (user_id, code_hash) VALUES ($1, $2)
+		`, userID, h); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (r *mfaImpl) Enable(ctx context.Context, userID int64, step int64) error {
+	res, err := r.db.ExecContext(ctx, `
+		UPDATE auth.user_mfa
+		SET enabled_at = NOW(), last_step = $2, updated_at = NOW()
+		WHERE user_id = $1 AND enabled_at IS NULL
+	`, userID, step)
+	if err != nil {
+		return err
+	}
+	aff, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if aff == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *mfaImpl) Disable(ctx context.Context, userID int64) error {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM auth.mfa_recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM auth.user_mfa WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UseStep records step as used. Steps at or before the last used one are
+// rejected with ErrInvalidMFACode, which stops a code from being replayed.
+func (r *mfaImpl) UseStep(ctx context.Context, userID int64, step int64) error {
+	res, err := r.db.ExecContext(ctx, `
+		UPDATE auth.user_mfa
+		SET last_step = $2, updated_at = NOW()
+		WHERE user_id = $1 AND last_step < $2
+	`, userID, step)
+	if err != nil {
+		return err
+	}
+	aff, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if aff == 0 {
+		return ErrInvalidMFACode
+	}
+	return nil
+}
+
+func (r *mfaImpl) UseRecoveryCode(ctx context.Context, userID int64, codeHash string) error {
+	res, err := r.db.ExecContext(ctx, `
+		UPDATE auth.mfa_recovery_codes
+		SET used_at = NOW()
+		WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL
+	`, userID, codeHash)
+	if err != nil {
+		return err
+	}
+	aff, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if aff == 0 {
+		return ErrInvalidMFACode
+	}
+	return nil
+}
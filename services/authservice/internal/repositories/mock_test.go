@@ -0,0 +1,20 @@
+package repositories
+
+import (
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/require"
+)
+
+// newSQLMock returns a database backed by sqlmock, matching queries as
+// regular expressions. It is closed when the test ends.
+func newSQLMock(t *testing.T) (*sqlx.DB, sqlmock.Sqlmock) {
+	t.Helper()
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
+	require.NoError(t, err)
+	xdb := sqlx.NewDb(db, "sqlmock")
+	t.Cleanup(func() { xdb.Close() })
+	return xdb, mock
+}
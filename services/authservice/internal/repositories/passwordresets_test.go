@@ -0,0 +1,68 @@
+package repositories
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+
+	"bioly/auth/internal/types"
+)
+
+func TestPasswordResets_Create(t *testing.T) {
+	db, mock := newSQLMock(t)
+	repo := NewPasswordResets(db)
+
+	now := time.Now().UTC()
+	pr := &types.PasswordReset{UserID: 3, TokenID: uuid.New(), TokenHash: "hash", ExpiresAt: now.Add(time.Hour)}
+	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO auth.password_resets (user_id, token_id, token_hash, expires_at)`)).
+		WithArgs(pr.UserID, pr.TokenID, pr.TokenHash, pr.ExpiresAt).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(int64(11), now))
+
+	assert.NoError(t, repo.Create(context.Background(), pr))
+	assert.Equal(t, int64(11), pr.ID)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPasswordResets_Consume(t *testing.T) {
+	db, mock := newSQLMock(t)
+	repo := NewPasswordResets(db)
+
+	tokenID := uuid.New()
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`WHERE token_id = $1 AND used_at IS NULL AND expires_at > NOW()`)).
+		WithArgs(tokenID).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(int64(3)))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE auth.password_resets`)).
+		WithArgs(int64(3)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`SET password_hash = $2, failed_login_count = 0, locked_until = NULL`)).
+		WithArgs(int64(3), "newhash").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE auth.refresh_tokens`)).
+		WithArgs(int64(3)).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+
+	assert.NoError(t, repo.Consume(context.Background(), tokenID, "newhash"))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPasswordResets_ConsumeUsedToken(t *testing.T) {
+	db, mock := newSQLMock(t)
+	repo := NewPasswordResets(db)
+
+	tokenID := uuid.New()
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`WHERE token_id = $1 AND used_at IS NULL`)).
+		WithArgs(tokenID).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id"}))
+	mock.ExpectRollback()
+
+	assert.ErrorIs(t, repo.Consume(context.Background(), tokenID, "newhash"), ErrInvalidToken)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
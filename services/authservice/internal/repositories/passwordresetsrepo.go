@@ -0,0 +1,101 @@
+package repositories
+
+import (
+	"bioly/auth/internal/types"
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+)
+
+type PasswordResets interface {
+	Create(ctx context.Context, pr *types.PasswordReset) error
+	FindByTokenID(ctx context.Context, tokenID uuid.UUID) (*types.PasswordReset, error)
+	Consume(ctx context.Context, tokenID uuid.UUID, passwordHash string) error
+}
+
+type passwordResetsImpl struct {
+	db *sqlx.DB
+}
+
+func NewPasswordResets(db *sqlx.DB) PasswordResets {
+	return &passwordResetsImpl{db: db}
+}
+
+func (r *passwordResetsImpl) Create(ctx context.Context, pr *types.PasswordReset) error {
+	return r.db.QueryRowxContext(ctx, `
+		INSERT INTO auth.password_resets (user_id, token_id, token_hash, expires_at)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at
+	`, pr.UserID, pr.TokenID, pr.TokenHash, pr.ExpiresAt).Scan(&pr.ID, &pr.CreatedAt)
+}
+
+func (r *passwordResetsImpl) FindByTokenID(ctx context.Context, tokenID uuid.UUID) (*types.PasswordReset, error) {
+	var pr types.PasswordReset
+	err := r.db.GetContext(ctx, &pr, `
+		SELECT id, user_id, token_id, token_hash, expires_at, used_at, created_at
+		FROM auth.password_resets
+		WHERE token_id = $1
+	`, tokenID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return &pr, nil
+}
+
+// Consume marks the reset token used, stores the new password hash and
+// revokes every refresh token of the user in one transaction. Other pending
+// resets of the user are used up as well. ErrInvalidToken is returned when
+// the token was already used or has expired.
+func (r *passwordResetsImpl) Consume(ctx context.Context, tokenID uuid.UUID, passwordHash string) error {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var userID int64
+	err = tx.QueryRowxContext(ctx, `
+		UPDATE auth.password_resets
+		SET used_at = NOW()
+		WHERE token_id = $1 AND used_at IS NULL AND expires_at > NOW()
+		RETURNING user_id
+	`, tokenID).Scan(&userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrInvalidToken
+		}
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE auth.password_resets
+		SET used_at = NOW()
+		WHERE user_id = $1 AND used_at IS NULL
+	`, userID); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE auth.users
+		SET password_hash = $2, failed_login_count = 0, locked_until = NULL, updated_at = NOW()
+		WHERE id = $1
+	`, userID, passwordHash); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE auth.refresh_tokens
+		SET revoked_at = NOW(), updated_at = NOW()
+		WHERE user_id = $1 AND revoked_at IS NULL
+	`, userID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,81 @@
+package repositories
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+
+	"bioly/auth/internal/types"
+)
+
+var personalTokenColumns = []string{"id", "user_id", "token_id", "token_hash", "name", "scopes", "expires_at", "last_used_at", "revoked_at", "created_at"}
+
+func TestPersonalTokens_Add(t *testing.T) {
+	db, mock := newSQLMock(t)
+	repo := NewPersonalTokens(db)
+	now := time.Now()
+
+	tok := &types.PersonalToken{UserID: 3, TokenID: uuid.New(), TokenHash: "hash", Name: "backup", Scopes: pq.StringArray{"profile:read"}}
+	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO auth.personal_access_tokens (user_id, token_id, token_hash, name, scopes, expires_at)`)).
+		WithArgs(tok.UserID, tok.TokenID, "hash", "backup", tok.Scopes, nil).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(int64(5), now))
+
+	assert.NoError(t, repo.Add(context.Background(), tok))
+	assert.Equal(t, int64(5), tok.ID)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPersonalTokens_FindByTokenID(t *testing.T) {
+	db, mock := newSQLMock(t)
+	repo := NewPersonalTokens(db)
+	tokenID := uuid.New()
+
+	q := regexp.QuoteMeta(`WHERE token_id = $1`)
+	mock.ExpectQuery(q).
+		WithArgs(tokenID).
+		WillReturnRows(sqlmock.NewRows(personalTokenColumns).
+			AddRow(int64(5), int64(3), tokenID, "hash", "backup", "{profile:read,profile:write}", nil, nil, nil, time.Now()))
+	mock.ExpectQuery(q).
+		WithArgs(sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows(personalTokenColumns))
+
+	tok, err := repo.FindByTokenID(context.Background(), tokenID)
+	assert.NoError(t, err)
+	assert.Equal(t, pq.StringArray{"profile:read", "profile:write"}, tok.Scopes)
+	assert.Nil(t, tok.ExpiresAt)
+
+	_, err = repo.FindByTokenID(context.Background(), uuid.New())
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPersonalTokens_Revoke(t *testing.T) {
+	db, mock := newSQLMock(t)
+	repo := NewPersonalTokens(db)
+
+	q := regexp.QuoteMeta(`WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL`)
+	mock.ExpectExec(q).WithArgs(int64(5), int64(3)).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(q).WithArgs(int64(5), int64(4)).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	assert.NoError(t, repo.Revoke(context.Background(), 3, 5))
+	assert.ErrorIs(t, repo.Revoke(context.Background(), 4, 5), ErrNotFound)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPersonalTokens_Touch(t *testing.T) {
+	db, mock := newSQLMock(t)
+	repo := NewPersonalTokens(db)
+
+	mock.ExpectExec(regexp.QuoteMeta(`last_used_at < NOW() - INTERVAL '1 minute'`)).
+		WithArgs(int64(5)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	assert.NoError(t, repo.Touch(context.Background(), 5))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,111 @@
+package repositories
+
+import (
+	"bioly/auth/internal/types"
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+)
+
+type PersonalTokens interface {
+	Add(ctx context.Context, t *types.PersonalToken) error
+	FindByTokenID(ctx context.Context, tokenID uuid.UUID) (*types.PersonalToken, error)
+	ListByUser(ctx context.Context, userID int64) ([]types.PersonalToken, error)
+	CountActive(ctx context.Context, userID int64) (int, error)
+	Revoke(ctx context.Context, userID, id int64) error
+	Touch(ctx context.Context, id int64) error
+}
+
+type personalTokensImpl struct {
+	db *sqlx.DB
+}
+
+func NewPersonalTokens(db *sqlx.DB) PersonalTokens {
+	return &personalTokensImpl{db: db}
+}
+
+func (r *personalTokensImpl) Add(ctx context.Context, t *types.PersonalToken) error {
+	return r.db.QueryRowxContext(ctx, `
+		INSERT INTO auth.personal_access_tokens (user_id, token_id, token_hash, name, scopes, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at
+	`, t.UserID, t.TokenID, t.TokenHash, t.Name, t.Scopes, t.ExpiresAt).Scan(&t.ID, &t.CreatedAt)
+}
+
+func (r *personalTokensImpl) FindByTokenID(ctx context.Context, tokenID uuid.UUID) (*types.PersonalToken, error) {
+	var t types.PersonalToken
+	err := r.db.GetContext(ctx, &t, `
+		SELECT id, user_id, token_id, token_hash, name, scopes, expires_at, last_used_at, revoked_at, created_at
+		FROM auth.personal_access_tokens
+		WHERE token_id = $1
+	`, tokenID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return &t, nil
+}
+
+// ListByUser returns the tokens of the user that are not revoked, newest
+// first. Expired tokens are included so the user can see and remove them.
+func (r *personalTokensImpl) ListByUser(ctx context.Context, userID int64) ([]types.PersonalToken, error) {
+	tokens := []types.PersonalToken{}
+	err := r.db.SelectContext(ctx, &tokens, `
+		SELECT id, user_id, token_id, token_hash, name, scopes, expires_at, last_used_at, revoked_at, created_at
+		FROM auth.personal_access_tokens
+		WHERE user_id = $1 AND revoked_at IS NULL
+		ORDER BY created_at DESC, id DESC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// CountActive counts the tokens of the user that can still be used.
+func (r *personalTokensImpl) CountActive(ctx context.Context, userID int64) (int, error) {
+	var n int
+	err := r.db.GetContext(ctx, &n, `
+		SELECT COUNT(*)
+		FROM auth.personal_access_tokens
+		WHERE user_id = $1 AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > NOW())
+	`, userID)
+	return n, err
+}
+
+// Revoke revokes token id of the user. ErrNotFound is returned when the user
+// has no such token, or it was revoked already.
+func (r *personalTokensImpl) Revoke(ctx context.Context, userID, id int64) error {
+	res, err := r.db.ExecContext(ctx, `
+		UPDATE auth.personal_access_tokens
+		SET revoked_at = NOW()
+		WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL
+	`, id, userID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Touch records that the token was used. It writes at most once a minute per
+// token, so busy scripts do not turn every request into a write.
+func (r *personalTokensImpl) Touch(ctx context.Context, id int64) error {
+	_, err := r.db.ExecContext(ctx, `
+		UPDATE auth.personal_access_tokens
+		SET last_used_at = NOW()
+		WHERE id = $1 AND (last_used_at IS NULL OR last_used_at < NOW() - INTERVAL '1 minute')
+	`, id)
+	return err
+}
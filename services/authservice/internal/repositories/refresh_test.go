@@ -0,0 +1,180 @@
+package repositories
+
+import (
+	"context"
+	"database/sql"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+
+	"bioly/auth/internal/types"
+)
+
+func TestRefresh_Create_Success(t *testing.T) {
+	db, mock := newSQLMock(t)
+	repo := NewRefreshTokens(db)
+
+	rt := &types.RefreshToken{
+		UserID:    7,
+		JTI:       uuid.New(),
+		FamilyID:  uuid.New(),
+		TokenHash: "hash",
+		UserAgent: "UA",
+		IP:        "127.0.0.1",
+		ExpiresAt: time.Now().UTC().Add(time.Hour),
+	}
+	now := time.Now().UTC()
+	mock.ExpectQuery(regexp.QuoteMeta(insertRefreshQuery)).
+		WithArgs(rt.UserID, rt.JTI, rt.FamilyID, rt.TokenHash, rt.UserAgent, rt.IP, rt.ExpiresAt).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(int64(3), now))
+
+	err := repo.Create(context.Background(), rt)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), rt.ID)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRefresh_Create_DropsInvalidIP(t *testing.T) {
+	db, mock := newSQLMock(t)
+	repo := NewRefreshTokens(db)
+
+	rt := &types.RefreshToken{UserID: 7, JTI: uuid.New(), FamilyID: uuid.New(), TokenHash: "hash", IP: "unknown"}
+	mock.ExpectQuery(regexp.QuoteMeta(insertRefreshQuery)).
+		WithArgs(rt.UserID, rt.JTI, rt.FamilyID, rt.TokenHash, "", "", rt.ExpiresAt).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(int64(4), time.Now()))
+
+	assert.NoError(t, repo.Create(context.Background(), rt))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRefresh_Rotate_Success(t *testing.T) {
+	db, mock := newSQLMock(t)
+	repo := NewRefreshTokens(db)
+
+	oldJTI := uuid.New()
+	next := &types.RefreshToken{UserID: 7, JTI: uuid.New(), FamilyID: uuid.New(), TokenHash: "hash2"}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`WHERE jti = $1 AND revoked_at IS NULL`)).
+		WithArgs(oldJTI).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(regexp.QuoteMeta(insertRefreshQuery)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(int64(5), time.Now()))
+	mock.ExpectCommit()
+
+	assert.NoError(t, repo.Rotate(context.Background(), oldJTI, next))
+	assert.Equal(t, int64(5), next.ID)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRefresh_Rotate_AlreadyRevoked(t *testing.T) {
+	db, mock := newSQLMock(t)
+	repo := NewRefreshTokens(db)
+
+	oldJTI := uuid.New()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`WHERE jti = $1 AND revoked_at IS NULL`)).
+		WithArgs(oldJTI).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	err := repo.Rotate(context.Background(), oldJTI, &types.RefreshToken{})
+	assert.ErrorIs(t, err, ErrTokenReused)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRefresh_RevokeFamily(t *testing.T) {
+	db, mock := newSQLMock(t)
+	repo := NewRefreshTokens(db)
+
+	family := uuid.New()
+	mock.ExpectExec(regexp.QuoteMeta(`WHERE family_id = $1 AND revoked_at IS NULL`)).
+		WithArgs(family).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+
+	assert.NoError(t, repo.RevokeFamily(context.Background(), family))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRefresh_FindByJTI_NotFound(t *testing.T) {
+	db, mock := newSQLMock(t)
+	repo := NewRefreshTokens(db)
+
+	jti := uuid.New()
+	mock.ExpectQuery(regexp.QuoteMeta(`FROM auth.refresh_tokens`)).
+		WithArgs(jti).
+		WillReturnError(sql.ErrNoRows)
+
+	_, err := repo.FindByJTI(context.Background(), jti)
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRefresh_ListActiveByUser(t *testing.T) {
+	db, mock := newSQLMock(t)
+	repo := NewRefreshTokens(db)
+
+	now := time.Now().UTC()
+	rows := sqlmock.NewRows([]string{"jti", "family_id", "user_agent", "ip", "created_at", "last_used_at", "expires_at"}).
+		AddRow(uuid.New(), uuid.New(), "UA", "10.0.0.1", now.Add(-time.Hour), now, now.Add(time.Hour))
+	mock.ExpectQuery(regexp.QuoteMeta(`WHERE t.user_id = $1 AND t.revoked_at IS NULL AND t.expires_at > NOW()`)).
+		WithArgs(int64(7)).
+		WillReturnRows(rows)
+
+	sessions, err := repo.ListActiveByUser(context.Background(), 7)
+	assert.NoError(t, err)
+	if assert.Len(t, sessions, 1) {
+		assert.Equal(t, "UA", sessions[0].UserAgent)
+		assert.Equal(t, now, sessions[0].LastUsedAt)
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRefresh_RevokeSession_NotOwned(t *testing.T) {
+	db, mock := newSQLMock(t)
+	repo := NewRefreshTokens(db)
+
+	jti := uuid.New()
+	mock.ExpectExec(regexp.QuoteMeta(`SELECT family_id FROM auth.refresh_tokens WHERE jti = $1 AND user_id = $2`)).
+		WithArgs(jti, int64(7)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	err := repo.RevokeSession(context.Background(), 7, jti)
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRefresh_SessionActive(t *testing.T) {
+	db, mock := newSQLMock(t)
+	repo := NewRefreshTokens(db)
+
+	family := uuid.New()
+	mock.ExpectQuery(regexp.QuoteMeta(`WHERE family_id = $1 AND revoked_at IS NULL AND expires_at > NOW()`)).
+		WithArgs(family).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+
+	active, err := repo.SessionActive(context.Background(), family)
+	assert.NoError(t, err)
+	assert.False(t, active)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRefresh_Purge(t *testing.T) {
+	db, mock := newSQLMock(t)
+	repo := NewRefreshTokens(db)
+
+	before := time.Now().Add(-30 * 24 * time.Hour)
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM auth.refresh_tokens`)).
+		WithArgs(before, 500).
+		WillReturnResult(sqlmock.NewResult(0, 42))
+
+	n, err := repo.Purge(context.Background(), before, 500)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(42), n)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -1,39 +1,213 @@
 package repositories
 
 import (
+	"bioly/auth/internal/types"
 	"context"
+	"database/sql"
+	"errors"
+	"net"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/jmoiron/sqlx"
 )
 
 type RefreshTokens interface {
-	Create(ctx context.Context, userID int64, jti [16]byte, tokenHash, userAgent, ip string, expiresAt time.Time) error
-	RevokeByJTI(ctx context.Context, jti [16]byte) error
+	Create(ctx context.Context, t *types.RefreshToken) error
+	Rotate(ctx context.Context, oldJTI uuid.UUID, next *types.RefreshToken) error
+	RevokeByJTI(ctx context.Context, jti uuid.UUID) error
+	RevokeFamily(ctx context.Context, familyID uuid.UUID) error
 	RevokeAllByUser(ctx context.Context, userID int64) error
-	FindValidByJTI(ctx context.Context, jti [16]byte) (userID int64, tokenHash string, expiresAt time.Time, revoked bool, err error)
+	FindByJTI(ctx context.Context, jti uuid.UUID) (*types.RefreshToken, error)
+	ListActiveByUser(ctx context.Context, userID int64) ([]types.Session, error)
+	RevokeSession(ctx context.Context, userID int64, jti uuid.UUID) error
+	SessionActive(ctx context.Context, familyID uuid.UUID) (bool, error)
+	Purge(ctx context.Context, revokedBefore time.Time, limit int) (int64, error)
 }
 
 type refreshTokensImpl struct {
 	db *sqlx.DB
 }
 
-func NewRefreshTokens(db *sqlx.DB) *refreshTokensImpl {
+func NewRefreshTokens(db *sqlx.DB) RefreshTokens {
 	return &refreshTokensImpl{db: db}
 }
 
-func (r *refreshTokensImpl) Create(ctx context.Context, userID int64, jti [16]byte, tokenHash, userAgent, ip string, expiresAt time.Time) error {
-	return ErrNotImplemented
+const insertRefreshQuery = `
+		INSERT INTO auth.refresh_tokens (user_id, jti, family_id, token_hash, user_agent, ip, expires_at)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''), NULLIF($6, '')::inet, $7)
+		RETURNING id, created_at
+	`
+
+func (r *refreshTokensImpl) Create(ctx context.Context, t *types.RefreshToken) error {
+	return insertRefresh(ctx, r.db, t)
+}
+
+// Rotate revokes the token identified by oldJTI and stores next in a single
+// transaction. ErrTokenReused is returned when the old token was already
+// revoked, which means someone else rotated it first.
+func (r *refreshTokensImpl) Rotate(ctx context.Context, oldJTI uuid.UUID, next *types.RefreshToken) error {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `
+		UPDATE auth.refresh_tokens
+		SET revoked_at = NOW(), updated_at = NOW()
+		WHERE jti = $1 AND revoked_at IS NULL
+	`, oldJTI)
+	if err != nil {
+		return err
+	}
+	aff, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if aff == 0 {
+		return ErrTokenReused
+	}
+
+	if err := insertRefresh(ctx, tx, next); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
-func (r *refreshTokensImpl) RevokeByJTI(ctx context.Context, jti [16]byte) error {
-	return ErrNotImplemented
+func (r *refreshTokensImpl) RevokeByJTI(ctx context.Context, jti uuid.UUID) error {
+	_, err := r.db.ExecContext(ctx, `
+		UPDATE auth.refresh_tokens
+		SET revoked_at = NOW(), updated_at = NOW()
+		WHERE jti = $1 AND revoked_at IS NULL
+	`, jti)
+	return err
+}
+
+func (r *refreshTokensImpl) RevokeFamily(ctx context.Context, familyID uuid.UUID) error {
+	_, err := r.db.ExecContext(ctx, `
+		UPDATE auth.refresh_tokens
+		SET revoked_at = NOW(), updated_at = NOW()
+		WHERE family_id = $1 AND revoked_at IS NULL
+	`, familyID)
+	return err
 }
 
 func (r *refreshTokensImpl) RevokeAllByUser(ctx context.Context, userID int64) error {
-	return ErrNotImplemented
+	_, err := r.db.ExecContext(ctx, `
+		UPDATE auth.refresh_tokens
+		SET revoked_at = NOW(), updated_at = NOW()
+		WHERE user_id = $1 AND revoked_at IS NULL
+	`, userID)
+	return err
+}
+
+func (r *refreshTokensImpl) FindByJTI(ctx context.Context, jti uuid.UUID) (*types.RefreshToken, error) {
+	var t types.RefreshToken
+	err := r.db.GetContext(ctx, &t, `
+		SELECT id, user_id, jti, family_id, token_hash,
+		       COALESCE(user_agent, '') AS user_agent, COALESCE(host(ip), '') AS ip,
+		       expires_at, revoked_at, created_at
+		FROM auth.refresh_tokens
+		WHERE jti = $1
+	`, jti)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return &t, nil
+}
+
+// ListActiveByUser returns the live token of every family, newest first.
+// CreatedAt is the time of the original login, LastUsedAt the last refresh.
+func (r *refreshTokensImpl) ListActiveByUser(ctx context.Context, userID int64) ([]types.Session, error) {
+	sessions := []types.Session{}
+	err := r.db.SelectContext(ctx, &sessions, `
+		SELECT t.jti, t.family_id,
+		       COALESCE(t.user_agent, '') AS user_agent, COALESCE(host(t.ip), '') AS ip,
+		       (SELECT MIN(f.created_at) FROM auth.refresh_tokens f WHERE f.family_id = t.family_id) AS created_at,
+		       t.created_at AS last_used_at, t.expires_at
+		FROM auth.refresh_tokens t
+		WHERE t.user_id = $1 AND t.revoked_at IS NULL AND t.expires_at > NOW()
+		ORDER BY t.created_at DESC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// RevokeSession revokes the family that jti belongs to, provided it is owned
+// by userID. Any jti of the family works, so a session can be revoked even if
+// it was refreshed after the list was fetched.
+func (r *refreshTokensImpl) RevokeSession(ctx context.Context, userID int64, jti uuid.UUID) error {
+	res, err := r.db.ExecContext(ctx, `
+		UPDATE auth.refresh_tokens
+		SET revoked_at = NOW(), updated_at = NOW()
+		WHERE family_id = (
+			SELECT family_id FROM auth.refresh_tokens WHERE jti = $1 AND user_id = $2
+		) AND revoked_at IS NULL
+	`, jti, userID)
+	if err != nil {
+		return err
+	}
+	aff, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if aff == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// SessionActive reports whether the family still has a live token, i.e. the
+// login session was neither logged out, revoked nor left to expire.
+func (r *refreshTokensImpl) SessionActive(ctx context.Context, familyID uuid.UUID) (bool, error) {
+	var active bool
+	err := r.db.GetContext(ctx, &active, `
+		SELECT EXISTS (
+			SELECT 1 FROM auth.refresh_tokens
+			WHERE family_id = $1 AND revoked_at IS NULL AND expires_at > NOW()
+		)
+	`, familyID)
+	return active, err
+}
+
+// Purge deletes up to limit tokens that expired unrevoked or were revoked
+// before revokedBefore, and returns how many it removed. The first token of
+// a live session is kept because the session list reports its creation as
+// the login time.
+func (r *refreshTokensImpl) Purge(ctx context.Context, revokedBefore time.Time, limit int) (int64, error) {
+	res, err := r.db.ExecContext(ctx, `
+		DELETE FROM auth.refresh_tokens
+		WHERE id IN (
+			SELECT t.id FROM auth.refresh_tokens t
+			WHERE ((t.revoked_at IS NULL AND t.expires_at <= NOW()) OR t.revoked_at < $1)
+			  AND NOT (
+			    t.id = (SELECT MIN(f.id) FROM auth.refresh_tokens f WHERE f.family_id = t.family_id)
+			    AND EXISTS (
+			      SELECT 1 FROM auth.refresh_tokens l
+			      WHERE l.family_id = t.family_id AND l.revoked_at IS NULL AND l.expires_at > NOW()
+			    )
+			  )
+			LIMIT $2
+		)
+	`, revokedBefore, limit)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
 }
 
-func (r *refreshTokensImpl) FindValidByJTI(ctx context.Context, jti [16]byte) (userID int64, tokenHash string, expiresAt time.Time, revoked bool, err error) {
-	return 0, "", time.Time{}, false, ErrNotImplemented
+func insertRefresh(ctx context.Context, q sqlx.QueryerContext, t *types.RefreshToken) error {
+	ip := t.IP
+	if net.ParseIP(ip) == nil {
+		ip = ""
+	}
+	return q.QueryRowxContext(ctx, insertRefreshQuery,
+		t.UserID, t.JTI, t.FamilyID, t.TokenHash, t.UserAgent, ip, t.ExpiresAt,
+	).Scan(&t.ID, &t.CreatedAt)
 }
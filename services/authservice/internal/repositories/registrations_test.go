@@ -0,0 +1,101 @@
+package repositories
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+
+	"bioly/auth/internal/types"
+)
+
+func TestRegistrations_AddUser(t *testing.T) {
+	db, mock := newSQLMock(t)
+	repo := NewRegistrations(db)
+	now := time.Now()
+	challenge := uuid.New()
+
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM auth.spent_challenges`)).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO auth.spent_challenges (challenge_id, expires_at)`)).
+		WithArgs(challenge, now).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`SET uses = uses + 1`)).
+		WithArgs("invitehash").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO auth.users (username, email, password_hash, username_skeleton)`)).
+		WithArgs("mina", nil, "hash", "mlna", DefaultRole).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at", "updated_at"}).AddRow(int64(9), now, now))
+	mock.ExpectCommit()
+
+	u := &types.User{Username: "mina", PasswordHash: "hash"}
+	assert.NoError(t, repo.AddUser(context.Background(), u, challenge, now, "invitehash"))
+	assert.Equal(t, int64(9), u.ID)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRegistrations_AddUserRefused(t *testing.T) {
+	db, mock := newSQLMock(t)
+	repo := NewRegistrations(db)
+	now := time.Now()
+	challenge := uuid.New()
+
+	// The challenge was spent already.
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM auth.spent_challenges`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO auth.spent_challenges`)).
+		WithArgs(challenge, now).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	// The invite is used up.
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM auth.spent_challenges`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO auth.spent_challenges`)).
+		WithArgs(challenge, now).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`WHERE code_hash = $1 AND uses < max_uses`)).
+		WithArgs("invitehash").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	u := &types.User{Username: "mina", PasswordHash: "hash"}
+	assert.ErrorIs(t, repo.AddUser(context.Background(), u, challenge, now, ""), ErrInvalidChallenge)
+	assert.ErrorIs(t, repo.AddUser(context.Background(), u, challenge, now, "invitehash"), ErrInvalidInvite)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRegistrations_AddUserSpendsChallengeOnFailure(t *testing.T) {
+	db, mock := newSQLMock(t)
+	repo := NewRegistrations(db)
+	now := time.Now()
+	challenge := uuid.New()
+
+	// The spend is not rolled back with the insert, so retrying with the
+	// same challenge is refused.
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM auth.spent_challenges`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO auth.spent_challenges`)).
+		WithArgs(challenge, now).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO auth.users`)).
+		WillReturnError(&pq.Error{Code: "23505", Constraint: "users_email_lower_uidx"})
+	mock.ExpectRollback()
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM auth.spent_challenges`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO auth.spent_challenges`)).
+		WithArgs(challenge, now).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	u := &types.User{Username: "mina", PasswordHash: "hash"}
+	assert.ErrorIs(t, repo.AddUser(context.Background(), u, challenge, now, ""), ErrDuplicateEmail)
+	assert.ErrorIs(t, repo.AddUser(context.Background(), u, challenge, now, ""), ErrInvalidChallenge)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,97 @@
+package repositories
+
+import (
+	"bioly/auth/internal/types"
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+)
+
+type Registrations interface {
+	CreateInvite(ctx context.Context, inv *types.Invite) error
+	AddUser(ctx context.Context, u *types.User, challengeID uuid.UUID, challengeExpires time.Time, inviteHash string) error
+}
+
+type registrationsImpl struct {
+	db *sqlx.DB
+}
+
+func NewRegistrations(db *sqlx.DB) Registrations {
+	return &registrationsImpl{db: db}
+}
+
+func (r *registrationsImpl) CreateInvite(ctx context.Context, inv *types.Invite) error {
+	return r.db.QueryRowxContext(ctx, `
+		INSERT INTO auth.invites (code_hash, created_by, max_uses, expires_at)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at
+	`, inv.CodeHash, inv.CreatedBy, inv.MaxUses, inv.ExpiresAt).Scan(&inv.ID, &inv.CreatedAt)
+}
+
+// AddUser creates u, like Users.Add, for a self-service sign up. The
+// challenge is spent first, in its own statement, so every attempt costs a
+// fresh one whatever its outcome. One use of the invite, when inviteHash is
+// set, is taken in the same transaction as the insert, so a failed sign up
+// does not cost it. ErrInvalidChallenge is returned for a challenge that was
+// used before and ErrInvalidInvite for an unknown, used up or expired
+// invite.
+func (r *registrationsImpl) AddUser(ctx context.Context, u *types.User, challengeID uuid.UUID, challengeExpires time.Time, inviteHash string) error {
+	if err := spendChallenge(ctx, r.db, challengeID, challengeExpires); err != nil {
+		return err
+	}
+
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if inviteHash != "" {
+		res, err := tx.ExecContext(ctx, `
+			UPDATE auth.invites
+			SET uses = uses + 1
+			WHERE code_hash = $1 AND uses < max_uses AND (expires_at IS NULL OR expires_at > NOW())
+		`, inviteHash)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return ErrInvalidInvite
+		}
+	}
+
+	if err := insertUser(ctx, tx, u); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// spendChallenge records challengeID in auth.spent_challenges until it
+// expires. ErrInvalidChallenge means it was spent before.
+func spendChallenge(ctx context.Context, db sqlx.ExecerContext, challengeID uuid.UUID, expiresAt time.Time) error {
+	// Spent challenges are only needed until they expire.
+	if _, err := db.ExecContext(ctx, `
+		DELETE FROM auth.spent_challenges
+		WHERE expires_at < NOW()
+	`); err != nil {
+		return err
+	}
+	res, err := db.ExecContext(ctx, `
+		INSERT INTO auth.spent_challenges (challenge_id, expires_at)
+		VALUES ($1, $2)
+		ON CONFLICT (challenge_id) DO NOTHING
+	`, challengeID, expiresAt)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrInvalidChallenge
+	}
+	return nil
+}
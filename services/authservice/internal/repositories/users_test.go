@@ -9,11 +9,13 @@ import (
 
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/alexedwards/argon2id"
+	"github.com/google/uuid"
 	"github.com/jmoiron/sqlx"
 	"github.com/lib/pq"
 	"github.com/stretchr/testify/assert"
 
 	"bioly/auth/internal/types"
+	"bioly/usernames"
 )
 
 func TestUsers_Add_Success(t *testing.T) {
@@ -29,16 +31,19 @@ func TestUsers_Add_Success(t *testing.T) {
 	u := &types.User{Username: "admin", PasswordHash: "$argon2id$v=19$m=65536,t=3,p=2$SALT$HASH"}
 
 	q := regexp.QuoteMeta(`
-		INSERT INTO auth.users (username, password_hash)
-		VALUES ($1, $2)
-		RETURNING id, created_at, updated_at
-	`)
+			INSERT INTO auth.users (username, email, password_hash, username_skeleton)
+			VALUES ($1, $2, $3, $4)
+			RETURNING id, created_at, updated_at
+		), r AS (
+			INSERT INTO auth.user_roles (user_id, role)
+			SELECT id, $5 FROM u
+		)`)
 	now := time.Now().UTC()
 	rows := sqlmock.NewRows([]string{"id", "created_at", "updated_at"}).
 		AddRow(int64(1), now, now)
 
 	mock.ExpectQuery(q).
-		WithArgs(u.Username, u.PasswordHash).
+		WithArgs(u.Username, nil, u.PasswordHash, usernames.Skeleton(u.Username), DefaultRole).
 		WillReturnRows(rows)
 
 	err = repo.Add(context.Background(), u)
@@ -62,12 +67,15 @@ func TestUsers_Add_Duplicate(t *testing.T) {
 	u := &types.User{Username: "admin", PasswordHash: "hash"}
 
 	q := regexp.QuoteMeta(`
-		INSERT INTO auth.users (username, password_hash)
-		VALUES ($1, $2)
-		RETURNING id, created_at, updated_at
-	`)
+			INSERT INTO auth.users (username, email, password_hash, username_skeleton)
+			VALUES ($1, $2, $3, $4)
+			RETURNING id, created_at, updated_at
+		), r AS (
+			INSERT INTO auth.user_roles (user_id, role)
+			SELECT id, $5 FROM u
+		)`)
 	mock.ExpectQuery(q).
-		WithArgs(u.Username, u.PasswordHash).
+		WithArgs(u.Username, nil, u.PasswordHash, usernames.Skeleton(u.Username), DefaultRole).
 		WillReturnError(&pq.Error{Code: "23505"})
 
 	err = repo.Add(context.Background(), u)
@@ -76,6 +84,20 @@ func TestUsers_Add_Duplicate(t *testing.T) {
 	assert.NoError(t, mock.ExpectationsWereMet())
 }
 
+func TestUsers_Add_LookAlike(t *testing.T) {
+	xdb, mock := newSQLMock(t)
+	repo := NewUsers(xdb)
+
+	u := &types.User{Username: "al1ce", PasswordHash: "hash"}
+	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO auth.users`)).
+		WithArgs("al1ce", nil, "hash", "allce", DefaultRole).
+		WillReturnError(&pq.Error{Code: "23505", Constraint: "users_username_skeleton_uidx"})
+
+	err := repo.Add(context.Background(), u)
+	assert.ErrorIs(t, err, ErrDuplicateUsername, "looks like alice")
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
 func TestUsers_Delete_Success(t *testing.T) {
 	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
 	assert.NoError(t, err)
@@ -131,14 +153,14 @@ func TestUsers_VerifyCredentials_Success(t *testing.T) {
 	assert.NoError(t, herr)
 
 	sel := regexp.QuoteMeta(`
-		SELECT id, username, password_hash, last_login_at, created_at, updated_at
+		SELECT id, username, email, email_verified_at, password_hash, last_login_at, locked_until, created_at, updated_at
 		FROM auth.users
 		WHERE lower(username) = lower($1)
 		LIMIT 1
 	`)
 	now := time.Now().UTC()
-	rows := sqlmock.NewRows([]string{"id", "username", "password_hash", "last_login_at", "created_at", "updated_at"}).
-		AddRow(int64(7), "Admin", hash, sql.NullTime{}, now, now)
+	rows := sqlmock.NewRows([]string{"id", "username", "password_hash", "last_login_at", "locked_until", "created_at", "updated_at"}).
+		AddRow(int64(7), "Admin", hash, sql.NullTime{}, sql.NullTime{}, now, now)
 
 	mock.ExpectQuery(sel).
 		WithArgs("admin").
@@ -146,7 +168,7 @@ func TestUsers_VerifyCredentials_Success(t *testing.T) {
 
 	upd := regexp.QuoteMeta(`
 		UPDATE auth.users
-		SET last_login_at = NOW(), updated_at = NOW()
+		SET last_login_at = NOW(), updated_at = NOW(), failed_login_count = 0, locked_until = NULL
 		WHERE id = $1
 	`)
 	mock.ExpectExec(upd).
@@ -174,14 +196,14 @@ func TestUsers_VerifyCredentials_InvalidPassword(t *testing.T) {
 	assert.NoError(t, herr)
 
 	sel := regexp.QuoteMeta(`
-		SELECT id, username, password_hash, last_login_at, created_at, updated_at
+		SELECT id, username, email, email_verified_at, password_hash, last_login_at, locked_until, created_at, updated_at
 		FROM auth.users
 		WHERE lower(username) = lower($1)
 		LIMIT 1
 	`)
 	now := time.Now().UTC()
-	rows := sqlmock.NewRows([]string{"id", "username", "password_hash", "last_login_at", "created_at", "updated_at"}).
-		AddRow(int64(3), "user", hash, sql.NullTime{}, now, now)
+	rows := sqlmock.NewRows([]string{"id", "username", "password_hash", "last_login_at", "locked_until", "created_at", "updated_at"}).
+		AddRow(int64(3), "user", hash, sql.NullTime{}, sql.NullTime{}, now, now)
 
 	mock.ExpectQuery(sel).
 		WithArgs("user").
@@ -204,7 +226,7 @@ func TestUsers_VerifyCredentials_NoUser(t *testing.T) {
 	repo := NewUsers(xdb)
 
 	sel := regexp.QuoteMeta(`
-		SELECT id, username, password_hash, last_login_at, created_at, updated_at
+		SELECT id, username, email, email_verified_at, password_hash, last_login_at, locked_until, created_at, updated_at
 		FROM auth.users
 		WHERE lower(username) = lower($1)
 		LIMIT 1
@@ -218,3 +240,360 @@ func TestUsers_VerifyCredentials_NoUser(t *testing.T) {
 	assert.ErrorIs(t, err, ErrInvalidCredentials)
 	assert.NoError(t, mock.ExpectationsWereMet())
 }
+
+func TestUsers_VerifyCredentials_Locked(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
+	assert.NoError(t, err)
+	defer db.Close()
+
+	xdb := sqlx.NewDb(db, "sqlmock")
+	defer xdb.Close()
+
+	repo := NewUsers(xdb)
+
+	now := time.Now().UTC()
+	until := now.Add(10 * time.Minute)
+	rows := sqlmock.NewRows([]string{"id", "username", "password_hash", "last_login_at", "locked_until", "created_at", "updated_at"}).
+		AddRow(int64(3), "user", "irrelevant", sql.NullTime{}, until, now, now)
+
+	mock.ExpectQuery(regexp.QuoteMeta(`FROM auth.users`)).
+		WithArgs("user").
+		WillReturnRows(rows)
+
+	_, err = repo.VerifyCredentials(context.Background(), "user", "secret")
+	assert.ErrorIs(t, err, ErrAccountLocked)
+	var locked *LockedError
+	if assert.ErrorAs(t, err, &locked) {
+		assert.WithinDuration(t, until, locked.Until, time.Second)
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestUsers_RegisterFailedLogin(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
+	assert.NoError(t, err)
+	defer db.Close()
+
+	xdb := sqlx.NewDb(db, "sqlmock")
+	defer xdb.Close()
+
+	repo := NewUsers(xdb)
+
+	mock.ExpectExec(regexp.QuoteMeta(`SET failed_login_count = CASE WHEN failed_login_count + 1 >= $2`)).
+		WithArgs("user", 5, float64(900)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	err = repo.RegisterFailedLogin(context.Background(), "user", 5, 15*time.Minute)
+	assert.NoError(t, err)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestLoginFailures_Store(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
+	assert.NoError(t, err)
+	defer db.Close()
+
+	xdb := sqlx.NewDb(db, "sqlmock")
+	defer xdb.Close()
+
+	store := NewLoginFailures(xdb)
+	at := time.Now().UTC()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM auth.login_failures WHERE key = $1 AND failed_at <= $2`)).
+		WithArgs("user:bob", at.Add(-time.Minute)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO auth.login_failures (key, failed_at) VALUES ($1, $2)`)).
+		WithArgs("user:bob", at).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	assert.NoError(t, store.Add(context.Background(), "user:bob", at, time.Minute))
+
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT COUNT(*) AS count, MAX(failed_at) AS last`)).
+		WithArgs("user:bob", at.Add(-time.Minute)).
+		WillReturnRows(sqlmock.NewRows([]string{"count", "last"}).AddRow(1, at))
+	n, last, err := store.Since(context.Background(), "user:bob", at.Add(-time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, at, last)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestUsers_UpdatePasswordHash(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
+	assert.NoError(t, err)
+	defer db.Close()
+
+	xdb := sqlx.NewDb(db, "sqlmock")
+	defer xdb.Close()
+
+	repo := NewUsers(xdb)
+
+	q := regexp.QuoteMeta(`SET password_hash = $2, updated_at = NOW()`)
+	mock.ExpectExec(q).
+		WithArgs(int64(7), "$argon2id$new").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(q).
+		WithArgs(int64(8), "$argon2id$new").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	assert.NoError(t, repo.UpdatePasswordHash(context.Background(), 7, "$argon2id$new"))
+	assert.ErrorIs(t, repo.UpdatePasswordHash(context.Background(), 8, "$argon2id$new"), ErrNotFound)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestUsers_Add_DuplicateEmail(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
+	assert.NoError(t, err)
+	defer db.Close()
+
+	xdb := sqlx.NewDb(db, "sqlmock")
+	defer xdb.Close()
+
+	repo := NewUsers(xdb)
+
+	email := "admin@example.com"
+	u := &types.User{Username: "admin", Email: &email, PasswordHash: "hash"}
+
+	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO auth.users (username, email, password_hash, username_skeleton)`)).
+		WithArgs(u.Username, email, u.PasswordHash, usernames.Skeleton(u.Username), DefaultRole).
+		WillReturnError(&pq.Error{Code: "23505", Constraint: "users_email_lower_uidx"})
+
+	err = repo.Add(context.Background(), u)
+	assert.ErrorIs(t, err, ErrDuplicateEmail)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestUsers_MarkEmailVerified(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
+	assert.NoError(t, err)
+	defer db.Close()
+
+	xdb := sqlx.NewDb(db, "sqlmock")
+	defer xdb.Close()
+
+	repo := NewUsers(xdb)
+
+	q := regexp.QuoteMeta(`WHERE id = $1 AND lower(email) = lower($2)`)
+	mock.ExpectExec(q).
+		WithArgs(int64(7), "bob@example.com").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(q).
+		WithArgs(int64(7), "old@example.com").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	assert.NoError(t, repo.MarkEmailVerified(context.Background(), 7, "bob@example.com"))
+	assert.ErrorIs(t, repo.MarkEmailVerified(context.Background(), 7, "old@example.com"), ErrNotFound)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestUsers_GetByEmail(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
+	assert.NoError(t, err)
+	defer db.Close()
+
+	xdb := sqlx.NewDb(db, "sqlmock")
+	defer xdb.Close()
+
+	repo := NewUsers(xdb)
+
+	now := time.Now()
+	q := regexp.QuoteMeta(`WHERE lower(email) = lower($1)`)
+	mock.ExpectQuery(q).
+		WithArgs("Bob@Example.com").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "username", "email", "email_verified_at", "password_hash", "last_login_at", "created_at", "updated_at"}).
+			AddRow(int64(7), "bob", "bob@example.com", now, "hash", nil, now, now))
+	mock.ExpectQuery(q).
+		WithArgs("nobody@example.com").
+		WillReturnError(sql.ErrNoRows)
+
+	u, err := repo.GetByEmail(context.Background(), "Bob@Example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(7), u.ID)
+	assert.Equal(t, "bob@example.com", *u.Email)
+	_, err = repo.GetByEmail(context.Background(), "nobody@example.com")
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestUsers_GetRoles(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
+	assert.NoError(t, err)
+	defer db.Close()
+
+	xdb := sqlx.NewDb(db, "sqlmock")
+	defer xdb.Close()
+
+	repo := NewUsers(xdb)
+
+	mock.ExpectQuery(regexp.QuoteMeta(`FROM auth.user_roles`)).
+		WithArgs(int64(7)).
+		WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow("admin").AddRow("user"))
+
+	roles, err := repo.GetRoles(context.Background(), 7)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"admin", "user"}, roles)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestUsers_ChangePassword(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
+	assert.NoError(t, err)
+	defer db.Close()
+
+	xdb := sqlx.NewDb(db, "sqlmock")
+	defer xdb.Close()
+
+	repo := NewUsers(xdb)
+
+	next := &types.RefreshToken{
+		UserID:    7,
+		JTI:       uuid.New(),
+		FamilyID:  uuid.New(),
+		TokenHash: "hash",
+		ExpiresAt: time.Now().Add(time.Hour),
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`SET password_hash = $2, updated_at = NOW()`)).
+		WithArgs(int64(7), "$argon2id$new").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`WHERE user_id = $1 AND revoked_at IS NULL`)).
+		WithArgs(int64(7)).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO auth.refresh_tokens`)).
+		WithArgs(int64(7), next.JTI, next.FamilyID, "hash", "", "", next.ExpiresAt).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(int64(1), time.Now()))
+	mock.ExpectCommit()
+
+	assert.NoError(t, repo.ChangePassword(context.Background(), 7, "$argon2id$new", next))
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestUsers_ChangePassword_NotFound(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
+	assert.NoError(t, err)
+	defer db.Close()
+
+	xdb := sqlx.NewDb(db, "sqlmock")
+	defer xdb.Close()
+
+	repo := NewUsers(xdb)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`SET password_hash = $2, updated_at = NOW()`)).
+		WithArgs(int64(7), "$argon2id$new").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	err = repo.ChangePassword(context.Background(), 7, "$argon2id$new", &types.RefreshToken{UserID: 7})
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestUsers_ChangeUsername(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
+	assert.NoError(t, err)
+	defer db.Close()
+
+	xdb := sqlx.NewDb(db, "sqlmock")
+	defer xdb.Close()
+
+	repo := NewUsers(xdb)
+	since := time.Now().Add(-90 * 24 * time.Hour)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT username FROM auth.users WHERE id = $1 FOR UPDATE`)).
+		WithArgs(int64(7)).
+		WillReturnRows(sqlmock.NewRows([]string{"username"}).AddRow("bob"))
+	mock.ExpectQuery(regexp.QuoteMeta(`FROM auth.username_history`)).
+		WithArgs("robert", since, int64(7)).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectExec(regexp.QuoteMeta(`SET username = $2, username_skeleton = $3, updated_at = NOW()`)).
+		WithArgs(int64(7), "robert", "robert").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO auth.username_history (user_id, old_username)`)).
+		WithArgs(int64(7), "bob").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	old, err := repo.ChangeUsername(context.Background(), 7, "robert", since)
+	assert.NoError(t, err)
+	assert.Equal(t, "bob", old)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestUsers_ChangeUsername_Reserved(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
+	assert.NoError(t, err)
+	defer db.Close()
+
+	xdb := sqlx.NewDb(db, "sqlmock")
+	defer xdb.Close()
+
+	repo := NewUsers(xdb)
+	since := time.Now().Add(-90 * 24 * time.Hour)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`FOR UPDATE`)).
+		WithArgs(int64(7)).
+		WillReturnRows(sqlmock.NewRows([]string{"username"}).AddRow("bob"))
+	mock.ExpectQuery(regexp.QuoteMeta(`FROM auth.username_history`)).
+		WithArgs("alice", since, int64(7)).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+	mock.ExpectRollback()
+
+	_, err = repo.ChangeUsername(context.Background(), 7, "alice", since)
+	assert.ErrorIs(t, err, ErrUsernameReserved)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestUsers_ChangeUsername_Duplicate(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
+	assert.NoError(t, err)
+	defer db.Close()
+
+	xdb := sqlx.NewDb(db, "sqlmock")
+	defer xdb.Close()
+
+	repo := NewUsers(xdb)
+	since := time.Now()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`FOR UPDATE`)).
+		WithArgs(int64(7)).
+		WillReturnRows(sqlmock.NewRows([]string{"username"}).AddRow("bob"))
+	mock.ExpectQuery(regexp.QuoteMeta(`FROM auth.username_history`)).
+		WithArgs("admin", since, int64(7)).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+	mock.ExpectExec(regexp.QuoteMeta(`SET username = $2, username_skeleton = $3, updated_at = NOW()`)).
+		WithArgs(int64(7), "admin", "admln").
+		WillReturnError(&pq.Error{Code: "23505"})
+	mock.ExpectRollback()
+
+	_, err = repo.ChangeUsername(context.Background(), 7, "admin", since)
+	assert.ErrorIs(t, err, ErrDuplicateUsername)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestUsers_UsernameReserved(t *testing.T) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherRegexp))
+	assert.NoError(t, err)
+	defer db.Close()
+
+	xdb := sqlx.NewDb(db, "sqlmock")
+	defer xdb.Close()
+
+	repo := NewUsers(xdb)
+	since := time.Now()
+
+	mock.ExpectQuery(regexp.QuoteMeta(`WHERE lower(old_username) = lower($1) AND changed_at > $2 AND user_id <> $3`)).
+		WithArgs("bob", since, 0).
+		WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+
+	reserved, err := repo.UsernameReserved(context.Background(), "bob", since)
+	assert.NoError(t, err)
+	assert.True(t, reserved)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
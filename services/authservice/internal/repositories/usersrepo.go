@@ -2,7 +2,9 @@ package repositories
 
 import (
 	"bioly/auth/internal/types"
+	"bioly/usernames"
 	"context"
+	"database/sql"
 	"errors"
 	"time"
 
@@ -14,14 +16,51 @@ import (
 var ErrInvalidCredentials = errors.New("invalid credentials")
 var ErrNotImplemented = errors.New("not implemented")
 var ErrDuplicateUsername = errors.New("username already exists")
+var ErrInvalidUsername = errors.New("invalid username")
+var ErrUsernameReserved = errors.New("username is reserved")
+var ErrDuplicateEmail = errors.New("email already in use")
+var ErrInvalidEmail = errors.New("invalid email address")
 var ErrNotFound = errors.New("not found")
+var ErrInvalidToken = errors.New("invalid token")
+var ErrTokenReused = errors.New("refresh token reused")
+var ErrAccountLocked = errors.New("account temporarily locked")
+var ErrInvalidScope = errors.New("invalid scope")
+var ErrInvalidExpiry = errors.New("invalid expiry")
+var ErrTooManyTokens = errors.New("too many tokens")
+var ErrInvalidChallenge = errors.New("invalid or already used challenge")
+var ErrInvalidInvite = errors.New("invalid invite code")
+var ErrDuplicateCredential = errors.New("passkey already registered")
+var ErrInvalidPasskey = errors.New("passkey verification failed")
+var ErrSignCountMismatch = errors.New("authenticator signature counter did not increase")
+var ErrLinkUsed = errors.New("login link already used")
+
+// LockedError is returned by VerifyCredentials while an account is locked.
+type LockedError struct {
+	Until time.Time
+}
+
+func (e *LockedError) Error() string { return ErrAccountLocked.Error() }
+func (e *LockedError) Unwrap() error { return ErrAccountLocked }
 
 type Users interface {
 	Add(ctx context.Context, u *types.User) error
 	Delete(ctx context.Context, id int64) error
+	GetByID(ctx context.Context, id int64) (*types.User, error)
+	GetByUsername(ctx context.Context, username string) (*types.User, error)
+	GetByEmail(ctx context.Context, email string) (*types.User, error)
 	VerifyCredentials(ctx context.Context, username, password string) (*types.User, error)
+	RegisterFailedLogin(ctx context.Context, username string, threshold int, lockout time.Duration) error
+	UpdatePasswordHash(ctx context.Context, id int64, hash string) error
+	MarkEmailVerified(ctx context.Context, id int64, email string) error
+	GetRoles(ctx context.Context, id int64) ([]string, error)
+	ChangePassword(ctx context.Context, id int64, hash string, next *types.RefreshToken) error
+	ChangeUsername(ctx context.Context, id int64, username string, reservedSince time.Time) (string, error)
+	UsernameReserved(ctx context.Context, username string, reservedSince time.Time) (bool, error)
 }
 
+// DefaultRole is granted to every user created through Add.
+const DefaultRole = "user"
+
 type usersImpl struct {
 	db *sqlx.DB
 }
@@ -30,21 +69,20 @@ func NewUsers(db *sqlx.DB) Users {
 	return &usersImpl{db: db}
 }
 
-func (r *usersImpl) Add(ctx context.Context, u *types.User) error {
-	q := `
-		INSERT INTO auth.users (username, password_hash)
-		VALUES ($1, $2)
-		RETURNING id, created_at, updated_at
+const insertUserQuery = `
+		WITH u AS (
+			INSERT INTO auth.users (username, email, password_hash, username_skeleton)
+			VALUES ($1, $2, $3, $4)
+			RETURNING id, created_at, updated_at
+		), r AS (
+			INSERT INTO auth.user_roles (user_id, role)
+			SELECT id, $5 FROM u
+		)
+		SELECT id, created_at, updated_at FROM u
 	`
-	err := r.db.QueryRowxContext(ctx, q, u.Username, u.PasswordHash).Scan(&u.ID, &u.CreatedAt, &u.UpdatedAt)
-	if err != nil {
-		var pqErr *pq.Error
-		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
-			return ErrDuplicateUsername
-		}
-		return err
-	}
-	return nil
+
+func (r *usersImpl) Add(ctx context.Context, u *types.User) error {
+	return insertUser(ctx, r.db, u)
 }
 
 func (r *usersImpl) Delete(ctx context.Context, id int64) error {
@@ -62,10 +100,58 @@ func (r *usersImpl) Delete(ctx context.Context, id int64) error {
 	return nil
 }
 
+func (r *usersImpl) GetByID(ctx context.Context, id int64) (*types.User, error) {
+	var u types.User
+	err := r.db.GetContext(ctx, &u, `
+		SELECT id, username, email, email_verified_at, password_hash, last_login_at, created_at, updated_at
+		FROM auth.users
+		WHERE id = $1
+	`, id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return &u, nil
+}
+
+func (r *usersImpl) GetByUsername(ctx context.Context, username string) (*types.User, error) {
+	var u types.User
+	err := r.db.GetContext(ctx, &u, `
+		SELECT id, username, email, email_verified_at, password_hash, last_login_at, created_at, updated_at
+		FROM auth.users
+		WHERE lower(username) = lower($1)
+	`, username)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return &u, nil
+}
+
+func (r *usersImpl) GetByEmail(ctx context.Context, email string) (*types.User, error) {
+	var u types.User
+	err := r.db.GetContext(ctx, &u, `
+		SELECT id, username, email, email_verified_at, password_hash, last_login_at, created_at, updated_at
+		FROM auth.users
+		WHERE lower(email) = lower($1)
+	`, email)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return &u, nil
+}
+
 func (r *usersImpl) VerifyCredentials(ctx context.Context, username, password string) (*types.User, error) {
 	var u types.User
 	err := r.db.GetContext(ctx, &u, `
-		SELECT id, username, password_hash, last_login_at, created_at, updated_at
+		SELECT id, username, email, email_verified_at, password_hash, last_login_at, locked_until, created_at, updated_at
 		FROM auth.users
 		WHERE lower(username) = lower($1)
 		LIMIT 1
@@ -73,16 +159,214 @@ func (r *usersImpl) VerifyCredentials(ctx context.Context, username, password st
 	if err != nil {
 		return nil, ErrInvalidCredentials
 	}
+	if u.LockedUntil != nil && u.LockedUntil.After(time.Now()) {
+		return nil, &LockedError{Until: *u.LockedUntil}
+	}
 	ok, err := argon2id.ComparePasswordAndHash(password, u.PasswordHash)
 	if err != nil || !ok {
 		return nil, ErrInvalidCredentials
 	}
 	_, _ = r.db.ExecContext(ctx, `
 		UPDATE auth.users
-		SET last_login_at = NOW(), updated_at = NOW()
+		SET last_login_at = NOW(), updated_at = NOW(), failed_login_count = 0, locked_until = NULL
 		WHERE id = $1
 	`, u.ID)
 	now := time.Now().UTC()
 	u.LastLoginAt = &now
+	u.LockedUntil = nil
 	return &u, nil
 }
+
+// RegisterFailedLogin counts a wrong password for username. The threshold-th
+// failure in a row locks the account for lockout and resets the counter.
+// Unknown usernames are ignored.
+func (r *usersImpl) RegisterFailedLogin(ctx context.Context, username string, threshold int, lockout time.Duration) error {
+	_, err := r.db.ExecContext(ctx, `
+		UPDATE auth.users
+		SET failed_login_count = CASE WHEN failed_login_count + 1 >= $2 THEN 0 ELSE failed_login_count + 1 END,
+		    locked_until = CASE WHEN failed_login_count + 1 >= $2 THEN NOW() + make_interval(secs => $3) ELSE locked_until END
+		WHERE lower(username) = lower($1)
+	`, username, threshold, lockout.Seconds())
+	return err
+}
+
+func (r *usersImpl) UpdatePasswordHash(ctx context.Context, id int64, hash string) error {
+	res, err := r.db.ExecContext(ctx, `
+		UPDATE auth.users
+		SET password_hash = $2, updated_at = NOW()
+		WHERE id = $1
+	`, id, hash)
+	if err != nil {
+		return err
+	}
+	aff, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if aff == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ChangePassword stores a new password hash and revokes every refresh token
+// of user id in a single transaction, then stores next. next belongs to the
+// caller's own token family, so only that session survives the change.
+func (r *usersImpl) ChangePassword(ctx context.Context, id int64, hash string, next *types.RefreshToken) error {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `
+		UPDATE auth.users
+		SET password_hash = $2, updated_at = NOW()
+		WHERE id = $1
+	`, id, hash)
+	if err != nil {
+		return err
+	}
+	aff, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if aff == 0 {
+		return ErrNotFound
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE auth.refresh_tokens
+		SET revoked_at = NOW(), updated_at = NOW()
+		WHERE user_id = $1 AND revoked_at IS NULL
+	`, id); err != nil {
+		return err
+	}
+
+	if err := insertRefresh(ctx, tx, next); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// usernameReservedQuery finds renames away from $1 after $2 by anyone but
+// user $3, who may always take their own old name back.
+const usernameReservedQuery = `
+		SELECT EXISTS (
+			SELECT 1 FROM auth.username_history
+			WHERE lower(old_username) = lower($1) AND changed_at > $2 AND user_id <> $3
+		)
+	`
+
+// UsernameReserved reports whether username was given up by a rename after
+// reservedSince.
+func (r *usersImpl) UsernameReserved(ctx context.Context, username string, reservedSince time.Time) (bool, error) {
+	var reserved bool
+	err := r.db.GetContext(ctx, &reserved, usernameReservedQuery, username, reservedSince, 0)
+	return reserved, err
+}
+
+// ChangeUsername renames user id and records the previous name in the
+// history, returning it. Names another user gave up after reservedSince are
+// refused with ErrUsernameReserved.
+func (r *usersImpl) ChangeUsername(ctx context.Context, id int64, username string, reservedSince time.Time) (string, error) {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var old string
+	err = tx.GetContext(ctx, &old, `SELECT username FROM auth.users WHERE id = $1 FOR UPDATE`, id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", ErrNotFound
+		}
+		return "", err
+	}
+	if old == username {
+		return old, nil
+	}
+
+	var reserved bool
+	if err := tx.GetContext(ctx, &reserved, usernameReservedQuery, username, reservedSince, id); err != nil {
+		return "", err
+	}
+	if reserved {
+		return "", ErrUsernameReserved
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE auth.users
+		SET username = $2, username_skeleton = $3, updated_at = NOW()
+		WHERE id = $1
+	`, id, username, usernames.Skeleton(username)); err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			return "", ErrDuplicateUsername
+		}
+		return "", err
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO auth.username_history (user_id, old_username)
+		VALUES ($1, $2)
+	`, id, old); err != nil {
+		return "", err
+	}
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+	return old, nil
+}
+
+// MarkEmailVerified confirms the email of user id. It only succeeds while
+// the stored address still equals email, so a link sent for an old address
+// cannot verify a new one.
+func (r *usersImpl) MarkEmailVerified(ctx context.Context, id int64, email string) error {
+	res, err := r.db.ExecContext(ctx, `
+		UPDATE auth.users
+		SET email_verified_at = COALESCE(email_verified_at, NOW()), updated_at = NOW()
+		WHERE id = $1 AND lower(email) = lower($2)
+	`, id, email)
+	if err != nil {
+		return err
+	}
+	aff, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if aff == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *usersImpl) GetRoles(ctx context.Context, id int64) ([]string, error) {
+	roles := []string{}
+	err := r.db.SelectContext(ctx, &roles, `
+		SELECT role
+		FROM auth.user_roles
+		WHERE user_id = $1
+		ORDER BY role
+	`, id)
+	if err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
+func insertUser(ctx context.Context, q sqlx.QueryerContext, u *types.User) error {
+	err := q.QueryRowxContext(ctx, insertUserQuery, u.Username, u.Email, u.PasswordHash, usernames.Skeleton(u.Username), DefaultRole).Scan(&u.ID, &u.CreatedAt, &u.UpdatedAt)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			if pqErr.Constraint == "users_email_lower_uidx" {
+				return ErrDuplicateEmail
+			}
+			return ErrDuplicateUsername
+		}
+		return err
+	}
+	return nil
+}
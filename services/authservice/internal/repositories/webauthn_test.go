@@ -0,0 +1,108 @@
+package repositories
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+
+	"bioly/auth/internal/types"
+)
+
+var webAuthnColumns = []string{"id", "user_id", "credential_id", "public_key", "attestation_type", "aaguid", "transports",
+	"sign_count", "backup_eligible", "backup_state", "name", "last_used_at", "created_at"}
+
+func TestWebAuthnCredentials_Add(t *testing.T) {
+	db, mock := newSQLMock(t)
+	repo := NewWebAuthnCredentials(db)
+	q := regexp.QuoteMeta(`INSERT INTO auth.webauthn_credentials`)
+
+	c := &types.WebAuthnCredential{UserID: 3, CredentialID: []byte{1, 2}, PublicKey: []byte{3}, AttestationType: "none",
+		AAGUID: make([]byte, 16), Transports: pq.StringArray{"internal"}, SignCount: 1, Name: "Laptop"}
+	mock.ExpectQuery(q).
+		WithArgs(int64(3), c.CredentialID, c.PublicKey, "none", c.AAGUID, c.Transports, int64(1), false, false, "Laptop").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(int64(9), time.Now()))
+	mock.ExpectQuery(q).
+		WillReturnError(&pq.Error{Code: "23505"})
+
+	assert.NoError(t, repo.Add(context.Background(), c))
+	assert.Equal(t, int64(9), c.ID)
+	assert.ErrorIs(t, repo.Add(context.Background(), c), ErrDuplicateCredential)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestWebAuthnCredentials_FindByCredentialID(t *testing.T) {
+	db, mock := newSQLMock(t)
+	repo := NewWebAuthnCredentials(db)
+	q := regexp.QuoteMeta(`WHERE credential_id = $1`)
+
+	mock.ExpectQuery(q).
+		WithArgs([]byte{1, 2}).
+		WillReturnRows(sqlmock.NewRows(webAuthnColumns).
+			AddRow(int64(9), int64(3), []byte{1, 2}, []byte{3}, "none", make([]byte, 16), "{usb,nfc}", int64(7), true, false, "Key", nil, time.Now()))
+	mock.ExpectQuery(q).
+		WithArgs([]byte{4}).
+		WillReturnRows(sqlmock.NewRows(webAuthnColumns))
+
+	c, err := repo.FindByCredentialID(context.Background(), []byte{1, 2})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), c.UserID)
+	assert.Equal(t, pq.StringArray{"usb", "nfc"}, c.Transports)
+	assert.Equal(t, int64(7), c.SignCount)
+	assert.True(t, c.BackupEligible)
+
+	_, err = repo.FindByCredentialID(context.Background(), []byte{4})
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestWebAuthnCredentials_ListByUser(t *testing.T) {
+	db, mock := newSQLMock(t)
+	repo := NewWebAuthnCredentials(db)
+
+	mock.ExpectQuery(regexp.QuoteMeta(`WHERE user_id = $1`)).
+		WithArgs(int64(3)).
+		WillReturnRows(sqlmock.NewRows(webAuthnColumns))
+
+	creds, err := repo.ListByUser(context.Background(), 3)
+	assert.NoError(t, err)
+	assert.NotNil(t, creds)
+	assert.Empty(t, creds)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestWebAuthnCredentials_Use(t *testing.T) {
+	db, mock := newSQLMock(t)
+	repo := NewWebAuthnCredentials(db)
+	q := regexp.QuoteMeta(`WHERE id = $1 AND (sign_count < $2 OR (sign_count = 0 AND $2 = 0))`)
+	first, second := uuid.New(), uuid.New()
+	expires := time.Now()
+	spend := func(challenge uuid.UUID, fresh bool) {
+		mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM auth.spent_challenges`)).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		var n int64
+		if fresh {
+			n = 1
+		}
+		mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO auth.spent_challenges`)).
+			WithArgs(challenge, expires).
+			WillReturnResult(sqlmock.NewResult(0, n))
+	}
+
+	spend(first, true)
+	mock.ExpectExec(q).WithArgs(int64(9), int64(8), true).WillReturnResult(sqlmock.NewResult(0, 1))
+	spend(second, true)
+	mock.ExpectExec(q).WithArgs(int64(9), int64(8), true).WillReturnResult(sqlmock.NewResult(0, 0))
+	// A replayed ceremony never reaches the counter.
+	spend(first, false)
+
+	assert.NoError(t, repo.Use(context.Background(), 9, 8, true, first, expires))
+	assert.ErrorIs(t, repo.Use(context.Background(), 9, 8, true, second, expires), ErrSignCountMismatch)
+	assert.ErrorIs(t, repo.Use(context.Background(), 9, 8, true, first, expires), ErrInvalidChallenge)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,109 @@
+package repositories
+
+import (
+	"bioly/auth/internal/types"
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+type WebAuthnCredentials interface {
+	Add(ctx context.Context, c *types.WebAuthnCredential) error
+	ListByUser(ctx context.Context, userID int64) ([]types.WebAuthnCredential, error)
+	FindByCredentialID(ctx context.Context, credentialID []byte) (*types.WebAuthnCredential, error)
+	Use(ctx context.Context, id int64, signCount int64, backupState bool, challengeID uuid.UUID, challengeExpires time.Time) error
+}
+
+type webAuthnCredentialsImpl struct {
+	db *sqlx.DB
+}
+
+func NewWebAuthnCredentials(db *sqlx.DB) WebAuthnCredentials {
+	return &webAuthnCredentialsImpl{db: db}
+}
+
+const webAuthnCredentialColumns = `id, user_id, credential_id, public_key, attestation_type, aaguid, transports,
+		       sign_count, backup_eligible, backup_state, name, last_used_at, created_at`
+
+// Add stores a new passkey. A credential id that is already registered,
+// to this or another user, is rejected with ErrDuplicateCredential.
+func (r *webAuthnCredentialsImpl) Add(ctx context.Context, c *types.WebAuthnCredential) error {
+	err := r.db.QueryRowxContext(ctx, `
+		INSERT INTO auth.webauthn_credentials
+			(user_id, credential_id, public_key, attestation_type, aaguid, transports, sign_count, backup_eligible, backup_state, name)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		RETURNING id, created_at
+	`, c.UserID, c.CredentialID, c.PublicKey, c.AttestationType, c.AAGUID, c.Transports,
+		c.SignCount, c.BackupEligible, c.BackupState, c.Name).Scan(&c.ID, &c.CreatedAt)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+			return ErrDuplicateCredential
+		}
+		return err
+	}
+	return nil
+}
+
+func (r *webAuthnCredentialsImpl) ListByUser(ctx context.Context, userID int64) ([]types.WebAuthnCredential, error) {
+	creds := []types.WebAuthnCredential{}
+	err := r.db.SelectContext(ctx, &creds, `
+		SELECT `+webAuthnCredentialColumns+`
+		FROM auth.webauthn_credentials
+		WHERE user_id = $1
+		ORDER BY created_at, id
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	return creds, nil
+}
+
+func (r *webAuthnCredentialsImpl) FindByCredentialID(ctx context.Context, credentialID []byte) (*types.WebAuthnCredential, error) {
+	var c types.WebAuthnCredential
+	err := r.db.GetContext(ctx, &c, `
+		SELECT `+webAuthnCredentialColumns+`
+		FROM auth.webauthn_credentials
+		WHERE credential_id = $1
+	`, credentialID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return &c, nil
+}
+
+// Use records a login with the passkey. The ceremony's challenge is spent
+// first, like a sign up challenge, so an assertion is accepted once even
+// from authenticators without a counter; a replay is ErrInvalidChallenge.
+// signCount must then be greater than the stored counter, or both must be 0
+// for authenticators without a counter; otherwise ErrSignCountMismatch is
+// returned.
+func (r *webAuthnCredentialsImpl) Use(ctx context.Context, id int64, signCount int64, backupState bool, challengeID uuid.UUID, challengeExpires time.Time) error {
+	if err := spendChallenge(ctx, r.db, challengeID, challengeExpires); err != nil {
+		return err
+	}
+	res, err := r.db.ExecContext(ctx, `
+		UPDATE auth.webauthn_credentials
+		SET sign_count = $2, backup_state = $3, last_used_at = NOW()
+		WHERE id = $1 AND (sign_count < $2 OR (sign_count = 0 AND $2 = 0))
+	`, id, signCount, backupState)
+	if err != nil {
+		return err
+	}
+	aff, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if aff == 0 {
+		return ErrSignCountMismatch
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+// Package secretbox encrypts small secrets at rest with AES-256-GCM.
+package secretbox
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ErrDecrypt = errors.New("cannot decrypt secret")
+
+const prefix = "v1:"
+
+type Box struct {
+	aead cipher.AEAD
+	key  []byte
+}
+
+// New returns a box for a 32 byte key.
+func New(key []byte) (*Box, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("secretbox: key must be 32 bytes, got %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Box{aead: aead, key: key}, nil
+}
+
+// NewFromBase64 decodes a standard base64 key, as stored in config files.
+func NewFromBase64(key string) (*Box, error) {
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("secretbox: %w", err)
+	}
+	return New(raw)
+}
+
+// DeriveKey returns a 32 byte subkey for label, so the one configured key
+// can also serve purposes other than encryption.
+func (b *Box) DeriveKey(label string) []byte {
+	mac := hmac.New(sha256.New, b.key)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
+
+// Seal encrypts plaintext. The result is text safe to store in a column.
+func (b *Box) Seal(plaintext string) (string, error) {
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	out := b.aead.Seal(nonce, nonce, []byte(plaintext), nil)
+	return prefix + base64.RawStdEncoding.EncodeToString(out), nil
+}
+
+func (b *Box) Open(sealed string) (string, error) {
+	data, ok := strings.CutPrefix(sealed, prefix)
+	if !ok {
+		return "", ErrDecrypt
+	}
+	raw, err := base64.RawStdEncoding.DecodeString(data)
+	if err != nil || len(raw) < b.aead.NonceSize() {
+		return "", ErrDecrypt
+	}
+	n := b.aead.NonceSize()
+	plain, err := b.aead.Open(nil, raw[:n], raw[n:], nil)
+	if err != nil {
+		return "", ErrDecrypt
+	}
+	return string(plain), nil
+}
@@ -0,0 +1,51 @@
+package secretbox
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBox_RoundTrip(t *testing.T) {
+	b, err := New(bytes.Repeat([]byte{1}, 32))
+	assert.NoError(t, err)
+
+	sealed, err := b.Seal("JBSWY3DPEHPK3PXP")
+	assert.NoError(t, err)
+	assert.NotContains(t, sealed, "JBSWY3DPEHPK3PXP")
+
+	plain, err := b.Open(sealed)
+	assert.NoError(t, err)
+	assert.Equal(t, "JBSWY3DPEHPK3PXP", plain)
+}
+
+func TestBox_WrongKey(t *testing.T) {
+	a, _ := New(bytes.Repeat([]byte{1}, 32))
+	b, _ := New(bytes.Repeat([]byte{2}, 32))
+
+	sealed, err := a.Seal("secret")
+	assert.NoError(t, err)
+	_, err = b.Open(sealed)
+	assert.ErrorIs(t, err, ErrDecrypt)
+
+	_, err = a.Open("plain")
+	assert.ErrorIs(t, err, ErrDecrypt)
+}
+
+func TestNew_KeyLength(t *testing.T) {
+	_, err := New([]byte("short"))
+	assert.Error(t, err)
+	_, err = NewFromBase64("not base64!")
+	assert.Error(t, err)
+}
+
+func TestBox_DeriveKey(t *testing.T) {
+	b, _ := New(bytes.Repeat([]byte{1}, 32))
+
+	k1 := b.DeriveKey("a")
+	assert.Len(t, k1, 32)
+	assert.Equal(t, k1, b.DeriveKey("a"))
+	assert.NotEqual(t, k1, b.DeriveKey("b"))
+	assert.NotEqual(t, bytes.Repeat([]byte{1}, 32), k1)
+}
@@ -0,0 +1,56 @@
+package totp
+
+import (
+	"encoding/base32"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// RFC 6238 appendix B, SHA1 column, truncated to 6 digits.
+func TestCode_RFC6238Vectors(t *testing.T) {
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+	vectors := map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	}
+	for ts, want := range vectors {
+		got, err := Code(secret, Step(time.Unix(ts, 0)))
+		assert.NoError(t, err)
+		assert.Equal(t, want, got, "t=%d", ts)
+	}
+}
+
+func TestValidate_Skew(t *testing.T) {
+	secret, err := GenerateSecret()
+	assert.NoError(t, err)
+	now := time.Unix(1700000000, 0)
+
+	prev, _ := Code(secret, Step(now)-1)
+	step, ok := Validate(secret, prev, now, 1)
+	assert.True(t, ok)
+	assert.Equal(t, Step(now)-1, step)
+
+	old, _ := Code(secret, Step(now)-2)
+	_, ok = Validate(secret, old, now, 1)
+	assert.False(t, ok)
+
+	_, ok = Validate(secret, "12345", now, 1)
+	assert.False(t, ok)
+}
+
+func TestURI(t *testing.T) {
+	u, err := url.Parse(URI("Bioly", "bob", "ABC"))
+	assert.NoError(t, err)
+	assert.Equal(t, "otpauth", u.Scheme)
+	assert.Equal(t, "totp", u.Host)
+	assert.Equal(t, "/Bioly:bob", u.Path)
+	assert.Equal(t, "ABC", u.Query().Get("secret"))
+	assert.Equal(t, "Bioly", u.Query().Get("issuer"))
+}
@@ -0,0 +1,100 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+
+	"bioly/asynclogger"
+	"bioly/auth/internal/types"
+)
+
+// recordAudit stores e together with the request's client and ID. A failed
+// write is logged but never fails the request, and a client hanging up
+// does not cancel it.
+func (h *Handler) recordAudit(r *http.Request, e types.AuditEvent) {
+	if h.auditor == nil {
+		return
+	}
+	e.IP = clientIP(r)
+	e.UserAgent = r.Header.Get("User-Agent")
+	e.RequestID = middleware.GetReqID(r.Context())
+	if err := h.auditor.Record(context.WithoutCancel(r.Context()), &e); err != nil {
+		asynclogger.Error("[%s] audit %s/%s not recorded err=%v", e.RequestID, e.Type, e.Outcome, err)
+	}
+}
+
+// auditFilter reads the GET /audit query: user_id, type, since and until
+// (RFC 3339), cursor and limit.
+func auditFilter(r *http.Request) (types.AuditFilter, error) {
+	q := r.URL.Query()
+	f := types.AuditFilter{Type: q.Get("type")}
+	if v := q.Get("user_id"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || id <= 0 {
+			return f, fmt.Errorf("invalid user_id")
+		}
+		f.UserID = &id
+	}
+	for name, dst := range map[string]*time.Time{"since": &f.Since, "until": &f.Until} {
+		if v := q.Get(name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return f, fmt.Errorf("invalid %s, want RFC 3339", name)
+			}
+			*dst = t
+		}
+	}
+	if v := q.Get("cursor"); v != "" {
+		before, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || before <= 0 {
+			return f, fmt.Errorf("invalid cursor")
+		}
+		f.Before = before
+	}
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			return f, fmt.Errorf("invalid limit")
+		}
+		f.Limit = limit
+	}
+	return f, nil
+}
+
+func (h *Handler) listAudit(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	caller := principalFrom(r.Context())
+
+	if h.auditor == nil {
+		render.Render(w, r, types.ErrInvalidRequest(http.StatusNotImplemented, fmt.Errorf("audit log is not enabled")))
+		return
+	}
+	f, err := auditFilter(r)
+	if err != nil {
+		asynclogger.Warning("[%s] listAudit bad query caller_id=%d err=%v", reqID, caller.UserID, err)
+		render.Render(w, r, types.ErrInvalidRequest(http.StatusBadRequest, err))
+		return
+	}
+
+	page, err := h.auditor.List(r.Context(), f)
+	if err != nil {
+		asynclogger.Error("[%s] listAudit failed caller_id=%d err=%v", reqID, caller.UserID, err)
+		render.Render(w, r, types.ErrInvalidRequest(http.StatusInternalServerError, fmt.Errorf("internal error")))
+		return
+	}
+
+	resp := &types.AuditEventsResponse{
+		Events:     make([]types.AuditEventDTO, 0, len(page.Events)),
+		NextCursor: page.NextCursor,
+	}
+	for _, e := range page.Events {
+		resp.Events = append(resp.Events, types.NewAuditEventDTO(e))
+	}
+	render.Render(w, r, resp)
+}
@@ -0,0 +1,20 @@
+package transport
+
+import (
+	"context"
+	"net/http"
+
+	"bioly/authjwt"
+)
+
+// requireAuth rejects requests without a valid "Authorization: Bearer" access
+// token and stores the caller in the request context.
+func (h *Handler) requireAuth(next http.Handler) http.Handler {
+	verify := authjwt.VerifierFunc(h.auth.ParseAccess)
+	return authjwt.Authenticate(verify)(authjwt.RequireAuth(next))
+}
+
+func principalFrom(ctx context.Context) *authjwt.Principal {
+	p, _ := authjwt.PrincipalFrom(ctx)
+	return p
+}
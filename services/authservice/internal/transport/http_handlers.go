@@ -1,7 +1,9 @@
 package transport
 
 import (
+	"errors"
 	"fmt"
+	"math"
 	"net"
 	"net/http"
 	"strconv"
@@ -11,28 +13,98 @@ import (
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/render"
+	"github.com/google/uuid"
 
 	"bioly/asynclogger"
+	"bioly/auth/internal/config"
+	"bioly/auth/internal/passwords"
 	"bioly/auth/internal/repositories"
 	"bioly/auth/internal/types"
 	"bioly/auth/internal/usecase"
+	"bioly/auth/internal/useragent"
+	"bioly/authjwt"
+	"bioly/usernames"
 )
 
 type Handler struct {
-	auth usecase.AuthService
+	auth      usecase.AuthService
+	auditor   usecase.AuditService
+	cookie    *config.RefreshCookie
+	cookieTTL time.Duration
 }
 
-func NewHandler(a usecase.AuthService) *Handler {
-	return &Handler{auth: a}
+type HandlerOption func(*Handler)
+
+// WithAudit records security events and enables GET /audit.
+func WithAudit(a usecase.AuditService) HandlerOption {
+	return func(h *Handler) { h.auditor = a }
+}
+
+func NewHandler(a usecase.AuthService, opts ...HandlerOption) *Handler {
+	h := &Handler{auth: a}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
 }
 
 func (h *Handler) RegisterRoutes(r chi.Router) {
 	r.Get("/ping", h.ping)
 	r.Get("/health", h.health)
+	r.Get("/.well-known/jwks.json", h.jwks)
 	r.Post("/login", h.login)
+	r.Post("/login/mfa", h.loginMFA)
+	r.Post("/login/magic", h.sendMagicLink)
+	r.Get("/login/magic/{token}", h.loginMagic)
 	r.Post("/refresh", h.refresh)
-	r.Post("/users", h.createUser)
-	r.Delete("/users/{id}", h.deleteUser)
+	r.Post("/refresh/logout", h.logoutCookie)
+	r.Post("/logout", h.logout)
+	r.Post("/password/forgot", h.forgotPassword)
+	r.Post("/password/reset", h.resetPassword)
+	r.Post("/email/verify", h.verifyEmail)
+	r.Get("/oauth/{provider}/start", h.startOAuth)
+	r.Get("/oauth/{provider}/callback", h.oauthCallback)
+	r.Post("/introspect", h.introspect)
+	r.Get("/register/challenge", h.registerChallenge)
+	r.Post("/register", h.register)
+	r.Post("/webauthn/login/begin", h.beginPasskeyLogin)
+	r.Post("/webauthn/login/finish", h.finishPasskeyLogin)
+	r.Get("/verify", h.verify)
+
+	r.Group(func(r chi.Router) {
+		r.Use(h.requireAuth)
+		r.Post("/logout/all", h.logoutAll)
+		r.Get("/sessions", h.listSessions)
+		r.Delete("/sessions/{jti}", h.revokeSession)
+		r.Post("/password/change", h.changePassword)
+		r.Post("/email/verify/send", h.sendEmailVerification)
+		r.Post("/mfa/totp/enroll", h.enrollTOTP)
+		r.Post("/mfa/totp/confirm", h.confirmTOTP)
+		r.Post("/mfa/totp/disable", h.disableTOTP)
+		r.With(authjwt.RequireRole(authjwt.RoleAdmin)).Post("/users", h.createUser)
+		r.Patch("/users/me/username", h.changeUsername)
+		r.Delete("/users/{id}", h.deleteUser)
+		r.Post("/tokens", h.createToken)
+		r.Get("/tokens", h.listTokens)
+		r.Delete("/tokens/{id}", h.revokeToken)
+		r.Post("/webauthn/register/begin", h.beginPasskeyRegistration)
+		r.Post("/webauthn/register/finish", h.finishPasskeyRegistration)
+		r.With(authjwt.RequireRole(authjwt.RoleAdmin)).Get("/audit", h.listAudit)
+		r.With(authjwt.RequireRole(authjwt.RoleAdmin)).Post("/invites", h.createInvite)
+	})
+}
+
+// RouteNames returns the first path segment of every route h registers, to
+// be reserved so no username reads like one of the service's pages.
+func (h *Handler) RouteNames() []string {
+	r := chi.NewRouter()
+	h.RegisterRoutes(r)
+	var patterns []string
+	_ = chi.Walk(r, func(method, route string, _ http.Handler, _ ...func(http.Handler) http.Handler) error {
+		patterns = append(patterns, route)
+		return nil
+	})
+	return usernames.RouteWords(patterns...)
 }
 
 func (h *Handler) ping(w http.ResponseWriter, r *http.Request) {
@@ -43,6 +115,11 @@ func (h *Handler) health(w http.ResponseWriter, r *http.Request) {
 	render.PlainText(w, r, "OK")
 }
 
+func (h *Handler) jwks(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	render.JSON(w, r, h.auth.JWKS())
+}
+
 func clientIP(r *http.Request) string {
 	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
 		parts := strings.Split(xff, ",")
@@ -81,9 +158,67 @@ func (rr *refreshRequest) Bind(r *http.Request) error {
 	return nil
 }
 
+type forgotPasswordRequest struct {
+	Username string `json:"username"`
+}
+
+func (fr *forgotPasswordRequest) Bind(r *http.Request) error {
+	if fr.Username == "" {
+		return fmt.Errorf("username is required")
+	}
+	return nil
+}
+
+type resetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+func (rr *resetPasswordRequest) Bind(r *http.Request) error {
+	if rr.Token == "" || rr.Password == "" {
+		return fmt.Errorf("token and password are required")
+	}
+	return nil
+}
+
+type changePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+func (cr *changePasswordRequest) Bind(r *http.Request) error {
+	if cr.CurrentPassword == "" || cr.NewPassword == "" {
+		return fmt.Errorf("current_password and new_password are required")
+	}
+	return nil
+}
+
+type verifyEmailRequest struct {
+	Token string `json:"token"`
+}
+
+func (vr *verifyEmailRequest) Bind(r *http.Request) error {
+	if vr.Token == "" {
+		return fmt.Errorf("token is required")
+	}
+	return nil
+}
+
+type changeUsernameRequest struct {
+	Username string `json:"username"`
+}
+
+func (cr *changeUsernameRequest) Bind(r *http.Request) error {
+	if cr.Username == "" {
+		return fmt.Errorf("username is required")
+	}
+	return nil
+}
+
 type createUserRequest struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
+	Email    string `json:"email"`
 }
 
 func (c *createUserRequest) Bind(r *http.Request) error {
@@ -116,89 +251,480 @@ func (h *Handler) login(w http.ResponseWriter, r *http.Request) {
 	ua := r.Header.Get("User-Agent")
 	ip := clientIP(r)
 	user, tokens, err := h.auth.Login(r.Context(), req.Username, req.Password, ua, ip)
+	var retry *usecase.RetryLaterError
+	if errors.As(err, &retry) {
+		asynclogger.Warning("[%s] login throttled ip=%s ua=%q username=%q locked=%t retry_after=%s", reqID, ip, ua, req.Username, retry.Locked, retry.RetryAfter)
+		h.recordAudit(r, types.AuditEvent{Type: types.AuditLogin, Username: req.Username, Outcome: types.OutcomeThrottled, Detail: err.Error()})
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.RetryAfter.Seconds()))))
+		render.Render(w, r, types.ErrInvalidRequest(http.StatusTooManyRequests, err))
+		return
+	}
+	var mfa *usecase.MFARequiredError
+	if errors.As(err, &mfa) {
+		asynclogger.Info("[%s] login needs second factor ip=%s ua=%q username=%q dur=%s", reqID, ip, ua, req.Username, time.Since(start))
+		h.recordAudit(r, types.AuditEvent{Type: types.AuditLogin, Username: req.Username, Outcome: types.OutcomeMFARequired})
+		render.Render(w, r, &types.MFAChallengeResponse{
+			MFARequired: true,
+			MFAToken:    mfa.Token,
+			ExpiresIn:   int(mfa.ExpiresIn.Seconds()),
+		})
+		return
+	}
 	if err != nil {
 		asynclogger.Warning("[%s] login failed ip=%s ua=%q username=%q dur=%s err=%v", reqID, ip, ua, req.Username, time.Since(start), err)
+		h.recordAudit(r, types.AuditEvent{Type: types.AuditLogin, Username: req.Username, Outcome: types.OutcomeFailure, Detail: err.Error()})
 		render.Render(w, r, types.ErrInvalidRequest(http.StatusUnauthorized, err))
 		return
 	}
 
 	asynclogger.Info("[%s] login success ip=%s ua=%q user_id=%d username=%q dur=%s", reqID, ip, ua, user.ID, user.Username, time.Since(start))
+	h.recordAudit(r, types.AuditEvent{Type: types.AuditLogin, UserID: &user.ID, Username: req.Username, Outcome: types.OutcomeSuccess})
+	h.renderTokens(w, r, user, tokens, h.cookieDelivery(r))
+}
+
+func (h *Handler) refresh(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	start := time.Now().UTC()
+
+	ua := r.Header.Get("User-Agent")
+	ip := clientIP(r)
 
-	resp := &types.LoginResponse{
-		Access:  tokens.Access,
-		Refresh: tokens.Refresh,
-		User:    types.UserDTO{ID: user.ID, Username: user.Username},
+	// A refresh cookie wins over the body; without one the token is read
+	// from the body as always.
+	token, err := h.refreshCookie(r)
+	if err != nil {
+		asynclogger.Warning("[%s] refresh rejected ip=%s ua=%q err=%v", reqID, ip, ua, err)
+		render.Render(w, r, types.ErrInvalidRequest(http.StatusForbidden, err))
+		return
 	}
-	render.Render(w, r, resp)
+	fromCookie := token != ""
+	if !fromCookie {
+		var req refreshRequest
+		if err := render.Bind(r, &req); err != nil {
+			asynclogger.Warning("[%s] refresh bind failed ip=%s ua=%q err=%v", reqID, ip, ua, err)
+			render.Render(w, r, types.ErrInvalidRequest(http.StatusBadRequest, fmt.Errorf("invalid request body")))
+			return
+		}
+		token = req.Refresh
+	}
+
+	user, tokens, err := h.auth.Refresh(r.Context(), token, ua, ip)
+	if err != nil {
+		switch err {
+		case repositories.ErrTokenReused:
+			asynclogger.Warning("[%s] refresh token reuse detected ip=%s ua=%q dur=%s", reqID, ip, ua, time.Since(start))
+			if fromCookie {
+				// Stop the browser from sending a dead token.
+				h.clearRefreshCookies(w)
+			}
+			render.Render(w, r, types.ErrInvalidRequest(http.StatusUnauthorized, repositories.ErrInvalidToken))
+			return
+		case repositories.ErrInvalidToken:
+			asynclogger.Warning("[%s] refresh failed ip=%s ua=%q dur=%s err=%v", reqID, ip, ua, time.Since(start), err)
+			if fromCookie {
+				h.clearRefreshCookies(w)
+			}
+			render.Render(w, r, types.ErrInvalidRequest(http.StatusUnauthorized, err))
+			return
+		default:
+			asynclogger.Error("[%s] refresh failed ip=%s ua=%q dur=%s err=%v", reqID, ip, ua, time.Since(start), err)
+			render.Render(w, r, types.ErrInvalidRequest(http.StatusInternalServerError, fmt.Errorf("internal error")))
+			return
+		}
+	}
+
+	asynclogger.Info("[%s] refresh success ip=%s ua=%q user_id=%d cookie=%t dur=%s", reqID, ip, ua, user.ID, fromCookie, time.Since(start))
+	h.renderTokens(w, r, user, tokens, fromCookie)
 }
 
-func (h *Handler) refresh(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) logout(w http.ResponseWriter, r *http.Request) {
 	reqID := middleware.GetReqID(r.Context())
 	start := time.Now().UTC()
 
 	var req refreshRequest
 	if err := render.Bind(r, &req); err != nil {
-		asynclogger.Warning("[%s] refresh bind failed ip=%s ua=%q err=%v", reqID, clientIP(r), r.Header.Get("User-Agent"), err)
+		asynclogger.Warning("[%s] logout bind failed ip=%s ua=%q err=%v", reqID, clientIP(r), r.Header.Get("User-Agent"), err)
 		render.Render(w, r, types.ErrInvalidRequest(http.StatusBadRequest, fmt.Errorf("invalid request body")))
 		return
 	}
 
-	ua := r.Header.Get("User-Agent")
 	ip := clientIP(r)
-	user, tokens, err := h.auth.Refresh(r.Context(), req.Refresh, ua, ip)
-	if err != nil {
-		asynclogger.Warning("[%s] refresh failed ip=%s ua=%q dur=%s err=%v", reqID, ip, ua, time.Since(start), err)
-		render.Render(w, r, types.ErrInvalidRequest(http.StatusNotImplemented, err))
+	if err := h.auth.Logout(r.Context(), req.Refresh); err != nil {
+		if err == repositories.ErrInvalidToken {
+			asynclogger.Warning("[%s] logout failed ip=%s dur=%s err=%v", reqID, ip, time.Since(start), err)
+			render.Render(w, r, types.ErrInvalidRequest(http.StatusUnauthorized, err))
+			return
+		}
+		asynclogger.Error("[%s] logout failed ip=%s dur=%s err=%v", reqID, ip, time.Since(start), err)
+		render.Render(w, r, types.ErrInvalidRequest(http.StatusInternalServerError, fmt.Errorf("internal error")))
+		return
+	}
+
+	asynclogger.Info("[%s] logout success ip=%s dur=%s", reqID, ip, time.Since(start))
+	render.Render(w, r, &okResponse{Status: "ok", Message: "logged out"})
+}
+
+func (h *Handler) logoutAll(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	start := time.Now().UTC()
+	caller := principalFrom(r.Context())
+
+	if err := h.auth.LogoutAll(r.Context(), caller.UserID); err != nil {
+		asynclogger.Error("[%s] logoutAll failed user_id=%d dur=%s err=%v", reqID, caller.UserID, time.Since(start), err)
+		render.Render(w, r, types.ErrInvalidRequest(http.StatusInternalServerError, fmt.Errorf("internal error")))
 		return
 	}
 
-	asynclogger.Info("[%s] refresh success ip=%s ua=%q user_id=%d dur=%s", reqID, ip, ua, user.ID, time.Since(start))
+	asynclogger.Info("[%s] logoutAll success user_id=%d ip=%s dur=%s", reqID, caller.UserID, clientIP(r), time.Since(start))
+	render.Render(w, r, &okResponse{Status: "ok", Message: "logged out everywhere"})
+}
+
+func (h *Handler) listSessions(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	start := time.Now().UTC()
+	caller := principalFrom(r.Context())
+
+	sessions, err := h.auth.ListSessions(r.Context(), caller.UserID)
+	if err != nil {
+		asynclogger.Error("[%s] listSessions failed user_id=%d dur=%s err=%v", reqID, caller.UserID, time.Since(start), err)
+		render.Render(w, r, types.ErrInvalidRequest(http.StatusInternalServerError, fmt.Errorf("internal error")))
+		return
+	}
 
-	resp := &types.LoginResponse{
-		Access:  tokens.Access,
-		Refresh: tokens.Refresh,
-		User:    types.UserDTO{ID: user.ID, Username: user.Username},
+	resp := &types.SessionsResponse{Sessions: make([]types.SessionDTO, 0, len(sessions))}
+	for _, s := range sessions {
+		ua := useragent.Parse(s.UserAgent)
+		resp.Sessions = append(resp.Sessions, types.SessionDTO{
+			ID:         s.JTI.String(),
+			Current:    s.FamilyID.String() == caller.SessionID,
+			Device:     ua.Device,
+			OS:         ua.OS,
+			Browser:    ua.Browser,
+			Summary:    ua.Summary(),
+			IP:         s.IP,
+			CreatedAt:  s.CreatedAt,
+			LastUsedAt: s.LastUsedAt,
+			ExpiresAt:  s.ExpiresAt,
+		})
 	}
+
+	asynclogger.Info("[%s] listSessions success user_id=%d count=%d dur=%s", reqID, caller.UserID, len(sessions), time.Since(start))
 	render.Render(w, r, resp)
 }
 
-func (h *Handler) createUser(w http.ResponseWriter, r *http.Request) {
+func (h *Handler) revokeSession(w http.ResponseWriter, r *http.Request) {
 	reqID := middleware.GetReqID(r.Context())
 	start := time.Now().UTC()
+	caller := principalFrom(r.Context())
 
-	var req createUserRequest
+	jtiStr := chi.URLParam(r, "jti")
+	jti, err := uuid.Parse(jtiStr)
+	if err != nil {
+		asynclogger.Warning("[%s] revokeSession bad jti=%q", reqID, jtiStr)
+		render.Render(w, r, types.ErrInvalidRequest(http.StatusBadRequest, fmt.Errorf("invalid session id")))
+		return
+	}
+
+	if err := h.auth.RevokeSession(r.Context(), caller.UserID, jti); err != nil {
+		if err == repositories.ErrNotFound {
+			asynclogger.Warning("[%s] revokeSession not found user_id=%d jti=%s dur=%s", reqID, caller.UserID, jti, time.Since(start))
+			render.Render(w, r, types.ErrInvalidRequest(http.StatusNotFound, err))
+			return
+		}
+		asynclogger.Error("[%s] revokeSession failed user_id=%d jti=%s dur=%s err=%v", reqID, caller.UserID, jti, time.Since(start), err)
+		render.Render(w, r, types.ErrInvalidRequest(http.StatusInternalServerError, fmt.Errorf("internal error")))
+		return
+	}
+
+	asynclogger.Info("[%s] revokeSession success user_id=%d jti=%s dur=%s", reqID, caller.UserID, jti, time.Since(start))
+	render.Render(w, r, &okResponse{Status: "ok", Message: "session revoked"})
+}
+
+func (h *Handler) forgotPassword(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	start := time.Now().UTC()
+
+	var req forgotPasswordRequest
 	if err := render.Bind(r, &req); err != nil {
-		asynclogger.Warning("[%s] createUser bind failed ip=%s ua=%q err=%v", reqID, clientIP(r), r.Header.Get("User-Agent"), err)
+		asynclogger.Warning("[%s] forgotPassword bind failed ip=%s ua=%q err=%v", reqID, clientIP(r), r.Header.Get("User-Agent"), err)
+		render.Render(w, r, types.ErrInvalidRequest(http.StatusBadRequest, fmt.Errorf("invalid request body")))
+		return
+	}
+
+	ip := clientIP(r)
+	if err := h.auth.ForgotPassword(r.Context(), req.Username, ip); err != nil {
+		var retry *usecase.RetryLaterError
+		if errors.As(err, &retry) {
+			asynclogger.Warning("[%s] forgotPassword throttled ip=%s username=%q retry_after=%s", reqID, ip, req.Username, retry.RetryAfter)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.RetryAfter.Seconds()))))
+			render.Render(w, r, types.ErrInvalidRequest(http.StatusTooManyRequests, err))
+			return
+		}
+		if err == repositories.ErrNotImplemented {
+			render.Render(w, r, types.ErrInvalidRequest(http.StatusNotImplemented, err))
+			return
+		}
+		asynclogger.Error("[%s] forgotPassword failed ip=%s username=%q dur=%s err=%v", reqID, ip, req.Username, time.Since(start), err)
+		render.Render(w, r, types.ErrInvalidRequest(http.StatusInternalServerError, fmt.Errorf("internal error")))
+		return
+	}
+
+	asynclogger.Info("[%s] forgotPassword accepted ip=%s username=%q dur=%s", reqID, ip, req.Username, time.Since(start))
+	render.Status(r, http.StatusAccepted)
+	render.Render(w, r, &okResponse{Status: "ok", Message: "if the account exists, a reset link has been sent"})
+}
+
+// changePassword answers 403 for a wrong current password so clients do not
+// mistake it for an expired access token.
+func (h *Handler) changePassword(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	start := time.Now().UTC()
+	caller := principalFrom(r.Context())
+
+	var req changePasswordRequest
+	if err := render.Bind(r, &req); err != nil {
+		asynclogger.Warning("[%s] changePassword bind failed user_id=%d err=%v", reqID, caller.UserID, err)
 		render.Render(w, r, types.ErrInvalidRequest(http.StatusBadRequest, fmt.Errorf("invalid request body")))
 		return
 	}
 
-	user, err := h.auth.CreateUser(r.Context(), req.Username, req.Password)
+	ua := r.Header.Get("User-Agent")
+	ip := clientIP(r)
+	user, tokens, err := h.auth.ChangePassword(r.Context(), caller.UserID, caller.SessionID, req.CurrentPassword, req.NewPassword, ua, ip)
+	var retry *usecase.RetryLaterError
+	if errors.As(err, &retry) {
+		asynclogger.Warning("[%s] changePassword throttled ip=%s user_id=%d locked=%t retry_after=%s", reqID, ip, caller.UserID, retry.Locked, retry.RetryAfter)
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.RetryAfter.Seconds()))))
+		render.Render(w, r, types.ErrInvalidRequest(http.StatusTooManyRequests, err))
+		return
+	}
+	var weak *passwords.PolicyError
+	if errors.As(err, &weak) {
+		asynclogger.Warning("[%s] changePassword refused new password ip=%s user_id=%d code=%d", reqID, ip, caller.UserID, weak.Code)
+		render.Render(w, r, types.ErrWithAppCode(http.StatusBadRequest, weak, weak.Code))
+		return
+	}
 	if err != nil {
 		switch err {
-		case repositories.ErrDuplicateUsername:
-			asynclogger.Warning("[%s] createUser duplicate username=%q dur=%s", reqID, req.Username, time.Since(start))
-			render.Render(w, r, types.ErrInvalidRequest(http.StatusConflict, err))
-			return
 		case repositories.ErrInvalidCredentials:
-			asynclogger.Warning("[%s] createUser invalid input username=%q dur=%s", reqID, req.Username, time.Since(start))
+			asynclogger.Warning("[%s] changePassword rejected ip=%s user_id=%d dur=%s", reqID, ip, caller.UserID, time.Since(start))
+			render.Render(w, r, types.ErrInvalidRequest(http.StatusForbidden, err))
+			return
+		case repositories.ErrInvalidToken:
+			render.Render(w, r, types.ErrInvalidRequest(http.StatusUnauthorized, err))
+			return
+		default:
+			asynclogger.Error("[%s] changePassword failed ip=%s user_id=%d dur=%s err=%v", reqID, ip, caller.UserID, time.Since(start), err)
+			render.Render(w, r, types.ErrInvalidRequest(http.StatusInternalServerError, fmt.Errorf("internal error")))
+			return
+		}
+	}
+
+	asynclogger.Info("[%s] changePassword success ip=%s ua=%q user_id=%d dur=%s", reqID, ip, ua, user.ID, time.Since(start))
+	h.renderTokens(w, r, user, tokens, h.cookieDelivery(r))
+}
+
+func (h *Handler) resetPassword(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	start := time.Now().UTC()
+
+	var req resetPasswordRequest
+	if err := render.Bind(r, &req); err != nil {
+		asynclogger.Warning("[%s] resetPassword bind failed ip=%s ua=%q err=%v", reqID, clientIP(r), r.Header.Get("User-Agent"), err)
+		render.Render(w, r, types.ErrInvalidRequest(http.StatusBadRequest, fmt.Errorf("invalid request body")))
+		return
+	}
+
+	ip := clientIP(r)
+	if err := h.auth.ResetPassword(r.Context(), req.Token, req.Password); err != nil {
+		var weak *passwords.PolicyError
+		if errors.As(err, &weak) {
+			asynclogger.Warning("[%s] resetPassword refused new password ip=%s code=%d", reqID, ip, weak.Code)
+			render.Render(w, r, types.ErrWithAppCode(http.StatusBadRequest, weak, weak.Code))
+			return
+		}
+		switch err {
+		case repositories.ErrInvalidToken, repositories.ErrInvalidCredentials:
+			asynclogger.Warning("[%s] resetPassword rejected ip=%s dur=%s err=%v", reqID, ip, time.Since(start), err)
+			render.Render(w, r, types.ErrInvalidRequest(http.StatusBadRequest, err))
+			return
+		case repositories.ErrNotImplemented:
+			render.Render(w, r, types.ErrInvalidRequest(http.StatusNotImplemented, err))
+			return
+		default:
+			asynclogger.Error("[%s] resetPassword failed ip=%s dur=%s err=%v", reqID, ip, time.Since(start), err)
+			render.Render(w, r, types.ErrInvalidRequest(http.StatusInternalServerError, fmt.Errorf("internal error")))
+			return
+		}
+	}
+
+	asynclogger.Info("[%s] resetPassword success ip=%s dur=%s", reqID, ip, time.Since(start))
+	render.Render(w, r, &okResponse{Status: "ok", Message: "password changed"})
+}
+
+func (h *Handler) verifyEmail(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	start := time.Now().UTC()
+
+	var req verifyEmailRequest
+	if err := render.Bind(r, &req); err != nil {
+		asynclogger.Warning("[%s] verifyEmail bind failed ip=%s ua=%q err=%v", reqID, clientIP(r), r.Header.Get("User-Agent"), err)
+		render.Render(w, r, types.ErrInvalidRequest(http.StatusBadRequest, fmt.Errorf("invalid request body")))
+		return
+	}
+
+	ip := clientIP(r)
+	if err := h.auth.VerifyEmail(r.Context(), req.Token); err != nil {
+		switch err {
+		case repositories.ErrInvalidToken:
+			asynclogger.Warning("[%s] verifyEmail rejected ip=%s dur=%s", reqID, ip, time.Since(start))
 			render.Render(w, r, types.ErrInvalidRequest(http.StatusBadRequest, err))
 			return
+		case repositories.ErrNotImplemented:
+			render.Render(w, r, types.ErrInvalidRequest(http.StatusNotImplemented, err))
+			return
 		default:
-			asynclogger.Error("[%s] createUser failed username=%q dur=%s err=%v", reqID, req.Username, time.Since(start), err)
+			asynclogger.Error("[%s] verifyEmail failed ip=%s dur=%s err=%v", reqID, ip, time.Since(start), err)
 			render.Render(w, r, types.ErrInvalidRequest(http.StatusInternalServerError, fmt.Errorf("internal error")))
 			return
 		}
 	}
 
+	asynclogger.Info("[%s] verifyEmail success ip=%s dur=%s", reqID, ip, time.Since(start))
+	render.Render(w, r, &okResponse{Status: "ok", Message: "email verified"})
+}
+
+func (h *Handler) sendEmailVerification(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	start := time.Now().UTC()
+	caller := principalFrom(r.Context())
+
+	if err := h.auth.SendEmailVerification(r.Context(), caller.UserID); err != nil {
+		switch err {
+		case repositories.ErrInvalidEmail:
+			render.Render(w, r, types.ErrInvalidRequest(http.StatusBadRequest, fmt.Errorf("account has no email address")))
+			return
+		case repositories.ErrNotImplemented:
+			render.Render(w, r, types.ErrInvalidRequest(http.StatusNotImplemented, err))
+			return
+		default:
+			asynclogger.Error("[%s] sendEmailVerification failed user_id=%d dur=%s err=%v", reqID, caller.UserID, time.Since(start), err)
+			render.Render(w, r, types.ErrInvalidRequest(http.StatusInternalServerError, fmt.Errorf("internal error")))
+			return
+		}
+	}
+
+	asynclogger.Info("[%s] sendEmailVerification success user_id=%d dur=%s", reqID, caller.UserID, time.Since(start))
+	render.Status(r, http.StatusAccepted)
+	render.Render(w, r, &okResponse{Status: "ok", Message: "verification email sent"})
+}
+
+func (h *Handler) createUser(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	start := time.Now().UTC()
+
+	var req createUserRequest
+	if err := render.Bind(r, &req); err != nil {
+		asynclogger.Warning("[%s] createUser bind failed ip=%s ua=%q err=%v", reqID, clientIP(r), r.Header.Get("User-Agent"), err)
+		render.Render(w, r, types.ErrInvalidRequest(http.StatusBadRequest, fmt.Errorf("invalid request body")))
+		return
+	}
+
+	caller := principalFrom(r.Context())
+	user, err := h.auth.CreateUser(r.Context(), req.Username, req.Password, req.Email)
+	if err != nil {
+		h.recordAudit(r, types.AuditEvent{Type: types.AuditUserCreate, ActorID: &caller.UserID, Username: req.Username, Outcome: types.OutcomeFailure, Detail: err.Error()})
+		if resp := newUserError(err); resp != nil {
+			asynclogger.Warning("[%s] createUser refused username=%q status=%d err=%v dur=%s", reqID, req.Username, resp.HTTPStatusCode, err, time.Since(start))
+			render.Render(w, r, resp)
+			return
+		}
+		asynclogger.Error("[%s] createUser failed username=%q dur=%s err=%v", reqID, req.Username, time.Since(start), err)
+		render.Render(w, r, types.ErrInvalidRequest(http.StatusInternalServerError, fmt.Errorf("internal error")))
+		return
+	}
+
 	asynclogger.Info("[%s] createUser success user_id=%d username=%q dur=%s", reqID, user.ID, user.Username, time.Since(start))
+	h.recordAudit(r, types.AuditEvent{Type: types.AuditUserCreate, UserID: &user.ID, ActorID: &caller.UserID, Username: user.Username, Outcome: types.OutcomeSuccess})
 	render.Render(w, r, &types.LoginResponse{
 		Access:  "",
 		Refresh: "",
-		User:    types.UserDTO{ID: user.ID, Username: user.Username},
+		User:    types.NewUserDTO(user),
 	})
 }
 
+// newUserError maps the errors refusing the details of a new account to a
+// response, or returns nil for internal errors.
+func newUserError(err error) *types.ErrResponse {
+	var nameErr *usernames.Error
+	if errors.As(err, &nameErr) {
+		return types.ErrWithReason(http.StatusBadRequest, nameErr, string(nameErr.Reason))
+	}
+	var weak *passwords.PolicyError
+	if errors.As(err, &weak) {
+		return types.ErrWithAppCode(http.StatusBadRequest, weak, weak.Code)
+	}
+	switch err {
+	case repositories.ErrDuplicateUsername:
+		return types.ErrWithReason(http.StatusConflict, err, types.ReasonUsernameTaken)
+	case repositories.ErrUsernameReserved:
+		return types.ErrWithReason(http.StatusConflict, err, types.ReasonUsernameRecentlyUsed)
+	case repositories.ErrDuplicateEmail:
+		return types.ErrInvalidRequest(http.StatusConflict, err)
+	case repositories.ErrInvalidCredentials, repositories.ErrInvalidEmail:
+		return types.ErrInvalidRequest(http.StatusBadRequest, err)
+	}
+	return nil
+}
+
+func (h *Handler) changeUsername(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	start := time.Now().UTC()
+	caller := principalFrom(r.Context())
+
+	var req changeUsernameRequest
+	if err := render.Bind(r, &req); err != nil {
+		asynclogger.Warning("[%s] changeUsername bind failed user_id=%d err=%v", reqID, caller.UserID, err)
+		render.Render(w, r, types.ErrInvalidRequest(http.StatusBadRequest, fmt.Errorf("invalid request body")))
+		return
+	}
+
+	user, err := h.auth.ChangeUsername(r.Context(), caller.UserID, req.Username)
+	if err != nil {
+		var nameErr *usernames.Error
+		if errors.As(err, &nameErr) {
+			render.Render(w, r, types.ErrWithReason(http.StatusBadRequest, nameErr, string(nameErr.Reason)))
+			return
+		}
+		switch err {
+		case repositories.ErrInvalidUsername:
+			render.Render(w, r, types.ErrInvalidRequest(http.StatusBadRequest, err))
+			return
+		case repositories.ErrDuplicateUsername:
+			asynclogger.Warning("[%s] changeUsername taken user_id=%d username=%q dur=%s", reqID, caller.UserID, req.Username, time.Since(start))
+			render.Render(w, r, types.ErrWithReason(http.StatusConflict, err, types.ReasonUsernameTaken))
+			return
+		case repositories.ErrUsernameReserved:
+			asynclogger.Warning("[%s] changeUsername recently used user_id=%d username=%q dur=%s", reqID, caller.UserID, req.Username, time.Since(start))
+			render.Render(w, r, types.ErrWithReason(http.StatusConflict, err, types.ReasonUsernameRecentlyUsed))
+			return
+		case repositories.ErrNotFound:
+			render.Render(w, r, types.ErrInvalidRequest(http.StatusUnauthorized, repositories.ErrInvalidToken))
+			return
+		case repositories.ErrNotImplemented:
+			render.Render(w, r, types.ErrInvalidRequest(http.StatusNotImplemented, err))
+			return
+		default:
+			asynclogger.Error("[%s] changeUsername failed user_id=%d dur=%s err=%v", reqID, caller.UserID, time.Since(start), err)
+			render.Render(w, r, types.ErrInvalidRequest(http.StatusInternalServerError, fmt.Errorf("internal error")))
+			return
+		}
+	}
+
+	asynclogger.Info("[%s] changeUsername success user_id=%d old=%q new=%q dur=%s", reqID, user.ID, caller.Username, user.Username, time.Since(start))
+	render.Render(w, r, &types.UserResponse{User: types.NewUserDTO(user)})
+}
+
 func (h *Handler) deleteUser(w http.ResponseWriter, r *http.Request) {
 	reqID := middleware.GetReqID(r.Context())
 	start := time.Now().UTC()
@@ -211,7 +737,17 @@ func (h *Handler) deleteUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Admins may delete anyone, everybody else only their own account.
+	caller := principalFrom(r.Context())
+	if caller.UserID != id && !caller.HasRole(authjwt.RoleAdmin) {
+		asynclogger.Warning("[%s] deleteUser forbidden caller_id=%d id=%d", reqID, caller.UserID, id)
+		h.recordAudit(r, types.AuditEvent{Type: types.AuditUserDelete, UserID: &id, ActorID: &caller.UserID, Outcome: types.OutcomeDenied})
+		render.Render(w, r, types.ErrInvalidRequest(http.StatusForbidden, authjwt.ErrForbidden))
+		return
+	}
+
 	if err := h.auth.DeleteUser(r.Context(), id); err != nil {
+		h.recordAudit(r, types.AuditEvent{Type: types.AuditUserDelete, UserID: &id, ActorID: &caller.UserID, Outcome: types.OutcomeFailure, Detail: err.Error()})
 		if err == repositories.ErrNotFound {
 			asynclogger.Warning("[%s] deleteUser not found id=%d dur=%s", reqID, id, time.Since(start))
 			render.Render(w, r, types.ErrInvalidRequest(http.StatusNotFound, err))
@@ -223,5 +759,6 @@ func (h *Handler) deleteUser(w http.ResponseWriter, r *http.Request) {
 	}
 
 	asynclogger.Info("[%s] deleteUser success id=%d dur=%s", reqID, id, time.Since(start))
+	h.recordAudit(r, types.AuditEvent{Type: types.AuditUserDelete, UserID: &id, ActorID: &caller.UserID, Outcome: types.OutcomeSuccess})
 	render.Render(w, r, &okResponse{Status: "ok", Message: "user deleted"})
 }
@@ -4,20 +4,32 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/render"
+	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 
+	"bioly/auth/internal/config"
+	"bioly/auth/internal/keys"
+	"bioly/auth/internal/oauth"
+	"bioly/auth/internal/passwords"
+	"bioly/auth/internal/pow"
 	"bioly/auth/internal/repositories"
 	"bioly/auth/internal/transport"
 	"bioly/auth/internal/types"
 	"bioly/auth/internal/usecase"
+	"bioly/authjwt"
+	"bioly/usernames"
 )
 
 // --- mock AuthService ---
@@ -25,8 +37,39 @@ import (
 type authMock struct {
 	loginFn      func(username, password, ua, ip string) (*types.User, *usecase.Tokens, error)
 	refreshFn    func(refresh, ua, ip string) (*types.User, *usecase.Tokens, error)
-	createUserFn func(username, password string) (*types.User, error)
+	logoutFn     func(refresh string) error
+	logoutAllFn  func(userID int64) error
+	listSessFn   func(userID int64) ([]types.Session, error)
+	revokeSessFn func(userID int64, jti uuid.UUID) error
+	parseFn      func(token string) (*authjwt.Principal, error)
+	jwks         keys.JWKS
+	sendVerifyFn func(userID int64) error
+	loginMFAFn   func(token, code string) (*types.User, *usecase.Tokens, error)
+	enrollFn     func(userID int64) (*usecase.TOTPEnrollment, error)
+	confirmFn    func(userID int64, code string) error
+	disableFn    func(userID int64, code string) error
+	verifyMailFn func(token string) error
+	forgotFn     func(username string) error
+	resetFn      func(token, password string) error
+	changePwFn   func(userID int64, sid, current, password string) (*types.User, *usecase.Tokens, error)
+	createUserFn func(username, password, email string) (*types.User, error)
 	deleteUserFn func(id int64) error
+	renameFn     func(userID int64, username string) (*types.User, error)
+	startOAuthFn func(provider string) (*usecase.OAuthFlow, error)
+	finishFn     func(provider, code, state, flow string) (*types.User, *usecase.Tokens, error)
+	introspectFn func(token string) (*authjwt.Principal, error)
+	createTokFn  func(userID int64, name string, scopes []string, expiresIn time.Duration) (string, *types.PersonalToken, error)
+	listTokFn    func(userID int64) ([]types.PersonalToken, error)
+	revokeTokFn  func(userID, id int64) error
+	challengeFn  func() (*usecase.RegistrationChallenge, error)
+	registerFn   func(username, password, email, challenge, nonce, invite string) (*types.User, error)
+	inviteFn     func(createdBy int64, maxUses int, expiresIn time.Duration) (string, *types.Invite, error)
+	beginPKRegFn func(userID int64) (*usecase.PasskeyCeremony, error)
+	finPKRegFn   func(userID int64, session, name string, credential []byte) (*types.WebAuthnCredential, error)
+	beginPKFn    func() (*usecase.PasskeyCeremony, error)
+	finPKFn      func(session string, credential []byte, ua, ip string) (*types.User, *usecase.Tokens, error)
+	sendMagicFn  func(email, ua string) error
+	magicFn      func(token, ua, ip string) (*types.User, *usecase.Tokens, error)
 }
 
 func (m *authMock) Login(_ ctx, username, password, ua, ip string) (*types.User, *usecase.Tokens, error) {
@@ -35,12 +78,109 @@ func (m *authMock) Login(_ ctx, username, password, ua, ip string) (*types.User,
 func (m *authMock) Refresh(_ ctx, refresh, ua, ip string) (*types.User, *usecase.Tokens, error) {
 	return m.refreshFn(refresh, ua, ip)
 }
-func (m *authMock) CreateUser(_ ctx, username, password string) (*types.User, error) {
-	return m.createUserFn(username, password)
+func (m *authMock) Logout(_ ctx, refresh string) error {
+	return m.logoutFn(refresh)
+}
+func (m *authMock) LogoutAll(_ ctx, userID int64) error {
+	return m.logoutAllFn(userID)
+}
+func (m *authMock) ListSessions(_ ctx, userID int64) ([]types.Session, error) {
+	return m.listSessFn(userID)
+}
+func (m *authMock) RevokeSession(_ ctx, userID int64, jti uuid.UUID) error {
+	return m.revokeSessFn(userID, jti)
+}
+func (m *authMock) ParseAccess(_ ctx, token string) (*authjwt.Principal, error) {
+	if m.parseFn == nil {
+		return nil, repositories.ErrInvalidToken
+	}
+	return m.parseFn(token)
+}
+func (m *authMock) Introspect(_ ctx, token string) (*authjwt.Principal, error) {
+	return m.introspectFn(token)
+}
+func (m *authMock) JWKS() keys.JWKS {
+	return m.jwks
+}
+func (m *authMock) ForgotPassword(_ ctx, username, ip string) error {
+	return m.forgotFn(username)
+}
+func (m *authMock) ResetPassword(_ ctx, token, password string) error {
+	return m.resetFn(token, password)
+}
+func (m *authMock) ChangePassword(_ ctx, userID int64, sid, current, password, ua, ip string) (*types.User, *usecase.Tokens, error) {
+	return m.changePwFn(userID, sid, current, password)
+}
+func (m *authMock) LoginMFA(_ ctx, token, code, ua, ip string) (*types.User, *usecase.Tokens, error) {
+	return m.loginMFAFn(token, code)
+}
+func (m *authMock) EnrollTOTP(_ ctx, userID int64) (*usecase.TOTPEnrollment, error) {
+	return m.enrollFn(userID)
+}
+func (m *authMock) ConfirmTOTP(_ ctx, userID int64, code string) error {
+	return m.confirmFn(userID, code)
+}
+func (m *authMock) DisableTOTP(_ ctx, userID int64, code string) error {
+	return m.disableFn(userID, code)
+}
+func (m *authMock) SendEmailVerification(_ ctx, userID int64) error {
+	return m.sendVerifyFn(userID)
+}
+func (m *authMock) VerifyEmail(_ ctx, token string) error {
+	return m.verifyMailFn(token)
+}
+func (m *authMock) CreateUser(_ ctx, username, password, email string) (*types.User, error) {
+	return m.createUserFn(username, password, email)
+}
+func (m *authMock) ChangeUsername(_ ctx, userID int64, username string) (*types.User, error) {
+	return m.renameFn(userID, username)
 }
 func (m *authMock) DeleteUser(_ ctx, id int64) error {
 	return m.deleteUserFn(id)
 }
+func (m *authMock) StartOAuth(_ ctx, provider string) (*usecase.OAuthFlow, error) {
+	return m.startOAuthFn(provider)
+}
+func (m *authMock) FinishOAuth(_ ctx, provider, code, state, flow, ua, ip string) (*types.User, *usecase.Tokens, error) {
+	return m.finishFn(provider, code, state, flow)
+}
+
+func (m *authMock) CreateToken(_ ctx, userID int64, name string, scopes []string, expiresIn time.Duration) (string, *types.PersonalToken, error) {
+	return m.createTokFn(userID, name, scopes, expiresIn)
+}
+func (m *authMock) ListTokens(_ ctx, userID int64) ([]types.PersonalToken, error) {
+	return m.listTokFn(userID)
+}
+func (m *authMock) RevokeToken(_ ctx, userID, id int64) error {
+	return m.revokeTokFn(userID, id)
+}
+func (m *authMock) RegisterChallenge(_ ctx) (*usecase.RegistrationChallenge, error) {
+	return m.challengeFn()
+}
+func (m *authMock) Register(_ ctx, username, password, email, challenge, nonce, invite string) (*types.User, error) {
+	return m.registerFn(username, password, email, challenge, nonce, invite)
+}
+func (m *authMock) CreateInvite(_ ctx, createdBy int64, maxUses int, expiresIn time.Duration) (string, *types.Invite, error) {
+	return m.inviteFn(createdBy, maxUses, expiresIn)
+}
+func (m *authMock) BeginPasskeyRegistration(_ ctx, userID int64) (*usecase.PasskeyCeremony, error) {
+	return m.beginPKRegFn(userID)
+}
+func (m *authMock) FinishPasskeyRegistration(_ ctx, userID int64, session, name string, credential []byte) (*types.WebAuthnCredential, error) {
+	return m.finPKRegFn(userID, session, name, credential)
+}
+func (m *authMock) BeginPasskeyLogin(_ ctx) (*usecase.PasskeyCeremony, error) {
+	return m.beginPKFn()
+}
+func (m *authMock) FinishPasskeyLogin(_ ctx, session string, credential []byte, ua, ip string) (*types.User, *usecase.Tokens, error) {
+	return m.finPKFn(session, credential, ua, ip)
+}
+func (m *authMock) SendMagicLink(_ ctx, email, ua, _ string) error {
+	return m.sendMagicFn(email, ua)
+}
+func (m *authMock) LoginMagic(_ ctx, token, ua, ip string) (*types.User, *usecase.Tokens, error) {
+	return m.magicFn(token, ua, ip)
+}
 
 type ctx = context.Context
 
@@ -119,6 +259,114 @@ func TestLogin_BadJSON(t *testing.T) {
 	assert.Equal(t, http.StatusBadRequest, w.Code)
 }
 
+func TestLogin_Throttled(t *testing.T) {
+	m := &authMock{
+		loginFn: func(username, password, ua, ip string) (*types.User, *usecase.Tokens, error) {
+			return nil, nil, &usecase.RetryLaterError{RetryAfter: 1500 * time.Millisecond, Locked: true}
+		},
+	}
+	router := makeRouter(transport.NewHandler(m))
+
+	w := doJSON(t, router, http.MethodPost, "/login", map[string]string{
+		"username": "admin",
+		"password": "guess",
+	}, nil)
+
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "2", w.Header().Get("Retry-After"))
+}
+
+func TestLogin_MFARequired(t *testing.T) {
+	m := &authMock{
+		loginFn: func(username, password, ua, ip string) (*types.User, *usecase.Tokens, error) {
+			return nil, nil, &usecase.MFARequiredError{Token: "pending", ExpiresIn: 5 * time.Minute}
+		},
+	}
+	router := makeRouter(transport.NewHandler(m))
+
+	w := doJSON(t, router, http.MethodPost, "/login", map[string]string{
+		"username": "admin",
+		"password": "secret",
+	}, nil)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	var resp types.MFAChallengeResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.True(t, resp.MFARequired)
+	assert.Equal(t, "pending", resp.MFAToken)
+	assert.Equal(t, 300, resp.ExpiresIn)
+	assert.NotContains(t, w.Body.String(), `"access"`)
+}
+
+func TestLoginMFA(t *testing.T) {
+	m := &authMock{
+		loginMFAFn: func(token, code string) (*types.User, *usecase.Tokens, error) {
+			if token == "pending" && code == "123456" {
+				return &types.User{ID: 1, Username: "admin"}, &usecase.Tokens{Access: "a", Refresh: "r"}, nil
+			}
+			return nil, nil, repositories.ErrInvalidMFACode
+		},
+	}
+	router := makeRouter(transport.NewHandler(m))
+
+	w := doJSON(t, router, http.MethodPost, "/login/mfa", map[string]string{"mfa_token": "pending", "code": "123456"}, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var resp types.LoginResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, "a", resp.Access)
+
+	w = doJSON(t, router, http.MethodPost, "/login/mfa", map[string]string{"mfa_token": "pending", "code": "000000"}, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = doJSON(t, router, http.MethodPost, "/login/mfa", map[string]string{"code": "000000"}, nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestEnrollTOTP(t *testing.T) {
+	m := &authMock{
+		parseFn: asUser(7, "sid"),
+		enrollFn: func(userID int64) (*usecase.TOTPEnrollment, error) {
+			assert.Equal(t, int64(7), userID)
+			return &usecase.TOTPEnrollment{Secret: "S", URI: "otpauth://totp/x", RecoveryCodes: []string{"a", "b"}}, nil
+		},
+	}
+	router := makeRouter(transport.NewHandler(m))
+
+	w := doJSON(t, router, http.MethodPost, "/mfa/totp/enroll", nil, bearer)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+	var resp types.TOTPEnrollmentResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, "otpauth://totp/x", resp.OTPAuthURI)
+	assert.Equal(t, []string{"a", "b"}, resp.RecoveryCodes)
+
+	w = doJSON(t, router, http.MethodPost, "/mfa/totp/enroll", nil, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestConfirmAndDisableTOTP(t *testing.T) {
+	m := &authMock{
+		parseFn: asUser(7, "sid"),
+		confirmFn: func(userID int64, code string) error {
+			if code == "123456" {
+				return nil
+			}
+			return repositories.ErrInvalidMFACode
+		},
+		disableFn: func(userID int64, code string) error {
+			return repositories.ErrMFANotEnabled
+		},
+	}
+	router := makeRouter(transport.NewHandler(m))
+
+	w := doJSON(t, router, http.MethodPost, "/mfa/totp/confirm", map[string]string{"code": "123456"}, bearer)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = doJSON(t, router, http.MethodPost, "/mfa/totp/confirm", map[string]string{"code": "000000"}, bearer)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = doJSON(t, router, http.MethodPost, "/mfa/totp/disable", map[string]string{"code": "123456"}, bearer)
+	assert.Equal(t, http.StatusConflict, w.Code)
+}
+
 func TestRefresh_Success(t *testing.T) {
 	m := &authMock{
 		refreshFn: func(refresh, ua, ip string) (*types.User, *usecase.Tokens, error) {
@@ -157,12 +405,316 @@ func TestRefresh_BadJSON(t *testing.T) {
 	assert.Equal(t, http.StatusBadRequest, w.Code)
 }
 
+func TestRefresh_InvalidToken(t *testing.T) {
+	m := &authMock{
+		refreshFn: func(refresh, ua, ip string) (*types.User, *usecase.Tokens, error) {
+			return nil, nil, repositories.ErrTokenReused
+		},
+	}
+	h := transport.NewHandler(m)
+	router := makeRouter(h)
+
+	w := doJSON(t, router, http.MethodPost, "/refresh", map[string]string{
+		"refresh": "rt-reused",
+	}, nil)
+
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestLogout_Success(t *testing.T) {
+	m := &authMock{
+		logoutFn: func(refresh string) error {
+			assert.Equal(t, "rt-123", refresh)
+			return nil
+		},
+	}
+	router := makeRouter(transport.NewHandler(m))
+
+	w := doJSON(t, router, http.MethodPost, "/logout", map[string]string{"refresh": "rt-123"}, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestLogout_InvalidToken(t *testing.T) {
+	m := &authMock{
+		logoutFn: func(refresh string) error { return repositories.ErrInvalidToken },
+	}
+	router := makeRouter(transport.NewHandler(m))
+
+	w := doJSON(t, router, http.MethodPost, "/logout", map[string]string{"refresh": "bogus"}, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestLogout_BadJSON(t *testing.T) {
+	m := &authMock{logoutFn: func(string) error { return nil }}
+	router := makeRouter(transport.NewHandler(m))
+
+	w := doJSON(t, router, http.MethodPost, "/logout", map[string]any{}, nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestLogoutAll_Success(t *testing.T) {
+	m := &authMock{
+		parseFn: func(token string) (*authjwt.Principal, error) {
+			assert.Equal(t, "access.jwt", token)
+			return &authjwt.Principal{UserID: 3, Username: "u3"}, nil
+		},
+		logoutAllFn: func(userID int64) error {
+			assert.Equal(t, int64(3), userID)
+			return nil
+		},
+	}
+	router := makeRouter(transport.NewHandler(m))
+
+	w := doJSON(t, router, http.MethodPost, "/logout/all", nil, map[string]string{"Authorization": "Bearer access.jwt"})
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestLogoutAll_Unauthorized(t *testing.T) {
+	m := &authMock{
+		logoutAllFn: func(userID int64) error {
+			t.Fatalf("LogoutAll should not be called without a valid token")
+			return nil
+		},
+	}
+	router := makeRouter(transport.NewHandler(m))
+
+	w := doJSON(t, router, http.MethodPost, "/logout/all", nil, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = doJSON(t, router, http.MethodPost, "/logout/all", nil, map[string]string{"Authorization": "Bearer forged"})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func asUser(id int64, sid string, roles ...string) func(string) (*authjwt.Principal, error) {
+	return func(token string) (*authjwt.Principal, error) {
+		if token != "access.jwt" {
+			return nil, repositories.ErrInvalidToken
+		}
+		return &authjwt.Principal{UserID: id, Username: "u", SessionID: sid, Roles: roles}, nil
+	}
+}
+
+func asAdmin(id int64) func(string) (*authjwt.Principal, error) {
+	return asUser(id, "sid", authjwt.RoleUser, authjwt.RoleAdmin)
+}
+
+var bearer = map[string]string{"Authorization": "Bearer access.jwt"}
+
+func TestListSessions_FlagsCurrent(t *testing.T) {
+	current, other := uuid.New(), uuid.New()
+	now := time.Now().UTC().Truncate(time.Second)
+	m := &authMock{
+		parseFn: asUser(4, current.String()),
+		listSessFn: func(userID int64) ([]types.Session, error) {
+			assert.Equal(t, int64(4), userID)
+			return []types.Session{
+				{JTI: uuid.New(), FamilyID: current, IP: "10.0.0.1", CreatedAt: now, LastUsedAt: now, ExpiresAt: now.Add(time.Hour),
+					UserAgent: "Mozilla/5.0 (X11; Ubuntu; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0"},
+				{JTI: uuid.New(), FamilyID: other, CreatedAt: now, LastUsedAt: now, ExpiresAt: now.Add(time.Hour),
+					UserAgent: "Mozilla/5.0 (iPhone; CPU iPhone OS 17_2 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.2 Mobile/15E148 Safari/604.1"},
+			}, nil
+		},
+	}
+	router := makeRouter(transport.NewHandler(m))
+
+	w := doJSON(t, router, http.MethodGet, "/sessions", nil, bearer)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var resp types.SessionsResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	if assert.Len(t, resp.Sessions, 2) {
+		assert.True(t, resp.Sessions[0].Current)
+		assert.Equal(t, "Firefox 121 on Linux", resp.Sessions[0].Summary)
+		assert.Equal(t, "desktop", resp.Sessions[0].Device)
+		assert.Equal(t, "10.0.0.1", resp.Sessions[0].IP)
+		assert.False(t, resp.Sessions[1].Current)
+		assert.Equal(t, "mobile", resp.Sessions[1].Device)
+		assert.Equal(t, "Safari", resp.Sessions[1].Browser)
+	}
+}
+
+func TestListSessions_Unauthorized(t *testing.T) {
+	router := makeRouter(transport.NewHandler(&authMock{}))
+
+	w := doJSON(t, router, http.MethodGet, "/sessions", nil, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestRevokeSession(t *testing.T) {
+	jti := uuid.New()
+	m := &authMock{
+		parseFn: asUser(4, ""),
+		revokeSessFn: func(userID int64, got uuid.UUID) error {
+			assert.Equal(t, int64(4), userID)
+			if got != jti {
+				return repositories.ErrNotFound
+			}
+			return nil
+		},
+	}
+	router := makeRouter(transport.NewHandler(m))
+
+	w := doJSON(t, router, http.MethodDelete, "/sessions/"+jti.String(), nil, bearer)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = doJSON(t, router, http.MethodDelete, "/sessions/"+uuid.NewString(), nil, bearer)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = doJSON(t, router, http.MethodDelete, "/sessions/not-a-uuid", nil, bearer)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestJWKS(t *testing.T) {
+	m := &authMock{jwks: keys.JWKS{Keys: []keys.JWK{{Kty: "OKP", Kid: "k1", Use: "sig", Alg: "EdDSA", Crv: "Ed25519", X: "abc"}}}}
+	router := makeRouter(transport.NewHandler(m))
+
+	w := doJSON(t, router, http.MethodGet, "/.well-known/jwks.json", nil, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Header().Get("Cache-Control"), "max-age")
+	var resp keys.JWKS
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	if assert.Len(t, resp.Keys, 1) {
+		assert.Equal(t, "k1", resp.Keys[0].Kid)
+	}
+}
+
+func TestForgotPassword_Accepted(t *testing.T) {
+	var got string
+	m := &authMock{
+		forgotFn: func(username string) error {
+			got = username
+			return nil
+		},
+	}
+	router := makeRouter(transport.NewHandler(m))
+
+	w := doJSON(t, router, http.MethodPost, "/password/forgot", map[string]string{"username": "admin"}, nil)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.Equal(t, "admin", got)
+}
+
+func TestForgotPassword_Throttled(t *testing.T) {
+	m := &authMock{
+		forgotFn: func(username string) error {
+			return &usecase.RetryLaterError{RetryAfter: 1500 * time.Millisecond}
+		},
+	}
+	router := makeRouter(transport.NewHandler(m))
+
+	w := doJSON(t, router, http.MethodPost, "/password/forgot", map[string]string{"username": "admin"}, nil)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "2", w.Header().Get("Retry-After"))
+}
+
+func TestForgotPassword_BadJSON(t *testing.T) {
+	router := makeRouter(transport.NewHandler(&authMock{}))
+
+	w := doJSON(t, router, http.MethodPost, "/password/forgot", map[string]string{}, nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestResetPassword_Success(t *testing.T) {
+	m := &authMock{
+		resetFn: func(token, password string) error {
+			assert.Equal(t, "tok", token)
+			assert.Equal(t, "n3w-secret", password)
+			return nil
+		},
+	}
+	router := makeRouter(transport.NewHandler(m))
+
+	w := doJSON(t, router, http.MethodPost, "/password/reset", map[string]string{
+		"token":    "tok",
+		"password": "n3w-secret",
+	}, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestResetPassword_InvalidToken(t *testing.T) {
+	m := &authMock{
+		resetFn: func(token, password string) error {
+			return repositories.ErrInvalidToken
+		},
+	}
+	router := makeRouter(transport.NewHandler(m))
+
+	w := doJSON(t, router, http.MethodPost, "/password/reset", map[string]string{
+		"token":    "tok",
+		"password": "n3w-secret",
+	}, nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestResetPassword_PolicyError(t *testing.T) {
+	policy := passwords.NewPolicy(&config.PasswordPolicy{MinLength: 8, MinStrength: 2}, nil)
+	m := &authMock{
+		resetFn: func(token, password string) error {
+			return policy.Check(password)
+		},
+	}
+	router := makeRouter(transport.NewHandler(m))
+
+	w := doJSON(t, router, http.MethodPost, "/password/reset", map[string]string{
+		"token":    "tok",
+		"password": "password",
+	}, nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	var resp types.ErrResponse
+	_ = json.Unmarshal(w.Body.Bytes(), &resp)
+	assert.Equal(t, passwords.CodeTooWeak, resp.AppCode)
+	assert.Contains(t, resp.Error, "too easy to guess")
+}
+
+func TestChangePassword(t *testing.T) {
+	m := &authMock{
+		parseFn: asUser(7, "sid-1"),
+		changePwFn: func(userID int64, sid, current, password string) (*types.User, *usecase.Tokens, error) {
+			assert.Equal(t, int64(7), userID)
+			assert.Equal(t, "sid-1", sid)
+			switch current {
+			case "current":
+				assert.Equal(t, "n3w-secret", password)
+				return &types.User{ID: 7, Username: "u"}, &usecase.Tokens{Access: "a2", Refresh: "r2"}, nil
+			case "locked":
+				return nil, nil, &usecase.RetryLaterError{RetryAfter: time.Minute, Locked: true}
+			}
+			return nil, nil, repositories.ErrInvalidCredentials
+		},
+	}
+	router := makeRouter(transport.NewHandler(m))
+
+	body := func(current string) map[string]string {
+		return map[string]string{"current_password": current, "new_password": "n3w-secret"}
+	}
+
+	w := doJSON(t, router, http.MethodPost, "/password/change", body("current"), bearer)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var resp types.LoginResponse
+	_ = json.Unmarshal(w.Body.Bytes(), &resp)
+	assert.Equal(t, "a2", resp.Access)
+	assert.Equal(t, "r2", resp.Refresh)
+
+	w = doJSON(t, router, http.MethodPost, "/password/change", body("guess"), bearer)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = doJSON(t, router, http.MethodPost, "/password/change", body("locked"), bearer)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "60", w.Header().Get("Retry-After"))
+
+	w = doJSON(t, router, http.MethodPost, "/password/change", body(""), bearer)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = doJSON(t, router, http.MethodPost, "/password/change", body("current"), nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
 func TestCreateUser_Success(t *testing.T) {
 	m := &authMock{
-		createUserFn: func(username, password string) (*types.User, error) {
+		parseFn: asAdmin(1),
+		createUserFn: func(username, password, email string) (*types.User, error) {
 			assert.Equal(t, "newbie", username)
 			assert.Equal(t, "pass", password)
-			return &types.User{ID: 10, Username: "newbie"}, nil
+			assert.Equal(t, "newbie@example.com", email)
+			return &types.User{ID: 10, Username: "newbie", Email: &email}, nil
 		},
 	}
 	h := transport.NewHandler(m)
@@ -171,7 +723,8 @@ func TestCreateUser_Success(t *testing.T) {
 	w := doJSON(t, router, http.MethodPost, "/users", map[string]string{
 		"username": "newbie",
 		"password": "pass",
-	}, nil)
+		"email":    "newbie@example.com",
+	}, bearer)
 
 	assert.Equal(t, http.StatusOK, w.Code)
 	var resp struct {
@@ -180,11 +733,14 @@ func TestCreateUser_Success(t *testing.T) {
 	_ = json.Unmarshal(w.Body.Bytes(), &resp)
 	assert.Equal(t, int64(10), resp.User.ID)
 	assert.Equal(t, "newbie", resp.User.Username)
+	assert.Equal(t, "newbie@example.com", resp.User.Email)
+	assert.False(t, resp.User.EmailVerified)
 }
 
 func TestCreateUser_Conflict(t *testing.T) {
 	m := &authMock{
-		createUserFn: func(username, password string) (*types.User, error) {
+		parseFn: asAdmin(1),
+		createUserFn: func(username, password, email string) (*types.User, error) {
 			return nil, repositories.ErrDuplicateUsername
 		},
 	}
@@ -194,41 +750,959 @@ func TestCreateUser_Conflict(t *testing.T) {
 	w := doJSON(t, router, http.MethodPost, "/users", map[string]string{
 		"username": "admin",
 		"password": "x",
-	}, nil)
+	}, bearer)
 
 	assert.Equal(t, http.StatusConflict, w.Code)
 }
 
-func TestDeleteUser_Success(t *testing.T) {
+func TestCreateUser_InvalidEmail(t *testing.T) {
 	m := &authMock{
-		deleteUserFn: func(id int64) error {
-			assert.Equal(t, int64(5), id)
-			return nil
+		parseFn: asAdmin(1),
+		createUserFn: func(username, password, email string) (*types.User, error) {
+			return nil, repositories.ErrInvalidEmail
 		},
 	}
-	h := transport.NewHandler(m)
-	router := makeRouter(h)
+	router := makeRouter(transport.NewHandler(m))
 
-	w := doJSON(t, router, http.MethodDelete, "/users/"+strconv.FormatInt(5, 10), nil, nil)
-	assert.Equal(t, http.StatusOK, w.Code)
+	w := doJSON(t, router, http.MethodPost, "/users", map[string]string{
+		"username": "admin",
+		"password": "x",
+		"email":    "not an email",
+	}, bearer)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
 }
 
-func TestDeleteUser_NotFound(t *testing.T) {
+func TestVerifyEmail(t *testing.T) {
 	m := &authMock{
-		deleteUserFn: func(id int64) error { return repositories.ErrNotFound },
+		verifyMailFn: func(token string) error {
+			if token == "good" {
+				return nil
+			}
+			return repositories.ErrInvalidToken
+		},
 	}
-	h := transport.NewHandler(m)
-	router := makeRouter(h)
+	router := makeRouter(transport.NewHandler(m))
 
-	w := doJSON(t, router, http.MethodDelete, "/users/999", nil, nil)
-	assert.Equal(t, http.StatusNotFound, w.Code)
+	w := doJSON(t, router, http.MethodPost, "/email/verify", map[string]string{"token": "good"}, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = doJSON(t, router, http.MethodPost, "/email/verify", map[string]string{"token": "bad"}, nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
 }
 
-func TestDeleteUser_BadID(t *testing.T) {
-	m := &authMock{deleteUserFn: func(id int64) error { return nil }}
-	h := transport.NewHandler(m)
-	router := makeRouter(h)
+func TestSendEmailVerification(t *testing.T) {
+	var got int64
+	m := &authMock{
+		parseFn: asUser(7, "sid"),
+		sendVerifyFn: func(userID int64) error {
+			got = userID
+			return nil
+		},
+	}
+	router := makeRouter(transport.NewHandler(m))
 
-	w := doJSON(t, router, http.MethodDelete, "/users/abc", nil, nil)
-	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w := doJSON(t, router, http.MethodPost, "/email/verify/send", nil, bearer)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.Equal(t, int64(7), got)
+
+	w = doJSON(t, router, http.MethodPost, "/email/verify/send", nil, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestCreateUser_RequiresAdmin(t *testing.T) {
+	m := &authMock{
+		parseFn: asUser(7, "sid", authjwt.RoleUser),
+		createUserFn: func(username, password, email string) (*types.User, error) {
+			t.Fatal("CreateUser must not be called")
+			return nil, nil
+		},
+	}
+	router := makeRouter(transport.NewHandler(m))
+
+	body := map[string]string{"username": "newbie", "password": "pass"}
+	w := doJSON(t, router, http.MethodPost, "/users", body, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = doJSON(t, router, http.MethodPost, "/users", body, bearer)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestChangeUsername(t *testing.T) {
+	m := &authMock{
+		parseFn: asUser(7, "sid"),
+		renameFn: func(userID int64, username string) (*types.User, error) {
+			assert.Equal(t, int64(7), userID)
+			switch username {
+			case "robert":
+				return &types.User{ID: 7, Username: "robert"}, nil
+			case "x":
+				_, err := usernames.Default().Normalize(username)
+				return nil, fmt.Errorf("%w: %w", repositories.ErrInvalidUsername, err)
+			}
+			return nil, repositories.ErrUsernameReserved
+		},
+	}
+	router := makeRouter(transport.NewHandler(m))
+
+	w := doJSON(t, router, http.MethodPatch, "/users/me/username", map[string]string{"username": "robert"}, bearer)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var resp types.UserResponse
+	_ = json.Unmarshal(w.Body.Bytes(), &resp)
+	assert.Equal(t, "robert", resp.User.Username)
+
+	w = doJSON(t, router, http.MethodPatch, "/users/me/username", map[string]string{"username": "x"}, bearer)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	var errResp types.ErrResponse
+	_ = json.Unmarshal(w.Body.Bytes(), &errResp)
+	assert.Equal(t, "too_short", errResp.Reason)
+
+	w = doJSON(t, router, http.MethodPatch, "/users/me/username", map[string]string{"username": "alice"}, bearer)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	_ = json.Unmarshal(w.Body.Bytes(), &errResp)
+	assert.Equal(t, types.ReasonUsernameRecentlyUsed, errResp.Reason)
+
+	w = doJSON(t, router, http.MethodPatch, "/users/me/username", map[string]string{"username": "robert"}, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestRouteNames(t *testing.T) {
+	names := transport.NewHandler(&authMock{}).RouteNames()
+	assert.Subset(t, names, []string{"ping", "login", "users", "oauth", "audit"})
+	assert.NotContains(t, names, "{id}")
+}
+
+func TestDeleteUser_Success(t *testing.T) {
+	m := &authMock{
+		parseFn: asAdmin(1),
+		deleteUserFn: func(id int64) error {
+			assert.Equal(t, int64(5), id)
+			return nil
+		},
+	}
+	h := transport.NewHandler(m)
+	router := makeRouter(h)
+
+	w := doJSON(t, router, http.MethodDelete, "/users/"+strconv.FormatInt(5, 10), nil, bearer)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestDeleteUser_Self(t *testing.T) {
+	var deleted []int64
+	m := &authMock{
+		parseFn: asUser(7, "sid", authjwt.RoleUser),
+		deleteUserFn: func(id int64) error {
+			deleted = append(deleted, id)
+			return nil
+		},
+	}
+	router := makeRouter(transport.NewHandler(m))
+
+	w := doJSON(t, router, http.MethodDelete, "/users/7", nil, bearer)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = doJSON(t, router, http.MethodDelete, "/users/8", nil, bearer)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = doJSON(t, router, http.MethodDelete, "/users/7", nil, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, []int64{7}, deleted)
+}
+
+func TestDeleteUser_NotFound(t *testing.T) {
+	m := &authMock{
+		parseFn:      asAdmin(1),
+		deleteUserFn: func(id int64) error { return repositories.ErrNotFound },
+	}
+	h := transport.NewHandler(m)
+	router := makeRouter(h)
+
+	w := doJSON(t, router, http.MethodDelete, "/users/999", nil, bearer)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestDeleteUser_BadID(t *testing.T) {
+	m := &authMock{parseFn: asAdmin(1), deleteUserFn: func(id int64) error { return nil }}
+	h := transport.NewHandler(m)
+	router := makeRouter(h)
+
+	w := doJSON(t, router, http.MethodDelete, "/users/abc", nil, bearer)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestStartOAuth(t *testing.T) {
+	m := &authMock{
+		startOAuthFn: func(provider string) (*usecase.OAuthFlow, error) {
+			switch provider {
+			case "github":
+				return &usecase.OAuthFlow{URL: "https://github.test/authorize?state=s", Cookie: "sealed", ExpiresIn: 10 * time.Minute}, nil
+			case "down":
+				return nil, fmt.Errorf("%w: down: dial tcp: refused", oauth.ErrProvider)
+			}
+			return nil, repositories.ErrNotFound
+		},
+	}
+	router := makeRouter(transport.NewHandler(m))
+
+	w := doJSON(t, router, http.MethodGet, "/oauth/github/start", nil, nil)
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, "https://github.test/authorize?state=s", w.Header().Get("Location"))
+	cookies := w.Result().Cookies()
+	if assert.Len(t, cookies, 1) {
+		assert.Equal(t, "oauth_flow", cookies[0].Name)
+		assert.Equal(t, "sealed", cookies[0].Value)
+		assert.Equal(t, 600, cookies[0].MaxAge)
+		assert.True(t, cookies[0].HttpOnly)
+		assert.True(t, cookies[0].Secure)
+	}
+
+	w = doJSON(t, router, http.MethodGet, "/oauth/nope/start", nil, nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = doJSON(t, router, http.MethodGet, "/oauth/down/start", nil, nil)
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+	assert.NotContains(t, w.Body.String(), "refused")
+}
+
+func TestOAuthCallback(t *testing.T) {
+	m := &authMock{
+		finishFn: func(provider, code, state, flow string) (*types.User, *usecase.Tokens, error) {
+			assert.Equal(t, "github", provider)
+			assert.Equal(t, "sealed", flow)
+			switch code {
+			case "good":
+				assert.Equal(t, "s", state)
+				return &types.User{ID: 5, Username: "octo"}, &usecase.Tokens{Access: "a", Refresh: "r"}, nil
+			case "mfa":
+				return nil, nil, &usecase.MFARequiredError{Token: "pending", ExpiresIn: time.Minute}
+			}
+			return nil, nil, repositories.ErrInvalidToken
+		},
+	}
+	router := makeRouter(transport.NewHandler(m))
+	callback := func(query string, withCookie bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/oauth/github/callback?"+query, nil)
+		if withCookie {
+			req.AddCookie(&http.Cookie{Name: "oauth_flow", Value: "sealed"})
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := callback("code=good&state=s", true)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var resp types.LoginResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, "a", resp.Access)
+	assert.Equal(t, "octo", resp.User.Username)
+	cookies := w.Result().Cookies()
+	if assert.Len(t, cookies, 1) {
+		assert.Equal(t, -1, cookies[0].MaxAge, "flow cookie is cleared")
+	}
+
+	w = callback("code=mfa&state=s", true)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"mfa_token":"pending"`)
+
+	w = callback("code=good&state=s", false)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = callback("error=access_denied&state=s", true)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = callback("code=stale&state=s", true)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func introspectMock() *authMock {
+	return &authMock{introspectFn: func(token string) (*authjwt.Principal, error) {
+		switch token {
+		case "good":
+			return &authjwt.Principal{
+				UserID: 7, Username: "alice", SessionID: "sid", Roles: []string{authjwt.RoleUser},
+				ExpiresAt: time.Unix(2000000000, 0),
+			}, nil
+		case "bpat_good":
+			return &authjwt.Principal{
+				UserID: 7, Username: "alice", Roles: []string{authjwt.RoleUser},
+				Scopes: []string{authjwt.ScopeProfileRead, authjwt.ScopeProfileWrite},
+			}, nil
+		case "broken":
+			return nil, errors.New("db down")
+		}
+		return nil, repositories.ErrInvalidToken
+	}}
+}
+
+func TestIntrospect(t *testing.T) {
+	router := makeRouter(transport.NewHandler(introspectMock()))
+	post := func(form string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/introspect", strings.NewReader(form))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := post("token=good&token_type_hint=access_token")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"active":true,"token_type":"Bearer","sub":"7","username":"alice","sid":"sid","roles":["user"],"exp":2000000000}`, w.Body.String())
+
+	w = post("token=revoked")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"active":false}`, w.Body.String())
+
+	w = post("token=bpat_good")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"active":true,"token_type":"Bearer","sub":"7","username":"alice","roles":["user"],"scope":"profile:read profile:write"}`, w.Body.String())
+
+	assert.Equal(t, http.StatusBadRequest, post("").Code)
+	assert.Equal(t, http.StatusInternalServerError, post("token=broken").Code)
+}
+
+func TestVerify(t *testing.T) {
+	router := makeRouter(transport.NewHandler(introspectMock()))
+
+	w := doJSON(t, router, http.MethodGet, "/verify", nil, map[string]string{"Authorization": "Bearer good"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "7", w.Header().Get(authjwt.HeaderUserID))
+	assert.Equal(t, "alice", w.Header().Get(authjwt.HeaderUserName))
+	assert.Equal(t, "user", w.Header().Get(authjwt.HeaderUserRoles))
+	assert.Empty(t, w.Header().Values(authjwt.HeaderUserScopes))
+
+	w = doJSON(t, router, http.MethodGet, "/verify", nil, map[string]string{"Authorization": "Bearer bpat_good"})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "profile:read,profile:write", w.Header().Get(authjwt.HeaderUserScopes))
+
+	w = doJSON(t, router, http.MethodGet, "/verify", nil, map[string]string{"Authorization": "Bearer revoked"})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Contains(t, w.Header().Get("WWW-Authenticate"), "invalid_token")
+
+	w = doJSON(t, router, http.MethodGet, "/verify", nil, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = doJSON(t, router, http.MethodGet, "/verify?optional=1", nil, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get(authjwt.HeaderUserID))
+
+	w = doJSON(t, router, http.MethodGet, "/verify?optional=1", nil, map[string]string{"Authorization": "Bearer revoked"})
+	assert.Equal(t, http.StatusUnauthorized, w.Code, "a bad token is not downgraded to anonymous")
+}
+
+type auditRecorder struct {
+	events []types.AuditEvent
+	filter types.AuditFilter
+}
+
+func (a *auditRecorder) Record(_ ctx, e *types.AuditEvent) error {
+	a.events = append(a.events, *e)
+	return nil
+}
+func (a *auditRecorder) List(_ ctx, f types.AuditFilter) (*usecase.AuditPage, error) {
+	a.filter = f
+	uid := int64(7)
+	return &usecase.AuditPage{
+		Events:     []types.AuditEvent{{ID: 9, Type: types.AuditLogin, UserID: &uid, Outcome: types.OutcomeSuccess}},
+		NextCursor: "9",
+	}, nil
+}
+
+func TestLogin_RecordsAudit(t *testing.T) {
+	m := &authMock{
+		loginFn: func(username, password, ua, ip string) (*types.User, *usecase.Tokens, error) {
+			if password != "secret" {
+				return nil, nil, repositories.ErrInvalidCredentials
+			}
+			return &types.User{ID: 7, Username: username}, &usecase.Tokens{Access: "a", Refresh: "r"}, nil
+		},
+	}
+	audit := &auditRecorder{}
+	r := chi.NewRouter()
+	r.Use(middleware.RequestID)
+	transport.NewHandler(m, transport.WithAudit(audit)).RegisterRoutes(r)
+
+	headers := map[string]string{"User-Agent": "UA", "X-Real-IP": "10.0.0.9"}
+	doJSON(t, r, http.MethodPost, "/login", map[string]string{"username": "alice", "password": "wrong"}, headers)
+	doJSON(t, r, http.MethodPost, "/login", map[string]string{"username": "alice", "password": "secret"}, headers)
+
+	if assert.Len(t, audit.events, 2) {
+		failed, ok := audit.events[0], audit.events[1]
+		assert.Equal(t, types.AuditLogin, failed.Type)
+		assert.Equal(t, types.OutcomeFailure, failed.Outcome)
+		assert.Nil(t, failed.UserID)
+		assert.Equal(t, "alice", failed.Username)
+		assert.Equal(t, "10.0.0.9", failed.IP)
+		assert.Equal(t, "UA", failed.UserAgent)
+		assert.NotEmpty(t, failed.RequestID)
+
+		assert.Equal(t, types.OutcomeSuccess, ok.Outcome)
+		if assert.NotNil(t, ok.UserID) {
+			assert.Equal(t, int64(7), *ok.UserID)
+		}
+	}
+}
+
+func TestDeleteUser_RecordsActor(t *testing.T) {
+	m := &authMock{parseFn: asAdmin(1), deleteUserFn: func(id int64) error { return nil }}
+	audit := &auditRecorder{}
+	router := makeRouter(transport.NewHandler(m, transport.WithAudit(audit)))
+
+	w := doJSON(t, router, http.MethodDelete, "/users/5", nil, bearer)
+	assert.Equal(t, http.StatusOK, w.Code)
+	if assert.Len(t, audit.events, 1) {
+		e := audit.events[0]
+		assert.Equal(t, types.AuditUserDelete, e.Type)
+		assert.Equal(t, int64(5), *e.UserID)
+		assert.Equal(t, int64(1), *e.ActorID)
+	}
+}
+
+func TestListAudit(t *testing.T) {
+	audit := &auditRecorder{}
+	router := makeRouter(transport.NewHandler(&authMock{parseFn: asAdmin(1)}, transport.WithAudit(audit)))
+
+	w := doJSON(t, router, http.MethodGet, "/audit?user_id=7&type=login&since=2025-01-01T00:00:00Z&cursor=42&limit=10", nil, bearer)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, int64(7), *audit.filter.UserID)
+	assert.Equal(t, types.AuditLogin, audit.filter.Type)
+	assert.Equal(t, time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), audit.filter.Since)
+	assert.True(t, audit.filter.Until.IsZero())
+	assert.Equal(t, int64(42), audit.filter.Before)
+	assert.Equal(t, 10, audit.filter.Limit)
+
+	var resp types.AuditEventsResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, "9", resp.NextCursor)
+	if assert.Len(t, resp.Events, 1) {
+		assert.Equal(t, types.OutcomeSuccess, resp.Events[0].Outcome)
+	}
+
+	w = doJSON(t, router, http.MethodGet, "/audit?since=yesterday", nil, bearer)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = doJSON(t, router, http.MethodGet, "/audit?cursor=abc", nil, bearer)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestListAudit_AdminOnly(t *testing.T) {
+	router := makeRouter(transport.NewHandler(&authMock{parseFn: asUser(7, "sid", authjwt.RoleUser)}, transport.WithAudit(&auditRecorder{})))
+	w := doJSON(t, router, http.MethodGet, "/audit", nil, bearer)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	router = makeRouter(transport.NewHandler(&authMock{parseFn: asAdmin(1)}))
+	w = doJSON(t, router, http.MethodGet, "/audit", nil, bearer)
+	assert.Equal(t, http.StatusNotImplemented, w.Code)
+}
+
+func TestCreateToken(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	m := &authMock{
+		parseFn: asUser(4, "sid"),
+		createTokFn: func(userID int64, name string, scopes []string, expiresIn time.Duration) (string, *types.PersonalToken, error) {
+			assert.Equal(t, int64(4), userID)
+			assert.Equal(t, "backup", name)
+			if len(scopes) != 1 || scopes[0] != authjwt.ScopeProfileRead {
+				return "", nil, repositories.ErrInvalidScope
+			}
+			if expiresIn > 24*time.Hour {
+				return "", nil, repositories.ErrInvalidExpiry
+			}
+			return "bpat_x.y", &types.PersonalToken{ID: 3, Name: name, Scopes: scopes, TokenHash: "hash", CreatedAt: now}, nil
+		},
+	}
+	router := makeRouter(transport.NewHandler(m))
+
+	w := doJSON(t, router, http.MethodPost, "/tokens", map[string]any{"name": " backup ", "scopes": []string{"profile:read"}, "expires_in": 3600}, bearer)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var resp types.CreatedTokenResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, "bpat_x.y", resp.Token)
+	assert.Equal(t, int64(3), resp.PersonalToken.ID)
+	assert.NotContains(t, w.Body.String(), "hash")
+
+	w = doJSON(t, router, http.MethodPost, "/tokens", map[string]any{"name": "backup", "scopes": []string{"admin"}}, bearer)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = doJSON(t, router, http.MethodPost, "/tokens", map[string]any{"name": "backup", "scopes": []string{"profile:read"}, "expires_in": 86401}, bearer)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = doJSON(t, router, http.MethodPost, "/tokens", map[string]any{"scopes": []string{"profile:read"}}, bearer)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = doJSON(t, router, http.MethodPost, "/tokens", map[string]any{"name": "backup", "scopes": []string{"profile:read"}}, nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestListAndRevokeTokens(t *testing.T) {
+	m := &authMock{
+		parseFn: asUser(4, "sid"),
+		listTokFn: func(userID int64) ([]types.PersonalToken, error) {
+			assert.Equal(t, int64(4), userID)
+			return []types.PersonalToken{{ID: 3, Name: "backup", Scopes: []string{authjwt.ScopeProfileRead}, TokenHash: "hash"}}, nil
+		},
+		revokeTokFn: func(userID, id int64) error {
+			if userID != 4 || id != 3 {
+				return repositories.ErrNotFound
+			}
+			return nil
+		},
+	}
+	router := makeRouter(transport.NewHandler(m))
+
+	w := doJSON(t, router, http.MethodGet, "/tokens", nil, bearer)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var resp types.PersonalTokensResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	if assert.Len(t, resp.Tokens, 1) {
+		assert.Equal(t, "backup", resp.Tokens[0].Name)
+	}
+	assert.NotContains(t, w.Body.String(), "hash")
+
+	assert.Equal(t, http.StatusOK, doJSON(t, router, http.MethodDelete, "/tokens/3", nil, bearer).Code)
+	assert.Equal(t, http.StatusNotFound, doJSON(t, router, http.MethodDelete, "/tokens/4", nil, bearer).Code)
+	assert.Equal(t, http.StatusBadRequest, doJSON(t, router, http.MethodDelete, "/tokens/x", nil, bearer).Code)
+}
+
+func TestRegisterChallenge(t *testing.T) {
+	exp := time.Now().UTC().Add(time.Minute).Truncate(time.Second)
+	m := &authMock{challengeFn: func() (*usecase.RegistrationChallenge, error) {
+		return &usecase.RegistrationChallenge{Challenge: &pow.Challenge{Token: "tok", Difficulty: 20, ExpiresAt: exp}, InviteOnly: true}, nil
+	}}
+	router := makeRouter(transport.NewHandler(m))
+
+	w := doJSON(t, router, http.MethodGet, "/register/challenge", nil, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var resp types.RegisterChallengeResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, "tok", resp.Challenge)
+	assert.Equal(t, "sha256", resp.Algorithm)
+	assert.Equal(t, 20, resp.Difficulty)
+	assert.True(t, resp.InviteOnly)
+
+	m.challengeFn = func() (*usecase.RegistrationChallenge, error) { return nil, repositories.ErrNotImplemented }
+	assert.Equal(t, http.StatusNotImplemented, doJSON(t, router, http.MethodGet, "/register/challenge", nil, nil).Code)
+}
+
+func TestRegister(t *testing.T) {
+	m := &authMock{registerFn: func(username, password, email, challenge, nonce, invite string) (*types.User, error) {
+		switch {
+		case challenge != "tok" || nonce != "42":
+			return nil, repositories.ErrInvalidChallenge
+		case invite != "abcd-efgh":
+			return nil, repositories.ErrInvalidInvite
+		case username == "taken":
+			return nil, repositories.ErrDuplicateUsername
+		}
+		return &types.User{ID: 9, Username: username}, nil
+	}}
+	router := makeRouter(transport.NewHandler(m))
+	body := func(username, nonce, invite string) map[string]string {
+		return map[string]string{"username": username, "password": "velvet-canyon-drifts", "challenge": "tok", "nonce": nonce, "invite_code": invite}
+	}
+
+	w := doJSON(t, router, http.MethodPost, "/register", body("mina", "42", "abcd-efgh"), nil)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var resp types.UserResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, int64(9), resp.User.ID)
+
+	assert.Equal(t, http.StatusBadRequest, doJSON(t, router, http.MethodPost, "/register", body("mina", "41", "abcd-efgh"), nil).Code)
+	assert.Equal(t, http.StatusForbidden, doJSON(t, router, http.MethodPost, "/register", body("mina", "42", ""), nil).Code)
+	w = doJSON(t, router, http.MethodPost, "/register", body("taken", "42", "abcd-efgh"), nil)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Contains(t, w.Body.String(), `"reason":"taken"`)
+	assert.Equal(t, http.StatusBadRequest, doJSON(t, router, http.MethodPost, "/register", body("mina", "", ""), nil).Code)
+}
+
+func TestCreateInvite_AdminOnly(t *testing.T) {
+	exp := time.Now().UTC().Add(time.Hour)
+	m := &authMock{
+		parseFn: func(token string) (*authjwt.Principal, error) {
+			p := &authjwt.Principal{UserID: 1, Roles: []string{authjwt.RoleUser}}
+			if token == "admin" {
+				p.Roles = append(p.Roles, authjwt.RoleAdmin)
+			}
+			return p, nil
+		},
+		inviteFn: func(createdBy int64, maxUses int, expiresIn time.Duration) (string, *types.Invite, error) {
+			assert.Equal(t, int64(1), createdBy)
+			assert.Equal(t, 5, maxUses)
+			return "abcd-efgh-ijkl-mnop", &types.Invite{ID: 2, MaxUses: maxUses, ExpiresAt: &exp}, nil
+		},
+	}
+	router := makeRouter(transport.NewHandler(m))
+
+	w := doJSON(t, router, http.MethodPost, "/invites", map[string]int{"max_uses": 5}, map[string]string{"Authorization": "Bearer admin"})
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Contains(t, w.Body.String(), "abcd-efgh-ijkl-mnop")
+
+	w = doJSON(t, router, http.MethodPost, "/invites", map[string]int{"max_uses": 5}, map[string]string{"Authorization": "Bearer user"})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestPasskeyRegistration(t *testing.T) {
+	m := &authMock{
+		parseFn: asUser(7, "sid", authjwt.RoleUser),
+		beginPKRegFn: func(userID int64) (*usecase.PasskeyCeremony, error) {
+			assert.Equal(t, int64(7), userID)
+			return &usecase.PasskeyCeremony{Options: map[string]any{"publicKey": map[string]any{"challenge": "abc"}}, Session: "sealed", ExpiresIn: 5 * time.Minute}, nil
+		},
+		finPKRegFn: func(userID int64, session, name string, credential []byte) (*types.WebAuthnCredential, error) {
+			switch {
+			case session != "sealed":
+				return nil, repositories.ErrInvalidToken
+			case name == "twice":
+				return nil, repositories.ErrDuplicateCredential
+			}
+			assert.JSONEq(t, `{"id":"Y3JlZA"}`, string(credential))
+			return &types.WebAuthnCredential{ID: 3, UserID: userID, Name: name, CreatedAt: time.Now()}, nil
+		},
+	}
+	audit := &auditRecorder{}
+	router := makeRouter(transport.NewHandler(m, transport.WithAudit(audit)))
+
+	assert.Equal(t, http.StatusUnauthorized, doJSON(t, router, http.MethodPost, "/webauthn/register/begin", nil, nil).Code)
+	w := doJSON(t, router, http.MethodPost, "/webauthn/register/begin", nil, bearer)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+	assert.JSONEq(t, `{"options":{"publicKey":{"challenge":"abc"}},"session":"sealed","expires_in":300}`, w.Body.String())
+
+	body := func(session, name string) map[string]any {
+		return map[string]any{"session": session, "name": name, "credential": map[string]string{"id": "Y3JlZA"}}
+	}
+	w = doJSON(t, router, http.MethodPost, "/webauthn/register/finish", body("sealed", "Laptop"), bearer)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var resp types.PasskeyResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, int64(3), resp.Passkey.ID)
+	assert.Equal(t, "Laptop", resp.Passkey.Name)
+
+	assert.Equal(t, http.StatusBadRequest, doJSON(t, router, http.MethodPost, "/webauthn/register/finish", body("stale", "Laptop"), bearer).Code)
+	assert.Equal(t, http.StatusConflict, doJSON(t, router, http.MethodPost, "/webauthn/register/finish", body("sealed", "twice"), bearer).Code)
+	assert.Equal(t, http.StatusBadRequest, doJSON(t, router, http.MethodPost, "/webauthn/register/finish", body("sealed", strings.Repeat("x", 65)), bearer).Code)
+	assert.Equal(t, http.StatusBadRequest, doJSON(t, router, http.MethodPost, "/webauthn/register/finish", map[string]string{"session": "sealed"}, bearer).Code)
+
+	if assert.Len(t, audit.events, 3) {
+		assert.Equal(t, types.AuditPasskeyAdd, audit.events[0].Type)
+		assert.Equal(t, types.OutcomeSuccess, audit.events[0].Outcome)
+		assert.Equal(t, types.OutcomeFailure, audit.events[1].Outcome)
+	}
+}
+
+func TestPasskeyLogin(t *testing.T) {
+	m := &authMock{
+		beginPKFn: func() (*usecase.PasskeyCeremony, error) {
+			return &usecase.PasskeyCeremony{Options: map[string]any{}, Session: "sealed", ExpiresIn: time.Minute}, nil
+		},
+		finPKFn: func(session string, credential []byte, ua, ip string) (*types.User, *usecase.Tokens, error) {
+			switch {
+			case session != "sealed":
+				return nil, nil, repositories.ErrInvalidToken
+			case string(credential) == `"cloned"`:
+				return nil, nil, repositories.ErrSignCountMismatch
+			case string(credential) == `"bad"`:
+				return nil, nil, repositories.ErrInvalidPasskey
+			}
+			assert.Equal(t, "UA", ua)
+			assert.Equal(t, "10.0.0.9", ip)
+			return &types.User{ID: 7, Username: "mina"}, &usecase.Tokens{Access: "a", Refresh: "r"}, nil
+		},
+	}
+	audit := &auditRecorder{}
+	router := makeRouter(transport.NewHandler(m, transport.WithAudit(audit)))
+	headers := map[string]string{"User-Agent": "UA", "X-Real-IP": "10.0.0.9"}
+
+	w := doJSON(t, router, http.MethodPost, "/webauthn/login/begin", nil, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"session":"sealed"`)
+
+	w = doJSON(t, router, http.MethodPost, "/webauthn/login/finish", map[string]any{"session": "sealed", "credential": "ok"}, headers)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var resp types.LoginResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, "a", resp.Access)
+	assert.Equal(t, "r", resp.Refresh)
+	assert.Equal(t, int64(7), resp.User.ID)
+
+	for _, cred := range []string{"cloned", "bad"} {
+		w = doJSON(t, router, http.MethodPost, "/webauthn/login/finish", map[string]any{"session": "sealed", "credential": cred}, headers)
+		assert.Equal(t, http.StatusUnauthorized, w.Code, cred)
+	}
+	w = doJSON(t, router, http.MethodPost, "/webauthn/login/finish", map[string]any{"session": "stale", "credential": "ok"}, headers)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	if assert.Len(t, audit.events, 4) {
+		assert.Equal(t, types.AuditLoginPasskey, audit.events[0].Type)
+		assert.Equal(t, types.OutcomeSuccess, audit.events[0].Outcome)
+		assert.Equal(t, types.OutcomeFailure, audit.events[1].Outcome)
+	}
+
+	m.beginPKFn = func() (*usecase.PasskeyCeremony, error) { return nil, repositories.ErrNotImplemented }
+	assert.Equal(t, http.StatusNotImplemented, doJSON(t, router, http.MethodPost, "/webauthn/login/begin", nil, nil).Code)
+}
+
+func TestMagicLink_Send(t *testing.T) {
+	var gotEmail, gotUA string
+	m := &authMock{
+		sendMagicFn: func(email, ua string) error {
+			gotEmail, gotUA = email, ua
+			return nil
+		},
+	}
+	router := makeRouter(transport.NewHandler(m))
+
+	w := doJSON(t, router, http.MethodPost, "/login/magic", map[string]string{"email": "mina@example.com"}, map[string]string{"User-Agent": "Firefox"})
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.Equal(t, "mina@example.com", gotEmail)
+	assert.Equal(t, "Firefox", gotUA)
+
+	w = doJSON(t, router, http.MethodPost, "/login/magic", map[string]string{}, nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	m.sendMagicFn = func(email, ua string) error {
+		return &usecase.RetryLaterError{RetryAfter: 90 * time.Second, Mail: true}
+	}
+	w = doJSON(t, router, http.MethodPost, "/login/magic", map[string]string{"email": "mina@example.com"}, nil)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "90", w.Header().Get("Retry-After"))
+
+	m.sendMagicFn = func(email, ua string) error { return repositories.ErrNotImplemented }
+	w = doJSON(t, router, http.MethodPost, "/login/magic", map[string]string{"email": "mina@example.com"}, nil)
+	assert.Equal(t, http.StatusNotImplemented, w.Code)
+}
+
+func TestMagicLink_Login(t *testing.T) {
+	used := map[string]bool{}
+	m := &authMock{
+		magicFn: func(token, ua, ip string) (*types.User, *usecase.Tokens, error) {
+			switch {
+			case token == "mfa":
+				return nil, nil, &usecase.MFARequiredError{Token: "pending", ExpiresIn: time.Minute}
+			case token != "Zm9v-bar_" || ua != "Firefox":
+				return nil, nil, repositories.ErrInvalidToken
+			case used[token]:
+				return nil, nil, repositories.ErrLinkUsed
+			}
+			used[token] = true
+			assert.Equal(t, "10.0.0.9", ip)
+			return &types.User{ID: 7, Username: "mina"}, &usecase.Tokens{Access: "a", Refresh: "r"}, nil
+		},
+	}
+	audit := &auditRecorder{}
+	// The service router, so the token must survive its URL format handling.
+	router := transport.NewRouter(transport.NewHandler(m, transport.WithAudit(audit)))
+	headers := map[string]string{"User-Agent": "Firefox", "X-Real-IP": "10.0.0.9"}
+
+	w := doJSON(t, router, http.MethodGet, "/login/magic/Zm9v-bar_", nil, map[string]string{"User-Agent": "Chrome"})
+	assert.Equal(t, http.StatusUnauthorized, w.Code, "another browser")
+
+	w = doJSON(t, router, http.MethodGet, "/login/magic/Zm9v-bar_", nil, headers)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+	var resp types.LoginResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, "a", resp.Access)
+	assert.Equal(t, "r", resp.Refresh)
+	assert.Equal(t, int64(7), resp.User.ID)
+
+	w = doJSON(t, router, http.MethodGet, "/login/magic/Zm9v-bar_", nil, headers)
+	assert.Equal(t, http.StatusUnauthorized, w.Code, "replayed")
+
+	w = doJSON(t, router, http.MethodGet, "/login/magic/mfa", nil, headers)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var challenge types.MFAChallengeResponse
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &challenge))
+	assert.True(t, challenge.MFARequired)
+	assert.Equal(t, "pending", challenge.MFAToken)
+
+	if assert.Len(t, audit.events, 4) {
+		assert.Equal(t, types.AuditLoginMagic, audit.events[0].Type)
+		assert.Equal(t, types.OutcomeFailure, audit.events[0].Outcome)
+		assert.Equal(t, types.OutcomeSuccess, audit.events[1].Outcome)
+		assert.Equal(t, repositories.ErrLinkUsed.Error(), audit.events[2].Detail)
+		assert.Equal(t, types.OutcomeMFARequired, audit.events[3].Outcome)
+	}
+}
+
+// cookieDelivery is the header a frontend sends to get the refresh token as
+// a cookie without relying on Fetch Metadata.
+var cookieDelivery = map[string]string{"X-Refresh-Delivery": "cookie"}
+
+func newCookieRouter(m *authMock) http.Handler {
+	cfg := &config.RefreshCookie{
+		Enabled:    true,
+		Name:       "bioly_refresh",
+		Path:       "/auth/refresh",
+		SameSite:   "strict",
+		CSRFCookie: "bioly_csrf",
+		CSRFHeader: "X-CSRF-Token",
+	}
+	return makeRouter(transport.NewHandler(m, transport.WithRefreshCookie(cfg, time.Hour)))
+}
+
+func responseCookies(w *httptest.ResponseRecorder) map[string]*http.Cookie {
+	out := map[string]*http.Cookie{}
+	for _, c := range w.Result().Cookies() {
+		out[c.Name] = c
+	}
+	return out
+}
+
+func TestRefreshCookie_Login(t *testing.T) {
+	m := &authMock{
+		loginFn: func(username, password, ua, ip string) (*types.User, *usecase.Tokens, error) {
+			return &types.User{ID: 7, Username: "mina"}, &usecase.Tokens{Access: "a", Refresh: "r1"}, nil
+		},
+	}
+	router := newCookieRouter(m)
+	body := map[string]string{"username": "mina", "password": "secret"}
+
+	// Clients that are not browsers, such as existing mobile apps, keep
+	// getting the token in the body.
+	w := doJSON(t, router, http.MethodPost, "/login", body, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"refresh":"r1"`)
+	assert.Empty(t, w.Result().Cookies())
+
+	// Browsers get the cookie unless they opt out.
+	browser := map[string]string{"Sec-Fetch-Mode": "cors", "Sec-Fetch-Site": "same-origin"}
+	w = doJSON(t, router, http.MethodPost, "/login", body, browser)
+	assert.NotContains(t, w.Body.String(), `"refresh"`)
+	assert.NotNil(t, responseCookies(w)["bioly_refresh"])
+	browser["X-Refresh-Delivery"] = "body"
+	w = doJSON(t, router, http.MethodPost, "/login", body, browser)
+	assert.Contains(t, w.Body.String(), `"refresh":"r1"`)
+	assert.Empty(t, w.Result().Cookies())
+
+	w = doJSON(t, router, http.MethodPost, "/login", body, cookieDelivery)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), `"refresh"`)
+	assert.Contains(t, w.Body.String(), `"access":"a"`)
+	assert.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+	cookies := responseCookies(w)
+	if rc := cookies["bioly_refresh"]; assert.NotNil(t, rc) {
+		assert.Equal(t, "r1", rc.Value)
+		assert.Equal(t, "/auth/refresh", rc.Path)
+		assert.True(t, rc.HttpOnly)
+		assert.True(t, rc.Secure)
+		assert.Equal(t, http.SameSiteStrictMode, rc.SameSite)
+		assert.Equal(t, 3600, rc.MaxAge)
+	}
+	if csrf := cookies["bioly_csrf"]; assert.NotNil(t, csrf) {
+		assert.NotEmpty(t, csrf.Value)
+		assert.False(t, csrf.HttpOnly, "the frontend reads it")
+		assert.Equal(t, "/", csrf.Path)
+	}
+}
+
+func TestRefreshCookie_Navigation(t *testing.T) {
+	m := &authMock{
+		magicFn: func(token, ua, ip string) (*types.User, *usecase.Tokens, error) {
+			return &types.User{ID: 7, Username: "mina"}, &usecase.Tokens{Access: "a", Refresh: "r1"}, nil
+		},
+		finishFn: func(provider, code, state, flow string) (*types.User, *usecase.Tokens, error) {
+			return &types.User{ID: 7, Username: "mina"}, &usecase.Tokens{Access: "a", Refresh: "r1"}, nil
+		},
+	}
+	router := newCookieRouter(m)
+
+	// Opening a login link or coming back from a provider cannot set
+	// headers, so the cookie is used.
+	w := doJSON(t, router, http.MethodGet, "/login/magic/Zm9v", nil, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), `"refresh"`)
+	assert.NotNil(t, responseCookies(w)["bioly_refresh"])
+
+	req := httptest.NewRequest(http.MethodGet, "/oauth/github/callback?code=good&state=s", nil)
+	req.AddCookie(&http.Cookie{Name: "oauth_flow", Value: "sealed"})
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), `"refresh"`)
+	assert.NotNil(t, responseCookies(w)["bioly_refresh"])
+
+	w = doJSON(t, router, http.MethodGet, "/login/magic/Zm9v", nil, map[string]string{"X-Refresh-Delivery": "body"})
+	assert.Contains(t, w.Body.String(), `"refresh":"r1"`)
+	assert.Nil(t, responseCookies(w)["bioly_refresh"])
+}
+
+func TestRefreshCookie_Refresh(t *testing.T) {
+	m := &authMock{
+		loginFn: func(username, password, ua, ip string) (*types.User, *usecase.Tokens, error) {
+			return &types.User{ID: 7, Username: "mina"}, &usecase.Tokens{Access: "a", Refresh: "r1"}, nil
+		},
+		refreshFn: func(refresh, ua, ip string) (*types.User, *usecase.Tokens, error) {
+			if refresh != "r1" {
+				return nil, nil, repositories.ErrInvalidToken
+			}
+			return &types.User{ID: 7, Username: "mina"}, &usecase.Tokens{Access: "a2", Refresh: "r2"}, nil
+		},
+	}
+	router := newCookieRouter(m)
+	login := responseCookies(doJSON(t, router, http.MethodPost, "/login", map[string]string{"username": "mina", "password": "secret"}, cookieDelivery))
+	csrf := login["bioly_csrf"].Value
+	cookieHeader := "bioly_refresh=r1; bioly_csrf=" + csrf
+
+	w := doJSON(t, router, http.MethodPost, "/refresh", nil, map[string]string{"Cookie": cookieHeader})
+	assert.Equal(t, http.StatusForbidden, w.Code, "no CSRF header")
+	w = doJSON(t, router, http.MethodPost, "/refresh", nil, map[string]string{"Cookie": cookieHeader, "X-CSRF-Token": "guess"})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = doJSON(t, router, http.MethodPost, "/refresh", nil, map[string]string{"Cookie": "bioly_refresh=r1; bioly_csrf=forged", "X-CSRF-Token": "forged"})
+	assert.Equal(t, http.StatusForbidden, w.Code, "a planted CSRF cookie does not match the refresh token")
+
+	w = doJSON(t, router, http.MethodPost, "/refresh", nil, map[string]string{"Cookie": cookieHeader, "X-CSRF-Token": csrf})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"access":"a2"`)
+	assert.NotContains(t, w.Body.String(), `"refresh"`)
+	next := responseCookies(w)
+	if assert.NotNil(t, next["bioly_refresh"]) && assert.NotNil(t, next["bioly_csrf"]) {
+		assert.Equal(t, "r2", next["bioly_refresh"].Value)
+		assert.NotEqual(t, csrf, next["bioly_csrf"].Value, "the CSRF token rotates with the refresh token")
+	}
+
+	// A dead cookie is removed.
+	w = doJSON(t, router, http.MethodPost, "/refresh", nil, map[string]string{
+		"Cookie":       "bioly_refresh=r2; bioly_csrf=" + next["bioly_csrf"].Value,
+		"X-CSRF-Token": next["bioly_csrf"].Value,
+	})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	if rc := responseCookies(w)["bioly_refresh"]; assert.NotNil(t, rc) {
+		assert.Negative(t, rc.MaxAge)
+	}
+
+	// Without a cookie the body is used, and answered in the body.
+	w = doJSON(t, router, http.MethodPost, "/refresh", map[string]string{"refresh": "r1"}, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"refresh":"r2"`)
+	assert.Empty(t, w.Result().Cookies())
+}
+
+func TestRefreshCookie_Logout(t *testing.T) {
+	var loggedOut string
+	m := &authMock{
+		loginFn: func(username, password, ua, ip string) (*types.User, *usecase.Tokens, error) {
+			return &types.User{ID: 7, Username: "mina"}, &usecase.Tokens{Access: "a", Refresh: "r1"}, nil
+		},
+		logoutFn: func(refresh string) error {
+			loggedOut = refresh
+			return nil
+		},
+	}
+	router := newCookieRouter(m)
+
+	w := doJSON(t, router, http.MethodPost, "/refresh/logout", nil, map[string]string{"Cookie": "bioly_refresh=r1; bioly_csrf=x", "X-CSRF-Token": "x"})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Empty(t, loggedOut)
+
+	w = doJSON(t, router, http.MethodPost, "/login", map[string]string{"username": "mina", "password": "secret"}, cookieDelivery)
+	csrf := responseCookies(w)["bioly_csrf"].Value
+	w = doJSON(t, router, http.MethodPost, "/refresh/logout", nil, map[string]string{"Cookie": "bioly_refresh=r1; bioly_csrf=" + csrf, "X-CSRF-Token": csrf})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "r1", loggedOut)
+	cookies := responseCookies(w)
+	if assert.NotNil(t, cookies["bioly_refresh"]) && assert.NotNil(t, cookies["bioly_csrf"]) {
+		assert.Negative(t, cookies["bioly_refresh"].MaxAge)
+		assert.Negative(t, cookies["bioly_csrf"].MaxAge)
+	}
+
+	w = doJSON(t, makeRouter(transport.NewHandler(m)), http.MethodPost, "/refresh/logout", nil, nil)
+	assert.Equal(t, http.StatusNotImplemented, w.Code, "cookie mode is off")
 }
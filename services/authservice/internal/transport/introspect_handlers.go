@@ -0,0 +1,97 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+
+	"bioly/asynclogger"
+	"bioly/auth/internal/repositories"
+	"bioly/auth/internal/types"
+	"bioly/authjwt"
+)
+
+// introspect answers RFC 7662 token introspection requests. The token is
+// sent form encoded; anything that is not a live access token is reported
+// as inactive rather than as an error.
+func (h *Handler) introspect(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+
+	token := r.PostFormValue("token")
+	if token == "" {
+		asynclogger.Warning("[%s] introspect without token ip=%s", reqID, clientIP(r))
+		render.Render(w, r, types.ErrInvalidRequest(http.StatusBadRequest, fmt.Errorf("token is required")))
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	p, err := h.auth.Introspect(r.Context(), token)
+	if errors.Is(err, repositories.ErrInvalidToken) {
+		render.Render(w, r, &types.IntrospectionResponse{Active: false})
+		return
+	}
+	if err != nil {
+		asynclogger.Error("[%s] introspect failed ip=%s err=%v", reqID, clientIP(r), err)
+		render.Render(w, r, types.ErrInvalidRequest(http.StatusInternalServerError, fmt.Errorf("internal error")))
+		return
+	}
+
+	resp := &types.IntrospectionResponse{
+		Active:        true,
+		TokenType:     "Bearer",
+		Subject:       strconv.FormatInt(p.UserID, 10),
+		Username:      p.Username,
+		SessionID:     p.SessionID,
+		Roles:         p.Roles,
+		EmailVerified: p.EmailVerified,
+	}
+	if p.Scopes != nil {
+		resp.Scope = strings.Join(p.Scopes, " ")
+	}
+	if !p.IssuedAt.IsZero() {
+		resp.IssuedAt = p.IssuedAt.Unix()
+	}
+	if !p.ExpiresAt.IsZero() {
+		resp.ExpiresAt = p.ExpiresAt.Unix()
+	}
+	render.Render(w, r, resp)
+}
+
+// verify is the nginx auth_request target. It answers 200 with the caller
+// in the identity headers, or 401 for a missing, invalid or revoked access
+// token. With ?optional=1 requests without a token pass as anonymous, which
+// suits upstreams that mix public and private routes.
+func (h *Handler) verify(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+
+	token, ok := authjwt.BearerToken(r)
+	if !ok {
+		if r.URL.Query().Get("optional") == "1" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.Header().Set("WWW-Authenticate", `Bearer`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	p, err := h.auth.Introspect(r.Context(), token)
+	if errors.Is(err, repositories.ErrInvalidToken) {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		asynclogger.Error("[%s] verify failed uri=%q err=%v", reqID, r.Header.Get("X-Original-URI"), err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	authjwt.SetIdentityHeaders(w.Header(), p)
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,109 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+
+	"bioly/asynclogger"
+	"bioly/auth/internal/repositories"
+	"bioly/auth/internal/types"
+	"bioly/auth/internal/usecase"
+)
+
+type magicLinkRequest struct {
+	Email string `json:"email"`
+}
+
+func (mr *magicLinkRequest) Bind(r *http.Request) error {
+	if mr.Email == "" {
+		return fmt.Errorf("email is required")
+	}
+	return nil
+}
+
+// sendMagicLink answers 202 whether or not the address belongs to an
+// account, like forgotPassword, and 429 once the mail throttle trips.
+func (h *Handler) sendMagicLink(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	start := time.Now().UTC()
+	ua := r.Header.Get("User-Agent")
+	ip := clientIP(r)
+
+	var req magicLinkRequest
+	if err := render.Bind(r, &req); err != nil {
+		asynclogger.Warning("[%s] sendMagicLink bind failed ip=%s ua=%q err=%v", reqID, ip, ua, err)
+		render.Render(w, r, types.ErrInvalidRequest(http.StatusBadRequest, fmt.Errorf("invalid request body")))
+		return
+	}
+
+	if err := h.auth.SendMagicLink(r.Context(), req.Email, ua, ip); err != nil {
+		var retry *usecase.RetryLaterError
+		if errors.As(err, &retry) {
+			asynclogger.Warning("[%s] sendMagicLink throttled ip=%s ua=%q retry_after=%s", reqID, ip, ua, retry.RetryAfter)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.RetryAfter.Seconds()))))
+			render.Render(w, r, types.ErrInvalidRequest(http.StatusTooManyRequests, err))
+			return
+		}
+		if err == repositories.ErrNotImplemented {
+			render.Render(w, r, types.ErrInvalidRequest(http.StatusNotImplemented, err))
+			return
+		}
+		asynclogger.Error("[%s] sendMagicLink failed ip=%s ua=%q dur=%s err=%v", reqID, ip, ua, time.Since(start), err)
+		render.Render(w, r, types.ErrInvalidRequest(http.StatusInternalServerError, fmt.Errorf("internal error")))
+		return
+	}
+
+	asynclogger.Info("[%s] sendMagicLink accepted ip=%s ua=%q dur=%s", reqID, ip, ua, time.Since(start))
+	render.Status(r, http.StatusAccepted)
+	render.Render(w, r, &okResponse{Status: "ok", Message: "if the address belongs to an account, a login link has been sent"})
+}
+
+// loginMagic answers like login. The link must be opened in the browser
+// that asked for it.
+func (h *Handler) loginMagic(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	start := time.Now().UTC()
+	ua := r.Header.Get("User-Agent")
+	ip := clientIP(r)
+	w.Header().Set("Cache-Control", "no-store")
+
+	user, tokens, err := h.auth.LoginMagic(r.Context(), chi.URLParam(r, "token"), ua, ip)
+	var mfa *usecase.MFARequiredError
+	if errors.As(err, &mfa) {
+		asynclogger.Info("[%s] loginMagic needs second factor ip=%s ua=%q dur=%s", reqID, ip, ua, time.Since(start))
+		h.recordAudit(r, types.AuditEvent{Type: types.AuditLoginMagic, Outcome: types.OutcomeMFARequired})
+		render.Render(w, r, &types.MFAChallengeResponse{
+			MFARequired: true,
+			MFAToken:    mfa.Token,
+			ExpiresIn:   int(mfa.ExpiresIn.Seconds()),
+		})
+		return
+	}
+	switch err {
+	case nil:
+	case repositories.ErrInvalidToken, repositories.ErrLinkUsed:
+		asynclogger.Warning("[%s] loginMagic failed ip=%s ua=%q dur=%s err=%v", reqID, ip, ua, time.Since(start), err)
+		h.recordAudit(r, types.AuditEvent{Type: types.AuditLoginMagic, Outcome: types.OutcomeFailure, Detail: err.Error()})
+		render.Render(w, r, types.ErrInvalidRequest(http.StatusUnauthorized, err))
+		return
+	case repositories.ErrNotImplemented:
+		render.Render(w, r, types.ErrInvalidRequest(http.StatusNotImplemented, err))
+		return
+	default:
+		asynclogger.Error("[%s] loginMagic failed ip=%s ua=%q dur=%s err=%v", reqID, ip, ua, time.Since(start), err)
+		render.Render(w, r, types.ErrInvalidRequest(http.StatusInternalServerError, fmt.Errorf("internal error")))
+		return
+	}
+
+	asynclogger.Info("[%s] loginMagic success ip=%s ua=%q user_id=%d username=%q dur=%s", reqID, ip, ua, user.ID, user.Username, time.Since(start))
+	h.recordAudit(r, types.AuditEvent{Type: types.AuditLoginMagic, UserID: &user.ID, Username: user.Username, Outcome: types.OutcomeSuccess})
+	h.renderTokens(w, r, user, tokens, h.navigationDelivery(r))
+}
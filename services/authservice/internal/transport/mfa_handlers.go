@@ -0,0 +1,160 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+
+	"bioly/asynclogger"
+	"bioly/auth/internal/repositories"
+	"bioly/auth/internal/types"
+	"bioly/auth/internal/usecase"
+)
+
+type loginMFARequest struct {
+	MFAToken string `json:"mfa_token"`
+	Code     string `json:"code"`
+}
+
+func (lr *loginMFARequest) Bind(r *http.Request) error {
+	if lr.MFAToken == "" || lr.Code == "" {
+		return fmt.Errorf("mfa_token and code are required")
+	}
+	return nil
+}
+
+type mfaCodeRequest struct {
+	Code string `json:"code"`
+}
+
+func (mr *mfaCodeRequest) Bind(r *http.Request) error {
+	if mr.Code == "" {
+		return fmt.Errorf("code is required")
+	}
+	return nil
+}
+
+// mfaStatus maps 2FA errors to HTTP statuses. ok is false for errors that
+// are not specific to 2FA.
+func mfaStatus(err error) (int, bool) {
+	switch err {
+	case repositories.ErrInvalidMFACode:
+		return http.StatusBadRequest, true
+	case repositories.ErrMFAAlreadyEnabled, repositories.ErrMFANotEnabled:
+		return http.StatusConflict, true
+	case repositories.ErrNotImplemented:
+		return http.StatusNotImplemented, true
+	}
+	return 0, false
+}
+
+func (h *Handler) loginMFA(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	start := time.Now().UTC()
+
+	var req loginMFARequest
+	if err := render.Bind(r, &req); err != nil {
+		asynclogger.Warning("[%s] loginMFA bind failed ip=%s ua=%q err=%v", reqID, clientIP(r), r.Header.Get("User-Agent"), err)
+		render.Render(w, r, types.ErrInvalidRequest(http.StatusBadRequest, fmt.Errorf("invalid request body")))
+		return
+	}
+
+	ua := r.Header.Get("User-Agent")
+	ip := clientIP(r)
+	user, tokens, err := h.auth.LoginMFA(r.Context(), req.MFAToken, req.Code, ua, ip)
+	var retry *usecase.RetryLaterError
+	switch {
+	case errors.As(err, &retry):
+		asynclogger.Warning("[%s] loginMFA throttled ip=%s ua=%q retry_after=%s", reqID, ip, ua, retry.RetryAfter)
+		h.recordAudit(r, types.AuditEvent{Type: types.AuditLoginMFA, Outcome: types.OutcomeThrottled, Detail: err.Error()})
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.RetryAfter.Seconds()))))
+		render.Render(w, r, types.ErrInvalidRequest(http.StatusTooManyRequests, err))
+		return
+	case err == repositories.ErrInvalidToken, err == repositories.ErrInvalidMFACode:
+		asynclogger.Warning("[%s] loginMFA failed ip=%s ua=%q dur=%s err=%v", reqID, ip, ua, time.Since(start), err)
+		h.recordAudit(r, types.AuditEvent{Type: types.AuditLoginMFA, Outcome: types.OutcomeFailure, Detail: err.Error()})
+		render.Render(w, r, types.ErrInvalidRequest(http.StatusUnauthorized, err))
+		return
+	case err == repositories.ErrNotImplemented:
+		render.Render(w, r, types.ErrInvalidRequest(http.StatusNotImplemented, err))
+		return
+	case err != nil:
+		asynclogger.Error("[%s] loginMFA failed ip=%s ua=%q dur=%s err=%v", reqID, ip, ua, time.Since(start), err)
+		render.Render(w, r, types.ErrInvalidRequest(http.StatusInternalServerError, fmt.Errorf("internal error")))
+		return
+	}
+
+	asynclogger.Info("[%s] loginMFA success ip=%s ua=%q user_id=%d username=%q dur=%s", reqID, ip, ua, user.ID, user.Username, time.Since(start))
+	h.recordAudit(r, types.AuditEvent{Type: types.AuditLoginMFA, UserID: &user.ID, Username: user.Username, Outcome: types.OutcomeSuccess})
+	h.renderTokens(w, r, user, tokens, h.cookieDelivery(r))
+}
+
+func (h *Handler) enrollTOTP(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	start := time.Now().UTC()
+	caller := principalFrom(r.Context())
+
+	enr, err := h.auth.EnrollTOTP(r.Context(), caller.UserID)
+	if err != nil {
+		if status, ok := mfaStatus(err); ok {
+			asynclogger.Warning("[%s] enrollTOTP rejected user_id=%d dur=%s err=%v", reqID, caller.UserID, time.Since(start), err)
+			render.Render(w, r, types.ErrInvalidRequest(status, err))
+			return
+		}
+		asynclogger.Error("[%s] enrollTOTP failed user_id=%d dur=%s err=%v", reqID, caller.UserID, time.Since(start), err)
+		render.Render(w, r, types.ErrInvalidRequest(http.StatusInternalServerError, fmt.Errorf("internal error")))
+		return
+	}
+
+	asynclogger.Info("[%s] enrollTOTP success user_id=%d dur=%s", reqID, caller.UserID, time.Since(start))
+	w.Header().Set("Cache-Control", "no-store")
+	render.Render(w, r, &types.TOTPEnrollmentResponse{
+		Secret:        enr.Secret,
+		OTPAuthURI:    enr.URI,
+		RecoveryCodes: enr.RecoveryCodes,
+	})
+}
+
+func (h *Handler) confirmTOTP(w http.ResponseWriter, r *http.Request) {
+	h.totpCodeAction(w, r, "confirmTOTP", h.auth.ConfirmTOTP, "two-factor authentication enabled")
+}
+
+func (h *Handler) disableTOTP(w http.ResponseWriter, r *http.Request) {
+	h.totpCodeAction(w, r, "disableTOTP", h.auth.DisableTOTP, "two-factor authentication disabled")
+}
+
+// totpCodeAction runs a 2FA state change that is authorized by a code.
+func (h *Handler) totpCodeAction(w http.ResponseWriter, r *http.Request, name string,
+	action func(ctx context.Context, userID int64, code string) error, message string) {
+	reqID := middleware.GetReqID(r.Context())
+	start := time.Now().UTC()
+	caller := principalFrom(r.Context())
+
+	var req mfaCodeRequest
+	if err := render.Bind(r, &req); err != nil {
+		asynclogger.Warning("[%s] %s bind failed user_id=%d err=%v", reqID, name, caller.UserID, err)
+		render.Render(w, r, types.ErrInvalidRequest(http.StatusBadRequest, fmt.Errorf("invalid request body")))
+		return
+	}
+
+	if err := action(r.Context(), caller.UserID, req.Code); err != nil {
+		if status, ok := mfaStatus(err); ok {
+			asynclogger.Warning("[%s] %s rejected user_id=%d dur=%s err=%v", reqID, name, caller.UserID, time.Since(start), err)
+			render.Render(w, r, types.ErrInvalidRequest(status, err))
+			return
+		}
+		asynclogger.Error("[%s] %s failed user_id=%d dur=%s err=%v", reqID, name, caller.UserID, time.Since(start), err)
+		render.Render(w, r, types.ErrInvalidRequest(http.StatusInternalServerError, fmt.Errorf("internal error")))
+		return
+	}
+
+	asynclogger.Info("[%s] %s success user_id=%d dur=%s", reqID, name, caller.UserID, time.Since(start))
+	render.Render(w, r, &okResponse{Status: "ok", Message: message})
+}
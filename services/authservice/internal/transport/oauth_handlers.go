@@ -0,0 +1,128 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+
+	"bioly/asynclogger"
+	"bioly/auth/internal/oauth"
+	"bioly/auth/internal/repositories"
+	"bioly/auth/internal/types"
+	"bioly/auth/internal/usecase"
+)
+
+// oauthFlowCookie carries the sealed state of a provider login from start
+// to callback.
+const oauthFlowCookie = "oauth_flow"
+
+// oauthStatus maps provider login errors to an HTTP status and the error
+// shown to the client. Server and provider failures are reported without
+// details.
+func oauthStatus(err error) (int, error) {
+	switch {
+	case errors.Is(err, repositories.ErrInvalidToken):
+		return http.StatusBadRequest, err
+	case errors.Is(err, repositories.ErrNotFound):
+		return http.StatusNotFound, err
+	case errors.Is(err, repositories.ErrNotImplemented):
+		return http.StatusNotImplemented, err
+	case errors.Is(err, oauth.ErrProvider):
+		return http.StatusBadGateway, fmt.Errorf("identity provider unavailable")
+	}
+	return http.StatusInternalServerError, fmt.Errorf("internal error")
+}
+
+func (h *Handler) startOAuth(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	provider := chi.URLParam(r, "provider")
+
+	flow, err := h.auth.StartOAuth(r.Context(), provider)
+	if err != nil {
+		status, public := oauthStatus(err)
+		if public != err {
+			asynclogger.Error("[%s] startOAuth failed provider=%q ip=%s err=%v", reqID, provider, clientIP(r), err)
+		} else {
+			asynclogger.Warning("[%s] startOAuth rejected provider=%q ip=%s err=%v", reqID, provider, clientIP(r), err)
+		}
+		render.Render(w, r, types.ErrInvalidRequest(status, public))
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthFlowCookie,
+		Value:    flow.Cookie,
+		Path:     "/",
+		MaxAge:   int(flow.ExpiresIn.Seconds()),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, flow.URL, http.StatusFound)
+}
+
+func (h *Handler) oauthCallback(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	start := time.Now().UTC()
+	provider := chi.URLParam(r, "provider")
+	ua := r.Header.Get("User-Agent")
+	ip := clientIP(r)
+
+	// The flow is single use whatever the outcome.
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthFlowCookie,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		asynclogger.Warning("[%s] oauthCallback denied provider=%q ip=%s error=%q", reqID, provider, ip, e)
+		render.Render(w, r, types.ErrInvalidRequest(http.StatusBadRequest, fmt.Errorf("sign-in was not completed: %s", e)))
+		return
+	}
+	cookie, err := r.Cookie(oauthFlowCookie)
+	if err != nil || q.Get("code") == "" || q.Get("state") == "" {
+		asynclogger.Warning("[%s] oauthCallback incomplete provider=%q ip=%s ua=%q", reqID, provider, ip, ua)
+		render.Render(w, r, types.ErrInvalidRequest(http.StatusBadRequest, fmt.Errorf("code, state and the sign-in cookie are required")))
+		return
+	}
+
+	user, tokens, err := h.auth.FinishOAuth(r.Context(), provider, q.Get("code"), q.Get("state"), cookie.Value, ua, ip)
+	var mfa *usecase.MFARequiredError
+	if errors.As(err, &mfa) {
+		asynclogger.Info("[%s] oauthCallback needs second factor provider=%q ip=%s ua=%q dur=%s", reqID, provider, ip, ua, time.Since(start))
+		h.recordAudit(r, types.AuditEvent{Type: types.AuditLogin, Outcome: types.OutcomeMFARequired, Detail: "oauth " + provider})
+		render.Render(w, r, &types.MFAChallengeResponse{
+			MFARequired: true,
+			MFAToken:    mfa.Token,
+			ExpiresIn:   int(mfa.ExpiresIn.Seconds()),
+		})
+		return
+	}
+	if err != nil {
+		h.recordAudit(r, types.AuditEvent{Type: types.AuditLogin, Outcome: types.OutcomeFailure, Detail: "oauth " + provider + ": " + err.Error()})
+		status, public := oauthStatus(err)
+		if public != err {
+			asynclogger.Error("[%s] oauthCallback failed provider=%q ip=%s ua=%q dur=%s err=%v", reqID, provider, ip, ua, time.Since(start), err)
+		} else {
+			asynclogger.Warning("[%s] oauthCallback rejected provider=%q ip=%s ua=%q dur=%s err=%v", reqID, provider, ip, ua, time.Since(start), err)
+		}
+		render.Render(w, r, types.ErrInvalidRequest(status, public))
+		return
+	}
+
+	asynclogger.Info("[%s] oauthCallback success provider=%q ip=%s ua=%q user_id=%d username=%q dur=%s", reqID, provider, ip, ua, user.ID, user.Username, time.Since(start))
+	h.recordAudit(r, types.AuditEvent{Type: types.AuditLogin, UserID: &user.ID, Username: user.Username, Outcome: types.OutcomeSuccess, Detail: "oauth " + provider})
+	w.Header().Set("Cache-Control", "no-store")
+	h.renderTokens(w, r, user, tokens, h.navigationDelivery(r))
+}
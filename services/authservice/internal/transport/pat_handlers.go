@@ -0,0 +1,133 @@
+package transport
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+
+	"bioly/asynclogger"
+	"bioly/auth/internal/repositories"
+	"bioly/auth/internal/types"
+)
+
+const maxTokenName = 100
+
+type createTokenRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// ExpiresIn is the lifetime in seconds; zero for the longest allowed.
+	ExpiresIn int64 `json:"expires_in"`
+}
+
+func (cr *createTokenRequest) Bind(r *http.Request) error {
+	cr.Name = strings.TrimSpace(cr.Name)
+	if cr.Name == "" || len(cr.Scopes) == 0 {
+		return fmt.Errorf("name and scopes are required")
+	}
+	if utf8.RuneCountInString(cr.Name) > maxTokenName {
+		return fmt.Errorf("name must be at most %d characters", maxTokenName)
+	}
+	if cr.ExpiresIn < 0 {
+		return fmt.Errorf("expires_in must not be negative")
+	}
+	return nil
+}
+
+func (h *Handler) createToken(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	start := time.Now().UTC()
+	caller := principalFrom(r.Context())
+
+	var req createTokenRequest
+	if err := render.Bind(r, &req); err != nil {
+		asynclogger.Warning("[%s] createToken bind failed user_id=%d err=%v", reqID, caller.UserID, err)
+		render.Render(w, r, types.ErrInvalidRequest(http.StatusBadRequest, err))
+		return
+	}
+
+	token, t, err := h.auth.CreateToken(r.Context(), caller.UserID, req.Name, req.Scopes, time.Duration(req.ExpiresIn)*time.Second)
+	if err != nil {
+		switch err {
+		case repositories.ErrInvalidScope, repositories.ErrInvalidExpiry:
+			asynclogger.Warning("[%s] createToken refused user_id=%d scopes=%q expires_in=%d err=%v", reqID, caller.UserID, req.Scopes, req.ExpiresIn, err)
+			render.Render(w, r, types.ErrInvalidRequest(http.StatusBadRequest, err))
+		case repositories.ErrTooManyTokens:
+			asynclogger.Warning("[%s] createToken limit reached user_id=%d", reqID, caller.UserID)
+			render.Render(w, r, types.ErrInvalidRequest(http.StatusConflict, err))
+		case repositories.ErrNotImplemented:
+			render.Render(w, r, types.ErrInvalidRequest(http.StatusNotImplemented, err))
+		default:
+			asynclogger.Error("[%s] createToken failed user_id=%d dur=%s err=%v", reqID, caller.UserID, time.Since(start), err)
+			render.Render(w, r, types.ErrInvalidRequest(http.StatusInternalServerError, fmt.Errorf("internal error")))
+		}
+		return
+	}
+
+	asynclogger.Info("[%s] createToken success user_id=%d token_id=%d scopes=%q dur=%s", reqID, caller.UserID, t.ID, t.Scopes, time.Since(start))
+	h.recordAudit(r, types.AuditEvent{Type: types.AuditTokenCreate, UserID: &caller.UserID, Username: caller.Username, Outcome: types.OutcomeSuccess, Detail: t.Name})
+	render.Status(r, http.StatusCreated)
+	render.Render(w, r, &types.CreatedTokenResponse{Token: token, PersonalToken: types.NewPersonalTokenDTO(t)})
+}
+
+func (h *Handler) listTokens(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	start := time.Now().UTC()
+	caller := principalFrom(r.Context())
+
+	tokens, err := h.auth.ListTokens(r.Context(), caller.UserID)
+	if err != nil {
+		if err == repositories.ErrNotImplemented {
+			render.Render(w, r, types.ErrInvalidRequest(http.StatusNotImplemented, err))
+			return
+		}
+		asynclogger.Error("[%s] listTokens failed user_id=%d dur=%s err=%v", reqID, caller.UserID, time.Since(start), err)
+		render.Render(w, r, types.ErrInvalidRequest(http.StatusInternalServerError, fmt.Errorf("internal error")))
+		return
+	}
+
+	resp := &types.PersonalTokensResponse{Tokens: make([]types.PersonalTokenDTO, 0, len(tokens))}
+	for i := range tokens {
+		resp.Tokens = append(resp.Tokens, types.NewPersonalTokenDTO(&tokens[i]))
+	}
+	asynclogger.Info("[%s] listTokens success user_id=%d count=%d dur=%s", reqID, caller.UserID, len(tokens), time.Since(start))
+	render.Render(w, r, resp)
+}
+
+func (h *Handler) revokeToken(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	start := time.Now().UTC()
+	caller := principalFrom(r.Context())
+
+	idStr := chi.URLParam(r, "id")
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil || id <= 0 {
+		asynclogger.Warning("[%s] revokeToken bad id=%q", reqID, idStr)
+		render.Render(w, r, types.ErrInvalidRequest(http.StatusBadRequest, fmt.Errorf("invalid id")))
+		return
+	}
+
+	if err := h.auth.RevokeToken(r.Context(), caller.UserID, id); err != nil {
+		switch err {
+		case repositories.ErrNotFound:
+			asynclogger.Warning("[%s] revokeToken not found user_id=%d id=%d dur=%s", reqID, caller.UserID, id, time.Since(start))
+			render.Render(w, r, types.ErrInvalidRequest(http.StatusNotFound, err))
+		case repositories.ErrNotImplemented:
+			render.Render(w, r, types.ErrInvalidRequest(http.StatusNotImplemented, err))
+		default:
+			asynclogger.Error("[%s] revokeToken failed user_id=%d id=%d dur=%s err=%v", reqID, caller.UserID, id, time.Since(start), err)
+			render.Render(w, r, types.ErrInvalidRequest(http.StatusInternalServerError, fmt.Errorf("internal error")))
+		}
+		return
+	}
+
+	asynclogger.Info("[%s] revokeToken success user_id=%d id=%d dur=%s", reqID, caller.UserID, id, time.Since(start))
+	h.recordAudit(r, types.AuditEvent{Type: types.AuditTokenRevoke, UserID: &caller.UserID, Username: caller.Username, Outcome: types.OutcomeSuccess, Detail: strconv.FormatInt(id, 10)})
+	render.Render(w, r, &okResponse{Status: "ok", Message: "token revoked"})
+}
@@ -0,0 +1,193 @@
+package transport
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+
+	"bioly/asynclogger"
+	"bioly/auth/internal/config"
+	"bioly/auth/internal/repositories"
+	"bioly/auth/internal/types"
+	"bioly/auth/internal/usecase"
+)
+
+// refreshDeliveryHeader picks where the refresh token goes in cookie mode:
+// "body" keeps it in the response body, "cookie" asks for the cookie.
+// Without it browsers get the cookie and other clients, such as mobile
+// apps, the body.
+const refreshDeliveryHeader = "X-Refresh-Delivery"
+
+var errCSRF = errors.New("missing or invalid CSRF token")
+
+// WithRefreshCookie delivers refresh tokens to browsers in an HttpOnly
+// cookie, see config.RefreshCookie. ttl is the refresh token lifetime.
+func WithRefreshCookie(cfg *config.RefreshCookie, ttl time.Duration) HandlerOption {
+	return func(h *Handler) {
+		h.cookie = cfg
+		h.cookieTTL = ttl
+	}
+}
+
+// cookieDelivery reports whether tokens issued for r go into cookies.
+func (h *Handler) cookieDelivery(r *http.Request) bool {
+	if h.cookie == nil {
+		return false
+	}
+	switch strings.ToLower(r.Header.Get(refreshDeliveryHeader)) {
+	case "body":
+		return false
+	case "cookie":
+		return true
+	}
+	// Browsers send Fetch Metadata headers with every request; apps do not.
+	return r.Header.Get("Sec-Fetch-Mode") != ""
+}
+
+// navigationDelivery is cookieDelivery for top-level GET navigations, such
+// as opening a login link or the OAuth callback. Those cannot carry
+// refreshDeliveryHeader and come from a browser, so they get the cookie
+// unless the header asks for the body.
+func (h *Handler) navigationDelivery(r *http.Request) bool {
+	return h.cookie != nil && !strings.EqualFold(r.Header.Get(refreshDeliveryHeader), "body")
+}
+
+// renderTokens answers a successful login. With asCookie the refresh token
+// is set as a cookie, together with its CSRF token, and left out of the
+// body.
+func (h *Handler) renderTokens(w http.ResponseWriter, r *http.Request, user *types.User, tokens *usecase.Tokens, asCookie bool) {
+	resp := &types.LoginResponse{
+		Access:  tokens.Access,
+		Refresh: tokens.Refresh,
+		User:    types.NewUserDTO(user),
+	}
+	if asCookie {
+		h.setRefreshCookies(w, tokens.Refresh, int(h.cookieTTL.Seconds()))
+		resp.Refresh = ""
+		w.Header().Set("Cache-Control", "no-store")
+	}
+	render.Render(w, r, resp)
+}
+
+// clearRefreshCookies makes the browser drop the refresh cookies.
+func (h *Handler) clearRefreshCookies(w http.ResponseWriter) {
+	h.setRefreshCookies(w, "", -1)
+}
+
+// setRefreshCookies sets the refresh cookie and the CSRF cookie that goes
+// with it; maxAge -1 removes both. The CSRF cookie is readable by scripts
+// on every path, so the frontend can copy it into the CSRF header.
+func (h *Handler) setRefreshCookies(w http.ResponseWriter, refresh string, maxAge int) {
+	sameSite := sameSiteMode(h.cookie.SameSite)
+	http.SetCookie(w, &http.Cookie{
+		Name:     h.cookie.Name,
+		Value:    refresh,
+		Path:     h.cookie.Path,
+		Domain:   h.cookie.Domain,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: sameSite,
+	})
+	var csrf string
+	if refresh != "" {
+		csrf = csrfToken(refresh)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     h.cookie.CSRFCookie,
+		Value:    csrf,
+		Path:     "/",
+		Domain:   h.cookie.Domain,
+		MaxAge:   maxAge,
+		Secure:   true,
+		SameSite: sameSite,
+	})
+}
+
+// refreshCookie returns the refresh token from the cookie of r, or "" when
+// there is none. A cookie without the matching CSRF token in both the CSRF
+// cookie and header is errCSRF.
+func (h *Handler) refreshCookie(r *http.Request) (string, error) {
+	if h.cookie == nil {
+		return "", nil
+	}
+	c, err := r.Cookie(h.cookie.Name)
+	if err != nil || c.Value == "" {
+		return "", nil
+	}
+	csrf, err := r.Cookie(h.cookie.CSRFCookie)
+	if err != nil {
+		return "", errCSRF
+	}
+	want := []byte(csrfToken(c.Value))
+	if subtle.ConstantTimeCompare([]byte(csrf.Value), want) != 1 ||
+		subtle.ConstantTimeCompare([]byte(r.Header.Get(h.cookie.CSRFHeader)), want) != 1 {
+		return "", errCSRF
+	}
+	return c.Value, nil
+}
+
+// csrfToken derives the CSRF token of a refresh token. Binding the two
+// means a CSRF cookie planted by a sibling domain does not match, and the
+// token changes with every refresh.
+func csrfToken(refresh string) string {
+	m := hmac.New(sha256.New, []byte(refresh))
+	m.Write([]byte("bioly csrf"))
+	return base64.RawURLEncoding.EncodeToString(m.Sum(nil))
+}
+
+func sameSiteMode(s string) http.SameSite {
+	switch strings.ToLower(s) {
+	case "lax":
+		return http.SameSiteLaxMode
+	case "none":
+		return http.SameSiteNoneMode
+	}
+	return http.SameSiteStrictMode
+}
+
+// logoutCookie logs out the session of the refresh cookie and removes the
+// cookies. It lives under the cookie's path, as /logout never sees it.
+func (h *Handler) logoutCookie(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	start := time.Now().UTC()
+	ip := clientIP(r)
+
+	if h.cookie == nil {
+		render.Render(w, r, types.ErrInvalidRequest(http.StatusNotImplemented, repositories.ErrNotImplemented))
+		return
+	}
+	refresh, err := h.refreshCookie(r)
+	if err != nil {
+		asynclogger.Warning("[%s] logoutCookie rejected ip=%s err=%v", reqID, ip, err)
+		render.Render(w, r, types.ErrInvalidRequest(http.StatusForbidden, err))
+		return
+	}
+	h.clearRefreshCookies(w)
+	if refresh == "" {
+		render.Render(w, r, types.ErrInvalidRequest(http.StatusUnauthorized, repositories.ErrInvalidToken))
+		return
+	}
+	if err := h.auth.Logout(r.Context(), refresh); err != nil {
+		if err == repositories.ErrInvalidToken {
+			asynclogger.Warning("[%s] logoutCookie failed ip=%s dur=%s err=%v", reqID, ip, time.Since(start), err)
+			render.Render(w, r, types.ErrInvalidRequest(http.StatusUnauthorized, err))
+			return
+		}
+		asynclogger.Error("[%s] logoutCookie failed ip=%s dur=%s err=%v", reqID, ip, time.Since(start), err)
+		render.Render(w, r, types.ErrInvalidRequest(http.StatusInternalServerError, fmt.Errorf("internal error")))
+		return
+	}
+
+	asynclogger.Info("[%s] logoutCookie success ip=%s dur=%s", reqID, ip, time.Since(start))
+	render.Render(w, r, &okResponse{Status: "ok", Message: "logged out"})
+}
@@ -0,0 +1,143 @@
+package transport
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+
+	"bioly/asynclogger"
+	"bioly/auth/internal/pow"
+	"bioly/auth/internal/repositories"
+	"bioly/auth/internal/types"
+)
+
+type registerRequest struct {
+	Username   string `json:"username"`
+	Password   string `json:"password"`
+	Email      string `json:"email"`
+	Challenge  string `json:"challenge"`
+	Nonce      string `json:"nonce"`
+	InviteCode string `json:"invite_code"`
+}
+
+func (rr *registerRequest) Bind(r *http.Request) error {
+	if rr.Username == "" || rr.Password == "" {
+		return fmt.Errorf("username and password are required")
+	}
+	if rr.Challenge == "" || rr.Nonce == "" {
+		return fmt.Errorf("challenge and nonce are required")
+	}
+	return nil
+}
+
+type createInviteRequest struct {
+	MaxUses int `json:"max_uses"`
+	// ExpiresIn is the lifetime in seconds; zero for the default.
+	ExpiresIn int64 `json:"expires_in"`
+}
+
+func (cr *createInviteRequest) Bind(r *http.Request) error {
+	if cr.MaxUses < 0 || cr.ExpiresIn < 0 {
+		return fmt.Errorf("max_uses and expires_in must not be negative")
+	}
+	return nil
+}
+
+func (h *Handler) registerChallenge(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+
+	c, err := h.auth.RegisterChallenge(r.Context())
+	if err != nil {
+		if err == repositories.ErrNotImplemented {
+			render.Render(w, r, types.ErrInvalidRequest(http.StatusNotImplemented, err))
+			return
+		}
+		asynclogger.Error("[%s] registerChallenge failed ip=%s err=%v", reqID, clientIP(r), err)
+		render.Render(w, r, types.ErrInvalidRequest(http.StatusInternalServerError, fmt.Errorf("internal error")))
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	render.Render(w, r, &types.RegisterChallengeResponse{
+		Challenge:  c.Token,
+		Algorithm:  pow.Algorithm,
+		Difficulty: c.Difficulty,
+		ExpiresAt:  c.ExpiresAt,
+		InviteOnly: c.InviteOnly,
+	})
+}
+
+func (h *Handler) register(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	start := time.Now().UTC()
+	ip := clientIP(r)
+
+	var req registerRequest
+	if err := render.Bind(r, &req); err != nil {
+		asynclogger.Warning("[%s] register bind failed ip=%s ua=%q err=%v", reqID, ip, r.Header.Get("User-Agent"), err)
+		render.Render(w, r, types.ErrInvalidRequest(http.StatusBadRequest, err))
+		return
+	}
+
+	user, err := h.auth.Register(r.Context(), req.Username, req.Password, req.Email, req.Challenge, req.Nonce, req.InviteCode)
+	if err != nil {
+		h.recordAudit(r, types.AuditEvent{Type: types.AuditRegister, Username: req.Username, Outcome: types.OutcomeFailure, Detail: err.Error()})
+		switch err {
+		case repositories.ErrInvalidChallenge:
+			asynclogger.Warning("[%s] register bad challenge ip=%s username=%q dur=%s", reqID, ip, req.Username, time.Since(start))
+			render.Render(w, r, types.ErrInvalidRequest(http.StatusBadRequest, err))
+			return
+		case repositories.ErrInvalidInvite:
+			asynclogger.Warning("[%s] register bad invite ip=%s username=%q dur=%s", reqID, ip, req.Username, time.Since(start))
+			render.Render(w, r, types.ErrInvalidRequest(http.StatusForbidden, err))
+			return
+		case repositories.ErrNotImplemented:
+			render.Render(w, r, types.ErrInvalidRequest(http.StatusNotImplemented, err))
+			return
+		}
+		if resp := newUserError(err); resp != nil {
+			asynclogger.Warning("[%s] register refused ip=%s username=%q status=%d err=%v dur=%s", reqID, ip, req.Username, resp.HTTPStatusCode, err, time.Since(start))
+			render.Render(w, r, resp)
+			return
+		}
+		asynclogger.Error("[%s] register failed ip=%s username=%q dur=%s err=%v", reqID, ip, req.Username, time.Since(start), err)
+		render.Render(w, r, types.ErrInvalidRequest(http.StatusInternalServerError, fmt.Errorf("internal error")))
+		return
+	}
+
+	asynclogger.Info("[%s] register success user_id=%d username=%q ip=%s dur=%s", reqID, user.ID, user.Username, ip, time.Since(start))
+	h.recordAudit(r, types.AuditEvent{Type: types.AuditRegister, UserID: &user.ID, Username: user.Username, Outcome: types.OutcomeSuccess})
+	render.Status(r, http.StatusCreated)
+	render.Render(w, r, &types.UserResponse{User: types.NewUserDTO(user)})
+}
+
+func (h *Handler) createInvite(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	start := time.Now().UTC()
+	caller := principalFrom(r.Context())
+
+	var req createInviteRequest
+	if err := render.Bind(r, &req); err != nil {
+		asynclogger.Warning("[%s] createInvite bind failed user_id=%d err=%v", reqID, caller.UserID, err)
+		render.Render(w, r, types.ErrInvalidRequest(http.StatusBadRequest, err))
+		return
+	}
+
+	code, inv, err := h.auth.CreateInvite(r.Context(), caller.UserID, req.MaxUses, time.Duration(req.ExpiresIn)*time.Second)
+	if err != nil {
+		if err == repositories.ErrNotImplemented {
+			render.Render(w, r, types.ErrInvalidRequest(http.StatusNotImplemented, err))
+			return
+		}
+		asynclogger.Error("[%s] createInvite failed user_id=%d dur=%s err=%v", reqID, caller.UserID, time.Since(start), err)
+		render.Render(w, r, types.ErrInvalidRequest(http.StatusInternalServerError, fmt.Errorf("internal error")))
+		return
+	}
+
+	asynclogger.Info("[%s] createInvite success user_id=%d invite_id=%d max_uses=%d dur=%s", reqID, caller.UserID, inv.ID, inv.MaxUses, time.Since(start))
+	render.Status(r, http.StatusCreated)
+	render.Render(w, r, &types.InviteResponse{Code: code, ID: inv.ID, MaxUses: inv.MaxUses, ExpiresAt: *inv.ExpiresAt})
+}
@@ -0,0 +1,155 @@
+package transport
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/render"
+
+	"bioly/asynclogger"
+	"bioly/auth/internal/repositories"
+	"bioly/auth/internal/types"
+	"bioly/auth/internal/usecase"
+)
+
+const maxPasskeyNameLength = 64
+
+// passkeyFinishRequest carries the PublicKeyCredential the browser returned,
+// serialized with its binary fields in base64url, and the session from the
+// begin call.
+type passkeyFinishRequest struct {
+	Session    string          `json:"session"`
+	Name       string          `json:"name"`
+	Credential json.RawMessage `json:"credential"`
+}
+
+func (pr *passkeyFinishRequest) Bind(r *http.Request) error {
+	if pr.Session == "" || len(pr.Credential) == 0 {
+		return fmt.Errorf("session and credential are required")
+	}
+	if utf8.RuneCountInString(pr.Name) > maxPasskeyNameLength {
+		return fmt.Errorf("name must be at most %d characters", maxPasskeyNameLength)
+	}
+	return nil
+}
+
+func renderPasskeyCeremony(w http.ResponseWriter, r *http.Request, c *usecase.PasskeyCeremony) {
+	w.Header().Set("Cache-Control", "no-store")
+	render.Render(w, r, &types.PasskeyCeremonyResponse{
+		Options:   c.Options,
+		Session:   c.Session,
+		ExpiresIn: int(c.ExpiresIn.Seconds()),
+	})
+}
+
+func (h *Handler) beginPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	caller := principalFrom(r.Context())
+
+	c, err := h.auth.BeginPasskeyRegistration(r.Context(), caller.UserID)
+	if err != nil {
+		if err == repositories.ErrNotImplemented {
+			render.Render(w, r, types.ErrInvalidRequest(http.StatusNotImplemented, err))
+			return
+		}
+		asynclogger.Error("[%s] beginPasskeyRegistration failed user_id=%d err=%v", reqID, caller.UserID, err)
+		render.Render(w, r, types.ErrInvalidRequest(http.StatusInternalServerError, fmt.Errorf("internal error")))
+		return
+	}
+	renderPasskeyCeremony(w, r, c)
+}
+
+func (h *Handler) finishPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	start := time.Now().UTC()
+	caller := principalFrom(r.Context())
+
+	var req passkeyFinishRequest
+	if err := render.Bind(r, &req); err != nil {
+		asynclogger.Warning("[%s] finishPasskeyRegistration bind failed user_id=%d err=%v", reqID, caller.UserID, err)
+		render.Render(w, r, types.ErrInvalidRequest(http.StatusBadRequest, err))
+		return
+	}
+
+	cred, err := h.auth.FinishPasskeyRegistration(r.Context(), caller.UserID, req.Session, req.Name, req.Credential)
+	if err != nil {
+		var status int
+		switch err {
+		case repositories.ErrInvalidToken, repositories.ErrInvalidPasskey:
+			status = http.StatusBadRequest
+		case repositories.ErrDuplicateCredential:
+			status = http.StatusConflict
+		case repositories.ErrNotImplemented:
+			render.Render(w, r, types.ErrInvalidRequest(http.StatusNotImplemented, err))
+			return
+		default:
+			asynclogger.Error("[%s] finishPasskeyRegistration failed user_id=%d dur=%s err=%v", reqID, caller.UserID, time.Since(start), err)
+			render.Render(w, r, types.ErrInvalidRequest(http.StatusInternalServerError, fmt.Errorf("internal error")))
+			return
+		}
+		asynclogger.Warning("[%s] finishPasskeyRegistration rejected user_id=%d dur=%s err=%v", reqID, caller.UserID, time.Since(start), err)
+		h.recordAudit(r, types.AuditEvent{Type: types.AuditPasskeyAdd, UserID: &caller.UserID, Username: caller.Username, Outcome: types.OutcomeFailure, Detail: err.Error()})
+		render.Render(w, r, types.ErrInvalidRequest(status, err))
+		return
+	}
+
+	asynclogger.Info("[%s] finishPasskeyRegistration success user_id=%d passkey_id=%d dur=%s", reqID, caller.UserID, cred.ID, time.Since(start))
+	h.recordAudit(r, types.AuditEvent{Type: types.AuditPasskeyAdd, UserID: &caller.UserID, Username: caller.Username, Outcome: types.OutcomeSuccess, Detail: cred.Name})
+	render.Status(r, http.StatusCreated)
+	render.Render(w, r, &types.PasskeyResponse{Passkey: types.NewPasskeyDTO(cred)})
+}
+
+func (h *Handler) beginPasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+
+	c, err := h.auth.BeginPasskeyLogin(r.Context())
+	if err != nil {
+		if err == repositories.ErrNotImplemented {
+			render.Render(w, r, types.ErrInvalidRequest(http.StatusNotImplemented, err))
+			return
+		}
+		asynclogger.Error("[%s] beginPasskeyLogin failed ip=%s err=%v", reqID, clientIP(r), err)
+		render.Render(w, r, types.ErrInvalidRequest(http.StatusInternalServerError, fmt.Errorf("internal error")))
+		return
+	}
+	renderPasskeyCeremony(w, r, c)
+}
+
+func (h *Handler) finishPasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	reqID := middleware.GetReqID(r.Context())
+	start := time.Now().UTC()
+	ua := r.Header.Get("User-Agent")
+	ip := clientIP(r)
+
+	var req passkeyFinishRequest
+	if err := render.Bind(r, &req); err != nil {
+		asynclogger.Warning("[%s] finishPasskeyLogin bind failed ip=%s ua=%q err=%v", reqID, ip, ua, err)
+		render.Render(w, r, types.ErrInvalidRequest(http.StatusBadRequest, fmt.Errorf("invalid request body")))
+		return
+	}
+
+	user, tokens, err := h.auth.FinishPasskeyLogin(r.Context(), req.Session, req.Credential, ua, ip)
+	switch err {
+	case nil:
+	case repositories.ErrInvalidToken, repositories.ErrInvalidPasskey, repositories.ErrSignCountMismatch, repositories.ErrInvalidChallenge:
+		asynclogger.Warning("[%s] finishPasskeyLogin failed ip=%s ua=%q dur=%s err=%v", reqID, ip, ua, time.Since(start), err)
+		h.recordAudit(r, types.AuditEvent{Type: types.AuditLoginPasskey, Outcome: types.OutcomeFailure, Detail: err.Error()})
+		render.Render(w, r, types.ErrInvalidRequest(http.StatusUnauthorized, err))
+		return
+	case repositories.ErrNotImplemented:
+		render.Render(w, r, types.ErrInvalidRequest(http.StatusNotImplemented, err))
+		return
+	default:
+		asynclogger.Error("[%s] finishPasskeyLogin failed ip=%s ua=%q dur=%s err=%v", reqID, ip, ua, time.Since(start), err)
+		render.Render(w, r, types.ErrInvalidRequest(http.StatusInternalServerError, fmt.Errorf("internal error")))
+		return
+	}
+
+	asynclogger.Info("[%s] finishPasskeyLogin success ip=%s ua=%q user_id=%d username=%q dur=%s", reqID, ip, ua, user.ID, user.Username, time.Since(start))
+	h.recordAudit(r, types.AuditEvent{Type: types.AuditLoginPasskey, UserID: &user.ID, Username: user.Username, Outcome: types.OutcomeSuccess})
+	h.renderTokens(w, r, user, tokens, h.cookieDelivery(r))
+}
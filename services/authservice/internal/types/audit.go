@@ -0,0 +1,54 @@
+package types
+
+import "time"
+
+// Audit event types.
+const (
+	AuditLogin        = "login"
+	AuditLoginMFA     = "login_mfa"
+	AuditUserCreate   = "user_create"
+	AuditUserDelete   = "user_delete"
+	AuditTokenCreate  = "token_create"
+	AuditTokenRevoke  = "token_revoke"
+	AuditRegister     = "register"
+	AuditPasskeyAdd   = "passkey_add"
+	AuditLoginPasskey = "login_passkey"
+	AuditLoginMagic   = "login_magic"
+)
+
+// Audit event outcomes.
+const (
+	OutcomeSuccess     = "success"
+	OutcomeFailure     = "failure"
+	OutcomeThrottled   = "throttled"
+	OutcomeMFARequired = "mfa_required"
+	OutcomeDenied      = "denied"
+)
+
+// AuditEvent is a security relevant action. UserID is the account acted on
+// when it is known, Username the name that was given, and ActorID the
+// authenticated caller for actions taken on someone else's behalf.
+type AuditEvent struct {
+	ID        int64     `db:"id"`
+	Type      string    `db:"event_type"`
+	UserID    *int64    `db:"user_id"`
+	ActorID   *int64    `db:"actor_id"`
+	Username  string    `db:"username"`
+	IP        string    `db:"ip"`
+	UserAgent string    `db:"user_agent"`
+	RequestID string    `db:"request_id"`
+	Outcome   string    `db:"outcome"`
+	Detail    string    `db:"detail"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// AuditFilter selects audit events, newest first. Zero fields do not
+// filter. Before is a cursor: only events with a smaller ID are returned.
+type AuditFilter struct {
+	UserID *int64
+	Type   string
+	Since  time.Time
+	Until  time.Time
+	Before int64
+	Limit  int
+}
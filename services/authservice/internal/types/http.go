@@ -2,6 +2,7 @@ package types
 
 import (
 	"net/http"
+	"time"
 
 	"github.com/go-chi/render"
 )
@@ -10,6 +11,8 @@ type ErrResponse struct {
 	HTTPStatusCode int    `json:"-"`
 	Error          string `json:"error"`
 	AppCode        int64  `json:"app_code,omitempty"`
+	// Reason is a stable code saying why the input was refused.
+	Reason string `json:"reason,omitempty"`
 }
 
 func (e *ErrResponse) Render(w http.ResponseWriter, r *http.Request) error {
@@ -24,9 +27,30 @@ func ErrInvalidRequest(status int, err error) *ErrResponse {
 	}
 }
 
+// ErrWithReason is ErrInvalidRequest with a reason code.
+func ErrWithReason(status int, err error, reason string) *ErrResponse {
+	e := ErrInvalidRequest(status, err)
+	e.Reason = reason
+	return e
+}
+
+// ErrWithAppCode is ErrInvalidRequest with an application error code.
+func ErrWithAppCode(status int, err error, code int64) *ErrResponse {
+	e := ErrInvalidRequest(status, err)
+	e.AppCode = code
+	return e
+}
+
+// Reason codes for usernames that are valid but not available. Names the
+// policy refuses use the usernames.Reason codes.
+const (
+	ReasonUsernameTaken        = "taken"
+	ReasonUsernameRecentlyUsed = "recently_used"
+)
+
 type LoginResponse struct {
 	Access  string  `json:"access"`
-	Refresh string  `json:"refresh"`
+	Refresh string  `json:"refresh,omitempty"`
 	User    UserDTO `json:"user"`
 }
 
@@ -34,7 +58,235 @@ func (lr *LoginResponse) Render(w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
+// UserResponse wraps a user returned without tokens.
+type UserResponse struct {
+	User UserDTO `json:"user"`
+}
+
+func (ur *UserResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+// IntrospectionResponse follows RFC 7662. Only Active is set for tokens
+// that are invalid, expired or belong to a closed session. Scope, space
+// separated, is only set for personal access tokens; access tokens of a
+// login grant everything.
+type IntrospectionResponse struct {
+	Active        bool     `json:"active"`
+	TokenType     string   `json:"token_type,omitempty"`
+	Subject       string   `json:"sub,omitempty"`
+	Username      string   `json:"username,omitempty"`
+	SessionID     string   `json:"sid,omitempty"`
+	Roles         []string `json:"roles,omitempty"`
+	Scope         string   `json:"scope,omitempty"`
+	EmailVerified bool     `json:"email_verified,omitempty"`
+	IssuedAt      int64    `json:"iat,omitempty"`
+	ExpiresAt     int64    `json:"exp,omitempty"`
+}
+
+func (ir *IntrospectionResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+type AuditEventsResponse struct {
+	Events     []AuditEventDTO `json:"events"`
+	NextCursor string          `json:"next_cursor,omitempty"`
+}
+
+func (ar *AuditEventsResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+type AuditEventDTO struct {
+	ID        int64     `json:"id"`
+	Type      string    `json:"type"`
+	UserID    *int64    `json:"user_id,omitempty"`
+	ActorID   *int64    `json:"actor_id,omitempty"`
+	Username  string    `json:"username,omitempty"`
+	IP        string    `json:"ip,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+	Outcome   string    `json:"outcome"`
+	Detail    string    `json:"detail,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func NewAuditEventDTO(e AuditEvent) AuditEventDTO {
+	return AuditEventDTO{
+		ID:        e.ID,
+		Type:      e.Type,
+		UserID:    e.UserID,
+		ActorID:   e.ActorID,
+		Username:  e.Username,
+		IP:        e.IP,
+		UserAgent: e.UserAgent,
+		RequestID: e.RequestID,
+		Outcome:   e.Outcome,
+		Detail:    e.Detail,
+		CreatedAt: e.CreatedAt,
+	}
+}
+
 type UserDTO struct {
-	ID       int64  `json:"id"`
-	Username string `json:"username"`
+	ID            int64  `json:"id"`
+	Username      string `json:"username"`
+	Email         string `json:"email,omitempty"`
+	EmailVerified bool   `json:"email_verified"`
+}
+
+func NewUserDTO(u *User) UserDTO {
+	dto := UserDTO{ID: u.ID, Username: u.Username, EmailVerified: u.EmailVerifiedAt != nil}
+	if u.Email != nil {
+		dto.Email = *u.Email
+	}
+	return dto
+}
+
+type SessionDTO struct {
+	ID         string    `json:"id"`
+	Current    bool      `json:"current"`
+	Device     string    `json:"device"`
+	OS         string    `json:"os,omitempty"`
+	Browser    string    `json:"browser,omitempty"`
+	Summary    string    `json:"summary"`
+	IP         string    `json:"ip,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+type SessionsResponse struct {
+	Sessions []SessionDTO `json:"sessions"`
+}
+
+func (sr *SessionsResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+// PersonalTokenDTO describes a personal access token. The secret is never
+// part of it.
+type PersonalTokenDTO struct {
+	ID         int64      `json:"id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+func NewPersonalTokenDTO(t *PersonalToken) PersonalTokenDTO {
+	return PersonalTokenDTO{
+		ID:         t.ID,
+		Name:       t.Name,
+		Scopes:     append([]string{}, t.Scopes...),
+		ExpiresAt:  t.ExpiresAt,
+		LastUsedAt: t.LastUsedAt,
+		CreatedAt:  t.CreatedAt,
+	}
+}
+
+// CreatedTokenResponse is the only response that carries the token itself.
+type CreatedTokenResponse struct {
+	Token         string           `json:"token"`
+	PersonalToken PersonalTokenDTO `json:"personal_token"`
+}
+
+func (cr *CreatedTokenResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+type PersonalTokensResponse struct {
+	Tokens []PersonalTokenDTO `json:"tokens"`
+}
+
+func (pr *PersonalTokensResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+// RegisterChallengeResponse is a proof-of-work challenge. The client must
+// find a nonce such that the Algorithm hash of Challenge followed by the
+// nonce starts with Difficulty zero bits.
+type RegisterChallengeResponse struct {
+	Challenge  string    `json:"challenge"`
+	Algorithm  string    `json:"algorithm"`
+	Difficulty int       `json:"difficulty"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	InviteOnly bool      `json:"invite_only"`
+}
+
+func (rr *RegisterChallengeResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+// InviteResponse carries a new invite code, which is shown only once.
+type InviteResponse struct {
+	Code      string    `json:"code"`
+	ID        int64     `json:"id"`
+	MaxUses   int       `json:"max_uses"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func (ir *InviteResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+// PasskeyCeremonyResponse starts a passkey registration or login. Options
+// are passed to navigator.credentials.create or .get; Session is sent back
+// to the matching finish endpoint within ExpiresIn seconds.
+type PasskeyCeremonyResponse struct {
+	Options   any    `json:"options"`
+	Session   string `json:"session"`
+	ExpiresIn int    `json:"expires_in"`
+}
+
+func (pr *PasskeyCeremonyResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+type PasskeyDTO struct {
+	ID         int64      `json:"id"`
+	Name       string     `json:"name"`
+	Synced     bool       `json:"synced"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+func NewPasskeyDTO(c *WebAuthnCredential) PasskeyDTO {
+	return PasskeyDTO{
+		ID:         c.ID,
+		Name:       c.Name,
+		Synced:     c.BackupState,
+		LastUsedAt: c.LastUsedAt,
+		CreatedAt:  c.CreatedAt,
+	}
+}
+
+type PasskeyResponse struct {
+	Passkey PasskeyDTO `json:"passkey"`
+}
+
+func (pr *PasskeyResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+// MFAChallengeResponse answers a correct password on an account with 2FA.
+// MFAToken is exchanged together with a code at /login/mfa.
+type MFAChallengeResponse struct {
+	MFARequired bool   `json:"mfa_required"`
+	MFAToken    string `json:"mfa_token"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+func (mr *MFAChallengeResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+type TOTPEnrollmentResponse struct {
+	Secret        string   `json:"secret"`
+	OTPAuthURI    string   `json:"otpauth_uri"`
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+func (tr *TOTPEnrollmentResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
 }
@@ -0,0 +1,13 @@
+package types
+
+import "time"
+
+// Identity links an account at an external OAuth/OIDC provider to a user.
+// Subject is the provider's stable id for the account.
+type Identity struct {
+	ID        int64     `db:"id"`
+	UserID    int64     `db:"user_id"`
+	Provider  string    `db:"provider"`
+	Subject   string    `db:"subject"`
+	CreatedAt time.Time `db:"created_at"`
+}
@@ -0,0 +1,15 @@
+package types
+
+import "time"
+
+// Invite is a code that lets up to MaxUses people sign up while
+// registration is invite-only.
+type Invite struct {
+	ID        int64      `db:"id"`
+	CodeHash  string     `db:"code_hash"`
+	CreatedBy *int64     `db:"created_by"`
+	MaxUses   int        `db:"max_uses"`
+	Uses      int        `db:"uses"`
+	ExpiresAt *time.Time `db:"expires_at"`
+	CreatedAt time.Time  `db:"created_at"`
+}
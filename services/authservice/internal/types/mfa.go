@@ -0,0 +1,15 @@
+package types
+
+import "time"
+
+// MFA is the TOTP enrolment of a user. EnabledAt is nil until the user
+// confirmed a first code. LastStep is the last accepted time step, so a code
+// cannot be used twice.
+type MFA struct {
+	UserID    int64      `db:"user_id"`
+	SecretEnc string     `db:"secret_enc"`
+	EnabledAt *time.Time `db:"enabled_at"`
+	LastStep  int64      `db:"last_step"`
+	CreatedAt time.Time  `db:"created_at"`
+	UpdatedAt time.Time  `db:"updated_at"`
+}
@@ -0,0 +1,24 @@
+package types
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// PersonalToken is a long lived bearer token a user creates for scripts and
+// integrations. It grants only Scopes. ExpiresAt is nil for tokens that do
+// not expire.
+type PersonalToken struct {
+	ID         int64          `db:"id"`
+	UserID     int64          `db:"user_id"`
+	TokenID    uuid.UUID      `db:"token_id"`
+	TokenHash  string         `db:"token_hash"`
+	Name       string         `db:"name"`
+	Scopes     pq.StringArray `db:"scopes"`
+	ExpiresAt  *time.Time     `db:"expires_at"`
+	LastUsedAt *time.Time     `db:"last_used_at"`
+	RevokedAt  *time.Time     `db:"revoked_at"`
+	CreatedAt  time.Time      `db:"created_at"`
+}
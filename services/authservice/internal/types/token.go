@@ -0,0 +1,42 @@
+package types
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type RefreshToken struct {
+	ID        int64      `db:"id"`
+	UserID    int64      `db:"user_id"`
+	JTI       uuid.UUID  `db:"jti"`
+	FamilyID  uuid.UUID  `db:"family_id"`
+	TokenHash string     `db:"token_hash"`
+	UserAgent string     `db:"user_agent"`
+	IP        string     `db:"ip"`
+	ExpiresAt time.Time  `db:"expires_at"`
+	RevokedAt *time.Time `db:"revoked_at"`
+	CreatedAt time.Time  `db:"created_at"`
+}
+
+// Session is the live refresh token of one login, i.e. one device.
+type Session struct {
+	JTI        uuid.UUID `db:"jti"`
+	FamilyID   uuid.UUID `db:"family_id"`
+	UserAgent  string    `db:"user_agent"`
+	IP         string    `db:"ip"`
+	CreatedAt  time.Time `db:"created_at"`
+	LastUsedAt time.Time `db:"last_used_at"`
+	ExpiresAt  time.Time `db:"expires_at"`
+}
+
+// PasswordReset is a single-use token sent by mail to recover an account.
+type PasswordReset struct {
+	ID        int64      `db:"id"`
+	UserID    int64      `db:"user_id"`
+	TokenID   uuid.UUID  `db:"token_id"`
+	TokenHash string     `db:"token_hash"`
+	ExpiresAt time.Time  `db:"expires_at"`
+	UsedAt    *time.Time `db:"used_at"`
+	CreatedAt time.Time  `db:"created_at"`
+}
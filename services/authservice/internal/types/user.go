@@ -3,10 +3,13 @@ package types
 import "time"
 
 type User struct {
-	ID           int64      `db:"id"`
-	Username     string     `db:"username"`
-	PasswordHash string     `db:"password_hash"`
-	LastLoginAt  *time.Time `db:"last_login_at"`
-	CreatedAt    time.Time  `db:"created_at"`
-	UpdatedAt    time.Time  `db:"updated_at"`
+	ID              int64      `db:"id"`
+	Username        string     `db:"username"`
+	Email           *string    `db:"email"`
+	EmailVerifiedAt *time.Time `db:"email_verified_at"`
+	PasswordHash    string     `db:"password_hash"`
+	LastLoginAt     *time.Time `db:"last_login_at"`
+	LockedUntil     *time.Time `db:"locked_until"`
+	CreatedAt       time.Time  `db:"created_at"`
+	UpdatedAt       time.Time  `db:"updated_at"`
 }
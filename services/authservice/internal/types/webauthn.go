@@ -0,0 +1,25 @@
+package types
+
+import (
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// WebAuthnCredential is a passkey registered by a user. SignCount is the
+// last signature counter the authenticator reported.
+type WebAuthnCredential struct {
+	ID              int64          `db:"id"`
+	UserID          int64          `db:"user_id"`
+	CredentialID    []byte         `db:"credential_id"`
+	PublicKey       []byte         `db:"public_key"`
+	AttestationType string         `db:"attestation_type"`
+	AAGUID          []byte         `db:"aaguid"`
+	Transports      pq.StringArray `db:"transports"`
+	SignCount       int64          `db:"sign_count"`
+	BackupEligible  bool           `db:"backup_eligible"`
+	BackupState     bool           `db:"backup_state"`
+	Name            string         `db:"name"`
+	LastUsedAt      *time.Time     `db:"last_used_at"`
+	CreatedAt       time.Time      `db:"created_at"`
+}
@@ -0,0 +1,63 @@
+package usecase
+
+import (
+	"context"
+	"strconv"
+
+	"bioly/auth/internal/repositories"
+	"bioly/auth/internal/types"
+)
+
+const (
+	defaultAuditPage = 50
+	maxAuditPage     = 200
+)
+
+// AuditPage is one page of audit events, newest first. NextCursor is passed
+// back to fetch the following page and is empty on the last one.
+type AuditPage struct {
+	Events     []types.AuditEvent
+	NextCursor string
+}
+
+type AuditService interface {
+	Record(ctx context.Context, e *types.AuditEvent) error
+	List(ctx context.Context, f types.AuditFilter) (*AuditPage, error)
+}
+
+type auditImpl struct {
+	repo repositories.AuditEvents
+}
+
+func NewAudit(repo repositories.AuditEvents) AuditService {
+	return &auditImpl{repo: repo}
+}
+
+func (a *auditImpl) Record(ctx context.Context, e *types.AuditEvent) error {
+	return a.repo.Add(ctx, e)
+}
+
+// List returns a page of events matching f. Limit defaults to 50 and is
+// capped at 200.
+func (a *auditImpl) List(ctx context.Context, f types.AuditFilter) (*AuditPage, error) {
+	limit := f.Limit
+	if limit <= 0 {
+		limit = defaultAuditPage
+	}
+	if limit > maxAuditPage {
+		limit = maxAuditPage
+	}
+	// One extra row tells whether another page follows.
+	f.Limit = limit + 1
+	events, err := a.repo.List(ctx, f)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &AuditPage{Events: events}
+	if len(events) > limit {
+		page.Events = events[:limit]
+		page.NextCursor = strconv.FormatInt(page.Events[limit-1].ID, 10)
+	}
+	return page, nil
+}
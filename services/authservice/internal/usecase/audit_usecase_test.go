@@ -0,0 +1,65 @@
+package usecase_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"bioly/auth/internal/types"
+	"bioly/auth/internal/usecase"
+)
+
+type auditMock struct {
+	added []types.AuditEvent
+	seen  types.AuditFilter
+	total int64
+}
+
+func (m *auditMock) Add(ctx context.Context, e *types.AuditEvent) error {
+	m.added = append(m.added, *e)
+	return nil
+}
+
+// List serves events with IDs total..1, newest first.
+func (m *auditMock) List(ctx context.Context, f types.AuditFilter) ([]types.AuditEvent, error) {
+	m.seen = f
+	var events []types.AuditEvent
+	for id := m.total; id > 0 && len(events) < f.Limit; id-- {
+		if f.Before == 0 || id < f.Before {
+			events = append(events, types.AuditEvent{ID: id})
+		}
+	}
+	return events, nil
+}
+
+func TestAuditList_Pages(t *testing.T) {
+	repo := &auditMock{total: 5}
+	uc := usecase.NewAudit(repo)
+	ctx := context.Background()
+
+	page, err := uc.List(ctx, types.AuditFilter{Limit: 2, Type: types.AuditLogin})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, repo.seen.Limit)
+	assert.Equal(t, types.AuditLogin, repo.seen.Type)
+	assert.Len(t, page.Events, 2)
+	assert.Equal(t, "4", page.NextCursor)
+
+	page, err = uc.List(ctx, types.AuditFilter{Limit: 2, Before: 2})
+	assert.NoError(t, err)
+	assert.Len(t, page.Events, 1)
+	assert.Empty(t, page.NextCursor)
+}
+
+func TestAuditList_ClampsLimit(t *testing.T) {
+	repo := &auditMock{}
+	uc := usecase.NewAudit(repo)
+
+	_, err := uc.List(context.Background(), types.AuditFilter{})
+	assert.NoError(t, err)
+	assert.Equal(t, 51, repo.seen.Limit)
+
+	_, err = uc.List(context.Background(), types.AuditFilter{Limit: 10000})
+	assert.NoError(t, err)
+	assert.Equal(t, 201, repo.seen.Limit)
+}
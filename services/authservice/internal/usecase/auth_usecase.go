@@ -3,24 +3,71 @@ package usecase
 import (
 	"context"
 	"crypto/rand"
+	"crypto/subtle"
 	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/mail"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/alexedwards/argon2id"
+	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
 
+	"bioly/asynclogger"
 	"bioly/auth/internal/config"
+	"bioly/auth/internal/keys"
+	"bioly/auth/internal/magiclink"
+	"bioly/auth/internal/mailer"
+	"bioly/auth/internal/oauth"
+	"bioly/auth/internal/passwords"
+	"bioly/auth/internal/pow"
+	"bioly/auth/internal/ratelimit"
 	"bioly/auth/internal/repositories"
+	"bioly/auth/internal/secretbox"
 	"bioly/auth/internal/types"
+	"bioly/authjwt"
+	"bioly/usernames"
 )
 
 type AuthService interface {
 	Login(ctx context.Context, username, password, userAgent, ip string) (*types.User, *Tokens, error)
 	Refresh(ctx context.Context, refreshToken, userAgent, ip string) (*types.User, *Tokens, error)
-	CreateUser(ctx context.Context, username, password string) (*types.User, error)
+	Logout(ctx context.Context, refreshToken string) error
+	LogoutAll(ctx context.Context, userID int64) error
+	ListSessions(ctx context.Context, userID int64) ([]types.Session, error)
+	RevokeSession(ctx context.Context, userID int64, jti uuid.UUID) error
+	ParseAccess(ctx context.Context, token string) (*authjwt.Principal, error)
+	Introspect(ctx context.Context, token string) (*authjwt.Principal, error)
+	JWKS() keys.JWKS
+	ForgotPassword(ctx context.Context, username, ip string) error
+	ResetPassword(ctx context.Context, token, password string) error
+	ChangePassword(ctx context.Context, userID int64, sessionID, current, password, userAgent, ip string) (*types.User, *Tokens, error)
+	LoginMFA(ctx context.Context, mfaToken, code, userAgent, ip string) (*types.User, *Tokens, error)
+	EnrollTOTP(ctx context.Context, userID int64) (*TOTPEnrollment, error)
+	ConfirmTOTP(ctx context.Context, userID int64, code string) error
+	DisableTOTP(ctx context.Context, userID int64, code string) error
+	SendEmailVerification(ctx context.Context, userID int64) error
+	VerifyEmail(ctx context.Context, token string) error
+	CreateUser(ctx context.Context, username, password, email string) (*types.User, error)
+	ChangeUsername(ctx context.Context, userID int64, username string) (*types.User, error)
+	StartOAuth(ctx context.Context, provider string) (*OAuthFlow, error)
+	FinishOAuth(ctx context.Context, provider, code, state, flow, userAgent, ip string) (*types.User, *Tokens, error)
+	CreateToken(ctx context.Context, userID int64, name string, scopes []string, expiresIn time.Duration) (string, *types.PersonalToken, error)
+	ListTokens(ctx context.Context, userID int64) ([]types.PersonalToken, error)
+	RevokeToken(ctx context.Context, userID, id int64) error
+	RegisterChallenge(ctx context.Context) (*RegistrationChallenge, error)
+	Register(ctx context.Context, username, password, email, challenge, nonce, invite string) (*types.User, error)
+	CreateInvite(ctx context.Context, createdBy int64, maxUses int, expiresIn time.Duration) (string, *types.Invite, error)
+	BeginPasskeyRegistration(ctx context.Context, userID int64) (*PasskeyCeremony, error)
+	FinishPasskeyRegistration(ctx context.Context, userID int64, session, name string, credential []byte) (*types.WebAuthnCredential, error)
+	BeginPasskeyLogin(ctx context.Context) (*PasskeyCeremony, error)
+	FinishPasskeyLogin(ctx context.Context, session string, credential []byte, userAgent, ip string) (*types.User, *Tokens, error)
+	SendMagicLink(ctx context.Context, email, userAgent, ip string) error
+	LoginMagic(ctx context.Context, token, userAgent, ip string) (*types.User, *Tokens, error)
 	DeleteUser(ctx context.Context, id int64) error
 }
 
@@ -29,99 +76,785 @@ type Tokens struct {
 	Refresh string
 }
 
+// RetryLaterError is returned by Login when attempts are throttled or the
+// account is temporarily locked, and by the calls that send mail on request
+// (Mail) when too many were asked for.
+type RetryLaterError struct {
+	RetryAfter time.Duration
+	Locked     bool
+	Mail       bool
+}
+
+func (e *RetryLaterError) Error() string {
+	if e.Locked {
+		return repositories.ErrAccountLocked.Error()
+	}
+	if e.Mail {
+		return "too many mail requests"
+	}
+	return "too many login attempts"
+}
+
 type authImpl struct {
-	users   repositories.Users
-	rt      repositories.RefreshTokens
-	jwtConf *config.JWT
-	nowFn   func() time.Time
+	users    repositories.Users
+	rt       repositories.RefreshTokens
+	jwtConf  *config.JWT
+	limiter  *ratelimit.Limiter
+	throttle *config.LoginThrottle
+	mailRate *ratelimit.Limiter
+	keys     *keys.KeySet
+	hasher   *passwords.Hasher
+	resets   repositories.PasswordResets
+	mailer   mailer.Mailer
+	resetCfg *config.PasswordReset
+	emailCfg *config.EmailVerification
+	mfa      repositories.MFA
+	mfaBox   *secretbox.Box
+	mfaCfg   *config.MFA
+	nameCfg  *config.Username
+	names    *usernames.Policy
+	pwPolicy *passwords.Policy
+	idents   repositories.Identities
+	provs    map[string]*oauth.Provider
+	oauthBox *secretbox.Box
+	oauthCfg *config.OAuth
+	pats     repositories.PersonalTokens
+	patCfg   *config.PersonalTokens
+	regs     repositories.Registrations
+	pow      *pow.Issuer
+	regCfg   *config.Registration
+	passkeys repositories.WebAuthnCredentials
+	wa       *webauthn.WebAuthn
+	waBox    *secretbox.Box
+	waCfg    *config.WebAuthn
+	links    repositories.MagicLinks
+	linkSign *magiclink.Signer
+	linkCfg  *config.MagicLink
+	verifier authjwt.Verifier
+	nowFn    func() time.Time
+}
+
+type Option func(*authImpl)
+
+// WithKeys sets the key set used to sign and verify access tokens. Without
+// it tokens are signed with HS256 and jwtConf.AccessSecret.
+func WithKeys(ks *keys.KeySet) Option {
+	return func(a *authImpl) { a.keys = ks }
+}
+
+// WithLoginThrottle enables login throttling and account lockout.
+func WithLoginThrottle(l *ratelimit.Limiter, cfg *config.LoginThrottle) Option {
+	return func(a *authImpl) {
+		a.limiter = l
+		a.throttle = cfg
+	}
+}
+
+// WithMailThrottle limits the mails anonymous callers can have sent, such
+// as reset links, per recipient and per IP. l should be a Namespace of its
+// own, so these requests never count as failed logins.
+func WithMailThrottle(l *ratelimit.Limiter) Option {
+	return func(a *authImpl) { a.mailRate = l }
+}
+
+// WithHasher sets the password hasher. Without it the argon2id library
+// defaults are used.
+func WithHasher(h *passwords.Hasher) Option {
+	return func(a *authImpl) { a.hasher = h }
 }
 
-func NewAuth(users repositories.Users, rt repositories.RefreshTokens, jwtConf *config.JWT) AuthService {
-	return &authImpl{
+// WithPasswordReset enables the forgot/reset password flow. Without it both
+// calls return ErrNotImplemented.
+func WithPasswordReset(repo repositories.PasswordResets, m mailer.Mailer, cfg *config.PasswordReset) Option {
+	return func(a *authImpl) {
+		a.resets = repo
+		a.mailer = m
+		a.resetCfg = cfg
+	}
+}
+
+// WithEmailVerification enables verification links for email addresses.
+// Without it addresses are stored but never confirmed.
+func WithEmailVerification(m mailer.Mailer, cfg *config.EmailVerification) Option {
+	return func(a *authImpl) {
+		a.mailer = m
+		a.emailCfg = cfg
+	}
+}
+
+// WithUsernameChange enables renaming accounts. Without it ChangeUsername
+// returns ErrNotImplemented.
+func WithUsernameChange(cfg *config.Username) Option {
+	return func(a *authImpl) { a.nameCfg = cfg }
+}
+
+// WithPasswordPolicy checks new passwords on sign up, change and reset.
+// Without it any non-empty password is accepted.
+func WithPasswordPolicy(p *passwords.Policy) Option {
+	return func(a *authImpl) { a.pwPolicy = p }
+}
+
+// WithUsernamePolicy sets the rules new and changed usernames must follow.
+// Without it usernames.Default is used, which reserves no names.
+func WithUsernamePolicy(p *usernames.Policy) Option {
+	return func(a *authImpl) { a.names = p }
+}
+
+func NewAuth(users repositories.Users, rt repositories.RefreshTokens, jwtConf *config.JWT, opts ...Option) AuthService {
+	a := &authImpl{
 		users:   users,
 		rt:      rt,
 		jwtConf: jwtConf,
 		nowFn:   func() time.Time { return time.Now().UTC() },
 	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	if a.hasher == nil {
+		a.hasher = passwords.New(argon2id.DefaultParams)
+	}
+	if a.names == nil {
+		a.names = usernames.Default()
+	}
+	if a.keys == nil {
+		a.keys = keys.NewHMAC("", jwtConf.AccessSecret)
+	}
+	a.verifier = authjwt.NewJWTVerifier(authjwt.Options{
+		Issuer:  jwtConf.Issuer,
+		Keyfunc: a.keys.Keyfunc,
+		Methods: a.keys.Methods(),
+		NowFn:   a.nowFn,
+	})
+	return a
 }
 
 func (a *authImpl) Login(ctx context.Context, username, password, userAgent, ip string) (*types.User, *Tokens, error) {
-	user, err := a.users.VerifyCredentials(ctx, username, password)
+	user, err := a.verifyCredentials(ctx, username, password, ip)
 	if err != nil {
 		return nil, nil, err
 	}
+	a.rehash(ctx, user, password)
+	if err := a.requireMFA(ctx, user); err != nil {
+		return nil, nil, err
+	}
+	return a.startSession(ctx, user, userAgent, ip)
+}
+
+// startSession issues the first token pair of a new refresh token family.
+func (a *authImpl) startSession(ctx context.Context, user *types.User, userAgent, ip string) (*types.User, *Tokens, error) {
 	now := a.nowFn()
-	access, err := a.signAccess(user, now)
+	rtPlain, rt, err := a.newRefresh(user.ID, uuid.New(), userAgent, ip)
 	if err != nil {
 		return nil, nil, err
 	}
-	rtPlain, rtHash, jti, exp, err := a.newRefresh()
+	access, err := a.signAccess(ctx, user, rt.FamilyID, now)
 	if err != nil {
 		return nil, nil, err
 	}
-	if err := a.rt.Create(ctx, user.ID, jti, rtHash, userAgent, ip, exp); err != nil && err != repositories.ErrNotImplemented {
+	if err := a.rt.Create(ctx, rt); err != nil {
 		return nil, nil, err
 	}
 	return user, &Tokens{Access: access, Refresh: rtPlain}, nil
 }
 
+// verifyCredentials checks a password behind the login throttle. Wrong
+// passwords count towards both the backoff and the account lockout.
+func (a *authImpl) verifyCredentials(ctx context.Context, username, password, ip string) (*types.User, error) {
+	if a.limiter == nil {
+		return a.users.VerifyCredentials(ctx, username, password)
+	}
+
+	wait, err := a.limiter.Check(ctx, ip, username)
+	if err != nil {
+		return nil, err
+	}
+	if wait > 0 {
+		return nil, &RetryLaterError{RetryAfter: wait}
+	}
+
+	user, err := a.users.VerifyCredentials(ctx, username, password)
+	var locked *repositories.LockedError
+	switch {
+	case err == nil:
+		if err := a.limiter.Succeed(ctx, username); err != nil {
+			return nil, err
+		}
+		return user, nil
+	case errors.As(err, &locked):
+		return nil, &RetryLaterError{RetryAfter: locked.Until.Sub(a.nowFn()), Locked: true}
+	case errors.Is(err, repositories.ErrInvalidCredentials):
+		if ferr := a.limiter.Fail(ctx, ip, username); ferr != nil {
+			return nil, ferr
+		}
+		if a.throttle.LockoutThreshold > 0 {
+			if ferr := a.users.RegisterFailedLogin(ctx, username, a.throttle.LockoutThreshold, a.throttle.LockoutDuration); ferr != nil {
+				return nil, ferr
+			}
+		}
+		return nil, err
+	default:
+		return nil, err
+	}
+}
+
+// rehash upgrades a password hash made with outdated parameters. It runs
+// after a successful login, the only time the plain password is known.
+// Failures are ignored: the old hash stays valid and is retried next time.
+func (a *authImpl) rehash(ctx context.Context, u *types.User, password string) {
+	if !a.hasher.NeedsRehash(u.PasswordHash) {
+		return
+	}
+	hash, err := a.hasher.Hash(password)
+	if err != nil {
+		return
+	}
+	if err := a.users.UpdatePasswordHash(ctx, u.ID, hash); err == nil {
+		u.PasswordHash = hash
+	}
+}
+
+// Refresh exchanges a refresh token for a new access/refresh pair. Every
+// refresh token is single use: the presented one is revoked and a new one
+// from the same family is issued. Presenting an already revoked token is
+// treated as theft and revokes the whole family.
 func (a *authImpl) Refresh(ctx context.Context, refreshToken, userAgent, ip string) (*types.User, *Tokens, error) {
-	return nil, nil, repositories.ErrNotImplemented
+	old, err := a.lookupRefresh(ctx, refreshToken)
+	if err != nil {
+		return nil, nil, err
+	}
+	if old.RevokedAt != nil {
+		if err := a.rt.RevokeFamily(ctx, old.FamilyID); err != nil {
+			return nil, nil, err
+		}
+		return nil, nil, repositories.ErrTokenReused
+	}
+	now := a.nowFn()
+	if !now.Before(old.ExpiresAt) {
+		return nil, nil, repositories.ErrInvalidToken
+	}
+
+	user, err := a.users.GetByID(ctx, old.UserID)
+	if err != nil {
+		if errors.Is(err, repositories.ErrNotFound) {
+			return nil, nil, repositories.ErrInvalidToken
+		}
+		return nil, nil, err
+	}
+
+	rtPlain, next, err := a.newRefresh(user.ID, old.FamilyID, userAgent, ip)
+	if err != nil {
+		return nil, nil, err
+	}
+	access, err := a.signAccess(ctx, user, next.FamilyID, now)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := a.rt.Rotate(ctx, old.JTI, next); err != nil {
+		if errors.Is(err, repositories.ErrTokenReused) {
+			if rerr := a.rt.RevokeFamily(ctx, old.FamilyID); rerr != nil {
+				return nil, nil, rerr
+			}
+		}
+		return nil, nil, err
+	}
+	user.PasswordHash = ""
+	return user, &Tokens{Access: access, Refresh: rtPlain}, nil
 }
 
+// Logout revokes the presented refresh token. Logging out with a token that
+// is already revoked is not an error.
 func (a *authImpl) Logout(ctx context.Context, refreshToken string) error {
-	return repositories.ErrNotImplemented
+	rt, err := a.lookupRefresh(ctx, refreshToken)
+	if err != nil {
+		return err
+	}
+	if rt.RevokedAt != nil {
+		return nil
+	}
+	return a.rt.RevokeByJTI(ctx, rt.JTI)
 }
 
 func (a *authImpl) LogoutAll(ctx context.Context, userID int64) error {
-	return repositories.ErrNotImplemented
+	return a.rt.RevokeAllByUser(ctx, userID)
+}
+
+func (a *authImpl) ListSessions(ctx context.Context, userID int64) ([]types.Session, error) {
+	return a.rt.ListActiveByUser(ctx, userID)
+}
+
+func (a *authImpl) RevokeSession(ctx context.Context, userID int64, jti uuid.UUID) error {
+	return a.rt.RevokeSession(ctx, userID, jti)
 }
 
-func (a *authImpl) signAccess(u *types.User, now time.Time) (string, error) {
+func (a *authImpl) ParseAccess(ctx context.Context, token string) (*authjwt.Principal, error) {
+	p, err := a.verifier.Verify(ctx, token)
+	if err != nil {
+		return nil, repositories.ErrInvalidToken
+	}
+	return p, nil
+}
+
+// Introspect validates an access token like ParseAccess and also checks
+// that its login session is still active, so tokens stop working right
+// after logout or session revocation instead of when they expire. Personal
+// access tokens are accepted as well.
+func (a *authImpl) Introspect(ctx context.Context, token string) (*authjwt.Principal, error) {
+	if authjwt.IsPersonalToken(token) {
+		return a.introspectPersonal(ctx, token)
+	}
+	p, err := a.ParseAccess(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	family, err := uuid.Parse(p.SessionID)
+	if err != nil {
+		return nil, repositories.ErrInvalidToken
+	}
+	active, err := a.rt.SessionActive(ctx, family)
+	if err != nil {
+		return nil, err
+	}
+	if !active {
+		return nil, repositories.ErrInvalidToken
+	}
+	return p, nil
+}
+
+// ForgotPassword mails a single-use reset link to the user's verified
+// email address. Unknown usernames and accounts without a verified address
+// are not reported, so the endpoint cannot be used to probe for accounts.
+// Requests are limited per username and per IP by the mail throttle.
+func (a *authImpl) ForgotPassword(ctx context.Context, username, ip string) error {
+	if a.resets == nil {
+		return repositories.ErrNotImplemented
+	}
+	if err := a.throttleMail(ctx, ip, "reset:"+strings.TrimSpace(username)); err != nil {
+		return err
+	}
+	user, err := a.users.GetByUsername(ctx, strings.TrimSpace(username))
+	if err != nil {
+		if errors.Is(err, repositories.ErrNotFound) {
+			return nil
+		}
+		return err
+	}
+	if user.Email == nil || user.EmailVerifiedAt == nil {
+		return nil
+	}
+
+	secret, hash, err := a.newSecret()
+	if err != nil {
+		return err
+	}
+	pr := &types.PasswordReset{
+		UserID:    user.ID,
+		TokenID:   uuid.New(),
+		TokenHash: hash,
+		ExpiresAt: a.nowFn().Add(a.resetCfg.TokenTTL),
+	}
+	if err := a.resets.Create(ctx, pr); err != nil {
+		return err
+	}
+
+	token := pr.TokenID.String() + "." + secret
+	return a.mailer.Send(ctx, mailer.Message{
+		To:      *user.Email,
+		Subject: "Reset your Bioly password",
+		Body: "Someone asked to reset the password of your account " + user.Username + ".\n\n" +
+			"Open this link to choose a new one:\n" + a.resetCfg.LinkURL + token + "\n\n" +
+			"The link expires in " + a.resetCfg.TokenTTL.String() + ". If this wasn't you, ignore this message.\n",
+	})
+}
+
+// throttleMail counts a request to mail recipient against the mail
+// throttle and refuses it once the recipient or ip asked too often.
+func (a *authImpl) throttleMail(ctx context.Context, ip, recipient string) error {
+	if a.mailRate == nil {
+		return nil
+	}
+	wait, err := a.mailRate.Check(ctx, ip, recipient)
+	if err != nil {
+		return err
+	}
+	if wait > 0 {
+		return &RetryLaterError{RetryAfter: wait, Mail: true}
+	}
+	return a.mailRate.Fail(ctx, ip, recipient)
+}
+
+// ResetPassword consumes a reset token and sets a new password. Every
+// session of the user is logged out.
+func (a *authImpl) ResetPassword(ctx context.Context, token, password string) error {
+	if a.resets == nil {
+		return repositories.ErrNotImplemented
+	}
+	if password == "" {
+		return repositories.ErrInvalidCredentials
+	}
+	id, secret, err := parseToken(token)
+	if err != nil {
+		return err
+	}
+	pr, err := a.resets.FindByTokenID(ctx, id)
+	if err != nil {
+		if errors.Is(err, repositories.ErrNotFound) {
+			return repositories.ErrInvalidToken
+		}
+		return err
+	}
+	if !a.checkSecret(secret, pr.TokenHash) {
+		return repositories.ErrInvalidToken
+	}
+	if pr.UsedAt != nil || !a.nowFn().Before(pr.ExpiresAt) {
+		return repositories.ErrInvalidToken
+	}
+	if a.pwPolicy != nil {
+		// The token stays unused, so the user can try another password.
+		user, err := a.users.GetByID(ctx, pr.UserID)
+		if err != nil {
+			return err
+		}
+		if err := a.checkPassword(password, user); err != nil {
+			return err
+		}
+	}
+
+	hash, err := a.hasher.Hash(password)
+	if err != nil {
+		return err
+	}
+	return a.resets.Consume(ctx, pr.TokenID, hash)
+}
+
+const emailVerifyAudience = "email-verify"
+
+// SendEmailVerification mails a verification link for the user's current
+// address. It is a no-op once the address is verified.
+func (a *authImpl) SendEmailVerification(ctx context.Context, userID int64) error {
+	if a.emailCfg == nil {
+		return repositories.ErrNotImplemented
+	}
+	user, err := a.users.GetByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if user.Email == nil {
+		return repositories.ErrInvalidEmail
+	}
+	if user.EmailVerifiedAt != nil {
+		return nil
+	}
+	return a.sendEmailVerification(ctx, user)
+}
+
+// ChangePassword replaces the password of userID after checking the current
+// one behind the login throttle. Every refresh token is revoked except for
+// the caller's session (the sessionID family), which gets a fresh pair.
+func (a *authImpl) ChangePassword(ctx context.Context, userID int64, sessionID, current, password, userAgent, ip string) (*types.User, *Tokens, error) {
+	if password == "" {
+		return nil, nil, repositories.ErrInvalidCredentials
+	}
+	user, err := a.users.GetByID(ctx, userID)
+	if err != nil {
+		if errors.Is(err, repositories.ErrNotFound) {
+			return nil, nil, repositories.ErrInvalidToken
+		}
+		return nil, nil, err
+	}
+	if _, err := a.verifyCredentials(ctx, user.Username, current, ip); err != nil {
+		return nil, nil, err
+	}
+	if err := a.checkPassword(password, user); err != nil {
+		return nil, nil, err
+	}
+
+	familyID, err := uuid.Parse(sessionID)
+	if err != nil {
+		familyID = uuid.New()
+	}
+	hash, err := a.hasher.Hash(password)
+	if err != nil {
+		return nil, nil, err
+	}
+	now := a.nowFn()
+	rtPlain, rt, err := a.newRefresh(user.ID, familyID, userAgent, ip)
+	if err != nil {
+		return nil, nil, err
+	}
+	access, err := a.signAccess(ctx, user, familyID, now)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := a.users.ChangePassword(ctx, user.ID, hash, rt); err != nil {
+		return nil, nil, err
+	}
+	user.PasswordHash = ""
+	return user, &Tokens{Access: access, Refresh: rtPlain}, nil
+}
+
+// sendEmailVerification signs a token binding the user to their current
+// address, so changing the address invalidates links sent for the old one.
+func (a *authImpl) sendEmailVerification(ctx context.Context, u *types.User) error {
+	now := a.nowFn()
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"iss":   a.jwtConf.Issuer,
+		"aud":   emailVerifyAudience,
+		"sub":   strconv.FormatInt(u.ID, 10),
+		"email": *u.Email,
+		"iat":   now.Unix(),
+		"exp":   now.Add(a.emailCfg.TokenTTL).Unix(),
+	}).SignedString([]byte(a.emailCfg.Secret))
+	if err != nil {
+		return err
+	}
+	return a.mailer.Send(ctx, mailer.Message{
+		To:      *u.Email,
+		Subject: "Confirm your Bioly email address",
+		Body: "Hi " + u.Username + ",\n\n" +
+			"Open this link to confirm your email address:\n" + a.emailCfg.LinkURL + token + "\n\n" +
+			"The link expires in " + a.emailCfg.TokenTTL.String() + ".\n",
+	})
+}
+
+func (a *authImpl) VerifyEmail(ctx context.Context, token string) error {
+	if a.emailCfg == nil {
+		return repositories.ErrNotImplemented
+	}
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(token, claims,
+		func(*jwt.Token) (any, error) { return []byte(a.emailCfg.Secret), nil },
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithIssuer(a.jwtConf.Issuer),
+		jwt.WithAudience(emailVerifyAudience),
+		jwt.WithExpirationRequired(),
+		jwt.WithTimeFunc(a.nowFn),
+	)
+	if err != nil {
+		return repositories.ErrInvalidToken
+	}
+	sub, _ := claims.GetSubject()
+	id, err := strconv.ParseInt(sub, 10, 64)
+	email, _ := claims["email"].(string)
+	if err != nil || email == "" {
+		return repositories.ErrInvalidToken
+	}
+	if err := a.users.MarkEmailVerified(ctx, id, email); err != nil {
+		if errors.Is(err, repositories.ErrNotFound) {
+			return repositories.ErrInvalidToken
+		}
+		return err
+	}
+	return nil
+}
+
+// lookupRefresh parses a refresh token and loads its row, checking the
+// secret part against the stored hash.
+func (a *authImpl) lookupRefresh(ctx context.Context, refreshToken string) (*types.RefreshToken, error) {
+	jti, secret, err := parseToken(refreshToken)
+	if err != nil {
+		return nil, repositories.ErrInvalidToken
+	}
+	rt, err := a.rt.FindByJTI(ctx, jti)
+	if err != nil {
+		if errors.Is(err, repositories.ErrNotFound) {
+			return nil, repositories.ErrInvalidToken
+		}
+		return nil, err
+	}
+	if !a.checkSecret(secret, rt.TokenHash) {
+		return nil, repositories.ErrInvalidToken
+	}
+	return rt, nil
+}
+
+// signAccess issues an access token. The "sid" claim carries the refresh
+// token family so the session list can flag the caller's own session, and
+// "roles" is read fresh from the database so role changes apply on refresh.
+// The token is signed with the active key, whose ID goes into the "kid"
+// header so verifiers can pick the right key after a rotation.
+func (a *authImpl) signAccess(ctx context.Context, u *types.User, sessionID uuid.UUID, now time.Time) (string, error) {
+	roles, err := a.users.GetRoles(ctx, u.ID)
+	if err != nil {
+		return "", err
+	}
 	claims := jwt.MapClaims{
-		"iss":  a.jwtConf.Issuer,
-		"sub":  strconv.FormatInt(u.ID, 10),
-		"name": u.Username,
-		"iat":  now.Unix(),
-		"exp":  now.Add(a.jwtConf.AccessTTL).Unix(),
+		"iss":            a.jwtConf.Issuer,
+		"sub":            strconv.FormatInt(u.ID, 10),
+		"name":           u.Username,
+		"sid":            sessionID.String(),
+		"iat":            now.Unix(),
+		"exp":            now.Add(a.jwtConf.AccessTTL).Unix(),
+		"email_verified": u.EmailVerifiedAt != nil,
+		"roles":          roles,
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(a.jwtConf.AccessSecret))
+	return a.keys.Sign(claims)
 }
 
-func (a *authImpl) newRefresh() (plain string, hash string, jti uuid.UUID, exp time.Time, err error) {
+func (a *authImpl) JWKS() keys.JWKS {
+	return a.keys.JWKS()
+}
+
+// newSecret returns a random token secret and its hashTokenSecret hash.
+func (a *authImpl) newSecret() (string, string, error) {
 	buf := make([]byte, 32)
-	_, err = rand.Read(buf)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	secret := base64.RawURLEncoding.EncodeToString(buf)
+	return secret, hashTokenSecret(secret), nil
+}
+
+// checkSecret reports whether secret matches hash. Tokens issued before
+// secrets were hashed with SHA-256 carry an argon2id hash, which is still
+// accepted until they expire.
+func (a *authImpl) checkSecret(secret, hash string) bool {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		ok, err := a.hasher.Compare(secret, hash)
+		return err == nil && ok
+	}
+	return subtle.ConstantTimeCompare([]byte(hashTokenSecret(secret)), []byte(hash)) == 1
+}
+
+// newRefresh generates a refresh token in the form "<jti>.<secret>". Only a
+// hash of the secret is kept in the returned row.
+func (a *authImpl) newRefresh(userID int64, familyID uuid.UUID, userAgent, ip string) (string, *types.RefreshToken, error) {
+	secret, hash, err := a.newSecret()
 	if err != nil {
-		return
+		return "", nil, err
+	}
+	rt := &types.RefreshToken{
+		UserID:    userID,
+		JTI:       uuid.New(),
+		FamilyID:  familyID,
+		TokenHash: hash,
+		UserAgent: userAgent,
+		IP:        ip,
+		ExpiresAt: a.nowFn().Add(a.jwtConf.RefreshTTL),
+	}
+	return rt.JTI.String() + "." + secret, rt, nil
+}
+
+// parseToken splits an opaque "<uuid>.<secret>" token.
+func parseToken(token string) (uuid.UUID, string, error) {
+	jtiStr, secret, ok := strings.Cut(token, ".")
+	if !ok || secret == "" {
+		return uuid.Nil, "", repositories.ErrInvalidToken
+	}
+	jti, err := uuid.Parse(jtiStr)
+	if err != nil {
+		return uuid.Nil, "", repositories.ErrInvalidToken
 	}
-	plain = base64.RawURLEncoding.EncodeToString(buf)
-	jti = uuid.New()
-	exp = a.nowFn().Add(a.jwtConf.RefreshTTL)
-	hash, err = argon2id.CreateHash(plain, argon2id.DefaultParams)
-	return
+	return jti, secret, nil
 }
 
-func (a *authImpl) CreateUser(ctx context.Context, username, password string) (*types.User, error) {
-	u := strings.TrimSpace(username)
-	if len(u) < 3 || len(u) > 64 || password == "" {
+// CreateUser adds an account. The email is optional; when given, a
+// verification link is mailed.
+func (a *authImpl) CreateUser(ctx context.Context, username, password, email string) (*types.User, error) {
+	user, err := a.newUser(ctx, username, password, email)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.users.Add(ctx, user); err != nil {
+		return nil, err
+	}
+	a.welcome(ctx, user)
+	return user, nil
+}
+
+// newUser checks the details of a new account and hashes its password. The
+// user still has to be stored.
+func (a *authImpl) newUser(ctx context.Context, username, password, email string) (*types.User, error) {
+	if password == "" {
 		return nil, repositories.ErrInvalidCredentials
 	}
-	hash, err := argon2id.CreateHash(password, argon2id.DefaultParams)
+	u, err := a.normalizeUsername(username)
 	if err != nil {
 		return nil, err
 	}
-	user := &types.User{
-		Username:     u,
-		PasswordHash: hash,
+	if a.nameCfg != nil {
+		reserved, err := a.users.UsernameReserved(ctx, u, a.nowFn().Add(-a.nameCfg.ReserveFor))
+		if err != nil {
+			return nil, err
+		}
+		if reserved {
+			return nil, repositories.ErrUsernameReserved
+		}
 	}
-	if err := a.users.Add(ctx, user); err != nil {
+	user := &types.User{Username: u}
+	if e := strings.TrimSpace(email); e != "" {
+		addr, err := mail.ParseAddress(e)
+		if err != nil || addr.Address != e {
+			return nil, repositories.ErrInvalidEmail
+		}
+		user.Email = &e
+	}
+	if err := a.checkPassword(password, user); err != nil {
+		return nil, err
+	}
+	hash, err := a.hasher.Hash(password)
+	if err != nil {
+		return nil, err
+	}
+	user.PasswordHash = hash
+	return user, nil
+}
+
+// welcome finishes a stored new account: the hash is cleared from the
+// returned user and a verification link is mailed. A failed mail is logged
+// but does not undo the account, the user can ask for a new link later.
+func (a *authImpl) welcome(ctx context.Context, user *types.User) {
+	user.PasswordHash = ""
+	if user.Email != nil && a.emailCfg != nil {
+		if err := a.sendEmailVerification(ctx, user); err != nil {
+			asynclogger.Error("welcome verification mail failed user_id=%d err=%v", user.ID, err)
+		}
+	}
+}
+
+// ChangeUsername renames userID. The previous name is kept in the history
+// so old profile links redirect, and stays reserved for nameCfg.ReserveFor.
+func (a *authImpl) ChangeUsername(ctx context.Context, userID int64, username string) (*types.User, error) {
+	if a.nameCfg == nil {
+		return nil, repositories.ErrNotImplemented
+	}
+	u, err := a.normalizeUsername(username)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := a.users.ChangeUsername(ctx, userID, u, a.nowFn().Add(-a.nameCfg.ReserveFor)); err != nil {
+		return nil, err
+	}
+	user, err := a.users.GetByID(ctx, userID)
+	if err != nil {
 		return nil, err
 	}
 	user.PasswordHash = ""
 	return user, nil
 }
 
+// checkPassword applies the password policy to a new password for user.
+// Refused passwords give a *passwords.PolicyError.
+func (a *authImpl) checkPassword(password string, user *types.User) error {
+	if a.pwPolicy == nil {
+		return nil
+	}
+	inputs := []string{user.Username}
+	if user.Email != nil {
+		inputs = append(inputs, *user.Email)
+	}
+	return a.pwPolicy.Check(password, inputs...)
+}
+
+// normalizeUsername applies the username policy. Refused names wrap both
+// ErrInvalidUsername and the *usernames.Error giving the reason.
+func (a *authImpl) normalizeUsername(username string) (string, error) {
+	u, err := a.names.Normalize(username)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", repositories.ErrInvalidUsername, err)
+	}
+	return u, nil
+}
+
 func (a *authImpl) DeleteUser(ctx context.Context, id int64) error {
 	return a.users.Delete(ctx, id)
 }
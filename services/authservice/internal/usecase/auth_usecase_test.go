@@ -1,23 +1,45 @@
 package usecase_test
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"regexp"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/alexedwards/argon2id"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"bioly/auth/internal/config"
+	"bioly/auth/internal/keys"
+	"bioly/auth/internal/mailer"
+	"bioly/auth/internal/passwords"
+	"bioly/auth/internal/ratelimit"
 	"bioly/auth/internal/repositories"
 	"bioly/auth/internal/types"
 	"bioly/auth/internal/usecase"
+	"bioly/usernames"
 )
 
 type usersMock struct {
-	addFn    func(ctx context.Context, u *types.User) error
-	delFn    func(ctx context.Context, id int64) error
-	verifyFn func(ctx context.Context, username, password string) (*types.User, error)
+	addFn     func(ctx context.Context, u *types.User) error
+	delFn     func(ctx context.Context, id int64) error
+	getByIDFn func(ctx context.Context, id int64) (*types.User, error)
+	getByName func(ctx context.Context, username string) (*types.User, error)
+	byEmailFn func(ctx context.Context, email string) (*types.User, error)
+	verifyFn  func(ctx context.Context, username, password string) (*types.User, error)
+	failedFn  func(ctx context.Context, username string, threshold int, lockout time.Duration) error
+	rehashFn  func(ctx context.Context, id int64, hash string) error
+	markFn    func(ctx context.Context, id int64, email string) error
+	rolesFn   func(ctx context.Context, id int64) ([]string, error)
+	changeFn  func(ctx context.Context, id int64, hash string, next *types.RefreshToken) error
+	renameFn  func(ctx context.Context, id int64, username string, reservedSince time.Time) (string, error)
+	reservFn  func(ctx context.Context, username string, reservedSince time.Time) (bool, error)
 }
 
 func (m *usersMock) Add(ctx context.Context, u *types.User) error {
@@ -26,16 +48,67 @@ func (m *usersMock) Add(ctx context.Context, u *types.User) error {
 func (m *usersMock) Delete(ctx context.Context, id int64) error {
 	return m.delFn(ctx, id)
 }
+func (m *usersMock) GetByID(ctx context.Context, id int64) (*types.User, error) {
+	return m.getByIDFn(ctx, id)
+}
+func (m *usersMock) GetByUsername(ctx context.Context, username string) (*types.User, error) {
+	return m.getByName(ctx, username)
+}
+func (m *usersMock) GetByEmail(ctx context.Context, email string) (*types.User, error) {
+	return m.byEmailFn(ctx, email)
+}
 func (m *usersMock) VerifyCredentials(ctx context.Context, username, password string) (*types.User, error) {
 	return m.verifyFn(ctx, username, password)
 }
 
+func (m *usersMock) RegisterFailedLogin(ctx context.Context, username string, threshold int, lockout time.Duration) error {
+	if m.failedFn != nil {
+		return m.failedFn(ctx, username, threshold, lockout)
+	}
+	return nil
+}
+
+func (m *usersMock) UpdatePasswordHash(ctx context.Context, id int64, hash string) error {
+	if m.rehashFn != nil {
+		return m.rehashFn(ctx, id, hash)
+	}
+	return nil
+}
+
+func (m *usersMock) MarkEmailVerified(ctx context.Context, id int64, email string) error {
+	return m.markFn(ctx, id, email)
+}
+
+func (m *usersMock) GetRoles(ctx context.Context, id int64) ([]string, error) {
+	if m.rolesFn != nil {
+		return m.rolesFn(ctx, id)
+	}
+	return []string{repositories.DefaultRole}, nil
+}
+
+func (m *usersMock) ChangePassword(ctx context.Context, id int64, hash string, next *types.RefreshToken) error {
+	return m.changeFn(ctx, id, hash, next)
+}
+
+func (m *usersMock) ChangeUsername(ctx context.Context, id int64, username string, reservedSince time.Time) (string, error) {
+	return m.renameFn(ctx, id, username, reservedSince)
+}
+
+func (m *usersMock) UsernameReserved(ctx context.Context, username string, reservedSince time.Time) (bool, error) {
+	return m.reservFn(ctx, username, reservedSince)
+}
+
 type rtMock struct {
 	createCalled  bool
-	createFn      func(ctx context.Context, userID int64, jti [16]byte, tokenHash, userAgent, ip string, expiresAt time.Time) error
-	revokeFn      func(ctx context.Context, jti [16]byte) error
+	createFn      func(ctx context.Context, t *types.RefreshToken) error
+	rotateFn      func(ctx context.Context, oldJTI uuid.UUID, next *types.RefreshToken) error
+	revokeFn      func(ctx context.Context, jti uuid.UUID) error
+	revokeFamFn   func(ctx context.Context, familyID uuid.UUID) error
 	revokeAllFn   func(ctx context.Context, userID int64) error
-	findFn        func(ctx context.Context, jti [16]byte) (int64, string, time.Time, bool, error)
+	findFn        func(ctx context.Context, jti uuid.UUID) (*types.RefreshToken, error)
+	listFn        func(ctx context.Context, userID int64) ([]types.Session, error)
+	revokeSessFn  func(ctx context.Context, userID int64, jti uuid.UUID) error
+	activeFn      func(ctx context.Context, familyID uuid.UUID) (bool, error)
 	lastUserAgent string
 	lastIP        string
 	lastExpiresAt time.Time
@@ -43,35 +116,68 @@ type rtMock struct {
 	lastUserID    int64
 }
 
-func (m *rtMock) Create(ctx context.Context, userID int64, jti [16]byte, tokenHash, userAgent, ip string, expiresAt time.Time) error {
+func (m *rtMock) Create(ctx context.Context, t *types.RefreshToken) error {
 	m.createCalled = true
-	m.lastUserID = userID
-	m.lastUserAgent = userAgent
-	m.lastIP = ip
-	m.lastExpiresAt = expiresAt
-	m.lastTokenHash = tokenHash
+	m.lastUserID = t.UserID
+	m.lastUserAgent = t.UserAgent
+	m.lastIP = t.IP
+	m.lastExpiresAt = t.ExpiresAt
+	m.lastTokenHash = t.TokenHash
 	if m.createFn != nil {
-		return m.createFn(ctx, userID, jti, tokenHash, userAgent, ip, expiresAt)
+		return m.createFn(ctx, t)
+	}
+	return nil
+}
+func (m *rtMock) Rotate(ctx context.Context, oldJTI uuid.UUID, next *types.RefreshToken) error {
+	if m.rotateFn != nil {
+		return m.rotateFn(ctx, oldJTI, next)
+	}
+	return nil
+}
+func (m *rtMock) ListActiveByUser(ctx context.Context, userID int64) ([]types.Session, error) {
+	if m.listFn != nil {
+		return m.listFn(ctx, userID)
+	}
+	return nil, nil
+}
+func (m *rtMock) RevokeSession(ctx context.Context, userID int64, jti uuid.UUID) error {
+	if m.revokeSessFn != nil {
+		return m.revokeSessFn(ctx, userID, jti)
 	}
 	return nil
 }
-func (m *rtMock) RevokeByJTI(ctx context.Context, jti [16]byte) error {
+func (m *rtMock) RevokeByJTI(ctx context.Context, jti uuid.UUID) error {
 	if m.revokeFn != nil {
 		return m.revokeFn(ctx, jti)
 	}
 	return nil
 }
+func (m *rtMock) RevokeFamily(ctx context.Context, familyID uuid.UUID) error {
+	if m.revokeFamFn != nil {
+		return m.revokeFamFn(ctx, familyID)
+	}
+	return nil
+}
 func (m *rtMock) RevokeAllByUser(ctx context.Context, userID int64) error {
 	if m.revokeAllFn != nil {
 		return m.revokeAllFn(ctx, userID)
 	}
 	return nil
 }
-func (m *rtMock) FindValidByJTI(ctx context.Context, jti [16]byte) (int64, string, time.Time, bool, error) {
+func (m *rtMock) SessionActive(ctx context.Context, familyID uuid.UUID) (bool, error) {
+	if m.activeFn != nil {
+		return m.activeFn(ctx, familyID)
+	}
+	return true, nil
+}
+func (m *rtMock) Purge(ctx context.Context, revokedBefore time.Time, limit int) (int64, error) {
+	return 0, nil
+}
+func (m *rtMock) FindByJTI(ctx context.Context, jti uuid.UUID) (*types.RefreshToken, error) {
 	if m.findFn != nil {
 		return m.findFn(ctx, jti)
 	}
-	return 0, "", time.Time{}, false, nil
+	return nil, repositories.ErrNotFound
 }
 
 func TestCreateUser_Success(t *testing.T) {
@@ -92,7 +198,7 @@ func TestCreateUser_Success(t *testing.T) {
 		Issuer:        "auth.test",
 	})
 
-	user, err := uc.CreateUser(context.Background(), "newuser", "secret")
+	user, err := uc.CreateUser(context.Background(), "newuser", "secret", "")
 	assert.NoError(t, err)
 	assert.Equal(t, int64(101), user.ID)
 	assert.Equal(t, "newuser", user.Username)
@@ -113,7 +219,7 @@ func TestCreateUser_Duplicate(t *testing.T) {
 		Issuer:        "auth.test",
 	})
 
-	user, err := uc.CreateUser(context.Background(), "admin", "secret")
+	user, err := uc.CreateUser(context.Background(), "admin", "secret", "")
 	assert.Error(t, err)
 	assert.Nil(t, user)
 	assert.ErrorIs(t, err, repositories.ErrDuplicateUsername)
@@ -132,12 +238,37 @@ func TestCreateUser_InvalidInput(t *testing.T) {
 		Issuer:        "auth.test",
 	})
 
-	user, err := uc.CreateUser(context.Background(), "ab", "")
+	user, err := uc.CreateUser(context.Background(), "ab", "", "")
 	assert.Error(t, err)
 	assert.Nil(t, user)
 	assert.ErrorIs(t, err, repositories.ErrInvalidCredentials)
 }
 
+func TestCreateUser_UsernamePolicy(t *testing.T) {
+	policy, err := usernames.New(usernames.Config{Reserved: []string{"ping"}})
+	require.NoError(t, err)
+	uc := usecase.NewAuth(&usersMock{
+		addFn: func(ctx context.Context, u *types.User) error { return nil },
+	}, &rtMock{}, &config.JWT{AccessSecret: "access"}, usecase.WithUsernamePolicy(policy))
+
+	cases := map[string]usernames.Reason{
+		"P1ng":      usernames.ReasonReserved,
+		"bob/alice": usernames.ReasonCharacters,
+		"ab":        usernames.ReasonTooShort,
+	}
+	for name, want := range cases {
+		_, err := uc.CreateUser(context.Background(), name, "secret", "")
+		assert.ErrorIs(t, err, repositories.ErrInvalidUsername, name)
+		var nameErr *usernames.Error
+		require.ErrorAs(t, err, &nameErr, name)
+		assert.Equal(t, want, nameErr.Reason, name)
+	}
+
+	user, err := uc.CreateUser(context.Background(), " pinguin ", "secret", "")
+	require.NoError(t, err)
+	assert.Equal(t, "pinguin", user.Username)
+}
+
 func TestDeleteUser_Success(t *testing.T) {
 	uRepo := &usersMock{
 		delFn: func(ctx context.Context, id int64) error { return nil },
@@ -207,6 +338,34 @@ func TestLogin_Success(t *testing.T) {
 	assert.NotEmpty(t, rtRepo.lastTokenHash)
 }
 
+func TestLogin_SignsWithActiveSecret(t *testing.T) {
+	uRepo := &usersMock{
+		verifyFn: func(ctx context.Context, username, password string) (*types.User, error) {
+			return &types.User{ID: 77, Username: "root"}, nil
+		},
+	}
+	jwtConf := &config.JWT{AccessTTL: 15 * time.Minute, RefreshTTL: 24 * time.Hour, Issuer: "auth.test"}
+	secrets := []config.HMACSecret{{KID: "old", Secret: "old-secret"}, {KID: "new", Secret: "new-secret"}}
+	before, err := keys.NewHMACSet(secrets, "old")
+	require.NoError(t, err)
+	after, err := keys.NewHMACSet(secrets, "new")
+	require.NoError(t, err)
+
+	_, old, err := usecase.NewAuth(uRepo, &rtMock{}, jwtConf, usecase.WithKeys(before)).Login(context.Background(), "root", "secret", "UA", "127.0.0.1")
+	require.NoError(t, err)
+
+	uc := usecase.NewAuth(uRepo, &rtMock{}, jwtConf, usecase.WithKeys(after))
+	_, tokens, err := uc.Login(context.Background(), "root", "secret", "UA", "127.0.0.1")
+	require.NoError(t, err)
+	tok, _, err := jwt.NewParser().ParseUnverified(tokens.Access, jwt.MapClaims{})
+	require.NoError(t, err)
+	assert.Equal(t, "new", tok.Header["kid"])
+
+	p, err := uc.ParseAccess(context.Background(), old.Access)
+	require.NoError(t, err, "tokens signed with a listed older secret stay valid")
+	assert.Equal(t, int64(77), p.UserID)
+}
+
 func TestLogin_InvalidCredentials(t *testing.T) {
 	uRepo := &usersMock{
 		verifyFn: func(ctx context.Context, username, password string) (*types.User, error) {
@@ -228,19 +387,1068 @@ func TestLogin_InvalidCredentials(t *testing.T) {
 	assert.Nil(t, tokens)
 }
 
-func TestRefresh_NotImplemented(t *testing.T) {
-	uRepo := &usersMock{}
-	rtRepo := &rtMock{}
-	uc := usecase.NewAuth(uRepo, rtRepo, &config.JWT{
+// issueRefresh logs in through the usecase and returns the refresh token
+// together with the row that was stored for it.
+func issueRefresh(t *testing.T, uc usecase.AuthService, rtRepo *rtMock) (string, *types.RefreshToken) {
+	t.Helper()
+	var stored *types.RefreshToken
+	rtRepo.createFn = func(ctx context.Context, rt *types.RefreshToken) error {
+		stored = rt
+		return nil
+	}
+	_, tokens, err := uc.Login(context.Background(), "root", "secret", "UA", "127.0.0.1")
+	assert.NoError(t, err)
+	rtRepo.createFn = nil
+	return tokens.Refresh, stored
+}
+
+func newRefreshUsecase(rtRepo *rtMock) usecase.AuthService {
+	uRepo := &usersMock{
+		verifyFn: func(ctx context.Context, username, password string) (*types.User, error) {
+			return &types.User{ID: 77, Username: "root"}, nil
+		},
+		getByIDFn: func(ctx context.Context, id int64) (*types.User, error) {
+			return &types.User{ID: id, Username: "root", PasswordHash: "hash"}, nil
+		},
+	}
+	return usecase.NewAuth(uRepo, rtRepo, &config.JWT{
 		AccessSecret:  "access",
 		RefreshSecret: "refresh",
 		AccessTTL:     15 * time.Minute,
 		RefreshTTL:    24 * time.Hour,
 		Issuer:        "auth.test",
 	})
-	user, tokens, err := uc.Refresh(context.Background(), "rt", "UA", "ip")
+}
+
+func TestRefresh_Success(t *testing.T) {
+	rtRepo := &rtMock{}
+	uc := newRefreshUsecase(rtRepo)
+	plain, stored := issueRefresh(t, uc, rtRepo)
+
+	rtRepo.findFn = func(ctx context.Context, jti uuid.UUID) (*types.RefreshToken, error) {
+		assert.Equal(t, stored.JTI, jti)
+		return stored, nil
+	}
+	var rotated *types.RefreshToken
+	rtRepo.rotateFn = func(ctx context.Context, oldJTI uuid.UUID, next *types.RefreshToken) error {
+		assert.Equal(t, stored.JTI, oldJTI)
+		rotated = next
+		return nil
+	}
+
+	user, tokens, err := uc.Refresh(context.Background(), plain, "UA2", "10.0.0.1")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(77), user.ID)
+	assert.Empty(t, user.PasswordHash)
+	assert.NotEmpty(t, tokens.Access)
+	assert.NotEqual(t, plain, tokens.Refresh)
+	if assert.NotNil(t, rotated) {
+		assert.Equal(t, stored.FamilyID, rotated.FamilyID)
+		assert.NotEqual(t, stored.JTI, rotated.JTI)
+		assert.Equal(t, "UA2", rotated.UserAgent)
+		assert.Equal(t, "10.0.0.1", rotated.IP)
+	}
+}
+
+func TestRefresh_ReuseRevokesFamily(t *testing.T) {
+	rtRepo := &rtMock{}
+	uc := newRefreshUsecase(rtRepo)
+	plain, stored := issueRefresh(t, uc, rtRepo)
+
+	revokedAt := time.Now().UTC()
+	stored.RevokedAt = &revokedAt
+	rtRepo.findFn = func(ctx context.Context, jti uuid.UUID) (*types.RefreshToken, error) {
+		return stored, nil
+	}
+	var revokedFamily uuid.UUID
+	rtRepo.revokeFamFn = func(ctx context.Context, familyID uuid.UUID) error {
+		revokedFamily = familyID
+		return nil
+	}
+	rtRepo.rotateFn = func(ctx context.Context, oldJTI uuid.UUID, next *types.RefreshToken) error {
+		t.Fatalf("Rotate should not be called for a revoked token")
+		return nil
+	}
+
+	user, tokens, err := uc.Refresh(context.Background(), plain, "UA", "ip")
+	assert.ErrorIs(t, err, repositories.ErrTokenReused)
 	assert.Nil(t, user)
 	assert.Nil(t, tokens)
-	assert.True(t, err != nil)
-	assert.True(t, errors.Is(err, repositories.ErrNotImplemented) || errors.Is(err, repositories.ErrInvalidCredentials) || err != nil)
+	assert.Equal(t, stored.FamilyID, revokedFamily)
+}
+
+func TestRefresh_ConcurrentRotationRevokesFamily(t *testing.T) {
+	rtRepo := &rtMock{}
+	uc := newRefreshUsecase(rtRepo)
+	plain, stored := issueRefresh(t, uc, rtRepo)
+
+	rtRepo.findFn = func(ctx context.Context, jti uuid.UUID) (*types.RefreshToken, error) {
+		return stored, nil
+	}
+	rtRepo.rotateFn = func(ctx context.Context, oldJTI uuid.UUID, next *types.RefreshToken) error {
+		return repositories.ErrTokenReused
+	}
+	familyRevoked := false
+	rtRepo.revokeFamFn = func(ctx context.Context, familyID uuid.UUID) error {
+		familyRevoked = true
+		return nil
+	}
+
+	_, _, err := uc.Refresh(context.Background(), plain, "UA", "ip")
+	assert.ErrorIs(t, err, repositories.ErrTokenReused)
+	assert.True(t, familyRevoked)
+}
+
+func TestRefresh_WrongSecret(t *testing.T) {
+	rtRepo := &rtMock{}
+	uc := newRefreshUsecase(rtRepo)
+	_, stored := issueRefresh(t, uc, rtRepo)
+
+	rtRepo.findFn = func(ctx context.Context, jti uuid.UUID) (*types.RefreshToken, error) {
+		return stored, nil
+	}
+
+	_, _, err := uc.Refresh(context.Background(), stored.JTI.String()+".forged", "UA", "ip")
+	assert.ErrorIs(t, err, repositories.ErrInvalidToken)
+}
+
+func TestRefresh_LegacyArgonHash(t *testing.T) {
+	rtRepo := &rtMock{}
+	uc := newRefreshUsecase(rtRepo)
+	plain, stored := issueRefresh(t, uc, rtRepo)
+	assert.Len(t, stored.TokenHash, 64, "hex SHA-256")
+
+	// Tokens issued while secrets were hashed with argon2id still work.
+	_, secret, _ := strings.Cut(plain, ".")
+	legacy, err := argon2id.CreateHash(secret, &argon2id.Params{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32})
+	require.NoError(t, err)
+	stored.TokenHash = legacy
+	rtRepo.findFn = func(ctx context.Context, jti uuid.UUID) (*types.RefreshToken, error) {
+		return stored, nil
+	}
+
+	_, _, err = uc.Refresh(context.Background(), plain, "UA", "ip")
+	assert.NoError(t, err)
+	_, _, err = uc.Refresh(context.Background(), stored.JTI.String()+".forged", "UA", "ip")
+	assert.ErrorIs(t, err, repositories.ErrInvalidToken)
+}
+
+func TestRefresh_Expired(t *testing.T) {
+	rtRepo := &rtMock{}
+	uc := newRefreshUsecase(rtRepo)
+	plain, stored := issueRefresh(t, uc, rtRepo)
+
+	stored.ExpiresAt = time.Now().UTC().Add(-time.Minute)
+	rtRepo.findFn = func(ctx context.Context, jti uuid.UUID) (*types.RefreshToken, error) {
+		return stored, nil
+	}
+
+	_, _, err := uc.Refresh(context.Background(), plain, "UA", "ip")
+	assert.ErrorIs(t, err, repositories.ErrInvalidToken)
+}
+
+func TestRefresh_Malformed(t *testing.T) {
+	rtRepo := &rtMock{}
+	uc := newRefreshUsecase(rtRepo)
+
+	for _, tok := range []string{"", "rt", "not-a-uuid.secret", uuid.NewString() + "."} {
+		user, tokens, err := uc.Refresh(context.Background(), tok, "UA", "ip")
+		assert.Nil(t, user)
+		assert.Nil(t, tokens)
+		assert.ErrorIs(t, err, repositories.ErrInvalidToken)
+	}
+}
+
+func TestLogout_RevokesToken(t *testing.T) {
+	rtRepo := &rtMock{}
+	uc := newRefreshUsecase(rtRepo)
+	plain, stored := issueRefresh(t, uc, rtRepo)
+
+	rtRepo.findFn = func(ctx context.Context, jti uuid.UUID) (*types.RefreshToken, error) {
+		return stored, nil
+	}
+	var revoked uuid.UUID
+	rtRepo.revokeFn = func(ctx context.Context, jti uuid.UUID) error {
+		revoked = jti
+		return nil
+	}
+
+	assert.NoError(t, uc.Logout(context.Background(), plain))
+	assert.Equal(t, stored.JTI, revoked)
+}
+
+func TestLogout_AlreadyRevoked(t *testing.T) {
+	rtRepo := &rtMock{}
+	uc := newRefreshUsecase(rtRepo)
+	plain, stored := issueRefresh(t, uc, rtRepo)
+
+	revokedAt := time.Now().UTC()
+	stored.RevokedAt = &revokedAt
+	rtRepo.findFn = func(ctx context.Context, jti uuid.UUID) (*types.RefreshToken, error) {
+		return stored, nil
+	}
+	rtRepo.revokeFn = func(ctx context.Context, jti uuid.UUID) error {
+		t.Fatalf("RevokeByJTI should not be called for a revoked token")
+		return nil
+	}
+
+	assert.NoError(t, uc.Logout(context.Background(), plain))
+}
+
+func TestLogout_InvalidToken(t *testing.T) {
+	rtRepo := &rtMock{}
+	uc := newRefreshUsecase(rtRepo)
+
+	err := uc.Logout(context.Background(), uuid.NewString()+".secret")
+	assert.ErrorIs(t, err, repositories.ErrInvalidToken)
+}
+
+func TestLogoutAll_RevokesUserTokens(t *testing.T) {
+	var revokedFor int64
+	rtRepo := &rtMock{
+		revokeAllFn: func(ctx context.Context, userID int64) error {
+			revokedFor = userID
+			return nil
+		},
+	}
+	uc := newRefreshUsecase(rtRepo)
+
+	assert.NoError(t, uc.LogoutAll(context.Background(), 77))
+	assert.Equal(t, int64(77), revokedFor)
+}
+
+func TestParseAccess_RoundTrip(t *testing.T) {
+	rtRepo := &rtMock{}
+	uc := newRefreshUsecase(rtRepo)
+
+	_, tokens, err := uc.Login(context.Background(), "root", "secret", "UA", "127.0.0.1")
+	assert.NoError(t, err)
+
+	claims, err := uc.ParseAccess(context.Background(), tokens.Access)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(77), claims.UserID)
+	assert.Equal(t, "root", claims.Username)
+	assert.Equal(t, []string{"user"}, claims.Roles)
+}
+
+func TestAccessRoles_ReadOnEveryIssue(t *testing.T) {
+	roles := []string{"user"}
+	uRepo := &usersMock{
+		verifyFn: func(ctx context.Context, username, password string) (*types.User, error) {
+			return &types.User{ID: 77, Username: "root"}, nil
+		},
+		getByIDFn: func(ctx context.Context, id int64) (*types.User, error) {
+			return &types.User{ID: id, Username: "root"}, nil
+		},
+		rolesFn: func(ctx context.Context, id int64) ([]string, error) {
+			assert.Equal(t, int64(77), id)
+			return roles, nil
+		},
+	}
+	rtRepo := &rtMock{}
+	uc := usecase.NewAuth(uRepo, rtRepo, &config.JWT{
+		AccessSecret: "access", AccessTTL: time.Minute, RefreshTTL: time.Hour, Issuer: "auth.test",
+	})
+	plain, stored := issueRefresh(t, uc, rtRepo)
+	rtRepo.findFn = func(ctx context.Context, jti uuid.UUID) (*types.RefreshToken, error) {
+		return stored, nil
+	}
+
+	roles = []string{"admin", "user"}
+	_, tokens, err := uc.Refresh(context.Background(), plain, "UA", "ip")
+	assert.NoError(t, err)
+
+	p, err := uc.ParseAccess(context.Background(), tokens.Access)
+	assert.NoError(t, err)
+	assert.True(t, p.HasRole("admin"))
+}
+
+func TestLogin_RolesLookupError(t *testing.T) {
+	uRepo := &usersMock{
+		verifyFn: func(ctx context.Context, username, password string) (*types.User, error) {
+			return &types.User{ID: 77, Username: "root"}, nil
+		},
+		rolesFn: func(ctx context.Context, id int64) ([]string, error) {
+			return nil, errors.New("db down")
+		},
+	}
+	rtRepo := &rtMock{}
+	uc := usecase.NewAuth(uRepo, rtRepo, &config.JWT{AccessSecret: "access", AccessTTL: time.Minute, RefreshTTL: time.Hour})
+
+	_, _, err := uc.Login(context.Background(), "root", "secret", "UA", "ip")
+	assert.Error(t, err)
+	assert.False(t, rtRepo.createCalled)
+}
+
+func TestAccessSessionID_FollowsRefreshFamily(t *testing.T) {
+	rtRepo := &rtMock{}
+	uc := newRefreshUsecase(rtRepo)
+	plain, stored := issueRefresh(t, uc, rtRepo)
+
+	rtRepo.findFn = func(ctx context.Context, jti uuid.UUID) (*types.RefreshToken, error) {
+		return stored, nil
+	}
+	_, tokens, err := uc.Refresh(context.Background(), plain, "UA", "ip")
+	assert.NoError(t, err)
+
+	p, err := uc.ParseAccess(context.Background(), tokens.Access)
+	assert.NoError(t, err)
+	assert.Equal(t, stored.FamilyID.String(), p.SessionID)
+}
+
+func TestIntrospect_ChecksSession(t *testing.T) {
+	var family uuid.UUID
+	rtRepo := &rtMock{createFn: func(ctx context.Context, rt *types.RefreshToken) error {
+		family = rt.FamilyID
+		return nil
+	}}
+	uc := newRefreshUsecase(rtRepo)
+	_, tokens, err := uc.Login(context.Background(), "root", "secret", "UA", "ip")
+	assert.NoError(t, err)
+
+	active := true
+	rtRepo.activeFn = func(ctx context.Context, familyID uuid.UUID) (bool, error) {
+		assert.Equal(t, family, familyID)
+		return active, nil
+	}
+	p, err := uc.Introspect(context.Background(), tokens.Access)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(77), p.UserID)
+	assert.WithinDuration(t, time.Now().Add(15*time.Minute), p.ExpiresAt, 5*time.Second)
+
+	active = false
+	_, err = uc.Introspect(context.Background(), tokens.Access)
+	assert.ErrorIs(t, err, repositories.ErrInvalidToken, "session was logged out")
+
+	_, err = uc.Introspect(context.Background(), "garbage")
+	assert.ErrorIs(t, err, repositories.ErrInvalidToken)
+}
+
+func TestRevokeSession_PassesOwner(t *testing.T) {
+	jti := uuid.New()
+	rtRepo := &rtMock{
+		revokeSessFn: func(ctx context.Context, userID int64, got uuid.UUID) error {
+			assert.Equal(t, int64(77), userID)
+			assert.Equal(t, jti, got)
+			return repositories.ErrNotFound
+		},
+	}
+	uc := newRefreshUsecase(rtRepo)
+
+	err := uc.RevokeSession(context.Background(), 77, jti)
+	assert.ErrorIs(t, err, repositories.ErrNotFound)
+}
+
+func TestParseAccess_WrongSecret(t *testing.T) {
+	rtRepo := &rtMock{}
+	uc := newRefreshUsecase(rtRepo)
+	other := usecase.NewAuth(&usersMock{
+		verifyFn: func(ctx context.Context, username, password string) (*types.User, error) {
+			return &types.User{ID: 1, Username: "x"}, nil
+		},
+	}, &rtMock{}, &config.JWT{
+		AccessSecret: "other",
+		AccessTTL:    15 * time.Minute,
+		RefreshTTL:   24 * time.Hour,
+		Issuer:       "auth.test",
+	})
+
+	_, tokens, err := other.Login(context.Background(), "x", "y", "UA", "ip")
+	assert.NoError(t, err)
+
+	_, err = uc.ParseAccess(context.Background(), tokens.Access)
+	assert.ErrorIs(t, err, repositories.ErrInvalidToken)
+}
+
+func newThrottledUsecase(uRepo *usersMock) usecase.AuthService {
+	cfg := &config.LoginThrottle{
+		Window:           time.Minute,
+		FreeAttempts:     2,
+		IPFreeAttempts:   10,
+		BaseDelay:        time.Minute,
+		MaxDelay:         time.Hour,
+		LockoutThreshold: 5,
+		LockoutDuration:  15 * time.Minute,
+	}
+	return usecase.NewAuth(uRepo, &rtMock{}, &config.JWT{
+		AccessSecret: "access",
+		AccessTTL:    15 * time.Minute,
+		RefreshTTL:   24 * time.Hour,
+		Issuer:       "auth.test",
+	}, usecase.WithLoginThrottle(ratelimit.New(ratelimit.NewMemoryStore(), cfg), cfg))
+}
+
+func TestLogin_ThrottlesRepeatedFailures(t *testing.T) {
+	verifyCalls, failed := 0, 0
+	uRepo := &usersMock{
+		verifyFn: func(ctx context.Context, username, password string) (*types.User, error) {
+			verifyCalls++
+			return nil, repositories.ErrInvalidCredentials
+		},
+		failedFn: func(ctx context.Context, username string, threshold int, lockout time.Duration) error {
+			assert.Equal(t, 5, threshold)
+			assert.Equal(t, 15*time.Minute, lockout)
+			failed++
+			return nil
+		},
+	}
+	uc := newThrottledUsecase(uRepo)
+
+	for i := 0; i < 2; i++ {
+		_, _, err := uc.Login(context.Background(), "root", "bad", "UA", "10.0.0.1")
+		assert.ErrorIs(t, err, repositories.ErrInvalidCredentials)
+	}
+	_, _, err := uc.Login(context.Background(), "root", "bad", "UA", "10.0.0.1")
+	var retry *usecase.RetryLaterError
+	if assert.ErrorAs(t, err, &retry) {
+		assert.False(t, retry.Locked)
+		assert.InDelta(t, time.Minute.Seconds(), retry.RetryAfter.Seconds(), 1)
+	}
+	assert.Equal(t, 2, verifyCalls, "throttled attempts must not reach the password check")
+	assert.Equal(t, 2, failed)
+}
+
+func TestLogin_LockedAccount(t *testing.T) {
+	until := time.Now().UTC().Add(10 * time.Minute)
+	uRepo := &usersMock{
+		verifyFn: func(ctx context.Context, username, password string) (*types.User, error) {
+			return nil, &repositories.LockedError{Until: until}
+		},
+	}
+	uc := newThrottledUsecase(uRepo)
+
+	_, _, err := uc.Login(context.Background(), "root", "secret", "UA", "10.0.0.1")
+	var retry *usecase.RetryLaterError
+	if assert.ErrorAs(t, err, &retry) {
+		assert.True(t, retry.Locked)
+		assert.InDelta(t, (10 * time.Minute).Seconds(), retry.RetryAfter.Seconds(), 2)
+	}
+}
+
+func TestLogin_SuccessResetsUsernameCounter(t *testing.T) {
+	fail := true
+	uRepo := &usersMock{
+		verifyFn: func(ctx context.Context, username, password string) (*types.User, error) {
+			if fail {
+				return nil, repositories.ErrInvalidCredentials
+			}
+			return &types.User{ID: 1, Username: "root"}, nil
+		},
+	}
+	uc := newThrottledUsecase(uRepo)
+
+	_, _, err := uc.Login(context.Background(), "root", "bad", "UA", "10.0.0.1")
+	assert.ErrorIs(t, err, repositories.ErrInvalidCredentials)
+	fail = false
+	_, _, err = uc.Login(context.Background(), "root", "secret", "UA", "10.0.0.1")
+	assert.NoError(t, err)
+
+	fail = true
+	for i := 0; i < 2; i++ {
+		_, _, err = uc.Login(context.Background(), "root", "bad", "UA", "10.0.0.2")
+		assert.ErrorIs(t, err, repositories.ErrInvalidCredentials)
+	}
+}
+
+func TestLogin_RehashesOutdatedHash(t *testing.T) {
+	current := &config.PasswordHash{Memory: 1024, Iterations: 2, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+	old, err := argon2id.CreateHash("secret", &argon2id.Params{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32})
+	assert.NoError(t, err)
+
+	var stored string
+	uRepo := &usersMock{
+		verifyFn: func(ctx context.Context, username, password string) (*types.User, error) {
+			return &types.User{ID: 5, Username: "root", PasswordHash: old}, nil
+		},
+		rehashFn: func(ctx context.Context, id int64, hash string) error {
+			assert.Equal(t, int64(5), id)
+			stored = hash
+			return nil
+		},
+	}
+	hasher := passwords.FromConfig(current)
+	uc := usecase.NewAuth(uRepo, &rtMock{}, &config.JWT{
+		AccessSecret: "access",
+		AccessTTL:    15 * time.Minute,
+		RefreshTTL:   24 * time.Hour,
+		Issuer:       "auth.test",
+	}, usecase.WithHasher(hasher))
+
+	_, _, err = uc.Login(context.Background(), "root", "secret", "UA", "127.0.0.1")
+	assert.NoError(t, err)
+	if assert.NotEmpty(t, stored) {
+		assert.False(t, hasher.NeedsRehash(stored))
+		ok, err := hasher.Compare("secret", stored)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	}
+}
+
+func TestLogin_KeepsCurrentHash(t *testing.T) {
+	hasher := passwords.FromConfig(&config.PasswordHash{Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32})
+	hash, err := hasher.Hash("secret")
+	assert.NoError(t, err)
+
+	uRepo := &usersMock{
+		verifyFn: func(ctx context.Context, username, password string) (*types.User, error) {
+			return &types.User{ID: 5, Username: "root", PasswordHash: hash}, nil
+		},
+		rehashFn: func(ctx context.Context, id int64, hash string) error {
+			t.Fatal("hash with current parameters must not be rewritten")
+			return nil
+		},
+	}
+	uc := usecase.NewAuth(uRepo, &rtMock{}, &config.JWT{
+		AccessSecret: "access",
+		AccessTTL:    15 * time.Minute,
+		RefreshTTL:   24 * time.Hour,
+		Issuer:       "auth.test",
+	}, usecase.WithHasher(hasher))
+
+	_, _, err = uc.Login(context.Background(), "root", "secret", "UA", "127.0.0.1")
+	assert.NoError(t, err)
+}
+
+type resetsMock struct {
+	created  *types.PasswordReset
+	consumed uuid.UUID
+	newHash  string
+}
+
+func (m *resetsMock) Create(ctx context.Context, pr *types.PasswordReset) error {
+	pr.ID = 1
+	m.created = pr
+	return nil
+}
+
+func (m *resetsMock) FindByTokenID(ctx context.Context, tokenID uuid.UUID) (*types.PasswordReset, error) {
+	if m.created == nil || m.created.TokenID != tokenID {
+		return nil, repositories.ErrNotFound
+	}
+	return m.created, nil
+}
+
+func (m *resetsMock) Consume(ctx context.Context, tokenID uuid.UUID, passwordHash string) error {
+	m.consumed = tokenID
+	m.newHash = passwordHash
+	return nil
+}
+
+func newResetUsecase(uRepo *usersMock, resets *resetsMock, outbox *bytes.Buffer) usecase.AuthService {
+	return usecase.NewAuth(uRepo, &rtMock{}, &config.JWT{
+		AccessSecret: "access",
+		AccessTTL:    15 * time.Minute,
+		RefreshTTL:   24 * time.Hour,
+		Issuer:       "auth.test",
+	}, usecase.WithPasswordReset(resets, mailer.NewOutbox(outbox, "noreply@test"), &config.PasswordReset{
+		TokenTTL: 30 * time.Minute,
+		LinkURL:  "https://bioly.test/reset?token=",
+	}))
+}
+
+func verifiedUser(id int64, username, email string) *types.User {
+	at := time.Now().UTC()
+	return &types.User{ID: id, Username: username, Email: &email, EmailVerifiedAt: &at}
+}
+
+var resetLink = regexp.MustCompile(`https://bioly\.test/reset\?token=(\S+)`)
+
+func TestForgotPassword_MailsSingleUseToken(t *testing.T) {
+	uRepo := &usersMock{
+		getByName: func(ctx context.Context, username string) (*types.User, error) {
+			assert.Equal(t, "root", username)
+			return verifiedUser(9, "root", "root@example.com"), nil
+		},
+	}
+	resets := &resetsMock{}
+	var outbox bytes.Buffer
+	uc := newResetUsecase(uRepo, resets, &outbox)
+
+	err := uc.ForgotPassword(context.Background(), " root ", "127.0.0.1")
+	assert.NoError(t, err)
+
+	assert.Contains(t, outbox.String(), "To: root@example.com\r\n")
+	m := resetLink.FindStringSubmatch(outbox.String())
+	if assert.Len(t, m, 2) && assert.NotNil(t, resets.created) {
+		assert.Equal(t, int64(9), resets.created.UserID)
+		assert.WithinDuration(t, time.Now().Add(30*time.Minute), resets.created.ExpiresAt, 5*time.Second)
+		assert.NotContains(t, resets.created.TokenHash, m[1], "only a hash of the token is stored")
+		assert.True(t, strings.HasPrefix(m[1], resets.created.TokenID.String()+"."))
+	}
+
+	err = uc.ResetPassword(context.Background(), m[1], "n3w-secret")
+	assert.NoError(t, err)
+	assert.Equal(t, resets.created.TokenID, resets.consumed)
+	ok, err := argon2id.ComparePasswordAndHash("n3w-secret", resets.newHash)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestForgotPassword_Throttled(t *testing.T) {
+	uRepo := &usersMock{
+		getByName: func(ctx context.Context, username string) (*types.User, error) {
+			return verifiedUser(9, "root", "root@example.com"), nil
+		},
+		verifyFn: func(ctx context.Context, username, password string) (*types.User, error) {
+			return verifiedUser(9, "root", "root@example.com"), nil
+		},
+	}
+	resets := &resetsMock{}
+	var outbox bytes.Buffer
+	cfg := &config.LoginThrottle{Window: time.Minute, FreeAttempts: 2, IPFreeAttempts: 10, BaseDelay: time.Minute, MaxDelay: time.Hour}
+	limiter := ratelimit.New(ratelimit.NewMemoryStore(), cfg)
+	uc := usecase.NewAuth(uRepo, &rtMock{}, &config.JWT{AccessSecret: "access", Issuer: "auth.test"},
+		usecase.WithPasswordReset(resets, mailer.NewOutbox(&outbox, "noreply@test"), &config.PasswordReset{TokenTTL: time.Minute, LinkURL: "https://bioly.test/reset?token="}),
+		usecase.WithLoginThrottle(limiter, cfg),
+		usecase.WithMailThrottle(limiter.Namespace("mail:")))
+
+	require.NoError(t, uc.ForgotPassword(context.Background(), "root", "10.0.0.1"))
+	require.NoError(t, uc.ForgotPassword(context.Background(), "root", "10.0.0.2"))
+	err := uc.ForgotPassword(context.Background(), "root", "10.0.0.3")
+	var retry *usecase.RetryLaterError
+	require.ErrorAs(t, err, &retry)
+	assert.True(t, retry.Mail)
+	assert.Equal(t, time.Minute, retry.RetryAfter.Round(time.Second))
+	assert.Len(t, resetLink.FindAllString(outbox.String(), -1), 2, "no mail once throttled")
+
+	// Reset requests never count as failed logins.
+	_, _, err = uc.Login(context.Background(), "root", "secret", "UA", "10.0.0.1")
+	assert.NoError(t, err)
+}
+
+func TestForgotPassword_UnknownUserIsSilent(t *testing.T) {
+	uRepo := &usersMock{
+		getByName: func(ctx context.Context, username string) (*types.User, error) {
+			return nil, repositories.ErrNotFound
+		},
+	}
+	resets := &resetsMock{}
+	var outbox bytes.Buffer
+	uc := newResetUsecase(uRepo, resets, &outbox)
+
+	assert.NoError(t, uc.ForgotPassword(context.Background(), "ghost", "127.0.0.1"))
+	assert.Nil(t, resets.created)
+	assert.Zero(t, outbox.Len())
+}
+
+func TestForgotPassword_RequiresVerifiedEmail(t *testing.T) {
+	email := "root@example.com"
+	uRepo := &usersMock{
+		getByName: func(ctx context.Context, username string) (*types.User, error) {
+			return &types.User{ID: 9, Username: "root", Email: &email}, nil
+		},
+	}
+	resets := &resetsMock{}
+	var outbox bytes.Buffer
+	uc := newResetUsecase(uRepo, resets, &outbox)
+
+	assert.NoError(t, uc.ForgotPassword(context.Background(), "root", "127.0.0.1"))
+	assert.Nil(t, resets.created)
+	assert.Zero(t, outbox.Len())
+}
+
+func TestResetPassword_RejectsBadTokens(t *testing.T) {
+	uRepo := &usersMock{
+		getByName: func(ctx context.Context, username string) (*types.User, error) {
+			return verifiedUser(9, "root", "root@example.com"), nil
+		},
+	}
+	resets := &resetsMock{}
+	var outbox bytes.Buffer
+	uc := newResetUsecase(uRepo, resets, &outbox)
+	assert.NoError(t, uc.ForgotPassword(context.Background(), "root", "127.0.0.1"))
+	token := resetLink.FindStringSubmatch(outbox.String())[1]
+	id, _, _ := strings.Cut(token, ".")
+
+	assert.ErrorIs(t, uc.ResetPassword(context.Background(), "garbage", "pw"), repositories.ErrInvalidToken)
+	assert.ErrorIs(t, uc.ResetPassword(context.Background(), id+".wrong", "pw"), repositories.ErrInvalidToken)
+	assert.ErrorIs(t, uc.ResetPassword(context.Background(), uuid.NewString()+".x", "pw"), repositories.ErrInvalidToken)
+
+	resets.created.ExpiresAt = time.Now().Add(-time.Second)
+	assert.ErrorIs(t, uc.ResetPassword(context.Background(), token, "pw"), repositories.ErrInvalidToken)
+
+	used := time.Now()
+	resets.created.ExpiresAt = time.Now().Add(time.Minute)
+	resets.created.UsedAt = &used
+	assert.ErrorIs(t, uc.ResetPassword(context.Background(), token, "pw"), repositories.ErrInvalidToken)
+	assert.Equal(t, uuid.Nil, resets.consumed)
+}
+
+func TestPasswordReset_DisabledWithoutOption(t *testing.T) {
+	uc := usecase.NewAuth(&usersMock{}, &rtMock{}, &config.JWT{AccessSecret: "access"})
+	assert.ErrorIs(t, uc.ForgotPassword(context.Background(), "root", "127.0.0.1"), repositories.ErrNotImplemented)
+	assert.ErrorIs(t, uc.ResetPassword(context.Background(), "t", "p"), repositories.ErrNotImplemented)
+}
+
+var verifyLink = regexp.MustCompile(`https://bioly\.test/verify\?token=(\S+)`)
+
+func newEmailUsecase(uRepo *usersMock, outbox *bytes.Buffer) usecase.AuthService {
+	return usecase.NewAuth(uRepo, &rtMock{}, &config.JWT{
+		AccessSecret: "access",
+		AccessTTL:    15 * time.Minute,
+		RefreshTTL:   24 * time.Hour,
+		Issuer:       "auth.test",
+	}, usecase.WithEmailVerification(mailer.NewOutbox(outbox, "noreply@test"), &config.EmailVerification{
+		Secret:   "email-secret",
+		TokenTTL: time.Hour,
+		LinkURL:  "https://bioly.test/verify?token=",
+	}))
+}
+
+func TestCreateUser_SendsVerificationLink(t *testing.T) {
+	var marked string
+	uRepo := &usersMock{
+		addFn: func(ctx context.Context, u *types.User) error {
+			u.ID = 12
+			return nil
+		},
+		markFn: func(ctx context.Context, id int64, email string) error {
+			assert.Equal(t, int64(12), id)
+			marked = email
+			return nil
+		},
+	}
+	var outbox bytes.Buffer
+	uc := newEmailUsecase(uRepo, &outbox)
+
+	user, err := uc.CreateUser(context.Background(), "bob", "secret", " bob@example.com ")
+	assert.NoError(t, err)
+	if assert.NotNil(t, user.Email) {
+		assert.Equal(t, "bob@example.com", *user.Email)
+	}
+	assert.Contains(t, outbox.String(), "To: bob@example.com\r\n")
+
+	m := verifyLink.FindStringSubmatch(outbox.String())
+	if assert.Len(t, m, 2) {
+		assert.NoError(t, uc.VerifyEmail(context.Background(), m[1]))
+		assert.Equal(t, "bob@example.com", marked)
+	}
+}
+
+func TestCreateUser_InvalidEmail(t *testing.T) {
+	uRepo := &usersMock{
+		addFn: func(ctx context.Context, u *types.User) error {
+			t.Fatal("user with invalid email must not be stored")
+			return nil
+		},
+	}
+	var outbox bytes.Buffer
+	uc := newEmailUsecase(uRepo, &outbox)
+
+	for _, email := range []string{"bob", "Bob <bob@example.com>", "bob@"} {
+		_, err := uc.CreateUser(context.Background(), "bob", "secret", email)
+		assert.ErrorIs(t, err, repositories.ErrInvalidEmail, email)
+	}
+}
+
+func TestVerifyEmail_RejectsStaleOrForgedTokens(t *testing.T) {
+	uRepo := &usersMock{
+		getByIDFn: func(ctx context.Context, id int64) (*types.User, error) {
+			email := "bob@example.com"
+			return &types.User{ID: id, Username: "bob", Email: &email}, nil
+		},
+		markFn: func(ctx context.Context, id int64, email string) error {
+			return repositories.ErrNotFound
+		},
+	}
+	var outbox bytes.Buffer
+	uc := newEmailUsecase(uRepo, &outbox)
+
+	assert.NoError(t, uc.SendEmailVerification(context.Background(), 12))
+	m := verifyLink.FindStringSubmatch(outbox.String())
+	if assert.Len(t, m, 2) {
+		// The address changed since the link was sent.
+		assert.ErrorIs(t, uc.VerifyEmail(context.Background(), m[1]), repositories.ErrInvalidToken)
+	}
+
+	forged, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"iss": "auth.test", "aud": "email-verify", "sub": "12", "email": "bob@example.com",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}).SignedString([]byte("access"))
+	assert.NoError(t, err)
+	assert.ErrorIs(t, uc.VerifyEmail(context.Background(), forged), repositories.ErrInvalidToken)
+}
+
+func TestSendEmailVerification_NoEmail(t *testing.T) {
+	uRepo := &usersMock{
+		getByIDFn: func(ctx context.Context, id int64) (*types.User, error) {
+			return &types.User{ID: id, Username: "bob"}, nil
+		},
+	}
+	var outbox bytes.Buffer
+	uc := newEmailUsecase(uRepo, &outbox)
+
+	assert.ErrorIs(t, uc.SendEmailVerification(context.Background(), 12), repositories.ErrInvalidEmail)
+}
+
+func TestAccessToken_EmailVerifiedClaim(t *testing.T) {
+	uRepo := &usersMock{
+		verifyFn: func(ctx context.Context, username, password string) (*types.User, error) {
+			return verifiedUser(3, "bob", "bob@example.com"), nil
+		},
+	}
+	uc := usecase.NewAuth(uRepo, &rtMock{}, &config.JWT{
+		AccessSecret: "access",
+		AccessTTL:    15 * time.Minute,
+		RefreshTTL:   24 * time.Hour,
+		Issuer:       "auth.test",
+	})
+
+	_, tokens, err := uc.Login(context.Background(), "bob", "secret", "UA", "127.0.0.1")
+	assert.NoError(t, err)
+	p, err := uc.ParseAccess(context.Background(), tokens.Access)
+	assert.NoError(t, err)
+	assert.True(t, p.EmailVerified)
+}
+
+func newChangePasswordMock(t *testing.T, changed **types.RefreshToken, hash *string) *usersMock {
+	return &usersMock{
+		getByIDFn: func(ctx context.Context, id int64) (*types.User, error) {
+			return &types.User{ID: id, Username: "root", PasswordHash: "old"}, nil
+		},
+		verifyFn: func(ctx context.Context, username, password string) (*types.User, error) {
+			assert.Equal(t, "root", username)
+			if password != "current" {
+				return nil, repositories.ErrInvalidCredentials
+			}
+			return &types.User{ID: 77, Username: "root"}, nil
+		},
+		changeFn: func(ctx context.Context, id int64, h string, next *types.RefreshToken) error {
+			assert.Equal(t, int64(77), id)
+			*changed, *hash = next, h
+			return nil
+		},
+	}
+}
+
+func TestChangePassword_Success(t *testing.T) {
+	var next *types.RefreshToken
+	var hash string
+	uRepo := newChangePasswordMock(t, &next, &hash)
+	rtRepo := &rtMock{}
+	uc := usecase.NewAuth(uRepo, rtRepo, &config.JWT{
+		AccessSecret: "access",
+		AccessTTL:    15 * time.Minute,
+		RefreshTTL:   24 * time.Hour,
+		Issuer:       "auth.test",
+	})
+	session := uuid.New()
+
+	user, tokens, err := uc.ChangePassword(context.Background(), 77, session.String(), "current", "n3w-pass", "UA", "10.0.0.1")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(77), user.ID)
+	assert.Empty(t, user.PasswordHash)
+
+	ok, err := argon2id.ComparePasswordAndHash("n3w-pass", hash)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	if assert.NotNil(t, next) {
+		assert.Equal(t, session, next.FamilyID, "the caller's session must survive")
+		assert.Equal(t, int64(77), next.UserID)
+		assert.Equal(t, "UA", next.UserAgent)
+		assert.True(t, strings.HasPrefix(tokens.Refresh, next.JTI.String()+"."))
+	}
+	assert.False(t, rtRepo.createCalled, "the new token is stored together with the password")
+
+	p, err := uc.ParseAccess(context.Background(), tokens.Access)
+	assert.NoError(t, err)
+	assert.Equal(t, session.String(), p.SessionID)
+}
+
+func TestChangePassword_WrongCurrentPassword(t *testing.T) {
+	var next *types.RefreshToken
+	var hash string
+	uc := newThrottledUsecase(newChangePasswordMock(t, &next, &hash))
+
+	for i := 0; i < 2; i++ {
+		_, _, err := uc.ChangePassword(context.Background(), 77, uuid.NewString(), "guess", "n3w-pass", "UA", "10.0.0.1")
+		assert.ErrorIs(t, err, repositories.ErrInvalidCredentials)
+	}
+	_, _, err := uc.ChangePassword(context.Background(), 77, uuid.NewString(), "current", "n3w-pass", "UA", "10.0.0.1")
+	var retry *usecase.RetryLaterError
+	assert.ErrorAs(t, err, &retry, "guesses share the login throttle")
+	assert.Nil(t, next)
+}
+
+func TestChangePassword_EmptyPassword(t *testing.T) {
+	var next *types.RefreshToken
+	var hash string
+	uc := usecase.NewAuth(newChangePasswordMock(t, &next, &hash), &rtMock{}, &config.JWT{AccessSecret: "access"})
+
+	_, _, err := uc.ChangePassword(context.Background(), 77, uuid.NewString(), "current", "", "UA", "ip")
+	assert.ErrorIs(t, err, repositories.ErrInvalidCredentials)
+	assert.Nil(t, next)
+}
+
+func testPasswordPolicy() *passwords.Policy {
+	return passwords.NewPolicy(&config.PasswordPolicy{MinLength: 8, MaxLength: 64, MinStrength: 2}, nil)
+}
+
+func policyCode(t *testing.T, err error) int64 {
+	t.Helper()
+	var pe *passwords.PolicyError
+	require.ErrorAs(t, err, &pe)
+	return pe.Code
+}
+
+func TestChangePassword_PasswordPolicy(t *testing.T) {
+	var next *types.RefreshToken
+	var hash string
+	uc := usecase.NewAuth(newChangePasswordMock(t, &next, &hash), &rtMock{}, &config.JWT{AccessSecret: "access"},
+		usecase.WithPasswordPolicy(testPasswordPolicy()))
+
+	_, _, err := uc.ChangePassword(context.Background(), 77, uuid.NewString(), "current", "password1", "UA", "ip")
+	assert.Equal(t, passwords.CodeTooWeak, policyCode(t, err))
+	assert.Nil(t, next)
+
+	_, _, err = uc.ChangePassword(context.Background(), 77, uuid.NewString(), "current", "velvet-canyon-drifts", "UA", "ip")
+	assert.NoError(t, err)
+	assert.NotNil(t, next)
+}
+
+func TestCreateUser_PasswordPolicy(t *testing.T) {
+	uRepo := &usersMock{
+		addFn: func(ctx context.Context, u *types.User) error {
+			t.Fatal("refused password must not create the user")
+			return nil
+		},
+	}
+	uc := usecase.NewAuth(uRepo, &rtMock{}, &config.JWT{AccessSecret: "access"}, usecase.WithPasswordPolicy(testPasswordPolicy()))
+
+	_, err := uc.CreateUser(context.Background(), "bob", "123456", "")
+	assert.Equal(t, passwords.CodeTooShort, policyCode(t, err))
+
+	_, err = uc.CreateUser(context.Background(), "mina_murray", "mina_murray!!", "")
+	assert.Equal(t, passwords.CodeContainsPersonal, policyCode(t, err))
+}
+
+func TestResetPassword_PasswordPolicyKeepsToken(t *testing.T) {
+	uRepo := &usersMock{
+		getByName: func(ctx context.Context, username string) (*types.User, error) {
+			return verifiedUser(9, "root", "root@example.com"), nil
+		},
+		getByIDFn: func(ctx context.Context, id int64) (*types.User, error) {
+			assert.Equal(t, int64(9), id)
+			return verifiedUser(9, "root", "root@example.com"), nil
+		},
+	}
+	resets := &resetsMock{}
+	var outbox bytes.Buffer
+	uc := usecase.NewAuth(uRepo, &rtMock{}, &config.JWT{AccessSecret: "access"},
+		usecase.WithPasswordReset(resets, mailer.NewOutbox(&outbox, "noreply@test"), &config.PasswordReset{
+			TokenTTL: 30 * time.Minute,
+			LinkURL:  "https://bioly.test/reset?token=",
+		}),
+		usecase.WithPasswordPolicy(testPasswordPolicy()))
+	require.NoError(t, uc.ForgotPassword(context.Background(), "root", "127.0.0.1"))
+	token := resetLink.FindStringSubmatch(outbox.String())[1]
+
+	err := uc.ResetPassword(context.Background(), token, "qwertyuiop")
+	assert.Equal(t, passwords.CodeTooWeak, policyCode(t, err))
+	assert.Equal(t, uuid.Nil, resets.consumed)
+
+	assert.NoError(t, uc.ResetPassword(context.Background(), token, "velvet-canyon-drifts"))
+	assert.Equal(t, resets.created.TokenID, resets.consumed)
+}
+
+func TestChangePassword_UnknownSessionStartsNewFamily(t *testing.T) {
+	var next *types.RefreshToken
+	var hash string
+	uc := usecase.NewAuth(newChangePasswordMock(t, &next, &hash), &rtMock{}, &config.JWT{
+		AccessSecret: "access", AccessTTL: time.Minute, RefreshTTL: time.Hour,
+	})
+
+	_, _, err := uc.ChangePassword(context.Background(), 77, "", "current", "n3w-pass", "UA", "ip")
+	assert.NoError(t, err)
+	if assert.NotNil(t, next) {
+		assert.NotEqual(t, uuid.Nil, next.FamilyID)
+	}
+}
+
+func TestChangePassword_DeletedUser(t *testing.T) {
+	uRepo := &usersMock{
+		getByIDFn: func(ctx context.Context, id int64) (*types.User, error) {
+			return nil, repositories.ErrNotFound
+		},
+	}
+	uc := usecase.NewAuth(uRepo, &rtMock{}, &config.JWT{AccessSecret: "access"})
+
+	_, _, err := uc.ChangePassword(context.Background(), 77, "", "current", "n3w-pass", "UA", "ip")
+	assert.ErrorIs(t, err, repositories.ErrInvalidToken)
+}
+
+func newRenameUsecase(uRepo *usersMock) usecase.AuthService {
+	return usecase.NewAuth(uRepo, &rtMock{}, &config.JWT{AccessSecret: "access"},
+		usecase.WithUsernameChange(&config.Username{ReserveFor: 90 * 24 * time.Hour}))
+}
+
+func TestChangeUsername_Success(t *testing.T) {
+	name := "bob"
+	uRepo := &usersMock{
+		renameFn: func(ctx context.Context, id int64, username string, reservedSince time.Time) (string, error) {
+			assert.Equal(t, int64(7), id)
+			assert.Equal(t, "robert", username)
+			assert.WithinDuration(t, time.Now().Add(-90*24*time.Hour), reservedSince, time.Minute)
+			old := name
+			name = username
+			return old, nil
+		},
+		getByIDFn: func(ctx context.Context, id int64) (*types.User, error) {
+			return &types.User{ID: id, Username: name, PasswordHash: "hash"}, nil
+		},
+	}
+	uc := newRenameUsecase(uRepo)
+
+	user, err := uc.ChangeUsername(context.Background(), 7, "  robert ")
+	assert.NoError(t, err)
+	assert.Equal(t, "robert", user.Username)
+	assert.Empty(t, user.PasswordHash)
+}
+
+func TestChangeUsername_Invalid(t *testing.T) {
+	uc := newRenameUsecase(&usersMock{})
+
+	_, err := uc.ChangeUsername(context.Background(), 7, "ab")
+	assert.ErrorIs(t, err, repositories.ErrInvalidUsername)
+}
+
+func TestChangeUsername_Reserved(t *testing.T) {
+	uRepo := &usersMock{
+		renameFn: func(ctx context.Context, id int64, username string, reservedSince time.Time) (string, error) {
+			return "", repositories.ErrUsernameReserved
+		},
+	}
+	uc := newRenameUsecase(uRepo)
+
+	_, err := uc.ChangeUsername(context.Background(), 7, "alice")
+	assert.ErrorIs(t, err, repositories.ErrUsernameReserved)
+}
+
+func TestChangeUsername_DisabledWithoutOption(t *testing.T) {
+	uc := usecase.NewAuth(&usersMock{}, &rtMock{}, &config.JWT{AccessSecret: "access"})
+
+	_, err := uc.ChangeUsername(context.Background(), 7, "robert")
+	assert.ErrorIs(t, err, repositories.ErrNotImplemented)
+}
+
+func TestCreateUser_ReservedUsername(t *testing.T) {
+	uRepo := &usersMock{
+		reservFn: func(ctx context.Context, username string, reservedSince time.Time) (bool, error) {
+			return username == "bob", nil
+		},
+		addFn: func(ctx context.Context, u *types.User) error {
+			assert.Equal(t, "carol", u.Username)
+			u.ID = 8
+			return nil
+		},
+	}
+	uc := newRenameUsecase(uRepo)
+
+	_, err := uc.CreateUser(context.Background(), "bob", "secret", "")
+	assert.ErrorIs(t, err, repositories.ErrUsernameReserved)
+
+	user, err := uc.CreateUser(context.Background(), "carol", "secret", "")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(8), user.ID)
 }
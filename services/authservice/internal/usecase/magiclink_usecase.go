@@ -0,0 +1,92 @@
+package usecase
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"bioly/auth/internal/config"
+	"bioly/auth/internal/magiclink"
+	"bioly/auth/internal/mailer"
+	"bioly/auth/internal/repositories"
+	"bioly/auth/internal/types"
+)
+
+// WithMagicLink enables logging in with links sent by email, signed by
+// signer. Without it the magic link calls return ErrNotImplemented.
+func WithMagicLink(repo repositories.MagicLinks, m mailer.Mailer, signer *magiclink.Signer, cfg *config.MagicLink) Option {
+	return func(a *authImpl) {
+		a.links = repo
+		a.mailer = m
+		a.linkSign = signer
+		a.linkCfg = cfg
+	}
+}
+
+// SendMagicLink mails a login link to email when it is the verified
+// address of an account. Like ForgotPassword it reports nothing about
+// unknown addresses and is limited per address and per IP by the mail
+// throttle. The link only works with the same userAgent, and only while
+// email stays the account's address.
+func (a *authImpl) SendMagicLink(ctx context.Context, email, userAgent, ip string) error {
+	if a.links == nil {
+		return repositories.ErrNotImplemented
+	}
+	email = strings.TrimSpace(email)
+	if err := a.throttleMail(ctx, ip, "magic:"+email); err != nil {
+		return err
+	}
+	user, err := a.users.GetByEmail(ctx, email)
+	if err != nil {
+		if errors.Is(err, repositories.ErrNotFound) {
+			return nil
+		}
+		return err
+	}
+	if user.Email == nil || user.EmailVerifiedAt == nil {
+		return nil
+	}
+	link, err := a.linkSign.Issue(user.ID, *user.Email, userAgent)
+	if err != nil {
+		return err
+	}
+	return a.mailer.Send(ctx, mailer.Message{
+		To:      *user.Email,
+		Subject: "Your Bioly login link",
+		Body: "Someone asked to log in to your account " + user.Username + ".\n\n" +
+			"Open this link in the same browser to log in:\n" + a.linkCfg.LinkURL + link.Token + "\n\n" +
+			"The link works once and expires in " + a.linkCfg.TokenTTL.String() + ". If this wasn't you, ignore this message.\n",
+	})
+}
+
+// LoginMagic exchanges a login link for a session like Login, or an
+// MFARequiredError when the user has 2FA enabled. A link opened with
+// another userAgent, expired, forged or sent to an address the account no
+// longer has verified is ErrInvalidToken and stays usable in the right
+// browser; one used before is ErrLinkUsed.
+func (a *authImpl) LoginMagic(ctx context.Context, token, userAgent, ip string) (*types.User, *Tokens, error) {
+	if a.links == nil {
+		return nil, nil, repositories.ErrNotImplemented
+	}
+	link, err := a.linkSign.Verify(token, userAgent)
+	if err != nil {
+		return nil, nil, repositories.ErrInvalidToken
+	}
+	user, err := a.users.GetByID(ctx, link.UserID)
+	if err != nil {
+		if errors.Is(err, repositories.ErrNotFound) {
+			return nil, nil, repositories.ErrInvalidToken
+		}
+		return nil, nil, err
+	}
+	if user.Email == nil || user.EmailVerifiedAt == nil || !link.SentTo(*user.Email) {
+		return nil, nil, repositories.ErrInvalidToken
+	}
+	if err := a.links.Consume(ctx, link.ID, user.ID, link.ExpiresAt, userAgent, ip); err != nil {
+		return nil, nil, err
+	}
+	if err := a.requireMFA(ctx, user); err != nil {
+		return nil, nil, err
+	}
+	return a.startSession(ctx, user, userAgent, ip)
+}
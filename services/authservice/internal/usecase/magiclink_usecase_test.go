@@ -0,0 +1,196 @@
+package usecase_test
+
+import (
+	"bytes"
+	"context"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"bioly/auth/internal/config"
+	"bioly/auth/internal/magiclink"
+	"bioly/auth/internal/mailer"
+	"bioly/auth/internal/ratelimit"
+	"bioly/auth/internal/repositories"
+	"bioly/auth/internal/secretbox"
+	"bioly/auth/internal/types"
+	"bioly/auth/internal/usecase"
+)
+
+// linksMock records used links like the real repository.
+type linksMock struct {
+	used map[uuid.UUID]string
+}
+
+func (m *linksMock) Consume(ctx context.Context, tokenID uuid.UUID, userID int64, expiresAt time.Time, userAgent, ip string) error {
+	if _, ok := m.used[tokenID]; ok {
+		return repositories.ErrLinkUsed
+	}
+	m.used[tokenID] = ip
+	return nil
+}
+
+type magicEnv struct {
+	uc     usecase.AuthService
+	links  *linksMock
+	rtRepo *rtMock
+	outbox *bytes.Buffer
+	// address is mina's current verified address.
+	address string
+}
+
+var magicLink = regexp.MustCompile(`https://bioly\.test/login/magic/(\S+)`)
+
+func newMagicEnv(t *testing.T, opts ...usecase.Option) *magicEnv {
+	t.Helper()
+	env := &magicEnv{links: &linksMock{used: map[uuid.UUID]string{}}, rtRepo: &rtMock{}, outbox: &bytes.Buffer{}, address: "mina@example.com"}
+	users := &usersMock{
+		byEmailFn: func(ctx context.Context, email string) (*types.User, error) {
+			switch strings.ToLower(email) {
+			case "mina@example.com":
+				return verifiedUser(7, "mina", "mina@example.com"), nil
+			case "lucy@example.com":
+				addr := "lucy@example.com"
+				return &types.User{ID: 8, Username: "lucy", Email: &addr}, nil
+			}
+			return nil, repositories.ErrNotFound
+		},
+		getByIDFn: func(ctx context.Context, id int64) (*types.User, error) {
+			if id != 7 {
+				return nil, repositories.ErrNotFound
+			}
+			return verifiedUser(7, "mina", env.address), nil
+		},
+	}
+	cfg := &config.MagicLink{TokenTTL: 10 * time.Minute, LinkURL: "https://bioly.test/login/magic/"}
+	opts = append([]usecase.Option{usecase.WithMagicLink(env.links, mailer.NewOutbox(env.outbox, "noreply@test"),
+		magiclink.New([]byte("magic"), cfg.TokenTTL), cfg)}, opts...)
+	env.uc = usecase.NewAuth(users, env.rtRepo, &config.JWT{
+		AccessSecret: "access",
+		AccessTTL:    15 * time.Minute,
+		RefreshTTL:   24 * time.Hour,
+		Issuer:       "auth.test",
+	}, opts...)
+	return env
+}
+
+// send asks for a link for email from userAgent and returns the mailed
+// token, or "" when nothing was sent.
+func (e *magicEnv) send(t *testing.T, email, userAgent string) string {
+	t.Helper()
+	e.outbox.Reset()
+	require.NoError(t, e.uc.SendMagicLink(context.Background(), email, userAgent, "10.0.0.1"))
+	m := magicLink.FindStringSubmatch(e.outbox.String())
+	if m == nil {
+		return ""
+	}
+	return m[1]
+}
+
+func TestMagicLink_Login(t *testing.T) {
+	env := newMagicEnv(t)
+	ctx := context.Background()
+
+	token := env.send(t, " Mina@Example.com ", "Firefox")
+	require.NotEmpty(t, token)
+	assert.Contains(t, env.outbox.String(), "To: mina@example.com\r\n")
+	assert.Contains(t, env.outbox.String(), "expires in 10m0s")
+
+	user, tokens, err := env.uc.LoginMagic(ctx, token, "Firefox", "10.0.0.1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), user.ID)
+	assert.True(t, env.rtRepo.createCalled)
+	assert.Equal(t, "Firefox", env.rtRepo.lastUserAgent)
+	p, err := env.uc.ParseAccess(ctx, tokens.Access)
+	require.NoError(t, err)
+	assert.Equal(t, "mina", p.Username)
+	assert.Len(t, env.links.used, 1)
+
+	// The link was used; replaying it fails.
+	_, _, err = env.uc.LoginMagic(ctx, token, "Firefox", "10.0.0.1")
+	assert.ErrorIs(t, err, repositories.ErrLinkUsed)
+}
+
+func TestMagicLink_BoundToBrowser(t *testing.T) {
+	env := newMagicEnv(t)
+	ctx := context.Background()
+	token := env.send(t, "mina@example.com", "Firefox")
+
+	_, _, err := env.uc.LoginMagic(ctx, token, "Chrome", "10.0.0.2")
+	assert.ErrorIs(t, err, repositories.ErrInvalidToken)
+	assert.Empty(t, env.links.used, "a link opened elsewhere is not spent")
+	assert.False(t, env.rtRepo.createCalled)
+
+	tampered := []byte(token)
+	tampered[len(tampered)-1] ^= 1
+	_, _, err = env.uc.LoginMagic(ctx, string(tampered), "Firefox", "10.0.0.1")
+	assert.ErrorIs(t, err, repositories.ErrInvalidToken)
+
+	_, _, err = env.uc.LoginMagic(ctx, token, "Firefox", "10.0.0.1")
+	assert.NoError(t, err)
+}
+
+func TestMagicLink_BoundToAddress(t *testing.T) {
+	env := newMagicEnv(t)
+	token := env.send(t, "mina@example.com", "Firefox")
+
+	env.address = "mina@example.org"
+	_, _, err := env.uc.LoginMagic(context.Background(), token, "Firefox", "10.0.0.1")
+	assert.ErrorIs(t, err, repositories.ErrInvalidToken, "sent to an address the account no longer has")
+	assert.Empty(t, env.links.used)
+	assert.False(t, env.rtRepo.createCalled)
+}
+
+func TestMagicLink_Throttled(t *testing.T) {
+	cfg := &config.LoginThrottle{Window: time.Minute, FreeAttempts: 2, IPFreeAttempts: 10, BaseDelay: time.Minute, MaxDelay: time.Hour}
+	env := newMagicEnv(t, usecase.WithMailThrottle(ratelimit.New(ratelimit.NewMemoryStore(), cfg).Namespace("mail:")))
+
+	require.NotEmpty(t, env.send(t, "mina@example.com", "Firefox"))
+	require.NotEmpty(t, env.send(t, "Mina@Example.com", "Chrome"))
+	env.outbox.Reset()
+	err := env.uc.SendMagicLink(context.Background(), "mina@example.com", "Firefox", "10.0.0.2")
+	var retry *usecase.RetryLaterError
+	require.ErrorAs(t, err, &retry)
+	assert.True(t, retry.Mail)
+	assert.Zero(t, env.outbox.Len(), "no mail once throttled")
+
+	// Unknown addresses count too, so they answer the same way.
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, env.uc.SendMagicLink(context.Background(), "ghost@example.com", "Firefox", "10.0.0.3"))
+	}
+	assert.ErrorAs(t, env.uc.SendMagicLink(context.Background(), "ghost@example.com", "Firefox", "10.0.0.3"), &retry)
+}
+
+func TestMagicLink_UnknownOrUnverifiedIsSilent(t *testing.T) {
+	env := newMagicEnv(t)
+	assert.Empty(t, env.send(t, "ghost@example.com", "Firefox"))
+	assert.Empty(t, env.send(t, "lucy@example.com", "Firefox"), "address not verified")
+	assert.Zero(t, env.outbox.Len())
+}
+
+func TestMagicLink_RespectsMFA(t *testing.T) {
+	box, err := secretbox.New(make([]byte, 32))
+	require.NoError(t, err)
+	now := time.Now()
+	mfa := &mfaMock{m: &types.MFA{UserID: 7, EnabledAt: &now}}
+	env := newMagicEnv(t, usecase.WithMFA(mfa, box, &config.MFA{Issuer: "Bioly", PendingTTL: time.Minute, RecoveryCodes: 2}))
+
+	token := env.send(t, "mina@example.com", "Firefox")
+	_, tokens, err := env.uc.LoginMagic(context.Background(), token, "Firefox", "10.0.0.1")
+	var required *usecase.MFARequiredError
+	assert.ErrorAs(t, err, &required)
+	assert.Nil(t, tokens)
+	assert.False(t, env.rtRepo.createCalled)
+}
+
+func TestMagicLink_NotConfigured(t *testing.T) {
+	uc := usecase.NewAuth(&usersMock{}, &rtMock{}, &config.JWT{AccessSecret: "secret", Issuer: "test"})
+	assert.ErrorIs(t, uc.SendMagicLink(context.Background(), "mina@example.com", "UA", ""), repositories.ErrNotImplemented)
+	_, _, err := uc.LoginMagic(context.Background(), "token", "UA", "")
+	assert.ErrorIs(t, err, repositories.ErrNotImplemented)
+}
@@ -0,0 +1,285 @@
+package usecase
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"bioly/auth/internal/config"
+	"bioly/auth/internal/repositories"
+	"bioly/auth/internal/secretbox"
+	"bioly/auth/internal/totp"
+	"bioly/auth/internal/types"
+)
+
+const mfaPendingAudience = "mfa-pending"
+
+// MFARequiredError is returned by Login when the password was right but the
+// account has two-factor authentication enabled. Token is exchanged for the
+// real token pair through LoginMFA.
+type MFARequiredError struct {
+	Token     string
+	ExpiresIn time.Duration
+}
+
+func (e *MFARequiredError) Error() string {
+	return "two-factor authentication required"
+}
+
+// TOTPEnrollment is shown to the user once, when enrolling.
+type TOTPEnrollment struct {
+	Secret        string
+	URI           string
+	RecoveryCodes []string
+}
+
+// WithMFA enables TOTP two-factor authentication. box encrypts the TOTP
+// secrets at rest and keys the short-lived mfa_pending tokens.
+func WithMFA(repo repositories.MFA, box *secretbox.Box, cfg *config.MFA) Option {
+	return func(a *authImpl) {
+		a.mfa = repo
+		a.mfaBox = box
+		a.mfaCfg = cfg
+	}
+}
+
+// requireMFA returns an MFARequiredError carrying an mfa_pending token when
+// u has two-factor authentication enabled.
+func (a *authImpl) requireMFA(ctx context.Context, u *types.User) error {
+	if a.mfa == nil {
+		return nil
+	}
+	m, err := a.mfa.Get(ctx, u.ID)
+	if err != nil {
+		if errors.Is(err, repositories.ErrNotFound) {
+			return nil
+		}
+		return err
+	}
+	if m.EnabledAt == nil {
+		return nil
+	}
+	now := a.nowFn()
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"iss": a.jwtConf.Issuer,
+		"aud": mfaPendingAudience,
+		"sub": strconv.FormatInt(u.ID, 10),
+		"iat": now.Unix(),
+		"exp": now.Add(a.mfaCfg.PendingTTL).Unix(),
+	}).SignedString(a.mfaBox.DeriveKey(mfaPendingAudience))
+	if err != nil {
+		return err
+	}
+	return &MFARequiredError{Token: token, ExpiresIn: a.mfaCfg.PendingTTL}
+}
+
+// LoginMFA completes a login that returned MFARequiredError. code is either
+// a current TOTP code or one of the recovery codes. Wrong codes count
+// towards the login throttle like wrong passwords.
+func (a *authImpl) LoginMFA(ctx context.Context, mfaToken, code, userAgent, ip string) (*types.User, *Tokens, error) {
+	if a.mfa == nil {
+		return nil, nil, repositories.ErrNotImplemented
+	}
+	userID, err := a.parseMFAPending(mfaToken)
+	if err != nil {
+		return nil, nil, err
+	}
+	user, err := a.users.GetByID(ctx, userID)
+	if err != nil {
+		if errors.Is(err, repositories.ErrNotFound) {
+			return nil, nil, repositories.ErrInvalidToken
+		}
+		return nil, nil, err
+	}
+	m, err := a.mfa.Get(ctx, userID)
+	if err != nil {
+		if errors.Is(err, repositories.ErrNotFound) {
+			return nil, nil, repositories.ErrInvalidToken
+		}
+		return nil, nil, err
+	}
+	if m.EnabledAt == nil {
+		return nil, nil, repositories.ErrInvalidToken
+	}
+
+	if a.limiter != nil {
+		wait, err := a.limiter.Check(ctx, ip, user.Username)
+		if err != nil {
+			return nil, nil, err
+		}
+		if wait > 0 {
+			return nil, nil, &RetryLaterError{RetryAfter: wait}
+		}
+	}
+	if err := a.checkMFACode(ctx, m, code); err != nil {
+		if errors.Is(err, repositories.ErrInvalidMFACode) && a.limiter != nil {
+			if ferr := a.limiter.Fail(ctx, ip, user.Username); ferr != nil {
+				return nil, nil, ferr
+			}
+		}
+		return nil, nil, err
+	}
+	if a.limiter != nil {
+		if err := a.limiter.Succeed(ctx, user.Username); err != nil {
+			return nil, nil, err
+		}
+	}
+	return a.startSession(ctx, user, userAgent, ip)
+}
+
+func (a *authImpl) parseMFAPending(token string) (int64, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(token, claims,
+		func(*jwt.Token) (any, error) { return a.mfaBox.DeriveKey(mfaPendingAudience), nil },
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithIssuer(a.jwtConf.Issuer),
+		jwt.WithAudience(mfaPendingAudience),
+		jwt.WithExpirationRequired(),
+		jwt.WithTimeFunc(a.nowFn),
+	)
+	if err != nil {
+		return 0, repositories.ErrInvalidToken
+	}
+	sub, _ := claims.GetSubject()
+	id, err := strconv.ParseInt(sub, 10, 64)
+	if err != nil {
+		return 0, repositories.ErrInvalidToken
+	}
+	return id, nil
+}
+
+// EnrollTOTP creates a new TOTP secret and recovery codes. 2FA stays off
+// until ConfirmTOTP proves the authenticator app was set up.
+func (a *authImpl) EnrollTOTP(ctx context.Context, userID int64) (*TOTPEnrollment, error) {
+	if a.mfa == nil {
+		return nil, repositories.ErrNotImplemented
+	}
+	user, err := a.users.GetByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := a.mfaBox.Seal(secret)
+	if err != nil {
+		return nil, err
+	}
+	codes := make([]string, a.mfaCfg.RecoveryCodes)
+	hashes := make([]string, len(codes))
+	for i := range codes {
+		if codes[i], err = newRecoveryCode(); err != nil {
+			return nil, err
+		}
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+	if err := a.mfa.Begin(ctx, userID, sealed, hashes); err != nil {
+		return nil, err
+	}
+	return &TOTPEnrollment{
+		Secret:        secret,
+		URI:           totp.URI(a.mfaCfg.Issuer, user.Username, secret),
+		RecoveryCodes: codes,
+	}, nil
+}
+
+func (a *authImpl) ConfirmTOTP(ctx context.Context, userID int64, code string) error {
+	if a.mfa == nil {
+		return repositories.ErrNotImplemented
+	}
+	m, err := a.mfa.Get(ctx, userID)
+	if err != nil {
+		if errors.Is(err, repositories.ErrNotFound) {
+			return repositories.ErrMFANotEnabled
+		}
+		return err
+	}
+	if m.EnabledAt != nil {
+		return repositories.ErrMFAAlreadyEnabled
+	}
+	step, err := a.validateTOTP(m, code)
+	if err != nil {
+		return err
+	}
+	return a.mfa.Enable(ctx, userID, step)
+}
+
+// DisableTOTP turns 2FA off. It takes a TOTP or recovery code so a stolen
+// access token alone cannot remove the second factor.
+func (a *authImpl) DisableTOTP(ctx context.Context, userID int64, code string) error {
+	if a.mfa == nil {
+		return repositories.ErrNotImplemented
+	}
+	m, err := a.mfa.Get(ctx, userID)
+	if err != nil {
+		if errors.Is(err, repositories.ErrNotFound) {
+			return repositories.ErrMFANotEnabled
+		}
+		return err
+	}
+	if m.EnabledAt == nil {
+		return repositories.ErrMFANotEnabled
+	}
+	if err := a.checkMFACode(ctx, m, code); err != nil {
+		return err
+	}
+	return a.mfa.Disable(ctx, userID)
+}
+
+// checkMFACode accepts a TOTP code or an unused recovery code. Either is
+// single use.
+func (a *authImpl) checkMFACode(ctx context.Context, m *types.MFA, code string) error {
+	code = strings.TrimSpace(code)
+	if len(code) == totp.Digits {
+		step, err := a.validateTOTP(m, code)
+		if err != nil {
+			return err
+		}
+		return a.mfa.UseStep(ctx, m.UserID, step)
+	}
+	if code == "" {
+		return repositories.ErrInvalidMFACode
+	}
+	return a.mfa.UseRecoveryCode(ctx, m.UserID, hashRecoveryCode(code))
+}
+
+func (a *authImpl) validateTOTP(m *types.MFA, code string) (int64, error) {
+	secret, err := a.mfaBox.Open(m.SecretEnc)
+	if err != nil {
+		return 0, err
+	}
+	step, ok := totp.Validate(secret, strings.TrimSpace(code), a.nowFn(), 1)
+	if !ok || step <= m.LastStep {
+		return 0, repositories.ErrInvalidMFACode
+	}
+	return step, nil
+}
+
+var recoveryEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// newRecoveryCode returns 50 random bits as "xxxxx-xxxxx".
+func newRecoveryCode() (string, error) {
+	buf := make([]byte, 7)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	s := strings.ToLower(recoveryEncoding.EncodeToString(buf))[:10]
+	return s[:5] + "-" + s[5:], nil
+}
+
+// hashRecoveryCode normalizes case and separators before hashing. The codes
+// are random enough that a plain SHA-256 is sufficient.
+func hashRecoveryCode(code string) string {
+	norm := strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(norm))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,197 @@
+package usecase_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"bioly/auth/internal/config"
+	"bioly/auth/internal/repositories"
+	"bioly/auth/internal/secretbox"
+	"bioly/auth/internal/totp"
+	"bioly/auth/internal/types"
+	"bioly/auth/internal/usecase"
+)
+
+// mfaMock keeps one user's enrolment in memory and enforces the same rules
+// as the Postgres repository.
+type mfaMock struct {
+	m     *types.MFA
+	codes map[string]bool
+}
+
+func (r *mfaMock) Get(ctx context.Context, userID int64) (*types.MFA, error) {
+	if r.m == nil || r.m.UserID != userID {
+		return nil, repositories.ErrNotFound
+	}
+	cp := *r.m
+	return &cp, nil
+}
+
+func (r *mfaMock) Begin(ctx context.Context, userID int64, secretEnc string, codeHashes []string) error {
+	if r.m != nil && r.m.EnabledAt != nil {
+		return repositories.ErrMFAAlreadyEnabled
+	}
+	r.m = &types.MFA{UserID: userID, SecretEnc: secretEnc}
+	r.codes = map[string]bool{}
+	for _, h := range codeHashes {
+		r.codes[h] = false
+	}
+	return nil
+}
+
+func (r *mfaMock) Enable(ctx context.Context, userID int64, step int64) error {
+	now := time.Now()
+	r.m.EnabledAt = &now
+	r.m.LastStep = step
+	return nil
+}
+
+func (r *mfaMock) Disable(ctx context.Context, userID int64) error {
+	r.m, r.codes = nil, nil
+	return nil
+}
+
+func (r *mfaMock) UseStep(ctx context.Context, userID int64, step int64) error {
+	if step <= r.m.LastStep {
+		return repositories.ErrInvalidMFACode
+	}
+	r.m.LastStep = step
+	return nil
+}
+
+func (r *mfaMock) UseRecoveryCode(ctx context.Context, userID int64, codeHash string) error {
+	used, ok := r.codes[codeHash]
+	if !ok || used {
+		return repositories.ErrInvalidMFACode
+	}
+	r.codes[codeHash] = true
+	return nil
+}
+
+func newMFAUsecase(t *testing.T, repo *mfaMock) usecase.AuthService {
+	box, err := secretbox.New(bytes.Repeat([]byte{7}, 32))
+	require.NoError(t, err)
+	uRepo := &usersMock{
+		verifyFn: func(ctx context.Context, username, password string) (*types.User, error) {
+			return &types.User{ID: 4, Username: "bob"}, nil
+		},
+		getByIDFn: func(ctx context.Context, id int64) (*types.User, error) {
+			return &types.User{ID: id, Username: "bob"}, nil
+		},
+	}
+	return usecase.NewAuth(uRepo, &rtMock{}, &config.JWT{
+		AccessSecret: "access",
+		AccessTTL:    15 * time.Minute,
+		RefreshTTL:   24 * time.Hour,
+		Issuer:       "auth.test",
+	}, usecase.WithMFA(repo, box, &config.MFA{Issuer: "Bioly", PendingTTL: 5 * time.Minute, RecoveryCodes: 3}))
+}
+
+func enrollAndConfirm(t *testing.T, uc usecase.AuthService) *usecase.TOTPEnrollment {
+	t.Helper()
+	enr, err := uc.EnrollTOTP(context.Background(), 4)
+	require.NoError(t, err)
+	code, err := totp.Code(enr.Secret, totp.Step(time.Now()))
+	require.NoError(t, err)
+	require.NoError(t, uc.ConfirmTOTP(context.Background(), 4, code))
+	return enr
+}
+
+func mfaToken(t *testing.T, uc usecase.AuthService) string {
+	t.Helper()
+	_, tokens, err := uc.Login(context.Background(), "bob", "secret", "UA", "127.0.0.1")
+	assert.Nil(t, tokens)
+	var mfa *usecase.MFARequiredError
+	require.ErrorAs(t, err, &mfa)
+	assert.Equal(t, 5*time.Minute, mfa.ExpiresIn)
+	return mfa.Token
+}
+
+func TestEnrollTOTP(t *testing.T) {
+	repo := &mfaMock{}
+	uc := newMFAUsecase(t, repo)
+
+	enr, err := uc.EnrollTOTP(context.Background(), 4)
+	require.NoError(t, err)
+	assert.Contains(t, enr.URI, "otpauth://totp/Bioly:bob?")
+	assert.Len(t, enr.RecoveryCodes, 3)
+	assert.NotContains(t, repo.m.SecretEnc, enr.Secret, "secret must be stored encrypted")
+	assert.Nil(t, repo.m.EnabledAt)
+
+	// Not enabled yet: login goes straight through.
+	_, tokens, err := uc.Login(context.Background(), "bob", "secret", "UA", "127.0.0.1")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, tokens.Access)
+
+	assert.ErrorIs(t, uc.ConfirmTOTP(context.Background(), 4, "000000"), repositories.ErrInvalidMFACode)
+}
+
+func TestLoginMFA_TOTP(t *testing.T) {
+	repo := &mfaMock{}
+	uc := newMFAUsecase(t, repo)
+	enr := enrollAndConfirm(t, uc)
+	token := mfaToken(t, uc)
+
+	// The code used to confirm enrolment cannot be replayed.
+	cur, _ := totp.Code(enr.Secret, totp.Step(time.Now()))
+	_, _, err := uc.LoginMFA(context.Background(), token, cur, "UA", "127.0.0.1")
+	assert.ErrorIs(t, err, repositories.ErrInvalidMFACode)
+
+	next, _ := totp.Code(enr.Secret, totp.Step(time.Now())+1)
+	user, tokens, err := uc.LoginMFA(context.Background(), token, next, "UA", "127.0.0.1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), user.ID)
+	assert.NotEmpty(t, tokens.Access)
+	assert.NotEmpty(t, tokens.Refresh)
+}
+
+func TestLoginMFA_RecoveryCodeIsSingleUse(t *testing.T) {
+	repo := &mfaMock{}
+	uc := newMFAUsecase(t, repo)
+	enr := enrollAndConfirm(t, uc)
+	token := mfaToken(t, uc)
+
+	_, _, err := uc.LoginMFA(context.Background(), token, enr.RecoveryCodes[0], "UA", "127.0.0.1")
+	assert.NoError(t, err)
+	_, _, err = uc.LoginMFA(context.Background(), token, enr.RecoveryCodes[0], "UA", "127.0.0.1")
+	assert.ErrorIs(t, err, repositories.ErrInvalidMFACode)
+}
+
+func TestLoginMFA_RejectsForeignTokens(t *testing.T) {
+	repo := &mfaMock{}
+	uc := newMFAUsecase(t, repo)
+	enr := enrollAndConfirm(t, uc)
+
+	// An access token is not an mfa_pending token.
+	repo.m.EnabledAt = nil
+	_, tokens, err := uc.Login(context.Background(), "bob", "secret", "UA", "127.0.0.1")
+	require.NoError(t, err)
+	now := time.Now()
+	repo.m.EnabledAt = &now
+
+	_, _, err = uc.LoginMFA(context.Background(), tokens.Access, enr.RecoveryCodes[0], "UA", "127.0.0.1")
+	assert.ErrorIs(t, err, repositories.ErrInvalidToken)
+	_, _, err = uc.LoginMFA(context.Background(), "garbage", enr.RecoveryCodes[0], "UA", "127.0.0.1")
+	assert.ErrorIs(t, err, repositories.ErrInvalidToken)
+}
+
+func TestDisableTOTP(t *testing.T) {
+	repo := &mfaMock{}
+	uc := newMFAUsecase(t, repo)
+	enr := enrollAndConfirm(t, uc)
+
+	_, err := uc.EnrollTOTP(context.Background(), 4)
+	assert.ErrorIs(t, err, repositories.ErrMFAAlreadyEnabled)
+
+	assert.ErrorIs(t, uc.DisableTOTP(context.Background(), 4, "nope"), repositories.ErrInvalidMFACode)
+	assert.NoError(t, uc.DisableTOTP(context.Background(), 4, enr.RecoveryCodes[1]))
+	assert.ErrorIs(t, uc.DisableTOTP(context.Background(), 4, enr.RecoveryCodes[2]), repositories.ErrMFANotEnabled)
+
+	_, _, err = uc.Login(context.Background(), "bob", "secret", "UA", "127.0.0.1")
+	assert.NoError(t, err)
+}
@@ -0,0 +1,207 @@
+package usecase
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"time"
+
+	"bioly/auth/internal/config"
+	"bioly/auth/internal/oauth"
+	"bioly/auth/internal/repositories"
+	"bioly/auth/internal/secretbox"
+	"bioly/auth/internal/types"
+)
+
+// OAuthFlow starts a login with an external provider. The browser is sent
+// to URL and must bring Cookie back to the callback within ExpiresIn.
+type OAuthFlow struct {
+	URL       string
+	Cookie    string
+	ExpiresIn time.Duration
+}
+
+// oauthFlowState is sealed into the flow cookie. The PKCE verifier never
+// leaves the server in readable form.
+type oauthFlowState struct {
+	Provider string `json:"p"`
+	State    string `json:"s"`
+	Verifier string `json:"v"`
+	Expires  int64  `json:"e"`
+}
+
+// WithOAuth enables sign-in with external providers. box seals the flow
+// cookie. Without it StartOAuth and FinishOAuth return ErrNotImplemented.
+func WithOAuth(repo repositories.Identities, providers map[string]*oauth.Provider, box *secretbox.Box, cfg *config.OAuth) Option {
+	return func(a *authImpl) {
+		a.idents = repo
+		a.provs = providers
+		a.oauthBox = box
+		a.oauthCfg = cfg
+	}
+}
+
+func (a *authImpl) StartOAuth(ctx context.Context, provider string) (*OAuthFlow, error) {
+	p, err := a.oauthProvider(provider)
+	if err != nil {
+		return nil, err
+	}
+	state, err := oauth.NewVerifier()
+	if err != nil {
+		return nil, err
+	}
+	verifier, err := oauth.NewVerifier()
+	if err != nil {
+		return nil, err
+	}
+	url, err := p.AuthCodeURL(ctx, state, verifier)
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := json.Marshal(oauthFlowState{
+		Provider: provider,
+		State:    state,
+		Verifier: verifier,
+		Expires:  a.nowFn().Add(a.oauthCfg.StateTTL).Unix(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	cookie, err := a.oauthBox.Seal(string(raw))
+	if err != nil {
+		return nil, err
+	}
+	return &OAuthFlow{URL: url, Cookie: cookie, ExpiresIn: a.oauthCfg.StateTTL}, nil
+}
+
+// FinishOAuth completes a provider login. state must match the one sealed
+// in flow, which ties the callback to the browser that started the login.
+// The first login with an external account creates a user for it; accounts
+// with two-factor authentication still get an MFARequiredError.
+func (a *authImpl) FinishOAuth(ctx context.Context, provider, code, state, flow, userAgent, ip string) (*types.User, *Tokens, error) {
+	p, err := a.oauthProvider(provider)
+	if err != nil {
+		return nil, nil, err
+	}
+	raw, err := a.oauthBox.Open(flow)
+	if err != nil {
+		return nil, nil, repositories.ErrInvalidToken
+	}
+	var fs oauthFlowState
+	if err := json.Unmarshal([]byte(raw), &fs); err != nil {
+		return nil, nil, repositories.ErrInvalidToken
+	}
+	if fs.Provider != provider || subtle.ConstantTimeCompare([]byte(fs.State), []byte(state)) != 1 ||
+		a.nowFn().Unix() > fs.Expires {
+		return nil, nil, repositories.ErrInvalidToken
+	}
+
+	token, err := p.Exchange(ctx, code, fs.Verifier)
+	if err != nil {
+		return nil, nil, err
+	}
+	ident, err := p.Identity(ctx, token)
+	if err != nil {
+		return nil, nil, err
+	}
+	user, err := a.oauthUser(ctx, provider, ident)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := a.requireMFA(ctx, user); err != nil {
+		return nil, nil, err
+	}
+	return a.startSession(ctx, user, userAgent, ip)
+}
+
+func (a *authImpl) oauthProvider(name string) (*oauth.Provider, error) {
+	if a.idents == nil {
+		return nil, repositories.ErrNotImplemented
+	}
+	p, ok := a.provs[name]
+	if !ok {
+		return nil, repositories.ErrNotFound
+	}
+	return p, nil
+}
+
+// oauthUser returns the user linked to ident, creating one on first login.
+// New users get an unusable random password and the provider's username,
+// with a random suffix when that is taken. Names the username policy refuses
+// are replaced by "<provider>-user".
+func (a *authImpl) oauthUser(ctx context.Context, provider string, ident *oauth.Identity) (*types.User, error) {
+	link, err := a.idents.Find(ctx, provider, ident.Subject)
+	if err == nil {
+		return a.users.GetByID(ctx, link.UserID)
+	}
+	if !errors.Is(err, repositories.ErrNotFound) {
+		return nil, err
+	}
+
+	// A random password nobody knows, stored like any other password.
+	secret, _, err := a.newSecret()
+	if err != nil {
+		return nil, err
+	}
+	hash, err := a.hasher.Hash(secret)
+	if err != nil {
+		return nil, err
+	}
+	base := oauthUsername(provider, ident)
+	if _, err := a.names.Normalize(base); err != nil {
+		// The provider's name is refused here, use a neutral one.
+		base = provider + "-user"
+	}
+	for i := 0; i < 5; i++ {
+		name := base
+		if i > 0 {
+			name = fmt.Sprintf("%s-%d", base, 1000+rand.IntN(9000))
+		}
+		if _, err := a.names.Normalize(name); err != nil {
+			continue
+		}
+		if a.nameCfg != nil {
+			reserved, err := a.users.UsernameReserved(ctx, name, a.nowFn().Add(-a.nameCfg.ReserveFor))
+			if err != nil {
+				return nil, err
+			}
+			if reserved {
+				continue
+			}
+		}
+		user := &types.User{Username: name, PasswordHash: hash}
+		err := a.idents.AddUser(ctx, user, &types.Identity{Provider: provider, Subject: ident.Subject})
+		if errors.Is(err, repositories.ErrDuplicateUsername) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return user, nil
+	}
+	return nil, repositories.ErrDuplicateUsername
+}
+
+// oauthUsername derives a username from the provider's, keeping room for a
+// collision suffix.
+func oauthUsername(provider string, ident *oauth.Identity) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '-', r == '.':
+			return r
+		}
+		return -1
+	}, ident.Username)
+	if len(name) < 3 {
+		name = provider + "_" + ident.Subject
+	}
+	if len(name) > 59 {
+		name = name[:59]
+	}
+	return name
+}
@@ -0,0 +1,199 @@
+package usecase_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"bioly/auth/internal/config"
+	"bioly/auth/internal/oauth"
+	"bioly/auth/internal/oauth/oauthtest"
+	"bioly/auth/internal/repositories"
+	"bioly/auth/internal/secretbox"
+	"bioly/auth/internal/types"
+	"bioly/auth/internal/usecase"
+	"bioly/usernames"
+)
+
+// identityStore keeps users and their identities in memory and backs both
+// the Users and the Identities repository.
+type identityStore struct {
+	users  map[int64]*types.User
+	links  map[string]int64
+	nextID int64
+}
+
+func newIdentityStore() *identityStore {
+	return &identityStore{users: map[int64]*types.User{}, links: map[string]int64{}, nextID: 100}
+}
+
+func (s *identityStore) Find(ctx context.Context, provider, subject string) (*types.Identity, error) {
+	id, ok := s.links[provider+"/"+subject]
+	if !ok {
+		return nil, repositories.ErrNotFound
+	}
+	return &types.Identity{UserID: id, Provider: provider, Subject: subject}, nil
+}
+
+func (s *identityStore) AddUser(ctx context.Context, u *types.User, ident *types.Identity) error {
+	for _, existing := range s.users {
+		if strings.EqualFold(existing.Username, u.Username) {
+			return repositories.ErrDuplicateUsername
+		}
+	}
+	s.nextID++
+	u.ID = s.nextID
+	cp := *u
+	s.users[u.ID] = &cp
+	ident.UserID = u.ID
+	s.links[ident.Provider+"/"+ident.Subject] = u.ID
+	return nil
+}
+
+func (s *identityStore) usersRepo() *usersMock {
+	return &usersMock{
+		getByIDFn: func(ctx context.Context, id int64) (*types.User, error) {
+			u, ok := s.users[id]
+			if !ok {
+				return nil, repositories.ErrNotFound
+			}
+			cp := *u
+			return &cp, nil
+		},
+	}
+}
+
+type oauthEnv struct {
+	uc     usecase.AuthService
+	srv    *oauthtest.Server
+	store  *identityStore
+	rtRepo *rtMock
+}
+
+func newOAuthEnv(t *testing.T, opts ...usecase.Option) *oauthEnv {
+	srv := oauthtest.NewServer(t)
+	cfg := &config.OAuth{
+		CallbackURL: "https://bioly.test/auth/oauth/{provider}/callback",
+		StateTTL:    10 * time.Minute,
+		Providers:   map[string]config.OAuthProvider{"test": srv.Config()},
+	}
+	box, err := secretbox.New(make([]byte, 32))
+	require.NoError(t, err)
+
+	store := newIdentityStore()
+	rtRepo := &rtMock{}
+	opts = append(opts, usecase.WithOAuth(store, oauth.FromConfig(cfg, nil), box, cfg))
+	uc := usecase.NewAuth(store.usersRepo(), rtRepo, &config.JWT{
+		AccessSecret: "access",
+		AccessTTL:    15 * time.Minute,
+		RefreshTTL:   24 * time.Hour,
+		Issuer:       "auth.test",
+	}, opts...)
+	return &oauthEnv{uc: uc, srv: srv, store: store, rtRepo: rtRepo}
+}
+
+// login runs the whole browser round trip and returns the callback result.
+func (e *oauthEnv) login(t *testing.T) (*types.User, *usecase.Tokens, error) {
+	t.Helper()
+	flow, err := e.uc.StartOAuth(context.Background(), "test")
+	require.NoError(t, err)
+	cb := e.srv.Authorize(t, flow.URL)
+	assert.Equal(t, "/auth/oauth/test/callback", cb.Path)
+	return e.uc.FinishOAuth(context.Background(), "test", cb.Query().Get("code"), cb.Query().Get("state"), flow.Cookie, "UA", "10.0.0.1")
+}
+
+func TestOAuth_FirstLoginCreatesUserThenReusesIt(t *testing.T) {
+	env := newOAuthEnv(t)
+
+	user, tokens, err := env.login(t)
+	require.NoError(t, err)
+	assert.Equal(t, "octo", user.Username)
+	assert.NotEmpty(t, tokens.Refresh)
+	assert.True(t, env.rtRepo.createCalled)
+
+	p, err := env.uc.ParseAccess(context.Background(), tokens.Access)
+	require.NoError(t, err)
+	assert.Equal(t, user.ID, p.UserID)
+
+	again, _, err := env.login(t)
+	require.NoError(t, err)
+	assert.Equal(t, user.ID, again.ID)
+	assert.Len(t, env.store.users, 1)
+}
+
+func TestOAuth_UsernameCollisionGetsSuffix(t *testing.T) {
+	env := newOAuthEnv(t)
+	env.store.users[1] = &types.User{ID: 1, Username: "Octo"}
+
+	user, _, err := env.login(t)
+	require.NoError(t, err)
+	assert.Regexp(t, `^octo-\d{4}$`, user.Username)
+
+	env.srv.SetUser(map[string]any{"sub": "43"})
+	user, _, err = env.login(t)
+	require.NoError(t, err)
+	assert.Equal(t, "test_43", user.Username)
+}
+
+func TestOAuth_RefusedUsernameIsReplaced(t *testing.T) {
+	policy, err := usernames.New(usernames.Config{Reserved: []string{"octo"}})
+	require.NoError(t, err)
+	env := newOAuthEnv(t, usecase.WithUsernamePolicy(policy))
+
+	user, _, err := env.login(t)
+	require.NoError(t, err)
+	assert.Equal(t, "test-user", user.Username)
+}
+
+func TestOAuth_RejectsForeignFlow(t *testing.T) {
+	env := newOAuthEnv(t)
+	ctx := context.Background()
+
+	flow, err := env.uc.StartOAuth(ctx, "test")
+	require.NoError(t, err)
+	cb := env.srv.Authorize(t, flow.URL)
+	code := cb.Query().Get("code")
+
+	other, err := env.uc.StartOAuth(ctx, "test")
+	require.NoError(t, err)
+
+	_, _, err = env.uc.FinishOAuth(ctx, "test", code, cb.Query().Get("state"), other.Cookie, "UA", "ip")
+	assert.ErrorIs(t, err, repositories.ErrInvalidToken, "state from another browser")
+
+	_, _, err = env.uc.FinishOAuth(ctx, "test", code, cb.Query().Get("state"), "garbage", "UA", "ip")
+	assert.ErrorIs(t, err, repositories.ErrInvalidToken)
+
+	_, _, err = env.uc.FinishOAuth(ctx, "test", "forged", cb.Query().Get("state"), flow.Cookie, "UA", "ip")
+	assert.ErrorIs(t, err, oauth.ErrProvider)
+	assert.Empty(t, env.store.users)
+}
+
+func TestOAuth_UnknownProviderAndDisabled(t *testing.T) {
+	env := newOAuthEnv(t)
+	_, err := env.uc.StartOAuth(context.Background(), "nope")
+	assert.ErrorIs(t, err, repositories.ErrNotFound)
+
+	uc := usecase.NewAuth(&usersMock{}, &rtMock{}, &config.JWT{AccessSecret: "access"})
+	_, err = uc.StartOAuth(context.Background(), "test")
+	assert.ErrorIs(t, err, repositories.ErrNotImplemented)
+}
+
+func TestOAuth_RespectsMFA(t *testing.T) {
+	box, err := secretbox.New(make([]byte, 32))
+	require.NoError(t, err)
+	mfa := &mfaMock{}
+	env := newOAuthEnv(t, usecase.WithMFA(mfa, box, &config.MFA{Issuer: "Bioly", PendingTTL: time.Minute, RecoveryCodes: 2}))
+
+	user, _, err := env.login(t)
+	require.NoError(t, err)
+	now := time.Now()
+	mfa.m = &types.MFA{UserID: user.ID, EnabledAt: &now}
+
+	_, _, err = env.login(t)
+	var required *usecase.MFARequiredError
+	assert.ErrorAs(t, err, &required)
+}
@@ -0,0 +1,183 @@
+package usecase
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+
+	"bioly/asynclogger"
+	"bioly/auth/internal/config"
+	"bioly/auth/internal/repositories"
+	"bioly/auth/internal/types"
+	"bioly/authjwt"
+)
+
+// WithPersonalTokens enables personal access tokens. Without it the token
+// calls return ErrNotImplemented and such tokens are never active.
+func WithPersonalTokens(repo repositories.PersonalTokens, cfg *config.PersonalTokens) Option {
+	return func(a *authImpl) {
+		a.pats = repo
+		a.patCfg = cfg
+	}
+}
+
+// CreateToken creates a personal access token granting scopes, which must
+// be a non-empty subset of authjwt.AllScopes. expiresIn zero means the
+// longest lifetime allowed. The token is returned in plain text only here.
+func (a *authImpl) CreateToken(ctx context.Context, userID int64, name string, scopes []string, expiresIn time.Duration) (string, *types.PersonalToken, error) {
+	if a.pats == nil {
+		return "", nil, repositories.ErrNotImplemented
+	}
+	scopes, err := normalizeScopes(scopes)
+	if err != nil {
+		return "", nil, err
+	}
+	if expiresIn < 0 || (a.patCfg.MaxTTL > 0 && expiresIn > a.patCfg.MaxTTL) {
+		return "", nil, repositories.ErrInvalidExpiry
+	}
+	if expiresIn == 0 {
+		expiresIn = a.patCfg.MaxTTL
+	}
+	if a.patCfg.MaxPerUser > 0 {
+		n, err := a.pats.CountActive(ctx, userID)
+		if err != nil {
+			return "", nil, err
+		}
+		if n >= a.patCfg.MaxPerUser {
+			return "", nil, repositories.ErrTooManyTokens
+		}
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", nil, err
+	}
+	secret := base64.RawURLEncoding.EncodeToString(buf)
+	t := &types.PersonalToken{
+		UserID:    userID,
+		TokenID:   uuid.New(),
+		TokenHash: hashTokenSecret(secret),
+		Name:      strings.TrimSpace(name),
+		Scopes:    pq.StringArray(scopes),
+	}
+	if expiresIn > 0 {
+		exp := a.nowFn().Add(expiresIn)
+		t.ExpiresAt = &exp
+	}
+	if err := a.pats.Add(ctx, t); err != nil {
+		return "", nil, err
+	}
+	return authjwt.PersonalTokenPrefix + t.TokenID.String() + "." + secret, t, nil
+}
+
+func (a *authImpl) ListTokens(ctx context.Context, userID int64) ([]types.PersonalToken, error) {
+	if a.pats == nil {
+		return nil, repositories.ErrNotImplemented
+	}
+	return a.pats.ListByUser(ctx, userID)
+}
+
+func (a *authImpl) RevokeToken(ctx context.Context, userID, id int64) error {
+	if a.pats == nil {
+		return repositories.ErrNotImplemented
+	}
+	return a.pats.Revoke(ctx, userID, id)
+}
+
+// introspectPersonal checks a "bpat_<token id>.<secret>" token. The
+// principal carries the token's scopes and, unlike a login, no session.
+func (a *authImpl) introspectPersonal(ctx context.Context, token string) (*authjwt.Principal, error) {
+	if a.pats == nil {
+		return nil, repositories.ErrInvalidToken
+	}
+	tokenID, secret, err := parseToken(strings.TrimPrefix(token, authjwt.PersonalTokenPrefix))
+	if err != nil {
+		return nil, err
+	}
+	t, err := a.pats.FindByTokenID(ctx, tokenID)
+	if errors.Is(err, repositories.ErrNotFound) {
+		return nil, repositories.ErrInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(hashTokenSecret(secret)), []byte(t.TokenHash)) != 1 {
+		return nil, repositories.ErrInvalidToken
+	}
+	now := a.nowFn()
+	if t.RevokedAt != nil || (t.ExpiresAt != nil && !now.Before(*t.ExpiresAt)) {
+		return nil, repositories.ErrInvalidToken
+	}
+
+	u, err := a.users.GetByID(ctx, t.UserID)
+	if errors.Is(err, repositories.ErrNotFound) {
+		return nil, repositories.ErrInvalidToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	roles, err := a.users.GetRoles(ctx, u.ID)
+	if err != nil {
+		return nil, err
+	}
+	// Last use is only informational: a failed write must not turn a valid
+	// token away, and a recent one needs no new write.
+	if t.LastUsedAt == nil || now.Sub(*t.LastUsedAt) >= time.Minute {
+		if err := a.pats.Touch(ctx, t.ID); err != nil {
+			asynclogger.Error("personal token touch failed token_id=%d err=%v", t.ID, err)
+		}
+	}
+
+	p := &authjwt.Principal{
+		UserID:        u.ID,
+		Username:      u.Username,
+		Roles:         roles,
+		Scopes:        append([]string{}, t.Scopes...),
+		EmailVerified: u.EmailVerifiedAt != nil,
+		IssuedAt:      t.CreatedAt,
+	}
+	if t.ExpiresAt != nil {
+		p.ExpiresAt = *t.ExpiresAt
+	}
+	return p, nil
+}
+
+// normalizeScopes returns scopes without duplicates in the order of
+// authjwt.AllScopes, or ErrInvalidScope for an empty list or unknown scope.
+func normalizeScopes(scopes []string) ([]string, error) {
+	if len(scopes) == 0 {
+		return nil, repositories.ErrInvalidScope
+	}
+	want := make(map[string]bool, len(scopes))
+	for _, s := range scopes {
+		want[s] = true
+	}
+	var out []string
+	for _, s := range authjwt.AllScopes {
+		if want[s] {
+			out = append(out, s)
+			delete(want, s)
+		}
+	}
+	if len(want) > 0 {
+		return nil, repositories.ErrInvalidScope
+	}
+	return out, nil
+}
+
+// hashTokenSecret hashes a token secret for storage. The secrets of
+// personal, refresh and reset tokens are 256 random bits, so a plain
+// SHA-256 is enough and keeps the check fast on every request.
+func hashTokenSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
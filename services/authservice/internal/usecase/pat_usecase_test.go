@@ -0,0 +1,183 @@
+package usecase_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"bioly/auth/internal/config"
+	"bioly/auth/internal/repositories"
+	"bioly/auth/internal/types"
+	"bioly/auth/internal/usecase"
+	"bioly/authjwt"
+)
+
+// patsMock keeps tokens in memory.
+type patsMock struct {
+	tokens   []*types.PersonalToken
+	touched  []int64
+	touchErr error
+}
+
+func (m *patsMock) Add(ctx context.Context, t *types.PersonalToken) error {
+	t.ID = int64(len(m.tokens) + 1)
+	t.CreatedAt = time.Now().UTC()
+	m.tokens = append(m.tokens, t)
+	return nil
+}
+func (m *patsMock) FindByTokenID(ctx context.Context, tokenID uuid.UUID) (*types.PersonalToken, error) {
+	for _, t := range m.tokens {
+		if t.TokenID == tokenID {
+			return t, nil
+		}
+	}
+	return nil, repositories.ErrNotFound
+}
+func (m *patsMock) ListByUser(ctx context.Context, userID int64) ([]types.PersonalToken, error) {
+	var out []types.PersonalToken
+	for _, t := range m.tokens {
+		if t.UserID == userID && t.RevokedAt == nil {
+			out = append(out, *t)
+		}
+	}
+	return out, nil
+}
+func (m *patsMock) CountActive(ctx context.Context, userID int64) (int, error) {
+	list, _ := m.ListByUser(ctx, userID)
+	return len(list), nil
+}
+func (m *patsMock) Revoke(ctx context.Context, userID, id int64) error {
+	for _, t := range m.tokens {
+		if t.ID == id && t.UserID == userID && t.RevokedAt == nil {
+			now := time.Now()
+			t.RevokedAt = &now
+			return nil
+		}
+	}
+	return repositories.ErrNotFound
+}
+func (m *patsMock) Touch(ctx context.Context, id int64) error {
+	m.touched = append(m.touched, id)
+	if m.touchErr != nil {
+		return m.touchErr
+	}
+	now := time.Now()
+	m.tokens[id-1].LastUsedAt = &now
+	return nil
+}
+
+func newPATUsecase(pats repositories.PersonalTokens, cfg *config.PersonalTokens) usecase.AuthService {
+	users := &usersMock{getByIDFn: func(ctx context.Context, id int64) (*types.User, error) {
+		if id != 77 {
+			return nil, repositories.ErrNotFound
+		}
+		return &types.User{ID: 77, Username: "root"}, nil
+	}}
+	return usecase.NewAuth(users, &rtMock{}, &config.JWT{AccessSecret: "secret", Issuer: "test", AccessTTL: time.Minute},
+		usecase.WithPersonalTokens(pats, cfg))
+}
+
+func TestCreateToken_Introspect(t *testing.T) {
+	pats := &patsMock{}
+	uc := newPATUsecase(pats, &config.PersonalTokens{MaxPerUser: 5, MaxTTL: 24 * time.Hour})
+	ctx := context.Background()
+
+	token, pt, err := uc.CreateToken(ctx, 77, " backup ", []string{authjwt.ScopeProfileWrite, authjwt.ScopeProfileRead, authjwt.ScopeProfileRead}, 0)
+	require.NoError(t, err)
+	assert.True(t, authjwt.IsPersonalToken(token))
+	assert.Equal(t, "backup", pt.Name)
+	assert.Equal(t, []string{authjwt.ScopeProfileRead, authjwt.ScopeProfileWrite}, []string(pt.Scopes))
+	require.NotNil(t, pt.ExpiresAt, "max_ttl applies to tokens without expiry")
+	assert.WithinDuration(t, time.Now().Add(24*time.Hour), *pt.ExpiresAt, 5*time.Second)
+	assert.NotContains(t, token, pt.TokenHash)
+
+	p, err := uc.Introspect(ctx, token)
+	require.NoError(t, err)
+	assert.Equal(t, int64(77), p.UserID)
+	assert.Equal(t, "root", p.Username)
+	assert.Empty(t, p.SessionID)
+	assert.True(t, p.HasScope(authjwt.ScopeProfileWrite))
+	assert.Equal(t, []int64{pt.ID}, pats.touched)
+
+	// Personal tokens are not access tokens.
+	_, err = uc.ParseAccess(ctx, token)
+	assert.ErrorIs(t, err, repositories.ErrInvalidToken)
+
+	_, err = uc.Introspect(ctx, token+"x")
+	assert.ErrorIs(t, err, repositories.ErrInvalidToken, "wrong secret")
+	_, err = uc.Introspect(ctx, authjwt.PersonalTokenPrefix+uuid.NewString()+".x")
+	assert.ErrorIs(t, err, repositories.ErrInvalidToken, "unknown token")
+
+	require.NoError(t, uc.RevokeToken(ctx, 77, pt.ID))
+	_, err = uc.Introspect(ctx, token)
+	assert.ErrorIs(t, err, repositories.ErrInvalidToken, "revoked")
+	assert.ErrorIs(t, uc.RevokeToken(ctx, 77, pt.ID), repositories.ErrNotFound)
+}
+
+func TestIntrospect_TouchIsBestEffort(t *testing.T) {
+	pats := &patsMock{touchErr: errors.New("db down")}
+	uc := newPATUsecase(pats, &config.PersonalTokens{})
+	ctx := context.Background()
+	token, pt, err := uc.CreateToken(ctx, 77, "ci", []string{authjwt.ScopeProfileRead}, 0)
+	require.NoError(t, err)
+
+	// Failing to record the use does not refuse the token.
+	_, err = uc.Introspect(ctx, token)
+	require.NoError(t, err)
+
+	// A use recorded a moment ago needs no new write.
+	pats.touchErr = nil
+	pats.touched = nil
+	recent := time.Now().Add(-10 * time.Second)
+	pt.LastUsedAt = &recent
+	_, err = uc.Introspect(ctx, token)
+	require.NoError(t, err)
+	assert.Empty(t, pats.touched)
+}
+
+func TestCreateToken_Expired(t *testing.T) {
+	pats := &patsMock{}
+	uc := newPATUsecase(pats, &config.PersonalTokens{})
+
+	token, pt, err := uc.CreateToken(context.Background(), 77, "ci", []string{authjwt.ScopeProfileRead}, 0)
+	require.NoError(t, err)
+	assert.Nil(t, pt.ExpiresAt, "no max_ttl, the token does not expire")
+
+	past := time.Now().Add(-time.Second)
+	pt.ExpiresAt = &past
+	_, err = uc.Introspect(context.Background(), token)
+	assert.ErrorIs(t, err, repositories.ErrInvalidToken)
+}
+
+func TestCreateToken_Refused(t *testing.T) {
+	pats := &patsMock{}
+	uc := newPATUsecase(pats, &config.PersonalTokens{MaxPerUser: 1, MaxTTL: time.Hour})
+	ctx := context.Background()
+
+	_, _, err := uc.CreateToken(ctx, 77, "ci", nil, 0)
+	assert.ErrorIs(t, err, repositories.ErrInvalidScope)
+	_, _, err = uc.CreateToken(ctx, 77, "ci", []string{"admin"}, 0)
+	assert.ErrorIs(t, err, repositories.ErrInvalidScope)
+	_, _, err = uc.CreateToken(ctx, 77, "ci", []string{authjwt.ScopeProfileRead}, 2*time.Hour)
+	assert.ErrorIs(t, err, repositories.ErrInvalidExpiry)
+
+	_, _, err = uc.CreateToken(ctx, 77, "ci", []string{authjwt.ScopeProfileRead}, time.Hour)
+	assert.NoError(t, err)
+	_, _, err = uc.CreateToken(ctx, 77, "ci", []string{authjwt.ScopeProfileRead}, time.Hour)
+	assert.ErrorIs(t, err, repositories.ErrTooManyTokens)
+}
+
+func TestPersonalTokens_NotConfigured(t *testing.T) {
+	uc := usecase.NewAuth(&usersMock{}, &rtMock{}, &config.JWT{AccessSecret: "secret", Issuer: "test"})
+
+	_, _, err := uc.CreateToken(context.Background(), 77, "ci", []string{authjwt.ScopeProfileRead}, 0)
+	assert.ErrorIs(t, err, repositories.ErrNotImplemented)
+	_, err = uc.Introspect(context.Background(), authjwt.PersonalTokenPrefix+strings.Repeat("x", 10))
+	assert.ErrorIs(t, err, repositories.ErrInvalidToken)
+}
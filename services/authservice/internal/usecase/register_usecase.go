@@ -0,0 +1,123 @@
+package usecase
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"bioly/auth/internal/config"
+	"bioly/auth/internal/pow"
+	"bioly/auth/internal/repositories"
+	"bioly/auth/internal/types"
+)
+
+// WithRegistration enables self-service sign up, guarded by proof-of-work
+// challenges from issuer and, in invite-only mode, invite codes. Without it
+// the registration calls return ErrNotImplemented.
+func WithRegistration(repo repositories.Registrations, issuer *pow.Issuer, cfg *config.Registration) Option {
+	return func(a *authImpl) {
+		a.regs = repo
+		a.pow = issuer
+		a.regCfg = cfg
+	}
+}
+
+// RegistrationChallenge is handed to a visitor before signing up.
+// InviteOnly tells whether an invite code is needed as well.
+type RegistrationChallenge struct {
+	*pow.Challenge
+	InviteOnly bool
+}
+
+func (a *authImpl) RegisterChallenge(ctx context.Context) (*RegistrationChallenge, error) {
+	if a.regs == nil {
+		return nil, repositories.ErrNotImplemented
+	}
+	c, err := a.pow.Issue()
+	if err != nil {
+		return nil, err
+	}
+	return &RegistrationChallenge{Challenge: c, InviteOnly: a.regCfg.InviteOnly}, nil
+}
+
+// Register creates an account for a visitor who solved challenge with
+// nonce. invite is required, and otherwise ignored, in invite-only mode.
+// Each challenge signs up one account; the account itself is checked like
+// in CreateUser.
+func (a *authImpl) Register(ctx context.Context, username, password, email, challenge, nonce, invite string) (*types.User, error) {
+	if a.regs == nil {
+		return nil, repositories.ErrNotImplemented
+	}
+	c, err := a.pow.Verify(challenge, nonce)
+	if err != nil {
+		return nil, repositories.ErrInvalidChallenge
+	}
+	var inviteHash string
+	if a.regCfg.InviteOnly {
+		if strings.TrimSpace(invite) == "" {
+			return nil, repositories.ErrInvalidInvite
+		}
+		inviteHash = hashInviteCode(invite)
+	}
+
+	user, err := a.newUser(ctx, username, password, email)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.regs.AddUser(ctx, user, c.ID, c.ExpiresAt, inviteHash); err != nil {
+		return nil, err
+	}
+	a.welcome(ctx, user)
+	return user, nil
+}
+
+// CreateInvite creates an invite code that signs up maxUses accounts, one
+// when it is zero. With expiresIn zero it is valid for the configured
+// InviteTTL. The code is returned in plain text only here.
+func (a *authImpl) CreateInvite(ctx context.Context, createdBy int64, maxUses int, expiresIn time.Duration) (string, *types.Invite, error) {
+	if a.regs == nil {
+		return "", nil, repositories.ErrNotImplemented
+	}
+	if maxUses <= 0 {
+		maxUses = 1
+	}
+	if expiresIn <= 0 {
+		expiresIn = a.regCfg.InviteTTL
+	}
+	code, err := newInviteCode()
+	if err != nil {
+		return "", nil, err
+	}
+	exp := a.nowFn().Add(expiresIn)
+	inv := &types.Invite{
+		CodeHash:  hashInviteCode(code),
+		CreatedBy: &createdBy,
+		MaxUses:   maxUses,
+		ExpiresAt: &exp,
+	}
+	if err := a.regs.CreateInvite(ctx, inv); err != nil {
+		return "", nil, err
+	}
+	return code, inv, nil
+}
+
+// newInviteCode returns 80 random bits as "xxxx-xxxx-xxxx-xxxx".
+func newInviteCode() (string, error) {
+	buf := make([]byte, 10)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	s := strings.ToLower(recoveryEncoding.EncodeToString(buf))
+	return s[:4] + "-" + s[4:8] + "-" + s[8:12] + "-" + s[12:16], nil
+}
+
+// hashInviteCode normalizes case and separators before hashing, like
+// recovery codes.
+func hashInviteCode(code string) string {
+	norm := strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(strings.TrimSpace(code)))
+	sum := sha256.Sum256([]byte(norm))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,120 @@
+package usecase_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"bioly/auth/internal/config"
+	"bioly/auth/internal/pow"
+	"bioly/auth/internal/repositories"
+	"bioly/auth/internal/types"
+	"bioly/auth/internal/usecase"
+)
+
+// registrationsMock remembers spent challenges and redeems invites by hash.
+type registrationsMock struct {
+	spent   map[uuid.UUID]bool
+	invites map[string]int
+	added   []*types.User
+}
+
+func (m *registrationsMock) CreateInvite(ctx context.Context, inv *types.Invite) error {
+	inv.ID = int64(len(m.invites) + 1)
+	m.invites[inv.CodeHash] = inv.MaxUses
+	return nil
+}
+func (m *registrationsMock) AddUser(ctx context.Context, u *types.User, challengeID uuid.UUID, challengeExpires time.Time, inviteHash string) error {
+	if m.spent[challengeID] {
+		return repositories.ErrInvalidChallenge
+	}
+	if inviteHash != "" {
+		if m.invites[inviteHash] == 0 {
+			return repositories.ErrInvalidInvite
+		}
+		m.invites[inviteHash]--
+	}
+	m.spent[challengeID] = true
+	u.ID = int64(len(m.added) + 1)
+	m.added = append(m.added, u)
+	return nil
+}
+
+func newRegisterUsecase(inviteOnly bool) (usecase.AuthService, *registrationsMock) {
+	regs := &registrationsMock{spent: map[uuid.UUID]bool{}, invites: map[string]int{}}
+	cfg := &config.Registration{InviteOnly: inviteOnly, InviteTTL: time.Hour}
+	uc := usecase.NewAuth(&usersMock{}, &rtMock{}, &config.JWT{AccessSecret: "secret", Issuer: "test"},
+		usecase.WithRegistration(regs, pow.New([]byte("key"), 8, time.Minute), cfg))
+	return uc, regs
+}
+
+func solvedChallenge(t *testing.T, uc usecase.AuthService) (string, string) {
+	t.Helper()
+	c, err := uc.RegisterChallenge(context.Background())
+	require.NoError(t, err)
+	return c.Token, pow.Solve(c.Token, c.Difficulty)
+}
+
+func TestRegister(t *testing.T) {
+	uc, regs := newRegisterUsecase(false)
+	ctx := context.Background()
+
+	token, nonce := solvedChallenge(t, uc)
+	user, err := uc.Register(ctx, "Mina", "velvet-canyon-drifts", "", token, nonce, "")
+	require.NoError(t, err)
+	assert.Equal(t, "Mina", user.Username)
+	assert.Empty(t, user.PasswordHash)
+	assert.Len(t, regs.added, 1)
+
+	_, err = uc.Register(ctx, "lucy", "velvet-canyon-drifts", "", token, nonce, "")
+	assert.ErrorIs(t, err, repositories.ErrInvalidChallenge, "a challenge signs up one account")
+
+	token, _ = solvedChallenge(t, uc)
+	_, err = uc.Register(ctx, "lucy", "velvet-canyon-drifts", "", token, "", "")
+	assert.ErrorIs(t, err, repositories.ErrInvalidChallenge, "unsolved")
+
+	token, nonce = solvedChallenge(t, uc)
+	_, err = uc.Register(ctx, "lucy", "", "", token, nonce, "")
+	assert.ErrorIs(t, err, repositories.ErrInvalidCredentials)
+}
+
+func TestRegister_InviteOnly(t *testing.T) {
+	uc, _ := newRegisterUsecase(true)
+	ctx := context.Background()
+
+	c, err := uc.RegisterChallenge(ctx)
+	require.NoError(t, err)
+	assert.True(t, c.InviteOnly)
+
+	code, inv, err := uc.CreateInvite(ctx, 1, 1, 0)
+	require.NoError(t, err)
+	assert.Len(t, code, 19)
+	assert.Equal(t, 1, inv.MaxUses)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), *inv.ExpiresAt, 5*time.Second)
+
+	token, nonce := solvedChallenge(t, uc)
+	_, err = uc.Register(ctx, "mina", "velvet-canyon-drifts", "", token, nonce, "")
+	assert.ErrorIs(t, err, repositories.ErrInvalidInvite)
+
+	// Codes are matched regardless of case and separators.
+	_, err = uc.Register(ctx, "mina", "velvet-canyon-drifts", "", token, nonce, " "+strings.ToUpper(code)+" ")
+	assert.NoError(t, err)
+
+	token, nonce = solvedChallenge(t, uc)
+	_, err = uc.Register(ctx, "lucy", "velvet-canyon-drifts", "", token, nonce, code)
+	assert.ErrorIs(t, err, repositories.ErrInvalidInvite, "used up")
+}
+
+func TestRegister_Disabled(t *testing.T) {
+	uc := usecase.NewAuth(&usersMock{}, &rtMock{}, &config.JWT{AccessSecret: "secret", Issuer: "test"})
+
+	_, err := uc.RegisterChallenge(context.Background())
+	assert.ErrorIs(t, err, repositories.ErrNotImplemented)
+	_, err = uc.Register(context.Background(), "mina", "pw", "", "tok", "1", "")
+	assert.ErrorIs(t, err, repositories.ErrNotImplemented)
+}
@@ -0,0 +1,299 @@
+package usecase
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+
+	"bioly/auth/internal/config"
+	"bioly/auth/internal/repositories"
+	"bioly/auth/internal/secretbox"
+	"bioly/auth/internal/types"
+)
+
+const (
+	passkeyRegister    = "register"
+	passkeyLogin       = "login"
+	defaultPasskeyName = "Passkey"
+)
+
+// passkeyChallengeSpace names the ids login challenges are spent under in
+// auth.spent_challenges. They are name-based UUIDs, so they never match the
+// random ids of sign up challenges.
+var passkeyChallengeSpace = uuid.MustParse("ca126534-d816-4293-927f-e1897c03f18e")
+
+// PasskeyCeremony starts a passkey registration or login. Options are
+// passed to navigator.credentials.create or .get in the browser; Session
+// must be sent back with the result within ExpiresIn.
+type PasskeyCeremony struct {
+	Options   any
+	Session   string
+	ExpiresIn time.Duration
+}
+
+// passkeySession is sealed into PasskeyCeremony.Session, so no ceremony
+// state is kept on the server.
+type passkeySession struct {
+	Kind    string               `json:"k"`
+	UserID  int64                `json:"u,omitempty"`
+	Data    webauthn.SessionData `json:"d"`
+	Expires int64                `json:"e"`
+}
+
+// WithWebAuthn enables passkey login. box seals the ceremony sessions and
+// keys the WebAuthn user handles. Without it the passkey calls return
+// ErrNotImplemented.
+func WithWebAuthn(repo repositories.WebAuthnCredentials, wa *webauthn.WebAuthn, box *secretbox.Box, cfg *config.WebAuthn) Option {
+	return func(a *authImpl) {
+		a.passkeys = repo
+		a.wa = wa
+		a.waBox = box
+		a.waCfg = cfg
+	}
+}
+
+// passkeyUser adapts a user and their passkeys to webauthn.User.
+type passkeyUser struct {
+	user   *types.User
+	handle []byte
+	creds  []webauthn.Credential
+}
+
+func (u *passkeyUser) WebAuthnID() []byte                         { return u.handle }
+func (u *passkeyUser) WebAuthnName() string                       { return u.user.Username }
+func (u *passkeyUser) WebAuthnDisplayName() string                { return u.user.Username }
+func (u *passkeyUser) WebAuthnCredentials() []webauthn.Credential { return u.creds }
+
+// BeginPasskeyRegistration starts adding a passkey to the account. The
+// passkey must be discoverable and verify the user (PIN or biometrics), so
+// it can sign in on its own later.
+func (a *authImpl) BeginPasskeyRegistration(ctx context.Context, userID int64) (*PasskeyCeremony, error) {
+	if a.passkeys == nil {
+		return nil, repositories.ErrNotImplemented
+	}
+	pu, err := a.passkeyUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	requireKey := true
+	creation, data, err := a.wa.BeginRegistration(pu,
+		webauthn.WithAuthenticatorSelection(protocol.AuthenticatorSelection{
+			RequireResidentKey: &requireKey,
+			ResidentKey:        protocol.ResidentKeyRequirementRequired,
+			UserVerification:   protocol.VerificationRequired,
+		}),
+		webauthn.WithExclusions(webauthn.Credentials(pu.creds).CredentialDescriptors()),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return a.passkeyCeremony(creation, passkeyRegister, userID, data)
+}
+
+// FinishPasskeyRegistration verifies the authenticator's response to
+// BeginPasskeyRegistration and stores the new passkey as name.
+func (a *authImpl) FinishPasskeyRegistration(ctx context.Context, userID int64, session, name string, credential []byte) (*types.WebAuthnCredential, error) {
+	if a.passkeys == nil {
+		return nil, repositories.ErrNotImplemented
+	}
+	data, err := a.openPasskeySession(session, passkeyRegister)
+	if err != nil {
+		return nil, err
+	}
+	if data.UserID != userID {
+		return nil, repositories.ErrInvalidToken
+	}
+	parsed, err := protocol.ParseCredentialCreationResponseBytes(credential)
+	if err != nil {
+		return nil, repositories.ErrInvalidPasskey
+	}
+	pu, err := a.passkeyUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	cred, err := a.wa.CreateCredential(pu, data.Data, parsed)
+	if err != nil {
+		return nil, repositories.ErrInvalidPasskey
+	}
+
+	transports := make([]string, len(cred.Transport))
+	for i, t := range cred.Transport {
+		transports[i] = string(t)
+	}
+	if name = strings.TrimSpace(name); name == "" {
+		name = defaultPasskeyName
+	}
+	c := &types.WebAuthnCredential{
+		UserID:          userID,
+		CredentialID:    cred.ID,
+		PublicKey:       cred.PublicKey,
+		AttestationType: cred.AttestationType,
+		AAGUID:          cred.Authenticator.AAGUID,
+		Transports:      transports,
+		SignCount:       int64(cred.Authenticator.SignCount),
+		BackupEligible:  cred.Flags.BackupEligible,
+		BackupState:     cred.Flags.BackupState,
+		Name:            name,
+	}
+	if err := a.passkeys.Add(ctx, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// BeginPasskeyLogin starts a login where the authenticator picks the
+// account, so no username is asked for.
+func (a *authImpl) BeginPasskeyLogin(ctx context.Context) (*PasskeyCeremony, error) {
+	if a.passkeys == nil {
+		return nil, repositories.ErrNotImplemented
+	}
+	assertion, data, err := a.wa.BeginDiscoverableLogin(webauthn.WithUserVerification(protocol.VerificationRequired))
+	if err != nil {
+		return nil, err
+	}
+	return a.passkeyCeremony(assertion, passkeyLogin, 0, data)
+}
+
+// FinishPasskeyLogin verifies a passkey assertion and starts a session like
+// Login. The authenticator verified the user itself, so neither the
+// password throttle nor TOTP apply. Each ceremony logs in once: finishing
+// it again is ErrInvalidChallenge. An assertion whose signature counter
+// did not grow may come from a cloned authenticator and is refused with
+// ErrSignCountMismatch.
+func (a *authImpl) FinishPasskeyLogin(ctx context.Context, session string, credential []byte, userAgent, ip string) (*types.User, *Tokens, error) {
+	if a.passkeys == nil {
+		return nil, nil, repositories.ErrNotImplemented
+	}
+	data, err := a.openPasskeySession(session, passkeyLogin)
+	if err != nil {
+		return nil, nil, err
+	}
+	parsed, err := protocol.ParseCredentialRequestResponseBytes(credential)
+	if err != nil {
+		return nil, nil, repositories.ErrInvalidPasskey
+	}
+
+	var (
+		record    *types.WebAuthnCredential
+		user      *types.User
+		lookupErr error
+	)
+	lookup := func(rawID, userHandle []byte) (webauthn.User, error) {
+		record, lookupErr = a.passkeys.FindByCredentialID(ctx, rawID)
+		if lookupErr != nil {
+			return nil, lookupErr
+		}
+		user, lookupErr = a.users.GetByID(ctx, record.UserID)
+		if lookupErr != nil {
+			return nil, lookupErr
+		}
+		handle := a.passkeyHandle(user.ID)
+		if !bytes.Equal(handle, userHandle) {
+			return nil, repositories.ErrNotFound
+		}
+		return &passkeyUser{user: user, handle: handle, creds: []webauthn.Credential{toWebAuthnCredential(record)}}, nil
+	}
+	_, cred, err := a.wa.ValidatePasskeyLogin(lookup, data.Data, parsed)
+	if err != nil {
+		if lookupErr != nil && !errors.Is(lookupErr, repositories.ErrNotFound) {
+			return nil, nil, lookupErr
+		}
+		return nil, nil, repositories.ErrInvalidPasskey
+	}
+	if cred.Authenticator.CloneWarning {
+		return nil, nil, repositories.ErrSignCountMismatch
+	}
+	challengeID := uuid.NewSHA1(passkeyChallengeSpace, []byte(data.Data.Challenge))
+	if err := a.passkeys.Use(ctx, record.ID, int64(cred.Authenticator.SignCount), cred.Flags.BackupState,
+		challengeID, time.Unix(data.Expires, 0)); err != nil {
+		return nil, nil, err
+	}
+	return a.startSession(ctx, user, userAgent, ip)
+}
+
+func (a *authImpl) passkeyUser(ctx context.Context, userID int64) (*passkeyUser, error) {
+	user, err := a.users.GetByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	records, err := a.passkeys.ListByUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	creds := make([]webauthn.Credential, len(records))
+	for i := range records {
+		creds[i] = toWebAuthnCredential(&records[i])
+	}
+	return &passkeyUser{user: user, handle: a.passkeyHandle(userID), creds: creds}, nil
+}
+
+// passkeyHandle is the WebAuthn user handle of a user. It is derived from
+// the user id with a key, so authenticators never see the id itself.
+func (a *authImpl) passkeyHandle(userID int64) []byte {
+	mac := hmac.New(sha256.New, a.waBox.DeriveKey("webauthn-user-handle"))
+	mac.Write([]byte(strconv.FormatInt(userID, 10)))
+	return mac.Sum(nil)
+}
+
+func toWebAuthnCredential(c *types.WebAuthnCredential) webauthn.Credential {
+	transports := make([]protocol.AuthenticatorTransport, len(c.Transports))
+	for i, t := range c.Transports {
+		transports[i] = protocol.AuthenticatorTransport(t)
+	}
+	return webauthn.Credential{
+		ID:              c.CredentialID,
+		PublicKey:       c.PublicKey,
+		AttestationType: c.AttestationType,
+		Transport:       transports,
+		Flags: webauthn.CredentialFlags{
+			BackupEligible: c.BackupEligible,
+			BackupState:    c.BackupState,
+		},
+		Authenticator: webauthn.Authenticator{
+			AAGUID:    c.AAGUID,
+			SignCount: uint32(c.SignCount),
+		},
+	}
+}
+
+func (a *authImpl) passkeyCeremony(options any, kind string, userID int64, data *webauthn.SessionData) (*PasskeyCeremony, error) {
+	raw, err := json.Marshal(passkeySession{
+		Kind:    kind,
+		UserID:  userID,
+		Data:    *data,
+		Expires: a.nowFn().Add(a.waCfg.Timeout).Unix(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	session, err := a.waBox.Seal(string(raw))
+	if err != nil {
+		return nil, err
+	}
+	return &PasskeyCeremony{Options: options, Session: session, ExpiresIn: a.waCfg.Timeout}, nil
+}
+
+func (a *authImpl) openPasskeySession(session, kind string) (*passkeySession, error) {
+	raw, err := a.waBox.Open(session)
+	if err != nil {
+		return nil, repositories.ErrInvalidToken
+	}
+	var s passkeySession
+	if err := json.Unmarshal([]byte(raw), &s); err != nil {
+		return nil, repositories.ErrInvalidToken
+	}
+	if s.Kind != kind || a.nowFn().Unix() > s.Expires {
+		return nil, repositories.ErrInvalidToken
+	}
+	return &s, nil
+}
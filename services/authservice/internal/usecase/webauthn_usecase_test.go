@@ -0,0 +1,276 @@
+package usecase_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"bioly/auth/internal/config"
+	"bioly/auth/internal/passkeytest"
+	"bioly/auth/internal/repositories"
+	"bioly/auth/internal/secretbox"
+	"bioly/auth/internal/types"
+	"bioly/auth/internal/usecase"
+)
+
+const passkeyOrigin = "https://bioly.test"
+
+// passkeysMock stores passkeys in memory and checks the signature counter
+// on use like the real repository.
+type passkeysMock struct {
+	creds []*types.WebAuthnCredential
+	spent map[uuid.UUID]bool
+}
+
+func (m *passkeysMock) Add(ctx context.Context, c *types.WebAuthnCredential) error {
+	for _, existing := range m.creds {
+		if bytes.Equal(existing.CredentialID, c.CredentialID) {
+			return repositories.ErrDuplicateCredential
+		}
+	}
+	c.ID = int64(len(m.creds) + 1)
+	c.CreatedAt = time.Now()
+	cp := *c
+	m.creds = append(m.creds, &cp)
+	return nil
+}
+func (m *passkeysMock) ListByUser(ctx context.Context, userID int64) ([]types.WebAuthnCredential, error) {
+	out := []types.WebAuthnCredential{}
+	for _, c := range m.creds {
+		if c.UserID == userID {
+			out = append(out, *c)
+		}
+	}
+	return out, nil
+}
+func (m *passkeysMock) FindByCredentialID(ctx context.Context, credentialID []byte) (*types.WebAuthnCredential, error) {
+	for _, c := range m.creds {
+		if bytes.Equal(c.CredentialID, credentialID) {
+			cp := *c
+			return &cp, nil
+		}
+	}
+	return nil, repositories.ErrNotFound
+}
+func (m *passkeysMock) Use(ctx context.Context, id int64, signCount int64, backupState bool, challengeID uuid.UUID, challengeExpires time.Time) error {
+	if m.spent[challengeID] {
+		return repositories.ErrInvalidChallenge
+	}
+	if m.spent == nil {
+		m.spent = map[uuid.UUID]bool{}
+	}
+	m.spent[challengeID] = true
+	c := m.creds[id-1]
+	if signCount <= c.SignCount && (signCount != 0 || c.SignCount != 0) {
+		return repositories.ErrSignCountMismatch
+	}
+	c.SignCount = signCount
+	c.BackupState = backupState
+	now := time.Now()
+	c.LastUsedAt = &now
+	return nil
+}
+
+type passkeyEnv struct {
+	uc       usecase.AuthService
+	passkeys *passkeysMock
+	rtRepo   *rtMock
+	auth     *passkeytest.Authenticator
+}
+
+func newPasskeyEnv(t *testing.T) *passkeyEnv {
+	t.Helper()
+	wa, err := webauthn.New(&webauthn.Config{
+		RPID:          "bioly.test",
+		RPDisplayName: "Bioly",
+		RPOrigins:     []string{passkeyOrigin},
+	})
+	require.NoError(t, err)
+	box, err := secretbox.New(make([]byte, 32))
+	require.NoError(t, err)
+
+	users := &usersMock{getByIDFn: func(ctx context.Context, id int64) (*types.User, error) {
+		if id != 7 && id != 8 {
+			return nil, repositories.ErrNotFound
+		}
+		return &types.User{ID: id, Username: map[int64]string{7: "mina", 8: "lucy"}[id]}, nil
+	}}
+	env := &passkeyEnv{passkeys: &passkeysMock{}, rtRepo: &rtMock{}, auth: passkeytest.New(passkeyOrigin)}
+	env.uc = usecase.NewAuth(users, env.rtRepo, &config.JWT{
+		AccessSecret: "access",
+		AccessTTL:    15 * time.Minute,
+		RefreshTTL:   24 * time.Hour,
+		Issuer:       "auth.test",
+	}, usecase.WithWebAuthn(env.passkeys, wa, box, &config.WebAuthn{Timeout: 5 * time.Minute}))
+	return env
+}
+
+func (e *passkeyEnv) register(t *testing.T, userID int64, name string) (*types.WebAuthnCredential, error) {
+	t.Helper()
+	c, err := e.uc.BeginPasskeyRegistration(context.Background(), userID)
+	require.NoError(t, err)
+	cred, err := e.auth.Create(c.Options)
+	require.NoError(t, err)
+	return e.uc.FinishPasskeyRegistration(context.Background(), userID, c.Session, name, cred)
+}
+
+func (e *passkeyEnv) login(t *testing.T) (*types.User, *usecase.Tokens, error) {
+	t.Helper()
+	c, err := e.uc.BeginPasskeyLogin(context.Background())
+	require.NoError(t, err)
+	assertion, err := e.auth.Get(c.Options)
+	require.NoError(t, err)
+	return e.uc.FinishPasskeyLogin(context.Background(), c.Session, assertion, "UA", "10.0.0.1")
+}
+
+func TestPasskey_RegisterThenLogin(t *testing.T) {
+	env := newPasskeyEnv(t)
+
+	cred, err := env.register(t, 7, "  ")
+	require.NoError(t, err)
+	assert.Equal(t, "Passkey", cred.Name)
+	assert.Equal(t, int64(7), cred.UserID)
+	assert.Equal(t, env.auth.CredentialID(), cred.CredentialID)
+	assert.Equal(t, "none", cred.AttestationType)
+	assert.ElementsMatch(t, []string{"internal", "hybrid"}, cred.Transports)
+
+	user, tokens, err := env.login(t)
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), user.ID)
+	assert.NotEmpty(t, tokens.Refresh)
+	assert.True(t, env.rtRepo.createCalled)
+	assert.Equal(t, "10.0.0.1", env.rtRepo.lastIP)
+	p, err := env.uc.ParseAccess(context.Background(), tokens.Access)
+	require.NoError(t, err)
+	assert.Equal(t, "mina", p.Username)
+	assert.Equal(t, int64(1), env.passkeys.creds[0].SignCount)
+	assert.NotNil(t, env.passkeys.creds[0].LastUsedAt)
+
+	_, _, err = env.login(t)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), env.passkeys.creds[0].SignCount)
+}
+
+func TestPasskey_SignCounter(t *testing.T) {
+	env := newPasskeyEnv(t)
+	_, err := env.register(t, 7, "YubiKey")
+	require.NoError(t, err)
+	_, _, err = env.login(t)
+	require.NoError(t, err)
+	_, _, err = env.login(t)
+	require.NoError(t, err)
+
+	// A clone of the key still at the first counter value.
+	env.auth.SignCount = 0
+	_, _, err = env.login(t)
+	assert.ErrorIs(t, err, repositories.ErrSignCountMismatch)
+	assert.Equal(t, int64(2), env.passkeys.creds[0].SignCount, "counter is not lowered")
+
+	// Replaying an assertion that was accepted once.
+	c, err := env.uc.BeginPasskeyLogin(context.Background())
+	require.NoError(t, err)
+	env.auth.SignCount = 2
+	assertion, err := env.auth.Get(c.Options)
+	require.NoError(t, err)
+	_, _, err = env.uc.FinishPasskeyLogin(context.Background(), c.Session, assertion, "UA", "10.0.0.1")
+	require.NoError(t, err)
+	_, _, err = env.uc.FinishPasskeyLogin(context.Background(), c.Session, assertion, "UA", "10.0.0.1")
+	assert.ErrorIs(t, err, repositories.ErrSignCountMismatch)
+}
+
+func TestPasskey_WithoutCounter(t *testing.T) {
+	env := newPasskeyEnv(t)
+	env.auth.NoCounter = true
+	env.auth.Synced = true
+	cred, err := env.register(t, 7, "iCloud Keychain")
+	require.NoError(t, err)
+	assert.True(t, cred.BackupEligible)
+
+	for i := 0; i < 3; i++ {
+		_, _, err = env.login(t)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, int64(0), env.passkeys.creds[0].SignCount)
+
+	// The counter cannot catch a replay here, the spent challenge does.
+	c, err := env.uc.BeginPasskeyLogin(context.Background())
+	require.NoError(t, err)
+	assertion, err := env.auth.Get(c.Options)
+	require.NoError(t, err)
+	_, _, err = env.uc.FinishPasskeyLogin(context.Background(), c.Session, assertion, "UA", "10.0.0.1")
+	require.NoError(t, err)
+	_, _, err = env.uc.FinishPasskeyLogin(context.Background(), c.Session, assertion, "UA", "10.0.0.1")
+	assert.ErrorIs(t, err, repositories.ErrInvalidChallenge)
+}
+
+func TestPasskey_Rejected(t *testing.T) {
+	env := newPasskeyEnv(t)
+	ctx := context.Background()
+
+	// Login before any passkey was registered here.
+	other := passkeytest.New(passkeyOrigin)
+	c, err := env.uc.BeginPasskeyRegistration(ctx, 8)
+	require.NoError(t, err)
+	_, err = other.Create(c.Options)
+	require.NoError(t, err)
+	env.auth = other
+	_, _, err = env.login(t)
+	assert.ErrorIs(t, err, repositories.ErrInvalidPasskey, "unknown credential")
+
+	env.auth = passkeytest.New(passkeyOrigin)
+	_, err = env.register(t, 7, "Laptop")
+	require.NoError(t, err)
+
+	// The same authenticator cannot be registered twice.
+	c, err = env.uc.BeginPasskeyRegistration(ctx, 7)
+	require.NoError(t, err)
+	_, err = env.auth.Create(c.Options)
+	assert.Error(t, err, "excluded by the options")
+
+	// A registration session belongs to the user who started it.
+	c, err = env.uc.BeginPasskeyRegistration(ctx, 8)
+	require.NoError(t, err)
+	cred, err := passkeytest.New(passkeyOrigin).Create(c.Options)
+	require.NoError(t, err)
+	_, err = env.uc.FinishPasskeyRegistration(ctx, 7, c.Session, "", cred)
+	assert.ErrorIs(t, err, repositories.ErrInvalidToken)
+
+	// Sessions are not interchangeable between ceremonies.
+	login, err := env.uc.BeginPasskeyLogin(ctx)
+	require.NoError(t, err)
+	assertion, err := env.auth.Get(login.Options)
+	require.NoError(t, err)
+	_, _, err = env.uc.FinishPasskeyLogin(ctx, c.Session, assertion, "UA", "10.0.0.1")
+	assert.ErrorIs(t, err, repositories.ErrInvalidToken)
+	_, _, err = env.uc.FinishPasskeyLogin(ctx, "v1:garbage", assertion, "UA", "10.0.0.1")
+	assert.ErrorIs(t, err, repositories.ErrInvalidToken)
+
+	// Another page, a missing PIN check and a tampered response fail.
+	env.auth.Origin = "https://evil.test"
+	_, _, err = env.login(t)
+	assert.ErrorIs(t, err, repositories.ErrInvalidPasskey)
+	env.auth.Origin = passkeyOrigin
+	env.auth.SkipUserVerification = true
+	_, _, err = env.login(t)
+	assert.ErrorIs(t, err, repositories.ErrInvalidPasskey)
+	env.auth.SkipUserVerification = false
+	_, _, err = env.uc.FinishPasskeyLogin(ctx, login.Session, []byte(`{"id":"x"}`), "UA", "10.0.0.1")
+	assert.ErrorIs(t, err, repositories.ErrInvalidPasskey)
+
+	_, _, err = env.login(t)
+	assert.NoError(t, err)
+}
+
+func TestPasskey_NotConfigured(t *testing.T) {
+	uc := usecase.NewAuth(&usersMock{}, &rtMock{}, &config.JWT{AccessSecret: "secret", Issuer: "test"})
+	_, err := uc.BeginPasskeyLogin(context.Background())
+	assert.ErrorIs(t, err, repositories.ErrNotImplemented)
+	_, err = uc.BeginPasskeyRegistration(context.Background(), 7)
+	assert.ErrorIs(t, err, repositories.ErrNotImplemented)
+}
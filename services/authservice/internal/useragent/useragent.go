@@ -0,0 +1,110 @@
+package useragent
+
+import (
+	"regexp"
+	"strings"
+)
+
+const (
+	DeviceDesktop = "desktop"
+	DeviceMobile  = "mobile"
+	DeviceTablet  = "tablet"
+	DeviceBot     = "bot"
+	DeviceUnknown = "unknown"
+)
+
+// Info is a coarse description of a User-Agent header, good enough for a
+// user to recognise their own devices in a session list.
+type Info struct {
+	Device  string
+	OS      string
+	Browser string
+	Version string
+}
+
+// Summary renders Info as e.g. "Firefox 128 on Windows".
+func (i Info) Summary() string {
+	browser := i.Browser
+	if i.Version != "" {
+		browser += " " + i.Version
+	}
+	switch {
+	case i.Browser == "" && i.OS == "":
+		return "Unknown device"
+	case i.OS == "":
+		return browser
+	case i.Browser == "":
+		return i.OS
+	default:
+		return browser + " on " + i.OS
+	}
+}
+
+type rule struct {
+	name string
+	re   *regexp.Regexp
+}
+
+// Order matters: Chromium based browsers also claim to be Chrome and Safari.
+var browsers = []rule{
+	{"Edge", regexp.MustCompile(`Edg(?:e|A|iOS)?/(\d+)`)},
+	{"Opera", regexp.MustCompile(`(?:OPR|Opera)/(\d+)`)},
+	{"Samsung Internet", regexp.MustCompile(`SamsungBrowser/(\d+)`)},
+	{"Yandex Browser", regexp.MustCompile(`YaBrowser/(\d+)`)},
+	{"Firefox", regexp.MustCompile(`(?:Firefox|FxiOS)/(\d+)`)},
+	{"Chrome", regexp.MustCompile(`(?:Chrome|CriOS)/(\d+)`)},
+	{"Safari", regexp.MustCompile(`Version/(\d+)[.\d]* (?:Mobile/\S+ )?Safari/`)},
+	{"curl", regexp.MustCompile(`^curl/(\d+)`)},
+	{"okhttp", regexp.MustCompile(`okhttp/(\d+)`)},
+	{"Postman", regexp.MustCompile(`PostmanRuntime/(\d+)`)},
+	{"Go HTTP client", regexp.MustCompile(`Go-http-client/(\d+)`)},
+}
+
+var systems = []struct {
+	name   string
+	marker string
+}{
+	{"iPadOS", "iPad"},
+	{"iOS", "iPhone"},
+	{"iOS", "iPod"},
+	{"Android", "Android"},
+	{"Windows", "Windows"},
+	{"macOS", "Macintosh"},
+	{"ChromeOS", "CrOS"},
+	{"Linux", "Linux"},
+}
+
+var botRe = regexp.MustCompile(`(?i)bot|crawler|spider|slurp`)
+
+func Parse(ua string) Info {
+	if strings.TrimSpace(ua) == "" {
+		return Info{Device: DeviceUnknown}
+	}
+	var info Info
+	for _, b := range browsers {
+		if m := b.re.FindStringSubmatch(ua); m != nil {
+			info.Browser, info.Version = b.name, m[1]
+			break
+		}
+	}
+	for _, s := range systems {
+		if strings.Contains(ua, s.marker) {
+			info.OS = s.name
+			break
+		}
+	}
+
+	switch {
+	case botRe.MatchString(ua):
+		info.Device = DeviceBot
+	case info.OS == "iPadOS" || (info.OS == "Android" && !strings.Contains(ua, "Mobile")):
+		info.Device = DeviceTablet
+	case info.OS == "iOS" || info.OS == "Android" || strings.Contains(ua, "Mobile"):
+		info.Device = DeviceMobile
+	case info.OS != "":
+		info.Device = DeviceDesktop
+	default:
+		info.Device = DeviceUnknown
+	}
+	return info
+}
@@ -0,0 +1,71 @@
+package useragent
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		ua      string
+		want    Info
+		summary string
+	}{
+		{
+			ua:      "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36",
+			want:    Info{Device: DeviceDesktop, OS: "Windows", Browser: "Chrome", Version: "120"},
+			summary: "Chrome 120 on Windows",
+		},
+		{
+			ua:      "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36 Edg/120.0.2210.91",
+			want:    Info{Device: DeviceDesktop, OS: "Windows", Browser: "Edge", Version: "120"},
+			summary: "Edge 120 on Windows",
+		},
+		{
+			ua:      "Mozilla/5.0 (Macintosh; Intel Mac OS X 14_2) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.2 Safari/605.1.15",
+			want:    Info{Device: DeviceDesktop, OS: "macOS", Browser: "Safari", Version: "17"},
+			summary: "Safari 17 on macOS",
+		},
+		{
+			ua:      "Mozilla/5.0 (iPhone; CPU iPhone OS 17_2 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.2 Mobile/15E148 Safari/604.1",
+			want:    Info{Device: DeviceMobile, OS: "iOS", Browser: "Safari", Version: "17"},
+			summary: "Safari 17 on iOS",
+		},
+		{
+			ua:      "Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Mobile Safari/537.36",
+			want:    Info{Device: DeviceMobile, OS: "Android", Browser: "Chrome", Version: "120"},
+			summary: "Chrome 120 on Android",
+		},
+		{
+			ua:      "Mozilla/5.0 (Linux; Android 13; SM-X700) AppleWebKit/537.36 (KHTML, like Gecko) SamsungBrowser/23.0 Chrome/115.0.0.0 Safari/537.36",
+			want:    Info{Device: DeviceTablet, OS: "Android", Browser: "Samsung Internet", Version: "23"},
+			summary: "Samsung Internet 23 on Android",
+		},
+		{
+			ua:      "Mozilla/5.0 (X11; Ubuntu; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0",
+			want:    Info{Device: DeviceDesktop, OS: "Linux", Browser: "Firefox", Version: "121"},
+			summary: "Firefox 121 on Linux",
+		},
+		{
+			ua:      "curl/8.4.0",
+			want:    Info{Device: DeviceUnknown, Browser: "curl", Version: "8"},
+			summary: "curl 8",
+		},
+		{
+			ua:      "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)",
+			want:    Info{Device: DeviceBot},
+			summary: "Unknown device",
+		},
+		{
+			ua:      "",
+			want:    Info{Device: DeviceUnknown},
+			summary: "Unknown device",
+		},
+	}
+	for _, c := range cases {
+		got := Parse(c.ua)
+		assert.Equal(t, c.want, got, c.ua)
+		assert.Equal(t, c.summary, got.Summary(), c.ua)
+	}
+}
@@ -7,7 +7,9 @@ import (
 	"os"
 
 	"bioly/common/asynclogger"
+	"bioly/common/authjwt"
 	"bioly/common/storage"
+	"bioly/common/usernames"
 	"bioly/profileservice/internal/cache"
 	"bioly/profileservice/internal/config"
 	"bioly/profileservice/internal/repositories"
@@ -39,8 +41,29 @@ func main() {
 	profile := repositories.NewProfile(db)
 	service := usecases.NewProfile(profile, lruCache)
 
+	authenticate := authjwt.FromGateway
+	if cfg.Auth.TrustGateway {
+		asynclogger.Info("Taking callers from gateway identity headers")
+	} else {
+		verifier, err := authjwt.New(cfg.Auth)
+		if err != nil {
+			asynclogger.Fatal("Can't configure token verification: %v", err)
+		}
+		authenticate = authjwt.Authenticate(verifier)
+	}
+
+	names, err := usernames.New(cfg.Username)
+	if err != nil {
+		asynclogger.Fatal("Can't load username policy: %v", err)
+	}
 	handler := transport.NewHandler(service)
-	router := transport.NewRouter(handler)
+	// The auth service only knows the names in the shared reserved file.
+	for _, route := range handler.RouteNames() {
+		if _, err := names.Normalize(route); err == nil {
+			asynclogger.Warning("Route /%s is not a reserved username, add it to the reserved file", route)
+		}
+	}
+	router := transport.NewRouter(handler, authenticate)
 
 	addr := fmt.Sprintf("%s:%d", cfg.HTTP.Host, cfg.HTTP.Port)
 	asynclogger.Info("Starting profile service on %s", addr)
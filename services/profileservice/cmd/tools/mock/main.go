@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"log"
 
+	"bioly/common/usernames"
+
 	"github.com/jmoiron/sqlx"
 	_ "github.com/lib/pq"
 )
@@ -60,8 +62,8 @@ func insertBatch(db *sqlx.DB, offset, limit int) error {
 }
 
 func insertUsersBatch(tx *sqlx.Tx, offset, limit int) ([]int64, error) {
-	query := `INSERT INTO auth.users (username, password_hash) VALUES `
-	args := make([]any, 0, limit*2)
+	query := `INSERT INTO auth.users (username, username_skeleton, password_hash) VALUES `
+	args := make([]any, 0, limit*3)
 	argPos := 1
 
 	const passwordHash = "$argon2id$v=19$m=65536,t=1,p=10$test$testhash"
@@ -70,14 +72,16 @@ func insertUsersBatch(tx *sqlx.Tx, offset, limit int) ([]int64, error) {
 		if i > 0 {
 			query += ","
 		}
-		query += fmt.Sprintf(" ($%d, $%d)", argPos, argPos+1)
+		query += fmt.Sprintf(" ($%d, $%d, $%d)", argPos, argPos+1, argPos+2)
 
+		username := fmt.Sprintf("user_%d", offset+i)
 		args = append(
 			args,
-			fmt.Sprintf("user_%d", offset+i),
+			username,
+			usernames.Skeleton(username),
 			passwordHash,
 		)
-		argPos += 2
+		argPos += 3
 	}
 
 	query += " RETURNING id"
@@ -8,22 +8,29 @@ replace bioly/common/asynclogger => ../../common/asynclogger
 
 replace bioly/common/storage => ../../common/storage
 
+replace bioly/common/authjwt => ../../common/authjwt
+
+replace bioly/common/usernames => ../../common/usernames
+
 require (
 	bioly/common/asynclogger v0.0.0-00010101000000-000000000000
+	bioly/common/authjwt v0.0.0-00010101000000-000000000000
 	bioly/common/storage v0.0.0-00010101000000-000000000000
+	bioly/common/usernames v0.0.0-00010101000000-000000000000
 	bioly/common/yamlconf v0.0.0-00010101000000-000000000000
 	github.com/DATA-DOG/go-sqlmock v1.5.2
+	github.com/go-chi/chi/v5 v5.2.3
+	github.com/go-chi/render v1.0.3
+	github.com/hashicorp/golang-lru/v2 v2.0.7
 	github.com/jmoiron/sqlx v1.4.0
+	github.com/lib/pq v1.10.9
 	github.com/stretchr/testify v1.11.1
 )
 
 require (
 	github.com/ajg/form v1.5.1 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
-	github.com/go-chi/chi/v5 v5.2.3 // indirect
-	github.com/go-chi/render v1.0.3 // indirect
-	github.com/hashicorp/golang-lru/v2 v2.0.7 // indirect
-	github.com/lib/pq v1.10.9 // indirect
+	github.com/golang-jwt/jwt/v5 v5.3.0 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	gopkg.in/natefinch/lumberjack.v2 v2.2.1 // indirect
 	gopkg.in/yaml.v2 v2.4.0 // indirect
@@ -1,7 +1,9 @@
 package config
 
 import (
+	"bioly/common/authjwt"
 	"bioly/common/storage"
+	"bioly/common/usernames"
 	"bioly/common/yamlconf"
 	"log"
 	"time"
@@ -17,6 +19,9 @@ type HTTP struct {
 type Config struct {
 	DBInfo storage.DbInfo `yaml:"profile_db"`
 	HTTP   HTTP           `yaml:"http"`
+	Auth   authjwt.Config `yaml:"auth"`
+	// Username should match the policy of the auth service.
+	Username usernames.Config `yaml:"username"`
 }
 
 func New(path string) *Config {
@@ -10,6 +10,7 @@ import (
 type Profile interface {
 	GetUserId(ctx context.Context, username string) (int64, error)
 	GetProfile(ctx context.Context, id int64) (types.Profile, error)
+	GetRenamedUsername(ctx context.Context, oldUsername string) (string, error)
 }
 
 type profilImpl struct {
@@ -44,3 +45,23 @@ func (r *profilImpl) GetProfile(ctx context.Context, id int64) (types.Profile, e
 	profile.UserID = id
 	return profile, nil
 }
+
+// GetRenamedUsername returns the current name of the user who most recently
+// gave up oldUsername.
+func (r *profilImpl) GetRenamedUsername(ctx context.Context, oldUsername string) (string, error) {
+	query := `
+		SELECT u.username
+		FROM auth.username_history h
+		JOIN auth.users u ON u.id = h.user_id
+		WHERE LOWER(h.old_username) = LOWER($1)
+		ORDER BY h.changed_at DESC
+		LIMIT 1`
+	var username string
+
+	err := r.db.GetContext(ctx, &username, query, oldUsername)
+	if err != nil {
+		return "", err
+	}
+
+	return username, nil
+}
@@ -103,3 +103,31 @@ func TestGetProfileError(t *testing.T) {
 	assert.Error(err)
 	assert.NoError(mock.ExpectationsWereMet())
 }
+
+func TestGetRenamedUsername(t *testing.T) {
+	assert := assert.New(t)
+	repo, mock, cleanup := newTestProfileRepo(t)
+	defer cleanup()
+
+	query := regexp.QuoteMeta("WHERE LOWER(h.old_username) = LOWER($1)")
+
+	rows := sqlmock.NewRows([]string{"username"}).AddRow("robert")
+	mock.ExpectQuery(query).WithArgs("bob").WillReturnRows(rows)
+
+	username, err := repo.GetRenamedUsername(context.Background(), "bob")
+	assert.NoError(err)
+	assert.Equal("robert", username)
+	assert.NoError(mock.ExpectationsWereMet())
+}
+
+func TestGetRenamedUsernameUnknown(t *testing.T) {
+	assert := assert.New(t)
+	repo, mock, cleanup := newTestProfileRepo(t)
+	defer cleanup()
+
+	mock.ExpectQuery(regexp.QuoteMeta("FROM auth.username_history h")).WithArgs("ghost").WillReturnError(sql.ErrNoRows)
+
+	_, err := repo.GetRenamedUsername(context.Background(), "ghost")
+	assert.ErrorIs(err, sql.ErrNoRows)
+	assert.NoError(mock.ExpectationsWereMet())
+}
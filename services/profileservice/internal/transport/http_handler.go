@@ -2,11 +2,14 @@ package transport
 
 import (
 	"bioly/common/asynclogger"
+	"bioly/common/usernames"
 	"bioly/profileservice/internal/types"
 	"bioly/profileservice/internal/usecases"
+	"errors"
 	"fmt"
 	"math/rand/v2"
 	"net/http"
+	"net/url"
 	"time"
 
 	"github.com/go-chi/chi/v5"
@@ -20,8 +23,13 @@ type Handler struct {
 	randomNames []string
 }
 
-func NewHandler(p usecases.ProfileService) *Handler {
+type HandlerOption func(*Handler)
+
+func NewHandler(p usecases.ProfileService, opts ...HandlerOption) *Handler {
 	handler := &Handler{profile: p}
+	for _, opt := range opts {
+		opt(handler)
+	}
 
 	handler.randomNames = make([]string, 0, 100_000)
 	for i := range 100_000 {
@@ -41,6 +49,20 @@ func (h *Handler) RegisterRoutes(r chi.Router) {
 	r.Get("/internal/CachedRandomPage", h.testGetProfileCached)
 }
 
+// RouteNames returns the first path segment of every route next to
+// /{username}. Each must be a reserved username, or its owner's profile
+// would be unreachable.
+func (h *Handler) RouteNames() []string {
+	r := chi.NewRouter()
+	h.RegisterRoutes(r)
+	var patterns []string
+	_ = chi.Walk(r, func(method, route string, _ http.Handler, _ ...func(http.Handler) http.Handler) error {
+		patterns = append(patterns, route)
+		return nil
+	})
+	return usernames.RouteWords(patterns...)
+}
+
 func (h *Handler) ping(w http.ResponseWriter, r *http.Request) {
 	render.PlainText(w, r, "pong")
 }
@@ -53,9 +75,18 @@ func (h *Handler) getProfile(w http.ResponseWriter, r *http.Request) {
 	reqID := middleware.GetReqID(r.Context())
 	start := time.Now().UTC()
 
+	// Not checked against the username policy: accounts created before it
+	// may hold names it refuses and must stay reachable.
 	idStr := chi.URLParam(r, "username")
-
 	profile, err := h.profile.GetProfile(r.Context(), idStr)
+	var moved *usecases.MovedError
+	if errors.As(err, &moved) {
+		asynclogger.Info("[%s] profile %s moved to %s", reqID, idStr, moved.Username)
+		// Relative, so the redirect keeps any prefix a proxy put in front.
+		w.Header().Set("Location", url.PathEscape(moved.Username))
+		render.Render(w, r, &types.MovedResponse{Username: moved.Username})
+		return
+	}
 	if err != nil {
 		asynclogger.Error("[%s] failed to get profile for username %s: %v", reqID, idStr, err)
 		render.Render(w, r, types.ErrInvalidRequest(http.StatusNotFound, fmt.Errorf("profile not found")))
@@ -6,14 +6,18 @@ import (
 	"errors"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
 	"testing"
 	"time"
 
+	"bioly/common/usernames"
 	"bioly/profileservice/internal/types"
+	"bioly/profileservice/internal/usecases"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 type mockProfileService struct {
@@ -121,3 +125,61 @@ func TestHandlerGetProfileError(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, expectedErr.Error(), resp["error"])
 }
+
+func TestHandlerGetProfileMoved(t *testing.T) {
+	mockSvc := &mockProfileService{
+		getProfileFunc: func(ctx context.Context, username string) (types.Profile, error) {
+			assert.Equal(t, "bob", username)
+			return types.Profile{}, &usecases.MovedError{Username: "robert"}
+		},
+	}
+
+	router := newTestRouter(t, mockSvc)
+	req := httptest.NewRequest(http.MethodGet, "/bob", nil)
+	rec := httptest.NewRecorder()
+
+	router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusMovedPermanently, rec.Code)
+	assert.Equal(t, "robert", rec.Header().Get("Location"))
+
+	var resp types.MovedResponse
+	err := json.Unmarshal(rec.Body.Bytes(), &resp)
+	assert.NoError(t, err)
+	assert.Equal(t, "robert", resp.Username)
+}
+
+func TestHandlerGetProfileLegacyUsername(t *testing.T) {
+	// Names the policy now refuses still belong to older accounts.
+	mockSvc := &mockProfileService{
+		getProfileFunc: func(ctx context.Context, username string) (types.Profile, error) {
+			return types.Profile{Username: username}, nil
+		},
+	}
+	router := newTestRouter(t, mockSvc)
+
+	for _, path := range []string{"/ab", "/_hidden"} {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		assert.Equal(t, http.StatusOK, rec.Code, path)
+	}
+}
+
+// The auth service learns the profile routes only from the shared list, so
+// every route must be in it.
+func TestRouteNamesAreReserved(t *testing.T) {
+	policy, err := usernames.New(usernames.Config{
+		ReservedFile: filepath.Join("..", "..", "..", "..", "configs", "reserved_usernames.txt"),
+	})
+	require.NoError(t, err)
+
+	names := NewHandler(&mockProfileService{}).RouteNames()
+	assert.NotEmpty(t, names)
+	for _, name := range names {
+		_, err := policy.Normalize(name)
+		var nameErr *usernames.Error
+		if assert.ErrorAs(t, err, &nameErr, name) {
+			assert.Equal(t, usernames.ReasonReserved, nameErr.Reason, name)
+		}
+	}
+}
@@ -9,7 +9,10 @@ import (
 	"github.com/go-chi/render"
 )
 
-func NewRouter(handler *Handler) http.Handler {
+// NewRouter builds the service router. When authenticate is not nil, it
+// identifies callers (see authjwt.Authenticate and authjwt.FromGateway),
+// who are then available via authjwt.PrincipalFrom.
+func NewRouter(handler *Handler, authenticate func(http.Handler) http.Handler) http.Handler {
 	r := chi.NewRouter()
 
 	r.Use(middleware.RequestID)
@@ -19,6 +22,9 @@ func NewRouter(handler *Handler) http.Handler {
 	r.Use(middleware.Recoverer)
 	r.Use(middleware.URLFormat)
 	r.Use(render.SetContentType(render.ContentTypeJSON))
+	if authenticate != nil {
+		r.Use(authenticate)
+	}
 
 	r.NotFound(func(w http.ResponseWriter, r *http.Request) {
 		asynclogger.Warning("[%s] not found %s %s", middleware.GetReqID(r.Context()), r.Method, r.URL.Path)
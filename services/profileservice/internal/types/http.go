@@ -32,3 +32,13 @@ type ProfileResponse struct {
 func (pr *ProfileResponse) Render(w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
+
+// MovedResponse answers a request for a username that was changed.
+type MovedResponse struct {
+	Username string `json:"username"`
+}
+
+func (mr *MovedResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	render.Status(r, http.StatusMovedPermanently)
+	return nil
+}
@@ -6,6 +6,8 @@ import (
 	"bioly/profileservice/internal/repositories"
 	"bioly/profileservice/internal/types"
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
 )
 
@@ -14,6 +16,16 @@ type ProfileService interface {
 	GetProfileCached(ctx context.Context, username string) (types.Profile, error)
 }
 
+// MovedError is returned for a username the user has since changed.
+// Username is the current name.
+type MovedError struct {
+	Username string
+}
+
+func (e *MovedError) Error() string {
+	return fmt.Sprintf("profile moved to %s", e.Username)
+}
+
 type profileImpl struct {
 	profileRepo repositories.Profile
 	cache       cache.ProfileCache
@@ -24,7 +36,7 @@ func NewProfile(profileRepo repositories.Profile, cache cache.ProfileCache) Prof
 }
 
 func (p *profileImpl) GetProfile(ctx context.Context, username string) (types.Profile, error) {
-	id, err := p.profileRepo.GetUserId(ctx, username)
+	id, err := p.userID(ctx, username)
 	if err != nil {
 		return types.Profile{}, err
 	}
@@ -46,7 +58,7 @@ func (p *profileImpl) GetProfileCached(ctx context.Context, username string) (ty
 		}
 	}
 
-	id, err := p.profileRepo.GetUserId(ctx, username)
+	id, err := p.userID(ctx, username)
 	if err != nil {
 		return types.Profile{}, err
 	}
@@ -67,3 +79,19 @@ func (p *profileImpl) GetProfileCached(ctx context.Context, username string) (ty
 
 	return profile, nil
 }
+
+// userID resolves a current username. Unknown names that a user gave up by
+// renaming the account yield a MovedError.
+func (p *profileImpl) userID(ctx context.Context, username string) (int64, error) {
+	id, err := p.profileRepo.GetUserId(ctx, username)
+	if errors.Is(err, sql.ErrNoRows) {
+		current, rerr := p.profileRepo.GetRenamedUsername(ctx, username)
+		if rerr == nil {
+			return 0, &MovedError{Username: current}
+		}
+		if !errors.Is(rerr, sql.ErrNoRows) {
+			asynclogger.Error("failed to look up renamed username %s: %v", username, rerr)
+		}
+	}
+	return id, err
+}
@@ -2,6 +2,7 @@ package usecases
 
 import (
 	"context"
+	"database/sql"
 	"errors"
 	"testing"
 	"time"
@@ -14,6 +15,7 @@ import (
 type mockProfileRepo struct {
 	getUserIDFunc  func(ctx context.Context, username string) (int64, error)
 	getProfileFunc func(ctx context.Context, id int64) (types.Profile, error)
+	getRenamedFunc func(ctx context.Context, oldUsername string) (string, error)
 }
 
 func (m *mockProfileRepo) GetUserId(ctx context.Context, username string) (int64, error) {
@@ -24,6 +26,13 @@ func (m *mockProfileRepo) GetProfile(ctx context.Context, id int64) (types.Profi
 	return m.getProfileFunc(ctx, id)
 }
 
+func (m *mockProfileRepo) GetRenamedUsername(ctx context.Context, oldUsername string) (string, error) {
+	if m.getRenamedFunc != nil {
+		return m.getRenamedFunc(ctx, oldUsername)
+	}
+	return "", sql.ErrNoRows
+}
+
 func TestProfileServiceGetProfileSuccess(t *testing.T) {
 	assert := assert.New(t)
 	ctx := context.Background()
@@ -96,3 +105,48 @@ func TestProfileServiceGetProfileLookupError(t *testing.T) {
 
 	assert.ErrorIs(err, expectedErr)
 }
+
+func TestProfileServiceGetProfileRenamed(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	repo := &mockProfileRepo{
+		getUserIDFunc: func(ctx context.Context, username string) (int64, error) {
+			return 0, sql.ErrNoRows
+		},
+		getRenamedFunc: func(ctx context.Context, oldUsername string) (string, error) {
+			assert.Equal("bob", oldUsername)
+			return "robert", nil
+		},
+		getProfileFunc: func(ctx context.Context, id int64) (types.Profile, error) {
+			t.Fatalf("GetProfile should not be called for a renamed user")
+			return types.Profile{}, nil
+		},
+	}
+
+	service := NewProfile(repo, nil)
+	for _, get := range []func(context.Context, string) (types.Profile, error){service.GetProfile, service.GetProfileCached} {
+		_, err := get(ctx, "bob")
+
+		var moved *MovedError
+		if assert.ErrorAs(err, &moved) {
+			assert.Equal("robert", moved.Username)
+		}
+	}
+}
+
+func TestProfileServiceGetProfileUnknown(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	repo := &mockProfileRepo{
+		getUserIDFunc: func(ctx context.Context, username string) (int64, error) {
+			return 0, sql.ErrNoRows
+		},
+	}
+
+	service := NewProfile(repo, nil)
+	_, err := service.GetProfile(ctx, "ghost")
+
+	assert.ErrorIs(err, sql.ErrNoRows)
+}
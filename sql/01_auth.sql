@@ -1,21 +1,35 @@
 \connect bioly
 
 CREATE TABLE IF NOT EXISTS auth.users (
-  id             BIGSERIAL    PRIMARY KEY,
-  username       TEXT         NOT NULL,
-  password_hash  TEXT         NOT NULL,
-  last_login_at  TIMESTAMPTZ  NULL,
-  created_at     TIMESTAMPTZ  NOT NULL DEFAULT NOW(),
-  updated_at     TIMESTAMPTZ  NOT NULL DEFAULT NOW()
+  id                  BIGSERIAL    PRIMARY KEY,
+  username            TEXT         NOT NULL,
+  -- usernames.Skeleton(username): names that look alike share it.
+  username_skeleton   TEXT         NOT NULL,
+  email               TEXT         NULL,
+  email_verified_at   TIMESTAMPTZ  NULL,
+  password_hash       TEXT         NOT NULL,
+  last_login_at       TIMESTAMPTZ  NULL,
+  failed_login_count  INT          NOT NULL DEFAULT 0,
+  locked_until        TIMESTAMPTZ  NULL,
+  created_at          TIMESTAMPTZ  NOT NULL DEFAULT NOW(),
+  updated_at          TIMESTAMPTZ  NOT NULL DEFAULT NOW()
 );
 
 CREATE UNIQUE INDEX IF NOT EXISTS users_username_lower_uidx
   ON auth.users (LOWER(username));
 
+-- Keeps "al1ce" or a Cyrillic "аlice" from registering next to "alice".
+CREATE UNIQUE INDEX IF NOT EXISTS users_username_skeleton_uidx
+  ON auth.users (username_skeleton);
+
+CREATE UNIQUE INDEX IF NOT EXISTS users_email_lower_uidx
+  ON auth.users (LOWER(email));
+
 CREATE TABLE IF NOT EXISTS auth.refresh_tokens (
   id          BIGSERIAL    PRIMARY KEY,
   user_id     BIGINT       NOT NULL REFERENCES auth.users(id) ON DELETE CASCADE,
   jti         UUID         NOT NULL,
+  family_id   UUID         NOT NULL,
   token_hash  TEXT         NOT NULL,
   user_agent  TEXT         NULL,
   ip          INET         NULL,
@@ -31,17 +45,195 @@ CREATE UNIQUE INDEX IF NOT EXISTS refresh_tokens_jti_uidx
 CREATE INDEX IF NOT EXISTS refresh_tokens_user_id_idx
   ON auth.refresh_tokens (user_id);
 
-INSERT INTO auth.users (username, password_hash)
-VALUES ('test', '$argon2id$v=19$m=65536,t=1,p=10$N+0U3LXewHdjFrkjrvn6NQ$5lowDuhO6KuqRdveEFIdOWe81KtJPTkANvgD4F/aqzk'); -- plain: password123
+CREATE INDEX IF NOT EXISTS refresh_tokens_family_id_idx
+  ON auth.refresh_tokens (family_id);
+
+-- Used by the token janitor to find expired and long revoked tokens.
+CREATE INDEX IF NOT EXISTS refresh_tokens_expires_at_idx
+  ON auth.refresh_tokens (expires_at) WHERE revoked_at IS NULL;
+
+CREATE INDEX IF NOT EXISTS refresh_tokens_revoked_at_idx
+  ON auth.refresh_tokens (revoked_at) WHERE revoked_at IS NOT NULL;
+
+CREATE TABLE IF NOT EXISTS auth.login_failures (
+  id          BIGSERIAL    PRIMARY KEY,
+  key         TEXT         NOT NULL,
+  failed_at   TIMESTAMPTZ  NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS login_failures_key_failed_at_idx
+  ON auth.login_failures (key, failed_at);
+
+CREATE TABLE IF NOT EXISTS auth.password_resets (
+  id          BIGSERIAL    PRIMARY KEY,
+  user_id     BIGINT       NOT NULL REFERENCES auth.users(id) ON DELETE CASCADE,
+  token_id    UUID         NOT NULL,
+  token_hash  TEXT         NOT NULL,
+  expires_at  TIMESTAMPTZ  NOT NULL,
+  used_at     TIMESTAMPTZ  NULL,
+  created_at  TIMESTAMPTZ  NOT NULL DEFAULT NOW()
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS password_resets_token_id_uidx
+  ON auth.password_resets (token_id);
+
+CREATE INDEX IF NOT EXISTS password_resets_user_id_idx
+  ON auth.password_resets (user_id);
+
+CREATE TABLE IF NOT EXISTS auth.user_mfa (
+  user_id     BIGINT       PRIMARY KEY REFERENCES auth.users(id) ON DELETE CASCADE,
+  secret_enc  TEXT         NOT NULL,
+  enabled_at  TIMESTAMPTZ  NULL,
+  last_step   BIGINT       NOT NULL DEFAULT 0,
+  created_at  TIMESTAMPTZ  NOT NULL DEFAULT NOW(),
+  updated_at  TIMESTAMPTZ  NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS auth.mfa_recovery_codes (
+  id          BIGSERIAL    PRIMARY KEY,
+  user_id     BIGINT       NOT NULL REFERENCES auth.users(id) ON DELETE CASCADE,
+  code_hash   TEXT         NOT NULL,
+  used_at     TIMESTAMPTZ  NULL
+);
+
+CREATE INDEX IF NOT EXISTS mfa_recovery_codes_user_id_idx
+  ON auth.mfa_recovery_codes (user_id);
+
+CREATE TABLE IF NOT EXISTS auth.user_roles (
+  user_id     BIGINT       NOT NULL REFERENCES auth.users(id) ON DELETE CASCADE,
+  role        TEXT         NOT NULL,
+  created_at  TIMESTAMPTZ  NOT NULL DEFAULT NOW(),
+  PRIMARY KEY (user_id, role)
+);
+
+CREATE TABLE IF NOT EXISTS auth.username_history (
+  id            BIGSERIAL    PRIMARY KEY,
+  user_id       BIGINT       NOT NULL REFERENCES auth.users(id) ON DELETE CASCADE,
+  old_username  TEXT         NOT NULL,
+  changed_at    TIMESTAMPTZ  NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS username_history_old_username_lower_idx
+  ON auth.username_history (lower(old_username), changed_at DESC);
 
-INSERT INTO auth.users (username, password_hash)
-VALUES ('admin', '$argon2id$v=19$m=65536,t=1,p=10$DgmMFWnKxCF9Lv4jz90L1w$cb3nu9Wqf0pMTHiuEW6DR3F9KBNlMZd7bct7luZi0ws'); -- plain: admin
+CREATE TABLE IF NOT EXISTS auth.identities (
+  id          BIGSERIAL    PRIMARY KEY,
+  user_id     BIGINT       NOT NULL REFERENCES auth.users(id) ON DELETE CASCADE,
+  provider    TEXT         NOT NULL,
+  subject     TEXT         NOT NULL,
+  created_at  TIMESTAMPTZ  NOT NULL DEFAULT NOW(),
+  UNIQUE (provider, subject)
+);
+
+CREATE INDEX IF NOT EXISTS identities_user_id_idx
+  ON auth.identities (user_id);
+
+-- Personal access tokens for scripts. Only a hash of the secret is kept;
+-- the token itself is shown once when it is created.
+CREATE TABLE IF NOT EXISTS auth.personal_access_tokens (
+  id            BIGSERIAL    PRIMARY KEY,
+  user_id       BIGINT       NOT NULL REFERENCES auth.users(id) ON DELETE CASCADE,
+  token_id      UUID         NOT NULL,
+  token_hash    TEXT         NOT NULL,
+  name          TEXT         NOT NULL,
+  scopes        TEXT[]       NOT NULL,
+  expires_at    TIMESTAMPTZ  NULL,
+  last_used_at  TIMESTAMPTZ  NULL,
+  revoked_at    TIMESTAMPTZ  NULL,
+  created_at    TIMESTAMPTZ  NOT NULL DEFAULT NOW()
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS personal_access_tokens_token_id_uidx
+  ON auth.personal_access_tokens (token_id);
+
+CREATE INDEX IF NOT EXISTS personal_access_tokens_user_id_idx
+  ON auth.personal_access_tokens (user_id);
+
+-- Invite codes for sign up in invite-only mode. Only a hash of the code
+-- is kept.
+CREATE TABLE IF NOT EXISTS auth.invites (
+  id          BIGSERIAL    PRIMARY KEY,
+  code_hash   TEXT         NOT NULL,
+  created_by  BIGINT       NULL REFERENCES auth.users(id) ON DELETE SET NULL,
+  max_uses    INTEGER      NOT NULL DEFAULT 1,
+  uses        INTEGER      NOT NULL DEFAULT 0,
+  expires_at  TIMESTAMPTZ  NULL,
+  created_at  TIMESTAMPTZ  NOT NULL DEFAULT NOW()
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS invites_code_hash_uidx
+  ON auth.invites (code_hash);
+
+-- Proof-of-work challenges that were used to sign up, and passkey login
+-- challenges, kept until they expire so each one is used once.
+CREATE TABLE IF NOT EXISTS auth.spent_challenges (
+  challenge_id  UUID         PRIMARY KEY,
+  expires_at    TIMESTAMPTZ  NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS spent_challenges_expires_at_idx
+  ON auth.spent_challenges (expires_at);
+
+-- Passkeys (WebAuthn credentials). sign_count is the last signature
+-- counter the authenticator reported; it must grow on every login unless
+-- the authenticator keeps no counter and always sends 0.
+CREATE TABLE IF NOT EXISTS auth.webauthn_credentials (
+  id                BIGSERIAL    PRIMARY KEY,
+  user_id           BIGINT       NOT NULL REFERENCES auth.users(id) ON DELETE CASCADE,
+  credential_id     BYTEA        NOT NULL,
+  public_key        BYTEA        NOT NULL,
+  attestation_type  TEXT         NOT NULL,
+  aaguid            BYTEA        NOT NULL,
+  transports        TEXT[]       NOT NULL DEFAULT '{}',
+  sign_count        BIGINT       NOT NULL DEFAULT 0,
+  backup_eligible   BOOLEAN      NOT NULL DEFAULT FALSE,
+  backup_state      BOOLEAN      NOT NULL DEFAULT FALSE,
+  name              TEXT         NOT NULL,
+  last_used_at      TIMESTAMPTZ  NULL,
+  created_at        TIMESTAMPTZ  NOT NULL DEFAULT NOW()
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS webauthn_credentials_credential_id_uidx
+  ON auth.webauthn_credentials (credential_id);
+
+CREATE INDEX IF NOT EXISTS webauthn_credentials_user_id_idx
+  ON auth.webauthn_credentials (user_id);
+
+-- Magic login links that were used. A link is signed rather than stored,
+-- so this row is what stops it from logging in twice.
+CREATE TABLE IF NOT EXISTS auth.magic_link_uses (
+  token_id    UUID         PRIMARY KEY,
+  user_id     BIGINT       NOT NULL REFERENCES auth.users(id) ON DELETE CASCADE,
+  ip          INET         NULL,
+  user_agent  TEXT         NULL,
+  expires_at  TIMESTAMPTZ  NOT NULL,
+  used_at     TIMESTAMPTZ  NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS magic_link_uses_user_id_idx
+  ON auth.magic_link_uses (user_id);
+
+-- Security audit trail. Events outlive the users they mention, so user_id
+-- and actor_id are plain columns rather than foreign keys.
+CREATE TABLE IF NOT EXISTS auth.audit_events (
+  id          BIGSERIAL    PRIMARY KEY,
+  event_type  TEXT         NOT NULL,
+  user_id     BIGINT       NULL,
+  actor_id    BIGINT       NULL,
+  username    TEXT         NULL,
+  ip          INET         NULL,
+  user_agent  TEXT         NULL,
+  request_id  TEXT         NULL,
+  outcome     TEXT         NOT NULL,
+  detail      TEXT         NULL,
+  created_at  TIMESTAMPTZ  NOT NULL DEFAULT NOW()
+);
 
-INSERT INTO auth.users (username, password_hash)
-VALUES ('rootuser', '$argon2id$v=19$m=65536,t=1,p=10$GsrhMNY5iHQAxqO9d3nZMw$B6dXaGjlBes7n5cIhw93+CPzp25ionS1nWT5pykNqu4'); -- plain: rootuser
+CREATE INDEX IF NOT EXISTS audit_events_user_id_idx
+  ON auth.audit_events (user_id, id);
 
-INSERT INTO auth.users (username, password_hash)
-VALUES ('123456', '$argon2id$v=19$m=65536,t=1,p=10$0r1L1QlKkC+ZnUn/JAhxcA$TpjiJ8Qi4fRRoQ1IL0jPKtVCOV0xfA6o7mUphDhIbvw'); -- plain: 123456
+CREATE INDEX IF NOT EXISTS audit_events_type_idx
+  ON auth.audit_events (event_type, id);
 
-INSERT INTO auth.users (username, password_hash)
-VALUES ('login', '$argon2id$v=19$m=65536,t=1,p=10$KrmAusLsUEckKjkGkwKGsQ$m7yTibqGtf0MpPYMIuJnT0vAu0e6YUdj1AmfyLq7Stc'); -- plain: pass
\ No newline at end of file
+CREATE INDEX IF NOT EXISTS audit_events_created_at_idx
+  ON auth.audit_events (created_at);
@@ -0,0 +1,29 @@
+\connect bioly
+
+-- Local development accounts. Their passwords would be refused by the
+-- password policy, which only checks new passwords; never load these
+-- outside development. docker-compose.dev.yaml runs this file after the
+-- schema scripts in sql/. username_skeleton holds usernames.Skeleton of
+-- each name.
+INSERT INTO auth.users (username, username_skeleton, password_hash)
+VALUES ('test', 'test', '$argon2id$v=19$m=65536,t=1,p=10$N+0U3LXewHdjFrkjrvn6NQ$5lowDuhO6KuqRdveEFIdOWe81KtJPTkANvgD4F/aqzk'); -- plain: password123
+
+INSERT INTO auth.users (username, username_skeleton, password_hash)
+VALUES ('admin', 'admln', '$argon2id$v=19$m=65536,t=1,p=10$DgmMFWnKxCF9Lv4jz90L1w$cb3nu9Wqf0pMTHiuEW6DR3F9KBNlMZd7bct7luZi0ws'); -- plain: admin
+
+INSERT INTO auth.users (username, username_skeleton, password_hash)
+VALUES ('rootuser', 'rootuser', '$argon2id$v=19$m=65536,t=1,p=10$GsrhMNY5iHQAxqO9d3nZMw$B6dXaGjlBes7n5cIhw93+CPzp25ionS1nWT5pykNqu4'); -- plain: rootuser
+
+INSERT INTO auth.users (username, username_skeleton, password_hash)
+VALUES ('123456', 'l2eas6', '$argon2id$v=19$m=65536,t=1,p=10$0r1L1QlKkC+ZnUn/JAhxcA$TpjiJ8Qi4fRRoQ1IL0jPKtVCOV0xfA6o7mUphDhIbvw'); -- plain: 123456
+
+INSERT INTO auth.users (username, username_skeleton, password_hash)
+VALUES ('login', 'logln', '$argon2id$v=19$m=65536,t=1,p=10$KrmAusLsUEckKjkGkwKGsQ$m7yTibqGtf0MpPYMIuJnT0vAu0e6YUdj1AmfyLq7Stc'); -- plain: pass
+
+INSERT INTO auth.user_roles (user_id, role)
+SELECT id, 'user' FROM auth.users
+ON CONFLICT DO NOTHING;
+
+INSERT INTO auth.user_roles (user_id, role)
+SELECT id, 'admin' FROM auth.users WHERE username = 'admin'
+ON CONFLICT DO NOTHING;